@@ -0,0 +1,259 @@
+// Package authserver is a tiny OAuth2 authorization server for local development and tests.
+// It issues opaque tokens by client-credentials grant, introspects (RFC 7662) and revokes (RFC 7009) them.
+// Token requested with client certificate is bound to it (RFC 8705).
+// Пакет authserver - маленький сервер авторизации OAuth2 для локальной разработки и тестов.
+// Выдает непрозрачные токены по схеме client-credentials, проверяет (RFC 7662) и отзывает (RFC 7009) их.
+// Токен, запрошенный с клиентским сертификатом, привязывается к нему (RFC 8705).
+package authserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultTokenTTL is a lifetime of issued tokens. Время жизни выданных токенов
+const DefaultTokenTTL = time.Hour
+
+// Issued token. Выданный токен
+type token struct {
+	clientID   string
+	scope      string
+	audience   string
+	expires    time.Time
+	thumbprint string // cnf "x5t#S256", empty if token is not bound. Пустой, если токен не привязан
+}
+
+// Server of authorization. Сервер авторизации
+type Server struct {
+	// TokenTTL of issued tokens, DefaultTokenTTL if zero. Время жизни выдаваемых токенов
+	TokenTTL time.Duration
+	// Issuer is "iss" of tokens, omitted if empty. "iss" токенов, не указывается, если пусто
+	Issuer string
+	// Audience is "aud" of tokens requested without "resource" parameter (RFC 8707), omitted if empty.
+	// "aud" токенов, запрошенных без параметра "resource" (RFC 8707), не указывается, если пусто.
+	Audience string
+
+	mu sync.Mutex
+	// Secrets of clients, empty secret requires client certificate with CN equal to client ID.
+	// Секреты клиентов, пустой секрет требует клиентского сертификата с CN, равным ID клиента.
+	clients map[string]string
+	// Secrets of resource servers allowed to introspect. Секреты серверов ресурсов, которым разрешена проверка
+	resources map[string]string
+	tokens    map[string]*token
+	now       func() time.Time
+}
+
+// New creates server without clients. Создает сервер без клиентов
+func New() *Server {
+	return &Server{
+		clients:   make(map[string]string),
+		resources: make(map[string]string),
+		tokens:    make(map[string]*token),
+		now:       time.Now,
+	}
+}
+
+// AddClient registers client of token endpoint. Регистрирует клиента конечной точки токенов
+func (s *Server) AddClient(id, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[id] = secret
+}
+
+// AddResource registers resource server allowed to introspect tokens.
+// Регистрирует сервер ресурсов, которому разрешена проверка токенов.
+func (s *Server) AddResource(id, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resources[id] = secret
+}
+
+// Issue issues token for Audience directly, cert binds it if not nil.
+// Выдает токен для Audience напрямую, cert привязывает его, если не nil.
+func (s *Server) Issue(clientID, scope string, cert *x509.Certificate) string {
+	return s.issue(clientID, scope, s.Audience, cert)
+}
+
+func (s *Server) issue(clientID, scope, audience string, cert *x509.Certificate) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+	ttl := s.TokenTTL
+	if ttl == 0 {
+		ttl = DefaultTokenTTL
+	}
+	t := &token{clientID: clientID, scope: scope, audience: audience, expires: s.now().Add(ttl)}
+	if cert != nil {
+		sum := sha256.Sum256(cert.Raw)
+		t.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[value] = t
+	return value
+}
+
+// Revoke revokes token. Отзывает токен
+func (s *Server) Revoke(value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, value)
+}
+
+// ServeHTTP serves /token, /introspect and /revoke. Обслуживает /token, /introspect и /revoke
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	switch r.URL.Path {
+	case "/token":
+		s.serveToken(w, r)
+	case "/introspect":
+		s.serveIntrospect(w, r)
+	case "/revoke":
+		s.serveRevoke(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Client-credentials grant. Схема client-credentials
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Form.Get("grant_type") != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	cert := clientCertificate(r)
+	id, ok := s.authenticateClient(r, cert)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	audience := s.Audience
+	if resource := r.Form.Get("resource"); resource != "" {
+		audience = resource
+	}
+	value := s.issue(id, r.Form.Get("scope"), audience, cert)
+	ttl := s.TokenTTL
+	if ttl == 0 {
+		ttl = DefaultTokenTTL
+	}
+	res := map[string]interface{}{
+		"access_token": value,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+	}
+	if scope := r.Form.Get("scope"); scope != "" {
+		res["scope"] = scope
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Token introspection (RFC 7662). Проверка токена (RFC 7662)
+func (s *Server) serveIntrospect(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	s.mu.Lock()
+	want, known := s.resources[id]
+	s.mu.Unlock()
+	if !ok || !known || subtle.ConstantTimeCompare([]byte(secret), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	t, found := s.tokens[r.Form.Get("token")]
+	s.mu.Unlock()
+	if !found || !s.now().Before(t.expires) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+	res := map[string]interface{}{
+		"active":     true,
+		"client_id":  t.clientID,
+		"sub":        t.clientID,
+		"token_type": "Bearer",
+		"exp":        t.expires.Unix(),
+	}
+	if t.scope != "" {
+		res["scope"] = t.scope
+	}
+	if t.audience != "" {
+		res["aud"] = t.audience
+	}
+	if s.Issuer != "" {
+		res["iss"] = s.Issuer
+	}
+	if t.thumbprint != "" {
+		res["cnf"] = map[string]string{"x5t#S256": t.thumbprint}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Token revocation (RFC 7009), client may revoke only its tokens.
+// Отзыв токена (RFC 7009), клиент может отозвать только свои токены.
+func (s *Server) serveRevoke(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticateClient(r, clientCertificate(r))
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	value := r.Form.Get("token")
+	s.mu.Lock()
+	if t, found := s.tokens[value]; found && t.clientID == id {
+		delete(s.tokens, value)
+	}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// Authenticates client by secret or by certificate (tls_client_auth of RFC 8705).
+// Аутентифицируем клиента секретом или сертификатом (tls_client_auth из RFC 8705).
+func (s *Server) authenticateClient(r *http.Request, cert *x509.Certificate) (string, bool) {
+	id, secret, basic := r.BasicAuth()
+	if !basic {
+		id, secret = r.Form.Get("client_id"), r.Form.Get("client_secret")
+	}
+	s.mu.Lock()
+	want, known := s.clients[id]
+	s.mu.Unlock()
+	switch {
+	case !known:
+		return "", false
+	case want == "":
+		return id, cert != nil && cert.Subject.CommonName == id
+	default:
+		return id, subtle.ConstantTimeCompare([]byte(secret), []byte(want)) == 1
+	}
+}
+
+// Verified client certificate of request. Проверенный клиентский сертификат запроса
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,128 @@
+package authserver
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blablatov/stream-mtls-grpc/internal/testcerts"
+)
+
+func post(t *testing.T, c *http.Client, u string, form url.Values, user, pass string) (int, map[string]interface{}) {
+	t.Helper()
+	r, err := http.NewRequest(http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		r.SetBasicAuth(user, pass)
+	}
+	resp, err := c.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func TestServer_TokenIntrospectRevoke(t *testing.T) {
+	s := New()
+	s.Issuer, s.Audience = "https://auth.local", "productinfo"
+	s.AddClient("mtls-client", "secret")
+	s.AddResource("productinfo", "resource-secret")
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+	c := hs.Client()
+
+	code, body := post(t, c, hs.URL+"/token", url.Values{"grant_type": {"client_credentials"}, "scope": {"products:read"}}, "mtls-client", "wrong")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret: got %d %v", code, body)
+	}
+	code, body = post(t, c, hs.URL+"/token", url.Values{"grant_type": {"client_credentials"}, "scope": {"products:read"}}, "mtls-client", "secret")
+	if code != http.StatusOK || body["token_type"] != "Bearer" || body["expires_in"] != float64(3600) {
+		t.Fatalf("token: got %d %v", code, body)
+	}
+	token := body["access_token"].(string)
+
+	introspect := url.Values{"token": {token}}
+	if code, _ := post(t, c, hs.URL+"/introspect", introspect, "mtls-client", "secret"); code != http.StatusUnauthorized {
+		t.Errorf("introspection by client: got %d", code)
+	}
+	_, body = post(t, c, hs.URL+"/introspect", introspect, "productinfo", "resource-secret")
+	if body["active"] != true || body["client_id"] != "mtls-client" || body["scope"] != "products:read" || body["cnf"] != nil ||
+		body["aud"] != "productinfo" || body["iss"] != "https://auth.local" {
+		t.Errorf("introspection: got %v", body)
+	}
+
+	// Resource parameter (RFC 8707) sets audience. Параметр resource (RFC 8707) задает аудиторию
+	_, body = post(t, c, hs.URL+"/token", url.Values{"grant_type": {"client_credentials"}, "resource": {"billing"}}, "mtls-client", "secret")
+	if _, body = post(t, c, hs.URL+"/introspect", url.Values{"token": {body["access_token"].(string)}}, "productinfo", "resource-secret"); body["aud"] != "billing" {
+		t.Errorf("token for resource: got %v", body)
+	}
+
+	post(t, c, hs.URL+"/revoke", url.Values{"token": {token}}, "mtls-client", "secret")
+	if _, body = post(t, c, hs.URL+"/introspect", introspect, "productinfo", "resource-secret"); body["active"] != false {
+		t.Errorf("revoked token is active: %v", body)
+	}
+}
+
+func TestServer_Expiry(t *testing.T) {
+	s := New()
+	s.AddResource("productinfo", "resource-secret")
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	token := s.Issue("mtls-client", "", nil)
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	now = now.Add(DefaultTokenTTL)
+	if _, body := post(t, hs.Client(), hs.URL+"/introspect", url.Values{"token": {token}}, "productinfo", "resource-secret"); body["active"] != false {
+		t.Errorf("expired token is active: %v", body)
+	}
+}
+
+func TestServer_CertificateBoundToken(t *testing.T) {
+	certs := testcerts.New(t, "mtls-client")
+	s := New()
+	s.AddClient("mtls-client", "")
+	s.AddResource("productinfo", "resource-secret")
+	hs := httptest.NewUnstartedServer(s)
+	hs.TLS = &tls.Config{
+		Certificates: []tls.Certificate{certs.Server},
+		ClientCAs:    certs.CAPool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	hs.StartTLS()
+	defer hs.Close()
+
+	form := url.Values{"grant_type": {"client_credentials"}, "client_id": {"mtls-client"}}
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certs.CAPool}}}
+	if code, _ := post(t, anonymous, hs.URL+"/token", form, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("client without certificate: got %d", code)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      certs.CAPool,
+		Certificates: []tls.Certificate{certs.Client},
+	}}}
+	code, body := post(t, client, hs.URL+"/token", form, "", "")
+	if code != http.StatusOK {
+		t.Fatalf("token: got %d %v", code, body)
+	}
+
+	_, body = post(t, anonymous, hs.URL+"/introspect", url.Values{"token": {body["access_token"].(string)}}, "productinfo", "resource-secret")
+	sum := sha256.Sum256(certs.Client.Certificate[0])
+	cnf, _ := body["cnf"].(map[string]interface{})
+	if cnf["x5t#S256"] != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Errorf("token is not bound to certificate: %v", body)
+	}
+}
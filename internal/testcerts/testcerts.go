@@ -0,0 +1,150 @@
+// Package testcerts generates CA, server and client certificates for mTLS tests.
+// Пакет testcerts генерирует сертификаты УЦ, сервера и клиента для тестов mTLS.
+package testcerts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Certs are files and parsed certificates of test PKI. Файлы и сертификаты тестовой PKI
+type Certs struct {
+	CAFile     string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+
+	CAPool *x509.CertPool
+	Server tls.Certificate
+	Client tls.Certificate
+
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+// New writes certificates to temporary dir of test. Server certificate is valid for localhost
+// and 127.0.0.1, client certificate has common name clientCN.
+// Записывает сертификаты во временный каталог теста. Сертификат сервера действителен для localhost
+// и 127.0.0.1, сертификат клиента имеет общее имя clientCN.
+func New(t testing.TB, clientCN string) *Certs {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Certs{
+		CAFile:     filepath.Join(dir, "ca.crt"),
+		ServerCert: filepath.Join(dir, "server.crt"),
+		ServerKey:  filepath.Join(dir, "server.key"),
+		ClientCert: filepath.Join(dir, "client.crt"),
+		ClientKey:  filepath.Join(dir, "client.key"),
+		CAPool:     x509.NewCertPool(),
+		dir:        dir,
+		ca:         ca,
+		caKey:      caKey,
+		serial:     1,
+	}
+	c.CAPool.AddCert(ca)
+	writePEM(t, c.CAFile, "CERTIFICATE", caDER)
+
+	c.Server = c.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, c.ServerCert, c.ServerKey)
+	c.Client = c.IssueClient(t, clientCN)
+	return c
+}
+
+// IssueClient creates one more client certificate signed by the same CA, its files are
+// named by common name. Выпускает еще один клиентский сертификат того же УЦ.
+func (c *Certs) IssueClient(t testing.TB, cn string) tls.Certificate {
+	t.Helper()
+	certFile, keyFile := c.ClientCert, c.ClientKey
+	if c.Client.Certificate != nil {
+		certFile = filepath.Join(c.dir, cn+".crt")
+		keyFile = filepath.Join(c.dir, cn+".key")
+	}
+	return c.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, certFile, keyFile)
+}
+
+// Signs certificate by test CA and writes it with key to files. Подписываем сертификат тестовым УЦ
+func (c *Certs) issue(t testing.TB, tmpl *x509.Certificate, certFile, keyFile string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.serial++
+	tmpl.SerialNumber = big.NewInt(c.serial)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(24 * time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, &key.PublicKey, c.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writePEM(t testing.TB, path, typ string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ServerTLS is config of test server requiring client certificates.
+// Конфигурация тестового сервера, требующего клиентские сертификаты.
+func (c *Certs) ServerTLS() *tls.Config {
+	return &tls.Config{
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		Certificates: []tls.Certificate{c.Server},
+		ClientCAs:    c.CAPool,
+	}
+}
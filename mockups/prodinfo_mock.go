@@ -11,6 +11,7 @@ import (
 	__ "github.com/blablatov/stream-mtls-grpc/mtls-proto"
 	gomock "github.com/golang/mock/gomock"
 	grpc "google.golang.org/grpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 // MockProductInfoClient is a mock of ProductInfoClient interface.
@@ -56,6 +57,26 @@ func (mr *MockProductInfoClientMockRecorder) AddProduct(arg0, arg1 interface{},
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddProduct", reflect.TypeOf((*MockProductInfoClient)(nil).AddProduct), varargs...)
 }
 
+// DeleteProduct mocks base method.
+func (m *MockProductInfoClient) DeleteProduct(arg0 context.Context, arg1 *__.ProductID, arg2 ...grpc.CallOption) (*emptypb.Empty, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "DeleteProduct", varargs...)
+	ret0, _ := ret[0].(*emptypb.Empty)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteProduct indicates an expected call of DeleteProduct.
+func (mr *MockProductInfoClientMockRecorder) DeleteProduct(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteProduct", reflect.TypeOf((*MockProductInfoClient)(nil).DeleteProduct), varargs...)
+}
+
 // GetProduct mocks base method.
 func (m *MockProductInfoClient) GetProduct(arg0 context.Context, arg1 *__.ProductID, arg2 ...grpc.CallOption) (*__.Product, error) {
 	m.ctrl.T.Helper()
@@ -75,3 +96,83 @@ func (mr *MockProductInfoClientMockRecorder) GetProduct(arg0, arg1 interface{},
 	varargs := append([]interface{}{arg0, arg1}, arg2...)
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetProduct", reflect.TypeOf((*MockProductInfoClient)(nil).GetProduct), varargs...)
 }
+
+// ListProducts mocks base method.
+func (m *MockProductInfoClient) ListProducts(arg0 context.Context, arg1 *__.ListProductsRequest, arg2 ...grpc.CallOption) (*__.ListProductsResponse, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "ListProducts", varargs...)
+	ret0, _ := ret[0].(*__.ListProductsResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListProducts indicates an expected call of ListProducts.
+func (mr *MockProductInfoClientMockRecorder) ListProducts(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListProducts", reflect.TypeOf((*MockProductInfoClient)(nil).ListProducts), varargs...)
+}
+
+// SearchProducts mocks base method.
+func (m *MockProductInfoClient) SearchProducts(arg0 context.Context, arg1 *__.SearchProductsRequest, arg2 ...grpc.CallOption) (*__.SearchProductsResponse, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "SearchProducts", varargs...)
+	ret0, _ := ret[0].(*__.SearchProductsResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SearchProducts indicates an expected call of SearchProducts.
+func (mr *MockProductInfoClientMockRecorder) SearchProducts(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SearchProducts", reflect.TypeOf((*MockProductInfoClient)(nil).SearchProducts), varargs...)
+}
+
+// UpdateProduct mocks base method.
+func (m *MockProductInfoClient) UpdateProduct(arg0 context.Context, arg1 *__.Product, arg2 ...grpc.CallOption) (*__.Product, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "UpdateProduct", varargs...)
+	ret0, _ := ret[0].(*__.Product)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateProduct indicates an expected call of UpdateProduct.
+func (mr *MockProductInfoClientMockRecorder) UpdateProduct(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateProduct", reflect.TypeOf((*MockProductInfoClient)(nil).UpdateProduct), varargs...)
+}
+
+// WatchProducts mocks base method.
+func (m *MockProductInfoClient) WatchProducts(arg0 context.Context, arg1 *__.WatchRequest, arg2 ...grpc.CallOption) (__.ProductInfo_WatchProductsClient, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "WatchProducts", varargs...)
+	ret0, _ := ret[0].(__.ProductInfo_WatchProductsClient)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// WatchProducts indicates an expected call of WatchProducts.
+func (mr *MockProductInfoClientMockRecorder) WatchProducts(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WatchProducts", reflect.TypeOf((*MockProductInfoClient)(nil).WatchProducts), varargs...)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/blablatov/stream-mtls-grpc/internal/authserver"
+)
+
+var (
+	crtFile = filepath.Join("..", "mcerts", "server.crt")
+	keyFile = filepath.Join("..", "mcerts", "server.key")
+	caFile  = filepath.Join("..", "mcerts", "ca.crt")
+)
+
+func main() {
+	log.SetPrefix("Authserver event: ")
+	log.SetFlags(log.Lshortfile)
+
+	addr := flag.String("addr", ":9443", "address of HTTPS listener")
+	clients := flag.String("clients", "mtls-client:mtls-client-secret,localhost:", "comma separated id:secret of clients, empty secret requires client certificate with CN equal to id")
+	resources := flag.String("resources", "productinfo:productinfo-secret", "comma separated id:secret of resource servers allowed to introspect")
+	ttl := flag.Duration("ttl", authserver.DefaultTokenTTL, "lifetime of tokens")
+	issuer := flag.String("issuer", "https://localhost:9443", "iss of tokens")
+	audience := flag.String("audience", "productinfo", "aud of tokens requested without resource parameter")
+	flag.Parse()
+
+	s := authserver.New()
+	s.TokenTTL = *ttl
+	s.Issuer, s.Audience = *issuer, *audience
+	for _, c := range splitPairs(*clients) {
+		s.AddClient(c[0], c[1])
+	}
+	for _, r := range splitPairs(*resources) {
+		s.AddResource(r[0], r[1])
+	}
+
+	cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		log.Fatalf("failed to load key pair: %s", err)
+	}
+	// Client certificate is optional, it authenticates client and binds token
+	// Клиентский сертификат необязателен, он аутентифицирует клиента и привязывает токен
+	certPool := x509.NewCertPool()
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		log.Fatalf("could not read ca certificate: %s", err)
+	}
+	if ok := certPool.AppendCertsFromPEM(ca); !ok {
+		log.Fatalf("failed to append client certs")
+	}
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: s,
+		TLSConfig: &tls.Config{
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    certPool,
+		},
+	}
+	log.Printf("Starting authorization server on " + *addr)
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
+
+// Parses "id:secret,id:secret". Разбираем "id:secret,id:secret"
+func splitPairs(s string) [][2]string {
+	var pairs [][2]string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		id, secret, _ := strings.Cut(item, ":")
+		pairs = append(pairs, [2]string{id, secret})
+	}
+	return pairs
+}
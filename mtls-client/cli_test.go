@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/money"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testProducts = []*pb.Product{
+	{Id: "1", Name: "Sumsung S9999", Description: "Samsung Galaxy S9999", Price: 7777},
+	{Id: "2", Name: "Apple", Price: 1.5},
+}
+
+func TestPrinter_Formats(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{formatTable, "ID  NAME           PRICE    DESCRIPTION\n" +
+			"1   Sumsung S9999  7777.00  Samsung Galaxy S9999\n" +
+			"2   Apple          1.50     \n"},
+		{formatJSON, `[
+  {
+    "description": "Samsung Galaxy S9999",
+    "id": "1",
+    "name": "Sumsung S9999",
+    "price": 7777
+  },
+  {
+    "description": "",
+    "id": "2",
+    "name": "Apple",
+    "price": 1.5
+  }
+]
+`},
+		{formatYAML, `- description: "Samsung Galaxy S9999"
+  id: "1"
+  name: "Sumsung S9999"
+  price: 7777
+- description: ""
+  id: "2"
+  name: "Apple"
+  price: 1.5
+`},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		p, err := newPrinter(test.format, &b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.products(testProducts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.format, b.String(), test.want)
+		}
+	}
+}
+
+func TestPrinter_Page(t *testing.T) {
+	var b bytes.Buffer
+	p, _ := newPrinter(formatTable, &b)
+	if err := p.page(&pb.ListProductsResponse{Products: testProducts[1:], NextPageToken: "tok", TotalSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+	want := "ID  NAME   PRICE  DESCRIPTION\n" +
+		"2   Apple  1.50   \n" +
+		"\n2 products in total, next page: -page-token tok\n"
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestPrinter_Search(t *testing.T) {
+	var b bytes.Buffer
+	p, _ := newPrinter(formatTable, &b)
+	err := p.search(&pb.SearchProductsResponse{TotalSize: 1, Results: []*pb.SearchResult{{
+		Product: &pb.Product{Id: "1", Name: "Смартфон", Description: "Новые смартфоны", Price: 3},
+		Score:   1.5,
+		Highlights: []*pb.Highlight{
+			{Field: "name", Spans: []*pb.TextSpan{{Start: 0, End: 8}}},
+			{Field: "description", Spans: []*pb.TextSpan{{Start: 6, End: 15}}},
+		},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ID  SCORE  NAME        PRICE  DESCRIPTION\n" +
+		"1   1.50   [Смартфон]  3.00   Новые [смартфоны]\n" +
+		"\n1 products found\n"
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestDecodeProducts(t *testing.T) {
+	products, err := decodeProducts([]byte(`[{"id": "1", "name": "Apple", "price": 1.5}, {"name": "Pear"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || products[0].Price != 1.5 || products[1].Name != "Pear" {
+		t.Errorf("unexpected products %v", products)
+	}
+	if _, err := decodeProducts([]byte(`[{"cost": 1}]`)); err == nil {
+		t.Error("want error on unknown field")
+	}
+}
+
+func TestProductFlags_Price(t *testing.T) {
+	apply := func(p *pb.Product, args ...string) error {
+		f := newProductFlags("update")
+		if err := f.fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return f.apply(p)
+	}
+	p := &pb.Product{}
+	if err := apply(p, "-price", "7776.9999"); err != nil || money.Format(p.PriceMoney) != "7776.9999 RUB" || p.Price != 7777 {
+		t.Errorf("price in default currency: %v, %v", p, err)
+	}
+	// Currency is changed, amount is kept. Валюта изменяется, сумма сохраняется
+	if err := apply(p, "-currency", "USD"); err != nil || money.Format(p.PriceMoney) != "7776.9999 USD" {
+		t.Errorf("currency: %v, %v", p, err)
+	}
+	// Float price of old service is converted. Цена float старого сервиса преобразуется
+	old := &pb.Product{Price: 1.5}
+	if err := apply(old, "-currency", "EUR"); err != nil || money.Format(old.PriceMoney) != "1.50 EUR" {
+		t.Errorf("currency of float price: %v, %v", old, err)
+	}
+	for _, args := range [][]string{{"-price", "1,5"}, {"-currency", "RUR"}} {
+		if err := apply(&pb.Product{}, args...); exitCode(err) != exitUsage {
+			t.Errorf("%v: got %v, want usage error", args, err)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, exitOK},
+		{usageErrorf("usage: get ID"), exitUsage},
+		{status.Error(codes.NotFound, "not found"), int(codes.NotFound)},
+		{status.Error(codes.Unauthenticated, "invalid token"), int(codes.Unauthenticated)},
+		{errors.New("open products.json: no such file"), exitSoftware},
+	}
+	for _, test := range tests {
+		if got := exitCode(test.err); got != test.want {
+			t.Errorf("exitCode(%v) = %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRun_Usage(t *testing.T) {
+	for _, args := range [][]string{{}, {"unknown"}, {"-o", "xml", "list"}, {"-bad"}} {
+		var stderr bytes.Buffer
+		if code := run(args, nil, &bytes.Buffer{}, &stderr); code != exitUsage {
+			t.Errorf("run(%q) = %d, want %d", args, code, exitUsage)
+		}
+	}
+}
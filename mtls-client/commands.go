@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/client"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/money"
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Subcommand of CLI. Подкоманда CLI
+type command func(ctx context.Context, env *cmdEnv, args []string) error
+
+// Environment of subcommand. Окружение подкоманды
+type cmdEnv struct {
+	client *client.Client
+	out    *printer
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+var commands = map[string]command{
+	"add":    runAdd,
+	"get":    runGet,
+	"list":   runList,
+	"search": runSearch,
+	"update": runUpdate,
+	"delete": runDelete,
+	"import": runImport,
+	"export": runExport,
+	"watch":  runWatch,
+}
+
+// Usage of subcommands. Справка по подкомандам
+var usages = map[string]string{
+	"add":    "add -name NAME [-description TEXT] [-price AMOUNT] [-currency CODE]",
+	"get":    "get ID",
+	"list":   "list [-filter EXPR] [-order-by FIELDS] [-page-size N] [-page-token TOKEN]",
+	"search": "search [-filter EXPR] [-page-size N] [-page-token TOKEN] WORDS...",
+	"update": "update ID [-name NAME] [-description TEXT] [-price AMOUNT] [-currency CODE]",
+	"delete": "delete ID",
+	"import": "import FILE|-",
+	"export": "export [FILE]",
+	"watch":  "watch [-from REVISION]",
+	"shell":  "shell",
+}
+
+// Order of subcommands in usage. Порядок подкоманд в справке
+var commandNames = []string{"add", "get", "list", "search", "update", "delete", "import", "export", "watch", "shell"}
+
+// Flags of product fields shared by add and update. Флаги полей товара, общие для add и update
+type productFlags struct {
+	fs          *flag.FlagSet
+	name        *string
+	description *string
+	price       *string
+	currency    *string
+}
+
+func newProductFlags(name string) *productFlags {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return &productFlags{
+		fs:          fs,
+		name:        fs.String("name", "", "name of product"),
+		description: fs.String("description", "", "description of product"),
+		price:       fs.String("price", "", `decimal price of product, for example "7777.99"`),
+		currency:    fs.String("currency", "", "ISO 4217 currency of price, currency of product or "+money.DefaultCurrency+" if empty"),
+	}
+}
+
+// Applies only flags set in command line. Применяем только заданные в командной строке флаги
+func (f *productFlags) apply(p *pb.Product) error {
+	var err error
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "name":
+			p.Name = *f.name
+		case "description":
+			p.Description = *f.description
+		}
+	})
+	if *f.price == "" && *f.currency == "" {
+		return nil
+	}
+	currency := *f.currency
+	if currency == "" && p.PriceMoney != nil {
+		currency = p.PriceMoney.CurrencyCode
+	} else if currency == "" {
+		currency = money.DefaultCurrency
+	}
+	price := p.PriceMoney
+	if *f.price != "" {
+		price, err = money.Parse(*f.price, currency)
+	} else if price != nil {
+		price = &moneypb.Money{CurrencyCode: currency, Units: price.Units, Nanos: price.Nanos}
+		err = money.Validate(price)
+	} else {
+		price, err = money.FromFloat32(p.Price, currency)
+	}
+	if err != nil {
+		return usageErrorf("%s: %v", f.fs.Name(), err)
+	}
+	// Float price is set too for services not knowing price_money. Цена float задается и для сервисов без price_money
+	p.PriceMoney, p.Price = price, money.Float32(price)
+	return nil
+}
+
+func runAdd(ctx context.Context, env *cmdEnv, args []string) error {
+	f := newProductFlags("add")
+	if err := f.fs.Parse(args); err != nil {
+		return usageErrorf("add: %v", err)
+	}
+	if *f.name == "" || f.fs.NArg() > 0 {
+		return usageErrorf("usage: %s", usages["add"])
+	}
+	product := &pb.Product{}
+	if err := f.apply(product); err != nil {
+		return err
+	}
+	id, err := env.client.AddProduct(ctx, product)
+	if err != nil {
+		return err
+	}
+	return env.out.id(id)
+}
+
+func runGet(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("usage: %s", usages["get"])
+	}
+	product, err := env.client.GetProduct(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return env.out.product(product)
+}
+
+// Lists all products, or one page if page flags are set. Выводим все товары или одну страницу, если заданы флаги страниц
+func runList(ctx context.Context, env *cmdEnv, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	filter := fs.String("filter", "", `products matching expression, for example 'price < 1000 AND name:"Samsung*"'`)
+	orderBy := fs.String("order-by", "", `order of products, for example "price desc, name"`)
+	pageSize := fs.Int("page-size", 0, "print one page of at most N products")
+	pageToken := fs.String("page-token", "", "token of page printed by previous list")
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("list: %v", err)
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("usage: %s", usages["list"])
+	}
+	opts := client.ListOptions{PageSize: int32(*pageSize), PageToken: *pageToken, OrderBy: *orderBy, Filter: *filter}
+	if *pageSize == 0 && *pageToken == "" {
+		products, err := env.client.ListAllProducts(ctx, opts)
+		if err != nil {
+			return err
+		}
+		return env.out.products(products)
+	}
+	page, err := env.client.ListProductsPage(ctx, opts)
+	if err != nil {
+		return err
+	}
+	return env.out.page(page)
+}
+
+// Prints page of products found by words, the most relevant first. Выводим страницу найденных по словам товаров
+func runSearch(ctx context.Context, env *cmdEnv, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	filter := fs.String("filter", "", `found products matching expression, for example "price < 1000"`)
+	pageSize := fs.Int("page-size", 0, "print at most N products")
+	pageToken := fs.String("page-token", "", "token of page printed by previous search")
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("search: %v", err)
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf("usage: %s", usages["search"])
+	}
+	opts := client.SearchOptions{PageSize: int32(*pageSize), PageToken: *pageToken, Filter: *filter}
+	res, err := env.client.SearchProducts(ctx, strings.Join(fs.Args(), " "), opts)
+	if err != nil {
+		return err
+	}
+	return env.out.search(res)
+}
+
+// Reads product and replaces the fields set by flags. Читаем товар и заменяем поля, заданные флагами
+func runUpdate(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) < 1 {
+		return usageErrorf("usage: %s", usages["update"])
+	}
+	f := newProductFlags("update")
+	if err := f.fs.Parse(args[1:]); err != nil {
+		return usageErrorf("update: %v", err)
+	}
+	if f.fs.NArg() > 0 {
+		return usageErrorf("usage: %s", usages["update"])
+	}
+	product, err := env.client.GetProduct(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err := f.apply(product); err != nil {
+		return err
+	}
+	if product, err = env.client.UpdateProduct(ctx, product); err != nil {
+		return err
+	}
+	return env.out.product(product)
+}
+
+func runDelete(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("usage: %s", usages["delete"])
+	}
+	return env.client.DeleteProduct(ctx, args[0])
+}
+
+// Adds products from JSON array, as written by export. IDs of file are ignored.
+// Добавляем товары из JSON массива, записанного export. ID из файла не используются.
+func runImport(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("usage: %s", usages["import"])
+	}
+	var data []byte
+	var err error
+	if args[0] == "-" {
+		data, err = ioutil.ReadAll(env.stdin)
+	} else {
+		data, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	products, err := decodeProducts(data)
+	if err != nil {
+		return err
+	}
+	for _, product := range products {
+		product.Id = ""
+		id, err := env.client.AddProduct(ctx, product)
+		if err != nil {
+			return err
+		}
+		product.Id = id
+	}
+	return env.out.products(products)
+}
+
+// Writes all products as JSON array (or YAML with -o yaml) to file or stdout.
+// Записываем все товары JSON массивом (или YAML при -o yaml) в файл или stdout.
+func runExport(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) > 1 {
+		return usageErrorf("usage: %s", usages["export"])
+	}
+	products, err := env.client.ListProducts(ctx)
+	if err != nil {
+		return err
+	}
+	format := env.out.format
+	if format == formatTable {
+		format = formatJSON
+	}
+	if len(args) == 0 {
+		return (&printer{format: format, w: env.stdout}).products(products)
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err := (&printer{format: format, w: f}).products(products); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Writes changes of products as JSON lines until interrupted. Записываем изменения товаров строками JSON до прерывания
+func runWatch(ctx context.Context, env *cmdEnv, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	from := fs.Int64("from", client.CurrentRevision, "revision to watch after, only new changes if -1")
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("watch: %v", err)
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("usage: %s", usages["watch"])
+	}
+	return env.client.WatchProducts(ctx, *from, func(e *pb.ProductEvent) error {
+		line, err := protojson.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(env.stdout, "%s\n", line)
+		return err
+	})
+}
+
+func decodeProducts(data []byte) ([]*pb.Product, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("import: %w", err)
+	}
+	products := make([]*pb.Product, 0, len(raw))
+	for i, r := range raw {
+		product := &pb.Product{}
+		if err := protojson.Unmarshal(r, product); err != nil {
+			return nil, fmt.Errorf("import: product %d: %w", i, err)
+		}
+		products = append(products, product)
+	}
+	return products, nil
+}
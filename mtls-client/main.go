@@ -2,21 +2,19 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/client"
 	"golang.org/x/oauth2"
-	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/oauth"
-	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/status"
 )
 
@@ -24,126 +22,195 @@ var (
 	crtFile = filepath.Join("..", "mcerts", "client.crt")
 	keyFile = filepath.Join("..", "mcerts", "client.key")
 	caFile  = filepath.Join("..", "mcerts", "ca.crt")
-)
 
-const (
 	address = "localhost:50051"
 	//address  = "net-tls-service:50051"
 	hostname = "localhost"
+	token    = "blablatok-tokblabla-blablatok"
+
+	// Client-credentials grant replaces static token if tokenURL is set.
+	// Схема client-credentials заменяет статический токен, если задан tokenURL.
+	tokenURL     string
+	clientID     = "mtls-client"
+	clientSecret string
+	tokenMTLS    bool
+	scopes       string
+	// API key replaces tokens if set. API ключ заменяет токены, если задан
+	apiKey string
+	// JSON file of gRPC service config with retries, hedging and timeouts of methods.
+	// JSON файл конфигурации сервиса gRPC с повторами, хеджированием и таймаутами методов.
+	serviceConfigFile string
+	// Policy of balancing between replicas of comma separated -addr, no balancing if empty.
+	// Политика балансировки между репликами из -addr через запятую, без балансировки, если пусто.
+	lbPolicy    string
+	healthCheck bool
+	ejectAfter  int
+)
+
+// Exit codes of local errors, RPC errors exit with number of gRPC status code.
+// Коды выхода локальных ошибок, ошибки RPC завершаются номером кода статуса gRPC.
+const (
+	exitOK       = 0
+	exitUsage    = 64 // EX_USAGE
+	exitSoftware = 70 // EX_SOFTWARE
 )
 
+// Error of command line. Ошибка командной строки
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string { return e.msg }
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
 func main() {
 	log.SetPrefix("Client event: ")
 	log.SetFlags(log.Lshortfile)
 
-	// Set up the credentials for the connection.
-	// Значение токена OAuth2. Используем строку, прописанную в коде.
-	tokau := oauth.NewOauthAccess(fetchToken())
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
 
-	// Load the client certificates from disk
-	// Создаем пары ключей X.509 непосредственно из ключа и сертификата сервера
-	certificate, err := tls.LoadX509KeyPair(crtFile, keyFile)
+// Parses flags, runs subcommand and returns exit code.
+// Разбираем флаги, выполняем подкоманду и возвращаем код выхода.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("mtls-client", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&address, "addr", address, "address of service, comma separated addresses of replicas or dns:///host:port")
+	fs.StringVar(&hostname, "server-name", hostname, "name in the server certificate")
+	fs.StringVar(&crtFile, "cert", crtFile, "client certificate file")
+	fs.StringVar(&keyFile, "key", keyFile, "client key file")
+	fs.StringVar(&caFile, "ca", caFile, "CA certificate file")
+	fs.StringVar(&token, "token", token, "OAuth2 access token")
+	fs.StringVar(&tokenURL, "token-url", tokenURL, "token endpoint of client-credentials grant, replaces -token")
+	fs.StringVar(&clientID, "client-id", clientID, "client ID of client-credentials grant")
+	fs.StringVar(&clientSecret, "client-secret", clientSecret, "client secret of client-credentials grant")
+	fs.BoolVar(&tokenMTLS, "token-mtls", tokenMTLS, "authenticate to token endpoint with client certificate (RFC 8705)")
+	fs.StringVar(&scopes, "scopes", scopes, "comma separated scopes of client-credentials grant")
+	fs.StringVar(&apiKey, "api-key", apiKey, "API key, replaces -token and -token-url")
+	fs.StringVar(&serviceConfigFile, "service-config", serviceConfigFile, "JSON file of gRPC service config")
+	fs.StringVar(&lbPolicy, "lb", lbPolicy, "load balancing between replicas: round_robin or least_request")
+	fs.BoolVar(&healthCheck, "health-check", healthCheck, "skip replicas not serving by health service, requires -lb")
+	fs.IntVar(&ejectAfter, "eject-after", ejectAfter, "eject replica after number of consecutive failures, requires -lb")
+	format := fs.String("o", formatTable, "output format: table, json or yaml")
+	timeout := fs.Duration("timeout", client.DefaultTimeout, "timeout of each call")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: mtls-client [flags] command [args]\n\nCommands:\n")
+		for _, name := range commandNames {
+			fmt.Fprintf(stderr, "  %s\n", usages[name])
+		}
+		fmt.Fprintf(stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "mtls-client: unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		return exitUsage
+	}
+	out, err := newPrinter(*format, stdout)
 	if err != nil {
-		log.Fatalf("could not load client key pair: %s", err)
+		return report(stderr, err)
 	}
 
-	// Create a certificate pool from the certificate authority
-	// Генерируем пул сертификатов в нашем локальном удостоверяющем центре
-	certPool := x509.NewCertPool()
-	ca, err := ioutil.ReadFile(caFile)
+	// Set up a connection to the server via client library.
+	// Устанавливаем безопасное соединение с сервером с помощью клиентской библиотеки
+	c, err := newClient(*timeout)
 	if err != nil {
-		log.Fatalf("could not read ca certificate: %s", err)
+		return report(stderr, err)
 	}
+	defer c.Close()
 
-	// Append the certificates from the CA
-	// Добавляем клиентские сертификаты из локального удостоверяющего центра в сгенерированный пул
-	if ok := certPool.AppendCertsFromPEM(ca); !ok {
-		log.Fatalf("failed to append ca certs")
+	env := &cmdEnv{client: c, out: out, stdin: stdin, stdout: stdout}
+	return report(stderr, cmd(context.Background(), env, fs.Args()[1:]))
+}
+
+// Prints error and returns its exit code. Выводим ошибку и возвращаем ее код выхода
+func report(stderr io.Writer, err error) int {
+	code := exitCode(err)
+	if code != exitOK {
+		fmt.Fprintf(stderr, "mtls-client: %s\n", strings.TrimSpace(err.Error()))
 	}
+	return code
+}
 
-	// Указываем аутентификационные данные для транспортного протокола с помощью DialOption.
-	opts := []grpc.DialOption{
-		// Указываем один и тот же токен OAuth в параметрах всех вызовов в рамках одного соединения.
-		// Если нужно указывать токен для каждого вызова отдельно, используем CallOption.
-		grpc.WithPerRPCCredentials(tokau),
-		// Указываем транспортные аутентификационные данные в виде параметров соединения
-		// Поле ServerName должно быть равно значению Common Name, указанному в сертификате
-		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
-			ServerName:   hostname, // NOTE: this is required!
-			Certificates: []tls.Certificate{certificate},
-			RootCAs:      certPool,
-		})),
+// Maps error to exit code. Сопоставляем ошибку коду выхода
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ue *usageError
+	if errors.As(err, &ue) {
+		return exitUsage
+	}
+	// Errors of client library carry gRPC status. Ошибки клиентской библиотеки содержат статус gRPC
+	if st, ok := status.FromError(err); ok {
+		return int(st.Code())
 	}
+	return exitSoftware
+}
 
-	// Set up a connection to the server.
-	// Устанавливаем безопасное соединение с сервером, передавая параметры аутентификации
-	conn, err := grpc.Dial(address, opts...)
-	if err != nil {
-		log.Fatalf("Did not connect: %v", err)
-	}
-	defer conn.Close()
-
-	// Sends connect, it include all methods of server. Передаем соединение и создаем заглушку.
-	// Ее экземпляр содержит все удаленные методы, которые можно вызвать на сервере.
-	client := pb.NewProductInfoClient(conn)
-
-	// Add invalid Order. Этот ID заказа недействителен
-	// Contact the server and print out its response. Отправка данных на сервер, получение ответа.
-	name := "-1"
-	description := "Samsung Galaxy S000 not famous smartphone, launched now 0000"
-	price := float32(0001.0)
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-
-	// Calls remote method Add Order and assigns an error him
-	// Вызываем удаленный метод AddOrder и присваиваем ошибку переменной addOrderError.
-	res, addOrderError := client.AddProduct(ctx, &pb.Product{Name: name, Description: description, Price: price}, grpc.UseCompressor(gzip.Name))
-
-	if addOrderError != nil {
-		errorCode := status.Code(addOrderError) // Get code an error. Получаем код ошибки из пакета grpc/status.
-		if errorCode == codes.InvalidArgument { // Compares an error. Сравниваем код ошибки с InvalidArgument.
-			log.Printf("Invalid Argument Error : %s", errorCode)
-			errorStatus := status.Convert(addOrderError) // Gets of status. Получаем состояние.
-			for _, d := range errorStatus.Details() {
-				switch info := d.(type) {
-				// Checks type of error. Проверяем, имеет ли ошибка тип BadRequest_FieldViolation.
-				case *epb.BadRequest_FieldViolation:
-					log.Printf("Request Field Invalid: %s", info)
-				default:
-					log.Printf("Unexpected error type: %s", info)
-				}
-			}
-		} else {
-			log.Printf("Unhandled error : %s ", errorCode)
-		}
+// Creates client with certificates and token. Создаем клиента с сертификатами и токеном
+func newClient(timeout time.Duration) (*client.Client, error) {
+	opts := client.Options{
+		// Поле ServerName должно быть равно значению Common Name, указанному в сертификате
+		ServerName: hostname,
+		CertFile:   crtFile,
+		KeyFile:    keyFile,
+		CAFile:     caFile,
+		Timeout:    timeout,
+		APIKey:     apiKey,
+	}
+	if addresses := strings.Split(address, ","); len(addresses) > 1 {
+		opts.Addresses = addresses
 	} else {
-		log.Print("AddOrder Response -> ", res.Value)
+		opts.Address = address
 	}
-
-	// Data for add. Contact the server and print out its response.
-	// Отправка достоверных данных на сервер, получение ответа.
-	name = "Sumsung S9999"
-	description = "Samsung Galaxy S9999 is the latest smart phone, launched in February 2039"
-	price = float32(7777.0)
-
-	// Add Order. Добавляет заказ на сервере.
-	r, err := client.AddProduct(ctx, &pb.Product{Name: name, Description: description, Price: price}, grpc.UseCompressor(gzip.Name))
-	if err != nil {
-		log.Fatalf("Could not add product: %v", err)
+	if lbPolicy != "" {
+		opts.LoadBalancing = &client.LoadBalancing{Policy: lbPolicy, HealthCheck: healthCheck}
+		if ejectAfter > 0 {
+			opts.LoadBalancing.OutlierEjection = &client.OutlierEjection{ConsecutiveFailures: ejectAfter}
+		}
 	}
-	log.Printf("Product ID: %s added successfully", r.Value)
-
-	// Response of server. Ответ сервера об успешном добавлении заказа с его номером.
-	product, err := client.GetProduct(ctx, &pb.ProductID{Value: r.Value})
-	if err != nil {
-		log.Fatalf("Could not get product: %v", err)
+	if serviceConfigFile != "" {
+		data, err := ioutil.ReadFile(serviceConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.ServiceConfig = string(data)
+	}
+	if tokenURL != "" {
+		// Токены OAuth2 получаются от сервера авторизации и обновляются до истечения срока.
+		opts.ClientCredentials = &client.ClientCredentials{
+			TokenURL:     tokenURL,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			UseMTLS:      tokenMTLS,
+		}
+		if scopes != "" {
+			opts.ClientCredentials.Scopes = strings.Split(scopes, ",")
+		}
+	} else {
+		// Значение токена OAuth2, задается флагом -token.
+		opts.TokenSource = oauth2.StaticTokenSource(fetchToken())
 	}
-	log.Println("Product: ", product.String())
+	return client.New(context.Background(), opts)
 }
 
 func fetchToken() *oauth2.Token {
 	return &oauth2.Token{
-		AccessToken: "blablatok-tokblabla-blablatok",
+		AccessToken: token,
 	}
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/money"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Output formats. Форматы вывода
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+)
+
+// Prints results of commands in chosen format. Выводит результаты команд в выбранном формате
+type printer struct {
+	format string
+	w      io.Writer
+}
+
+func newPrinter(format string, w io.Writer) (*printer, error) {
+	switch format {
+	case formatTable, formatJSON, formatYAML:
+		return &printer{format: format, w: w}, nil
+	}
+	return nil, usageErrorf("unknown output format %q, want table, json or yaml", format)
+}
+
+// Prints list of products. Выводит список товаров
+func (p *printer) products(products []*pb.Product) error {
+	if p.format == formatTable {
+		return p.table(products)
+	}
+	values := make([]interface{}, 0, len(products))
+	for _, product := range products {
+		v, err := toValue(product)
+		if err != nil {
+			return err
+		}
+		values = append(values, v)
+	}
+	return p.value(values)
+}
+
+// Prints page of products with token of the next page. Выводит страницу товаров с токеном следующей страницы
+func (p *printer) page(page *pb.ListProductsResponse) error {
+	if p.format != formatTable {
+		v, err := toValue(page)
+		if err != nil {
+			return err
+		}
+		return p.value(v)
+	}
+	if err := p.table(page.Products); err != nil {
+		return err
+	}
+	if page.NextPageToken == "" {
+		_, err := fmt.Fprintf(p.w, "\n%d products in total\n", page.TotalSize)
+		return err
+	}
+	_, err := fmt.Fprintf(p.w, "\n%d products in total, next page: -page-token %s\n", page.TotalSize, page.NextPageToken)
+	return err
+}
+
+// Prints found products, matched words are marked by brackets in table.
+// Выводит найденные товары, совпавшие слова отмечаются в таблице скобками.
+func (p *printer) search(res *pb.SearchProductsResponse) error {
+	if p.format != formatTable {
+		v, err := toValue(res)
+		if err != nil {
+			return err
+		}
+		return p.value(v)
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSCORE\tNAME\tPRICE\tDESCRIPTION")
+	for _, r := range res.Results {
+		name, description := r.Product.Name, r.Product.Description
+		for _, h := range r.Highlights {
+			switch h.Field {
+			case "name":
+				name = markSpans(name, h.Spans)
+			case "description":
+				description = markSpans(description, h.Spans)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%.2f\t%s\t%s\t%s\n", r.Product.Id, r.Score, name, formatPrice(r.Product), description)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if res.NextPageToken == "" {
+		_, err := fmt.Fprintf(p.w, "\n%d products found\n", res.TotalSize)
+		return err
+	}
+	_, err := fmt.Fprintf(p.w, "\n%d products found, next page: -page-token %s\n", res.TotalSize, res.NextPageToken)
+	return err
+}
+
+// Wraps spans of characters of text in brackets. Заключаем диапазоны символов текста в скобки
+func markSpans(text string, spans []*pb.TextSpan) string {
+	runes := []rune(text)
+	var b strings.Builder
+	pos := 0
+	for _, s := range spans {
+		start, end := int(s.Start), int(s.End)
+		if start < pos || end < start || end > len(runes) {
+			continue
+		}
+		b.WriteString(string(runes[pos:start]))
+		b.WriteString("[" + string(runes[start:end]) + "]")
+		pos = end
+	}
+	b.WriteString(string(runes[pos:]))
+	return b.String()
+}
+
+// Prints one product. Выводит один товар
+func (p *printer) product(product *pb.Product) error {
+	if p.format == formatTable {
+		return p.table([]*pb.Product{product})
+	}
+	v, err := toValue(product)
+	if err != nil {
+		return err
+	}
+	return p.value(v)
+}
+
+// Prints ID of product. Выводит ID товара
+func (p *printer) id(id string) error {
+	if p.format == formatTable {
+		_, err := fmt.Fprintln(p.w, id)
+		return err
+	}
+	return p.value(map[string]interface{}{"value": id})
+}
+
+func (p *printer) table(products []*pb.Product) error {
+	tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPRICE\tDESCRIPTION")
+	for _, product := range products {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", product.Id, product.Name, formatPrice(product), product.Description)
+	}
+	return tw.Flush()
+}
+
+// Price with currency, float price of services not knowing price_money. Цена с валютой или цена float
+func formatPrice(product *pb.Product) string {
+	if product.PriceMoney != nil {
+		return money.Format(product.PriceMoney)
+	}
+	return strconv.FormatFloat(float64(product.Price), 'f', 2, 32)
+}
+
+func (p *printer) value(v interface{}) error {
+	if p.format == formatYAML {
+		var b bytes.Buffer
+		writeYAML(&b, v, 0)
+		_, err := p.w.Write(b.Bytes())
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(p.w, "%s\n", data)
+	return err
+}
+
+// Converts message to generic value with JSON names of fields, output of protojson is not stable
+// Преобразуем сообщение в обобщенное значение с JSON именами полей, вывод protojson нестабилен
+func toValue(m proto.Message) (interface{}, error) {
+	data, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	dropNulls(v)
+	return v, nil
+}
+
+// Unset messages are emitted as null, they are omitted like in protojson by default.
+// Незаданные сообщения выводятся как null, они опускаются, как в protojson по умолчанию.
+func dropNulls(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if item == nil {
+				delete(v, k)
+				continue
+			}
+			dropNulls(item)
+		}
+	case []interface{}:
+		for _, item := range v {
+			dropNulls(item)
+		}
+	}
+}
+
+// Writes generic value as YAML block. Записываем обобщенное значение как блок YAML
+func writeYAML(b *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString(pad + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if isScalar(v[k]) {
+				fmt.Fprintf(b, "%s%s: %s\n", pad, k, yamlScalar(v[k]))
+				continue
+			}
+			fmt.Fprintf(b, "%s%s:\n", pad, k)
+			writeYAML(b, v[k], indent+1)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(pad + "[]\n")
+			return
+		}
+		for _, item := range v {
+			if isScalar(item) {
+				fmt.Fprintf(b, "%s- %s\n", pad, yamlScalar(item))
+				continue
+			}
+			// First line of item goes after dash. Первая строка элемента идет после дефиса
+			var nested bytes.Buffer
+			writeYAML(&nested, item, indent+1)
+			s := nested.String()
+			b.WriteString(pad + "- " + strings.TrimPrefix(s, pad+"  "))
+		}
+	default:
+		b.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(v)
+}
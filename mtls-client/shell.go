@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blablatov/stream-mtls-grpc/productinfo/client"
+	"golang.org/x/term"
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	shellPrompt = "productinfo> "
+	// Number of IDs loaded for completion. Число ID, загружаемых для автодополнения
+	idCompletionPageSize = 50
+)
+
+// Commands of shell besides subcommands. Команды оболочки помимо подкоманд
+var shellCommands = []string{`\timing`, `\state`, `\history`, "help", "exit"}
+
+// Subcommands not run by shell: watch streams until interrupt, but raw terminal gets no SIGINT.
+// Подкоманды, не выполняемые оболочкой: watch читает поток до прерывания, а терминал в raw-режиме не получает SIGINT.
+var notShellCommands = map[string]bool{"shell": true, "watch": true}
+
+// Subcommands whose first argument is ID of product. Подкоманды, первый аргумент которых - ID товара
+var idCommands = map[string]bool{"get": true, "update": true, "delete": true}
+
+func init() {
+	// Shell runs other commands, so it is registered here to avoid initialization cycle.
+	// Оболочка выполняет другие команды, поэтому регистрируется здесь во избежание цикла инициализации.
+	commands["shell"] = runShell
+}
+
+// Interactive shell over one connection. Интерактивная оболочка поверх одного соединения
+type shell struct {
+	env     *cmdEnv
+	timing  bool
+	history []string
+
+	ids []string // IDs of products for completion. ID товаров для автодополнения
+}
+
+// Runs shell, line editing and completion are enabled when input is terminal.
+// Запускаем оболочку, редактирование строк и автодополнение включены, если ввод - терминал.
+func runShell(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) != 0 {
+		return usageErrorf("usage: %s", usages["shell"])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sh := &shell{env: env}
+
+	var readLine func() (string, error)
+	var out io.Writer
+	if f, ok := env.stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		state, err := term.MakeRaw(int(f.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(f.Fd()), state)
+		t := term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{env.stdin, env.stdout}, shellPrompt)
+		t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+			if key != '\t' {
+				return "", 0, false
+			}
+			sh.loadIDs(ctx, line[:pos])
+			newLine, newPos, candidates := sh.complete(line, pos)
+			if len(candidates) > 1 && newLine == line {
+				// Terminal is locked in callback. Терминал заблокирован в обработчике
+				go fmt.Fprintln(t, strings.Join(candidates, "  "))
+			}
+			return newLine, newPos, true
+		}
+		readLine, out = t.ReadLine, t
+	} else {
+		scanner := bufio.NewScanner(env.stdin)
+		out = &lockedWriter{w: env.stdout}
+		readLine = func() (string, error) {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		}
+	}
+	sh.env = &cmdEnv{
+		client: env.client,
+		out:    &printer{format: env.out.format, w: out},
+		stdin:  env.stdin,
+		stdout: out,
+	}
+
+	go sh.watchState(ctx, out)
+	fmt.Fprintf(out, "Connected to %s, type help for commands\n", address)
+	for {
+		line, err := readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !sh.exec(ctx, out, line) {
+			return nil
+		}
+	}
+}
+
+// Executes line of shell, returns false on exit. Выполняем строку оболочки, false при выходе
+func (sh *shell) exec(ctx context.Context, out io.Writer, line string) bool {
+	args, err := splitArgs(line)
+	if err != nil {
+		fmt.Fprintf(out, "error: %v\n", err)
+		return true
+	}
+	if len(args) == 0 {
+		return true
+	}
+	sh.history = append(sh.history, line)
+	switch args[0] {
+	case "exit", "quit", `\q`:
+		return false
+	case "help":
+		for _, name := range commandNames {
+			if !notShellCommands[name] {
+				fmt.Fprintf(out, "  %s\n", usages[name])
+			}
+		}
+		fmt.Fprintf(out, "  %s\n", strings.Join(shellCommands, ", "))
+		return true
+	case `\timing`:
+		sh.timing = !sh.timing
+		if sh.timing {
+			fmt.Fprintln(out, "Timing is on.")
+		} else {
+			fmt.Fprintln(out, "Timing is off.")
+		}
+		return true
+	case `\state`:
+		fmt.Fprintf(out, "Connection state: %s\n", sh.env.client.Conn().GetState())
+		return true
+	case `\history`:
+		for i, h := range sh.history {
+			fmt.Fprintf(out, "%4d  %s\n", i+1, h)
+		}
+		return true
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok || args[0] == "shell" {
+		fmt.Fprintf(out, "error: unknown command %q, type help for commands\n", args[0])
+		return true
+	}
+	if notShellCommands[args[0]] {
+		fmt.Fprintf(out, "error: %s is not available in shell, run mtls-client %s\n", args[0], args[0])
+		return true
+	}
+	start := time.Now()
+	err = cmd(ctx, sh.env, args[1:])
+	elapsed := time.Since(start)
+	if err != nil {
+		writeError(out, err)
+	}
+	if sh.timing {
+		fmt.Fprintf(out, "Time: %.3f ms\n", float64(elapsed)/float64(time.Millisecond))
+	}
+	return true
+}
+
+// Prints error with decoded details. Выводим ошибку с декодированными деталями
+func writeError(w io.Writer, err error) {
+	var e *client.Error
+	if !errors.As(err, &e) {
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "error: %s (%d): %s\n", e.Code, e.Code, e.Message)
+	for _, v := range e.FieldViolations {
+		fmt.Fprintf(w, "  field %s: %s\n", v.Field, v.Description)
+	}
+	for _, d := range e.Details {
+		fmt.Fprintf(w, "  detail %T: %v\n", d, d)
+	}
+}
+
+// Prints changes of connection state until context is done.
+// Выводим изменения состояния соединения до завершения контекста.
+func (sh *shell) watchState(ctx context.Context, out io.Writer) {
+	conn := sh.env.client.Conn()
+	state := conn.GetState()
+	for conn.WaitForStateChange(ctx, state) {
+		state = conn.GetState()
+		fmt.Fprintf(out, "-- connection %s\n", state)
+		if state == connectivity.Shutdown {
+			return
+		}
+	}
+}
+
+// Loads one page of IDs starting with the word before cursor when Tab completes ID, errors are ignored.
+// Загружаем одну страницу ID, начинающихся со слова перед курсором, когда Tab дополняет ID, ошибки игнорируются.
+func (sh *shell) loadIDs(ctx context.Context, prefix string) {
+	fields, word := splitWord(prefix)
+	if len(fields) != 1 || !idCommands[fields[0]] || strings.ContainsAny(word, `"*\`) {
+		return
+	}
+	opts := client.ListOptions{PageSize: idCompletionPageSize}
+	if word != "" {
+		opts.Filter = fmt.Sprintf(`id:"%s*"`, word)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	res, err := sh.env.client.ListProductsPage(ctx, opts)
+	if err != nil {
+		return
+	}
+	ids := make([]string, 0, len(res.Products))
+	for _, p := range res.Products {
+		ids = append(ids, p.Id)
+	}
+	sh.ids = ids
+}
+
+// Splits text before cursor into complete fields and word being typed.
+// Разбиваем текст перед курсором на завершенные поля и набираемое слово.
+func splitWord(prefix string) ([]string, string) {
+	fields := strings.Fields(prefix)
+	if len(fields) > 0 && !strings.HasSuffix(prefix, " ") {
+		return fields[:len(fields)-1], fields[len(fields)-1]
+	}
+	return fields, ""
+}
+
+// Completes word before cursor with commands or IDs of products, returns new line, position and candidates.
+// Дополняем слово перед курсором командами или ID товаров, возвращаем новую строку, позицию и варианты.
+func (sh *shell) complete(line string, pos int) (string, int, []string) {
+	prefix := line[:pos]
+	fields, word := splitWord(prefix)
+
+	var words []string
+	switch {
+	case len(fields) == 0:
+		for _, name := range commandNames {
+			if !notShellCommands[name] {
+				words = append(words, name)
+			}
+		}
+		words = append(words, shellCommands...)
+	case len(fields) == 1 && idCommands[fields[0]]:
+		words = append(words, sh.ids...)
+	}
+
+	var candidates []string
+	for _, w := range words {
+		if strings.HasPrefix(w, word) {
+			candidates = append(candidates, w)
+		}
+	}
+	sort.Strings(candidates)
+	if len(candidates) == 0 {
+		return line, pos, nil
+	}
+	completion := commonPrefix(candidates)
+	if len(candidates) == 1 {
+		completion += " "
+	}
+	head := prefix[:len(prefix)-len(word)]
+	return head + completion + line[pos:], len(head) + len(completion), candidates
+}
+
+func commonPrefix(words []string) string {
+	p := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, p) {
+			p = p[:len(p)-1]
+		}
+	}
+	return p
+}
+
+// Splits line into arguments, quotes group words. Разбиваем строку на аргументы, кавычки объединяют слова
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var b strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			b.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, b.String())
+				b.Reset()
+				inArg = false
+			}
+		default:
+			b.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote %c", quote)
+	}
+	if inArg {
+		args = append(args, b.String())
+	}
+	return args, nil
+}
+
+// Writer safe for output of state watcher. Писатель, безопасный для вывода наблюдателя состояния
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
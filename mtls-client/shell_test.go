@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blablatov/stream-mtls-grpc/internal/testcerts"
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// Test server of ProductInfo. Тестовый сервер ProductInfo
+type testServer struct {
+	pb.UnimplementedProductInfoServer
+	mu       sync.Mutex
+	products map[string]*pb.Product
+}
+
+func (s *testServer) AddProduct(ctx context.Context, in *pb.Product) (*pb.ProductID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in.Id = "id-" + strings.ReplaceAll(in.Name, " ", "-")
+	s.products[in.Id] = in
+	return &pb.ProductID{Value: in.Id}, nil
+}
+
+func (s *testServer) GetProduct(ctx context.Context, in *pb.ProductID) (*pb.Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.products[in.Value]; ok {
+		return p, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "%v\nProduct does not exist.", in.Value)
+}
+
+func (s *testServer) ListProducts(ctx context.Context, in *pb.ListProductsRequest) (*pb.ListProductsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Only prefix filter of ID is supported. Поддерживается только фильтр по префиксу ID
+	prefix := strings.TrimSuffix(strings.TrimPrefix(in.Filter, `id:"`), `*"`)
+	res := &pb.ListProductsResponse{}
+	for _, p := range s.products {
+		if strings.HasPrefix(p.Id, prefix) {
+			res.Products = append(res.Products, p)
+		}
+	}
+	sort.Slice(res.Products, func(i, j int) bool { return res.Products[i].Id < res.Products[j].Id })
+	return res, nil
+}
+
+// Starts test server and returns global flags of client for it.
+// Запускаем тестовый сервер и возвращаем глобальные флаги клиента для него.
+func startTestServer(t *testing.T) []string {
+	certs := testcerts.New(t, "client")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(certs.ServerTLS())))
+	pb.RegisterProductInfoServer(s, &testServer{products: make(map[string]*pb.Product)})
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return []string{"-addr", lis.Addr().String(), "-cert", certs.ClientCert, "-key", certs.ClientKey, "-ca", certs.CAFile}
+}
+
+func TestShell_Session(t *testing.T) {
+	args := append(startTestServer(t), "shell")
+	input := strings.Join([]string{
+		`add -name "Sumsung S9999" -price 7777`,
+		`\timing`,
+		`list`,
+		`get missing`,
+		`frobnicate`,
+		`watch`,
+		`\history`,
+		`exit`,
+		`list`,
+	}, "\n")
+	var stdout, stderr bytes.Buffer
+	if code := run(args, strings.NewReader(input), &stdout, &stderr); code != exitOK {
+		t.Fatalf("run = %d, stderr %s", code, stderr.String())
+	}
+	out := stdout.String()
+	for _, want := range []string{
+		"id-Sumsung-S9999\n",
+		"Timing is on.",
+		"Sumsung S9999  7777.00",
+		"Time: ",
+		"error: NotFound (5): missing",
+		`error: unknown command "frobnicate"`,
+		"error: watch is not available in shell, run mtls-client watch",
+		`   2  \timing`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output has no %q:\n%s", want, out)
+		}
+	}
+	// Commands after exit are not run. Команды после exit не выполняются
+	if strings.Count(out, "NAME") != 1 {
+		t.Errorf("list is run after exit:\n%s", out)
+	}
+}
+
+func TestShell_Complete(t *testing.T) {
+	sh := &shell{ids: []string{"id-1", "id-12", "id-2"}}
+	tests := []struct {
+		line       string
+		pos        int
+		want       string
+		candidates int
+	}{
+		{"ge", 2, "get ", 1},
+		{`\t`, 2, `\timing `, 1},
+		{"e", 1, "ex", 2}, // export, exit
+		{"ex", 2, "ex", 2},
+		{"get id-1", 8, "get id-1", 2},
+		{"get id-2", 8, "get id-2 ", 1},
+		{"delete i", 8, "delete id-", 3},
+		{"list i", 6, "list i", 0},
+		{"wa", 2, "wa", 0},
+	}
+	for _, test := range tests {
+		got, pos, candidates := sh.complete(test.line, test.pos)
+		if got != test.want || pos != len(test.want) || len(candidates) != test.candidates {
+			t.Errorf("complete(%q) = %q, %d, %v", test.line, got, pos, candidates)
+		}
+	}
+}
+
+func TestShell_LoadIDs(t *testing.T) {
+	flags := startTestServer(t)
+	address, crtFile, keyFile, caFile = flags[1], flags[3], flags[5], flags[7]
+	c, err := newClient(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, name := range []string{"a1", "a2", "b1"} {
+		if _, err := c.AddProduct(context.Background(), &pb.Product{Name: name, Price: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sh := &shell{env: &cmdEnv{client: c}}
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"list ", ""}, // no IDs are loaded. ID не загружаются
+		{"get ", "id-a1 id-a2 id-b1"},
+		{"delete id-a", "id-a1 id-a2"},
+		{"update id-b", "id-b1"},
+	}
+	for _, test := range tests {
+		sh.ids = nil
+		sh.loadIDs(context.Background(), test.prefix)
+		if got := strings.Join(sh.ids, " "); got != test.want {
+			t.Errorf("loadIDs(%q) = %q, want %q", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	args, err := splitArgs(`add -name "Sumsung S9999" -description 'it''s' -price  7`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"add", "-name", "Sumsung S9999", "-description", "its", "-price", "7"}
+	if strings.Join(args, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", args, want)
+	}
+	if _, err := splitArgs(`get "id`); err == nil {
+		t.Error("want error on unterminated quote")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const productsPath = "/v1/products"
+
+var (
+	// Marshals messages like grpc-gateway does, with lowerCamel names and zero values.
+	// Сериализация ответов в JSON по аналогии с grpc-gateway.
+	marshaler   = protojson.MarshalOptions{EmitUnpopulated: true}
+	unmarshaler = protojson.UnmarshalOptions{DiscardUnknown: true}
+)
+
+// Routes REST/JSON requests to ProductInfo according to google.api.http rules of product_info.proto
+// Маршрутизация REST/JSON запросов к ProductInfo по правилам google.api.http из product_info.proto
+func newGatewayMux(client pb.ProductInfoClient) *http.ServeMux {
+	mux := http.NewServeMux()
+	// POST /v1/products -> addProduct, GET /v1/products -> listProducts
+	mux.HandleFunc(productsPath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			in := &pb.Product{}
+			if err := decodeBody(r, in); err != nil {
+				writeError(w, err)
+				return
+			}
+			writeResponse(w)(client.AddProduct(outgoingContext(r), in))
+		case http.MethodGet:
+			in, err := listRequest(r)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeResponse(w)(client.ListProducts(outgoingContext(r), in))
+		default:
+			writeError(w, status.Errorf(codes.Unimplemented, "method %s not allowed on %s", r.Method, r.URL.Path))
+		}
+	})
+	// GET /v1/products:search -> searchProducts
+	mux.HandleFunc(productsPath+":search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, status.Errorf(codes.Unimplemented, "method %s not allowed on %s", r.Method, r.URL.Path))
+			return
+		}
+		in, err := searchRequest(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResponse(w)(client.SearchProducts(outgoingContext(r), in))
+	})
+	// GET, PUT, DELETE /v1/products/{id} -> getProduct, updateProduct, deleteProduct
+	mux.HandleFunc(productsPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, productsPath+"/")
+		if id == "" || strings.Contains(id, "/") {
+			writeError(w, status.Errorf(codes.NotFound, "path %s not found", r.URL.Path))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeResponse(w)(client.GetProduct(outgoingContext(r), &pb.ProductID{Value: id}))
+		case http.MethodPut:
+			in := &pb.Product{}
+			if err := decodeBody(r, in); err != nil {
+				writeError(w, err)
+				return
+			}
+			// Path parameter overrides id of body. Параметр пути имеет приоритет над id из тела
+			in.Id = id
+			writeResponse(w)(client.UpdateProduct(outgoingContext(r), in))
+		case http.MethodDelete:
+			writeResponse(w)(client.DeleteProduct(outgoingContext(r), &pb.ProductID{Value: id}))
+		default:
+			writeError(w, status.Errorf(codes.Unimplemented, "method %s not allowed on %s", r.Method, r.URL.Path))
+		}
+	})
+	return mux
+}
+
+// Headers forwarded as gRPC metadata: token, key of retried addProduct and priority of load shedding.
+// Заголовки, передаваемые в метаданные gRPC-вызова: токен, ключ повторяемого addProduct и приоритет сброса нагрузки.
+var forwardedHeaders = []string{"Authorization", "Idempotency-Key", "X-Priority"}
+
+// Metadata with DER certificate of caller, the service takes it only from gateways of its trusted_gateways.
+// Метаданные с DER сертификатом вызывающего, сервис принимает их только от шлюзов из trusted_gateways.
+const forwardedCertHeader = "x-forwarded-client-cert-bin"
+
+// Forwards headers of request and client certificate verified by TLS as gRPC metadata, so certificate binding
+// of tokens, rate limits and idempotency keys of the service apply to the caller, not to the gateway.
+// Передаем заголовки запроса и сертификат клиента, проверенный TLS, в метаданные gRPC-вызова, поэтому привязка
+// токенов к сертификату, лимиты и ключи идемпотентности сервиса относятся к вызывающему, а не к шлюзу.
+func outgoingContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	for _, h := range forwardedHeaders {
+		if v := r.Header.Get(h); v != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(h), v)
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, forwardedCertHeader, string(r.TLS.VerifiedChains[0][0].Raw))
+	}
+	return ctx
+}
+
+// Reads query parameter by proto or JSON name, like grpc-gateway does
+// Читаем параметр запроса по имени proto или JSON, как это делает grpc-gateway
+func queryParam(q url.Values, name, jsonName string) string {
+	if v := q.Get(name); v != "" {
+		return v
+	}
+	return q.Get(jsonName)
+}
+
+func pageSizeParam(q url.Values) (int32, error) {
+	v := queryParam(q, "page_size", "pageSize")
+	if v == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid page_size %q", v)
+	}
+	return int32(size), nil
+}
+
+// Reads query parameters of listProducts. Читаем параметры запроса listProducts
+func listRequest(r *http.Request) (*pb.ListProductsRequest, error) {
+	q := r.URL.Query()
+	size, err := pageSizeParam(q)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ListProductsRequest{
+		PageSize:  size,
+		PageToken: queryParam(q, "page_token", "pageToken"),
+		OrderBy:   queryParam(q, "order_by", "orderBy"),
+		Filter:    q.Get("filter"),
+	}, nil
+}
+
+// Reads query parameters of searchProducts. Читаем параметры запроса searchProducts
+func searchRequest(r *http.Request) (*pb.SearchProductsRequest, error) {
+	q := r.URL.Query()
+	size, err := pageSizeParam(q)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SearchProductsRequest{
+		Query:     q.Get("query"),
+		PageSize:  size,
+		PageToken: queryParam(q, "page_token", "pageToken"),
+		Filter:    q.Get("filter"),
+	}, nil
+}
+
+// Reads JSON body of request to message. Читаем JSON тело запроса в сообщение
+func decodeBody(r *http.Request, m proto.Message) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err := unmarshaler.Unmarshal(body, m); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return nil
+}
+
+// Writes result of gRPC-call as message or error. Записываем результат gRPC-вызова как сообщение или ошибку
+func writeResponse(w http.ResponseWriter) func(proto.Message, error) {
+	return func(m proto.Message, err error) {
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeMessage(w, m)
+	}
+}
+
+func writeMessage(w http.ResponseWriter, m proto.Message) {
+	buf, err := marshaler.Marshal(m)
+	if err != nil {
+		writeError(w, status.Errorf(codes.Internal, "%v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(buf); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// Writes gRPC status as JSON with HTTP code of it, details of error are kept
+// Записываем состояние gRPC в JSON с соответствующим HTTP кодом, детали ошибки сохраняются
+func writeError(w http.ResponseWriter, err error) {
+	s := status.Convert(err)
+	buf, merr := marshaler.Marshal(s.Proto())
+	if merr != nil {
+		buf = []byte(`{"code": 13, "message": "failed to marshal error message"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusFromCode(s.Code()))
+	if _, err := w.Write(buf); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// Maps gRPC code to HTTP status, same as grpc-gateway runtime.HTTPStatusFromCode
+// Соответствие кодов gRPC статусам HTTP
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var (
+	crtFile       = filepath.Join("..", "mcerts", "server.crt")
+	keyFile       = filepath.Join("..", "mcerts", "server.key")
+	clientCrtFile = filepath.Join("..", "mcerts", "client.crt")
+	clientKeyFile = filepath.Join("..", "mcerts", "client.key")
+	caFile        = filepath.Join("..", "mcerts", "ca.crt")
+)
+
+const (
+	port     = ":8443"
+	address  = "localhost:50051"
+	hostname = "localhost"
+)
+
+func main() {
+	log.SetPrefix("Gateway event: ")
+	log.SetFlags(log.Lshortfile)
+
+	// Create a certificate pool from the certificate authority
+	// Генерируем пул сертификатов в удостоверяющем центре
+	certPool := x509.NewCertPool()
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		log.Fatalf("could not read ca certificate: %s", err)
+	}
+	if ok := certPool.AppendCertsFromPEM(ca); !ok {
+		log.Fatalf("failed to append ca certs")
+	}
+
+	// Key pair of gateway for HTTPS-clients. Пара ключей шлюза для HTTPS-клиентов
+	cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		log.Fatalf("failed to load key pair: %s", err)
+	}
+
+	// Key pair of gateway as client of gRPC-service. Пара ключей шлюза как клиента gRPC-сервиса
+	clientCert, err := tls.LoadX509KeyPair(clientCrtFile, clientKeyFile)
+	if err != nil {
+		log.Fatalf("could not load client key pair: %s", err)
+	}
+
+	// Token is not set here, it is forwarded from Authorization header of each request
+	// Токен здесь не задается, он передается из заголовка Authorization каждого запроса
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		ServerName:   hostname, // NOTE: this is required!
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      certPool,
+	})))
+	if err != nil {
+		log.Fatalf("Did not connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Terminates mTLS with the same CA as gRPC-service
+	// Завершаем mTLS на шлюзе с тем же удостоверяющим центром, что и у gRPC-сервиса
+	srv := &http.Server{
+		Addr:    port,
+		Handler: newGatewayMux(pb.NewProductInfoClient(conn)),
+		TLSConfig: &tls.Config{
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    certPool,
+		},
+	}
+	log.Printf("Starting REST/JSON gateway on port " + port)
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
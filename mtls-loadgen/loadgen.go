@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/money"
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// Names of methods in report. Имена методов в отчете
+const (
+	methodAdd = "addProduct"
+	methodGet = "getProduct"
+)
+
+// Parameters of run. Параметры прогона
+type config struct {
+	Address string `json:"address"`
+	// Number of connections, calls are spread over them. Количество соединений, вызовы распределяются по ним
+	Conns int `json:"conns"`
+	// Number of workers, that is maximum of calls in flight. Количество исполнителей, максимум одновременных вызовов
+	Concurrency int `json:"concurrency"`
+	// Target rate, zero runs workers in closed loop. Целевая частота, ноль - исполнители без пауз
+	RPS float64 `json:"rps"`
+	// Share of GetProduct calls, the rest are AddProduct. Доля вызовов GetProduct, остальные - AddProduct
+	GetRatio float64       `json:"get_ratio"`
+	Duration time.Duration `json:"-"`
+	Timeout  time.Duration `json:"-"`
+}
+
+// Result of run. Результат прогона
+type report struct {
+	Config      config                  `json:"config"`
+	Started     time.Time               `json:"started"`
+	DurationSec float64                 `json:"duration_s"`
+	Requests    int                     `json:"requests"`
+	Errors      int                     `json:"errors"`
+	RPS         float64                 `json:"achieved_rps"`
+	Missed      int64                   `json:"missed"`
+	Methods     map[string]methodReport `json:"methods"`
+	Handshake   latencySummary          `json:"tls_handshake"`
+}
+
+type methodReport struct {
+	Latency latencySummary `json:"latency"`
+	Errors  map[string]int `json:"errors,omitempty"`
+}
+
+// Load generator. Генератор нагрузки
+type loadgen struct {
+	cfg        config
+	creds      credentials.TransportCredentials
+	dialOpts   []grpc.DialOption
+	handshakes *recorder
+	methods    map[string]*recorder
+	// Ticks of target rate dropped as all workers were busy. Пропущенные такты целевой частоты
+	missed int64
+
+	mu  sync.Mutex
+	ids []string // IDs of added products for GetProduct. ID добавленных товаров для GetProduct
+}
+
+func newLoadgen(cfg config, creds credentials.TransportCredentials, opts ...grpc.DialOption) *loadgen {
+	handshakes := newRecorder()
+	return &loadgen{
+		cfg:        cfg,
+		creds:      &timedCreds{TransportCredentials: creds, rec: handshakes},
+		dialOpts:   opts,
+		handshakes: handshakes,
+		methods:    map[string]*recorder{methodAdd: newRecorder(), methodGet: newRecorder()},
+	}
+}
+
+// Dials connections, seeds products and drives calls for configured duration.
+// Устанавливаем соединения, добавляем начальные товары и выполняем вызовы в течение заданного времени.
+func (g *loadgen) run(ctx context.Context) (*report, error) {
+	clients := make([]pb.ProductInfoClient, 0, g.cfg.Conns)
+	for i := 0; i < g.cfg.Conns; i++ {
+		dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		opts := append([]grpc.DialOption{grpc.WithTransportCredentials(g.creds), grpc.WithBlock()}, g.dialOpts...)
+		conn, err := grpc.DialContext(dialCtx, g.cfg.Address, opts...)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("connection %d: %w", i, err)
+		}
+		defer conn.Close()
+		clients = append(clients, pb.NewProductInfoClient(conn))
+	}
+
+	// GetProduct needs existing IDs, seed calls are not counted.
+	// GetProduct требует существующих ID, начальные вызовы не учитываются.
+	for i, c := range clients {
+		res, err := c.AddProduct(ctx, seedProduct(i))
+		if err != nil {
+			return nil, fmt.Errorf("seed product: %w", err)
+		}
+		g.ids = append(g.ids, res.Value)
+	}
+
+	started := time.Now()
+	ctx, cancel := context.WithDeadline(ctx, started.Add(g.cfg.Duration))
+	defer cancel()
+
+	var jobs chan struct{}
+	if g.cfg.RPS > 0 {
+		jobs = make(chan struct{})
+		go g.dispatch(ctx, jobs)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < g.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g.worker(ctx, clients[i%len(clients)], rand.New(rand.NewSource(started.UnixNano()+int64(i))), jobs)
+		}(i)
+	}
+	wg.Wait()
+	return g.report(started, time.Since(started)), nil
+}
+
+// Sends ticks of target rate, drops them when all workers are busy.
+// Отправляем такты целевой частоты, пропускаем их, если все исполнители заняты.
+func (g *loadgen) dispatch(ctx context.Context, jobs chan<- struct{}) {
+	interval := time.Duration(float64(time.Second) / g.cfg.RPS)
+	next := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		select {
+		case jobs <- struct{}{}:
+		default:
+			atomic.AddInt64(&g.missed, 1)
+		}
+		next = next.Add(interval)
+		timer.Reset(time.Until(next))
+	}
+}
+
+// Makes calls until context is done, one per tick if jobs is not nil.
+// Выполняем вызовы до завершения контекста, по одному на такт, если jobs не nil.
+func (g *loadgen) worker(ctx context.Context, c pb.ProductInfoClient, rnd *rand.Rand, jobs <-chan struct{}) {
+	for {
+		if jobs != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-jobs:
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+		// Calls in flight are not cancelled at the end of run. Текущие вызовы не отменяются в конце прогона
+		callCtx, cancel := context.WithTimeout(context.Background(), g.cfg.Timeout)
+		if rnd.Float64() < g.cfg.GetRatio {
+			start := time.Now()
+			_, err := c.GetProduct(callCtx, &pb.ProductID{Value: g.randomID(rnd)})
+			g.methods[methodGet].record(time.Since(start), status.Code(err))
+		} else {
+			start := time.Now()
+			res, err := c.AddProduct(callCtx, seedProduct(rnd.Int()))
+			g.methods[methodAdd].record(time.Since(start), status.Code(err))
+			if err == nil {
+				g.addID(res.Value)
+			}
+		}
+		cancel()
+	}
+}
+
+func (g *loadgen) randomID(rnd *rand.Rand) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.ids[rnd.Intn(len(g.ids))]
+}
+
+func (g *loadgen) addID(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ids = append(g.ids, id)
+}
+
+func (g *loadgen) report(started time.Time, elapsed time.Duration) *report {
+	r := &report{
+		Config:      g.cfg,
+		Started:     started,
+		DurationSec: elapsed.Seconds(),
+		Missed:      atomic.LoadInt64(&g.missed),
+		Methods:     make(map[string]methodReport, len(g.methods)),
+	}
+	for name, rec := range g.methods {
+		latency, errors := rec.summary()
+		r.Methods[name] = methodReport{Latency: latency, Errors: errors}
+		r.Requests += latency.Count
+		for _, n := range errors {
+			r.Errors += n
+		}
+	}
+	r.RPS = float64(r.Requests) / elapsed.Seconds()
+	r.Handshake, _ = g.handshakes.summary()
+	return r
+}
+
+// Writes report as table. Записываем отчет таблицей
+func (r *report) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Target:\t%s, %d conns, concurrency %d, rps %s\n", r.Config.Address, r.Config.Conns,
+		r.Config.Concurrency, rateString(r.Config.RPS))
+	fmt.Fprintf(tw, "Duration:\t%.2fs\n", r.DurationSec)
+	fmt.Fprintf(tw, "Requests:\t%d (%.1f rps), errors %d, missed ticks %d\n", r.Requests, r.RPS, r.Errors, r.Missed)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "METHOD\tCOUNT\tMIN\tMEAN\tP50\tP90\tP99\tP99.9\tMAX")
+	names := make([]string, 0, len(r.Methods))
+	for name := range r.Methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeSummary(tw, name, r.Methods[name].Latency)
+	}
+	writeSummary(tw, "tls handshake", r.Handshake)
+	if r.Errors > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "METHOD\tCODE\tERRORS")
+		for _, name := range names {
+			errors := r.Methods[name].Errors
+			codes := make([]string, 0, len(errors))
+			for code := range errors {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			for _, code := range codes {
+				fmt.Fprintf(tw, "%s\t%s\t%d\n", name, code, errors[code])
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func writeSummary(w io.Writer, name string, s latencySummary) {
+	fmt.Fprintf(w, "%s\t%d\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%.2fms\n",
+		name, s.Count, s.Min, s.Mean, s.P50, s.P90, s.P99, s.P999, s.Max)
+}
+
+func rateString(rps float64) string {
+	if rps <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%g", rps)
+}
+
+func seedProduct(n int) *pb.Product {
+	return &pb.Product{
+		Name:        fmt.Sprintf("Load test product %d", n),
+		Description: "Product added by mtls-loadgen",
+		PriceMoney:  &moneypb.Money{CurrencyCode: money.DefaultCurrency, Units: int64(n % 10000), Nanos: 990000000},
+	}
+}
+
+// Transport credentials recording duration of TLS handshakes.
+// Учетные данные транспорта, записывающие длительность рукопожатий TLS.
+type timedCreds struct {
+	credentials.TransportCredentials
+	rec *recorder
+}
+
+func (c *timedCreds) ClientHandshake(ctx context.Context, authority string, raw net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	start := time.Now()
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, authority, raw)
+	code := codes.OK
+	if err != nil {
+		code = codes.Unavailable
+	}
+	c.rec.record(time.Since(start), code)
+	return conn, info, err
+}
+
+func (c *timedCreds) Clone() credentials.TransportCredentials {
+	return &timedCreds{TransportCredentials: c.TransportCredentials.Clone(), rec: c.rec}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blablatov/stream-mtls-grpc/internal/testcerts"
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// Test server, each fifth GetProduct fails. Тестовый сервер, каждый пятый GetProduct завершается ошибкой
+type testServer struct {
+	pb.UnimplementedProductInfoServer
+	mu       sync.Mutex
+	products map[string]*pb.Product
+	gets     int32
+}
+
+func (s *testServer) AddProduct(ctx context.Context, in *pb.Product) (*pb.ProductID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in.Id = in.Name
+	s.products[in.Id] = in
+	return &pb.ProductID{Value: in.Id}, nil
+}
+
+func (s *testServer) GetProduct(ctx context.Context, in *pb.ProductID) (*pb.Product, error) {
+	if atomic.AddInt32(&s.gets, 1)%5 == 0 {
+		return nil, status.Error(codes.ResourceExhausted, "busy")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.products[in.Value], nil
+}
+
+func newTestLoadgen(t *testing.T, cfg config) *loadgen {
+	certs := testcerts.New(t, "client")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(certs.ServerTLS())))
+	pb.RegisterProductInfoServer(s, &testServer{products: make(map[string]*pb.Product)})
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	cfg.Address = lis.Addr().String()
+	cfg.Timeout = time.Second
+	return newLoadgen(cfg, credentials.NewTLS(&tls.Config{
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{certs.Client},
+		RootCAs:      certs.CAPool,
+	}))
+}
+
+func TestLoadgen_ClosedLoop(t *testing.T) {
+	g := newTestLoadgen(t, config{Conns: 3, Concurrency: 6, GetRatio: 0.8, Duration: 200 * time.Millisecond})
+	r, err := g.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	get, add := r.Methods[methodGet], r.Methods[methodAdd]
+	if get.Latency.Count == 0 || add.Latency.Count == 0 || r.Requests != get.Latency.Count+add.Latency.Count {
+		t.Errorf("unexpected counts %+v", r)
+	}
+	if get.Errors["ResourceExhausted"] == 0 || r.Errors != get.Errors["ResourceExhausted"] {
+		t.Errorf("unexpected errors %v, total %d", get.Errors, r.Errors)
+	}
+	if r.Handshake.Count != 3 || r.Handshake.Max <= 0 {
+		t.Errorf("want 3 handshakes, got %+v", r.Handshake)
+	}
+
+	var b bytes.Buffer
+	if err := r.writeText(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"getProduct", "tls handshake", "ResourceExhausted"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("text report has no %q:\n%s", want, b.String())
+		}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"p99_ms"`) {
+		t.Errorf("unexpected JSON %s", data)
+	}
+}
+
+func TestLoadgen_TargetRate(t *testing.T) {
+	g := newTestLoadgen(t, config{Conns: 1, Concurrency: 4, RPS: 100, GetRatio: 1, Duration: 300 * time.Millisecond})
+	r, err := g.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// About 30 calls, timers of CI are coarse. Около 30 вызовов, таймеры CI неточны
+	if r.Requests < 15 || r.Requests > 35 {
+		t.Errorf("got %d requests at 100 rps for 300ms", r.Requests)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	samples := make([]time.Duration, 0, 1000)
+	for i := 1000; i > 0; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	s := summarize(samples)
+	if s.Count != 1000 || s.Min != 1 || s.Max != 1000 || s.P50 != 500 || s.P90 != 900 || s.P99 != 990 || s.P999 != 999 || s.Mean != 500.5 {
+		t.Errorf("unexpected summary %+v", s)
+	}
+	if s := summarize([]time.Duration{3 * time.Millisecond}); s.P50 != 3 || s.P999 != 3 {
+		t.Errorf("unexpected summary of one sample %+v", s)
+	}
+}
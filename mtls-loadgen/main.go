@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/oauth"
+)
+
+var (
+	crtFile = filepath.Join("..", "mcerts", "client.crt")
+	keyFile = filepath.Join("..", "mcerts", "client.key")
+	caFile  = filepath.Join("..", "mcerts", "ca.crt")
+)
+
+func main() {
+	log.SetPrefix("Loadgen event: ")
+	log.SetFlags(log.Lshortfile)
+
+	var cfg config
+	flag.StringVar(&cfg.Address, "addr", "localhost:50051", "address of service")
+	flag.IntVar(&cfg.Conns, "conns", 4, "number of connections")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 16, "number of concurrent calls")
+	flag.Float64Var(&cfg.RPS, "rps", 0, "target requests per second, 0 is as fast as possible")
+	flag.Float64Var(&cfg.GetRatio, "get-ratio", 0.9, "share of getProduct calls, the rest are addProduct")
+	flag.DurationVar(&cfg.Duration, "duration", 30*time.Second, "duration of run")
+	flag.DurationVar(&cfg.Timeout, "timeout", 5*time.Second, "timeout of each call")
+	serverName := flag.String("server-name", "localhost", "name in the server certificate")
+	flag.StringVar(&crtFile, "cert", crtFile, "client certificate file")
+	flag.StringVar(&keyFile, "key", keyFile, "client key file")
+	flag.StringVar(&caFile, "ca", caFile, "CA certificate file")
+	token := flag.String("token", "blablatok-tokblabla-blablatok", "OAuth2 access token")
+	jsonOut := flag.String("json", "", "write report as JSON to file, - is stdout")
+	flag.Parse()
+	if cfg.Conns < 1 || cfg.Concurrency < 1 || cfg.GetRatio < 0 || cfg.GetRatio > 1 {
+		log.Fatalf("conns and concurrency must be positive, get-ratio must be in [0, 1]")
+	}
+
+	// Create a certificate pool from the certificate authority
+	// Генерируем пул сертификатов в удостоверяющем центре
+	certPool := x509.NewCertPool()
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		log.Fatalf("could not read ca certificate: %s", err)
+	}
+	if ok := certPool.AppendCertsFromPEM(ca); !ok {
+		log.Fatalf("failed to append ca certs")
+	}
+	certificate, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		log.Fatalf("could not load client key pair: %s", err)
+	}
+	creds := credentials.NewTLS(&tls.Config{
+		ServerName:   *serverName,
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      certPool,
+	})
+	perRPC := oauth.TokenSource{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: *token})}
+
+	// Interrupt stops run early, report is written anyway.
+	// Прерывание завершает прогон досрочно, отчет все равно записывается.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	g := newLoadgen(cfg, creds, grpc.WithPerRPCCredentials(perRPC))
+	log.Printf("Running %s against %s", cfg.Duration, cfg.Address)
+	r, err := g.run(ctx)
+	if err != nil {
+		log.Fatalf("Load test failed: %v", err)
+	}
+
+	// Table goes to stderr when JSON is written to stdout. Таблица выводится в stderr, если JSON пишется в stdout
+	text := os.Stdout
+	if *jsonOut == "-" {
+		text = os.Stderr
+	}
+	if err := r.writeText(text); err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOut == "" {
+		return
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	data = append(data, '\n')
+	if *jsonOut == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(*jsonOut, data, 0644)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Latency summary in milliseconds. Сводка задержек в миллисекундах
+type latencySummary struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min_ms"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	P999  float64 `json:"p999_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// Collects all samples, percentiles are exact. Собирает все замеры, процентили точные
+type recorder struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	errors  map[codes.Code]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{errors: make(map[codes.Code]int)}
+}
+
+// Records latency of call and its code. Записываем задержку вызова и его код
+func (r *recorder) record(d time.Duration, code codes.Code) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, d)
+	if code != codes.OK {
+		r.errors[code]++
+	}
+}
+
+// Returns summary of samples and errors by code name. Возвращаем сводку замеров и ошибки по имени кода
+func (r *recorder) summary() (latencySummary, map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	errors := make(map[string]int, len(r.errors))
+	for code, n := range r.errors {
+		errors[code.String()] = n
+	}
+	return summarize(r.samples), errors
+}
+
+func summarize(samples []time.Duration) latencySummary {
+	if len(samples) == 0 {
+		return latencySummary{}
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	return latencySummary{
+		Count: len(sorted),
+		Min:   ms(sorted[0]),
+		Mean:  ms(total / time.Duration(len(sorted))),
+		P50:   ms(percentile(sorted, 50)),
+		P90:   ms(percentile(sorted, 90)),
+		P99:   ms(percentile(sorted, 99)),
+		P999:  ms(percentile(sorted, 99.9)),
+		Max:   ms(sorted[len(sorted)-1]),
+	}
+}
+
+// Nearest-rank percentile of sorted samples. Процентиль методом ближайшего ранга по отсортированным замерам
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	// Epsilon drops error of float, 99.9% of 1000 is not 999.0000000000001.
+	// Эпсилон убирает погрешность float, 99.9% от 1000 не равно 999.0000000000001.
+	rank := int(math.Ceil(p/100*float64(len(sorted))-1e-9)) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// Prefixes of debug and management services allowed only to admin.
+// Префиксы отладочных сервисов и сервисов управления, доступных только администратору.
+var adminServices = []string{
+	"/grpc.reflection.v1alpha.ServerReflection/",
+	"/grpc.reflection.v1.ServerReflection/",
+	"/grpc.channelz.v1.Channelz/",
+	"/ecommerce.ApiKeyAdmin/",
+	"/ecommerce.WebhookAdmin/",
+}
+
+var errNotAdmin = status.Errorf(codes.PermissionDenied, "admin identity is required")
+
+// Registers reflection and channelz services if they are enabled by config
+// Регистрируем сервисы reflection и channelz, если они включены в конфигурации
+func registerDebugServices(s *grpc.Server, cfg *config) {
+	if cfg.Reflection {
+		reflection.Register(s)
+	}
+	if cfg.Channelz {
+		service.RegisterChannelzServiceToServer(s)
+	}
+}
+
+// Checks that caller of debug services presents client certificate with admin identity
+// Проверяем, что вызывающий отладочные сервисы предъявил клиентский сертификат администратора
+type adminGuard struct {
+	identities []string
+}
+
+func (g *adminGuard) check(ctx context.Context, method string) error {
+	if !isAdminMethod(method) {
+		return nil
+	}
+	cert, ok := peerCertificate(ctx)
+	if !ok {
+		return errNotAdmin
+	}
+	for _, id := range certIdentities(cert) {
+		for _, admin := range g.identities {
+			if id == admin {
+				return nil
+			}
+		}
+	}
+	return errNotAdmin
+}
+
+// Unary interceptor of admin guard. Унарный перехватчик проверки администратора
+func (g *adminGuard) unary(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := g.check(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// Stream interceptor of admin guard, reflection is a streaming service
+// Потоковый перехватчик проверки администратора, reflection - потоковый сервис
+func (g *adminGuard) stream(srv interface{}, ss grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := g.check(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func isAdminMethod(method string) bool {
+	for _, prefix := range adminServices {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets verified client certificate of connection. Получаем проверенный клиентский сертификат соединения
+func peerCertificate(ctx context.Context) (*x509.Certificate, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil, false
+	}
+	if len(tlsInfo.State.VerifiedChains) > 0 && len(tlsInfo.State.VerifiedChains[0]) > 0 {
+		return tlsInfo.State.VerifiedChains[0][0], true
+	}
+	return nil, false
+}
+
+// Identities of certificate: common name and subject alternative names
+// Идентификаторы сертификата: общее имя и альтернативные имена субъекта
+func certIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	return ids
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Context of connection with verified client certificate. Контекст соединения с проверенным сертификатом клиента
+func peerContext(cert *x509.Certificate) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}},
+	})
+}
+
+func TestAdminGuard(t *testing.T) {
+	g := &adminGuard{identities: []string{"admin.blablatov.local"}}
+	admin := &x509.Certificate{Subject: pkix.Name{CommonName: "admin"}, DNSNames: []string{"admin.blablatov.local"}}
+	user := &x509.Certificate{Subject: pkix.Name{CommonName: "localhost"}}
+
+	var tests = []struct {
+		ctx    context.Context
+		method string
+		want   codes.Code
+	}{
+		{peerContext(admin), "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo", codes.OK},
+		{peerContext(user), "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo", codes.PermissionDenied},
+		{peerContext(admin), "/grpc.channelz.v1.Channelz/GetTopChannels", codes.OK},
+		{peerContext(user), "/grpc.channelz.v1.Channelz/GetTopChannels", codes.PermissionDenied},
+		{context.Background(), "/grpc.channelz.v1.Channelz/GetTopChannels", codes.PermissionDenied},
+		{peerContext(user), "/ecommerce.ProductInfo/getProduct", codes.OK},
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	for _, test := range tests {
+		_, err := g.unary(test.ctx, nil, &grpc.UnaryServerInfo{FullMethod: test.method}, handler)
+		if got := status.Code(err); got != test.want {
+			t.Errorf("unary %s: got %s, want %s", test.method, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Implements ApiKeyAdmin, it is protected by admin guard. Реализует ApiKeyAdmin, защищен проверкой администратора
+type apiKeyAdminServer struct {
+	pb.UnimplementedApiKeyAdminServer
+	store *apiKeyStore
+}
+
+// Method create of API key. Метод сервера CreateApiKey, создать API ключ
+func (s *apiKeyAdminServer) CreateApiKey(ctx context.Context, in *pb.CreateApiKeyRequest) (*pb.CreateApiKeyResponse, error) {
+	var violations []*epb.BadRequest_FieldViolation
+	if strings.TrimSpace(in.Name) == "" {
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "name", Description: "name is required"})
+	}
+	methods, err := normalizeAPIKeyMethods(in.Methods)
+	switch {
+	case len(in.Methods) == 0:
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "methods", Description: "at least one method is required"})
+	case err != nil:
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "methods", Description: err.Error()})
+	}
+	var expires time.Time
+	if in.ExpireTime != nil {
+		expires = in.ExpireTime.AsTime()
+		if !expires.After(s.store.now()) {
+			violations = append(violations, &epb.BadRequest_FieldViolation{Field: "expire_time", Description: "expire_time must be in the future"})
+		}
+	}
+	if len(violations) > 0 {
+		st := status.New(codes.InvalidArgument, "Invalid api key received")
+		if ds, err := st.WithDetails(&epb.BadRequest{FieldViolations: violations}); err == nil {
+			st = ds
+		}
+		return nil, st.Err()
+	}
+
+	r, key, err := s.store.create(in.Name, methods, expires)
+	if err != nil {
+		log.Printf("Failed to save api key: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to save api key")
+	}
+	log.Printf("Created api key %s (%s)", r.ID, r.Name)
+	return &pb.CreateApiKeyResponse{ApiKey: r.proto(), Key: key}, nil
+}
+
+// Method list of API keys. Метод сервера ListApiKeys, список API ключей
+func (s *apiKeyAdminServer) ListApiKeys(ctx context.Context, in *pb.ListApiKeysRequest) (*pb.ListApiKeysResponse, error) {
+	out := &pb.ListApiKeysResponse{}
+	for _, r := range s.store.list() {
+		out.ApiKeys = append(out.ApiKeys, r.proto())
+	}
+	return out, nil
+}
+
+// Method revoke of API key. Метод сервера RevokeApiKey, отозвать API ключ
+func (s *apiKeyAdminServer) RevokeApiKey(ctx context.Context, in *pb.RevokeApiKeyRequest) (*pb.ApiKey, error) {
+	r, err := s.store.revoke(in.Id)
+	if err == errAPIKeyNotFound {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("Failed to save api key: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to save api key")
+	}
+	log.Printf("Revoked api key %s (%s)", r.ID, r.Name)
+	return r.proto(), nil
+}
+
+func timestampOrNil(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"golang.org/x/crypto/argon2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Format of key is "pik_<id>.<secret>", id finds the record, secret is checked by its argon2id hash.
+// Формат ключа "pik_<id>.<secret>", по id находится запись, секрет проверяется по его хэшу argon2id.
+const (
+	apiKeyPrefix = "pik_"
+	// Parameters of argon2id recommended by OWASP. Параметры argon2id, рекомендованные OWASP
+	argonTime    = 2
+	argonMemory  = 19 * 1024
+	argonThreads = 1
+	argonKeyLen  = 32
+	// Verified key is not hashed again during this time. Проверенный ключ не хэшируется повторно в течение этого времени
+	apiKeyVerifiedTTL = time.Minute
+	// Failed and in-flight verifications of key by one caller allowed during window, further guesses of the caller
+	// are rejected without hashing, so guesses of known id can't exhaust CPU and memory of argon2id, and
+	// can't lock out the key for other callers.
+	// Неудачные и выполняемые проверки ключа одним вызывающим, разрешенные за окно, дальнейшие попытки вызывающего
+	// отклоняются без хэширования, поэтому подбор секрета известного id не исчерпывает процессор и память
+	// argon2id и не блокирует ключ для других вызывающих.
+	apiKeyMaxFailures   = 5
+	apiKeyFailureWindow = time.Minute
+)
+
+var (
+	errAPIKeyNotFound    = status.Errorf(codes.NotFound, "api key does not exist")
+	errAPIKeyNotAllowed  = status.Errorf(codes.PermissionDenied, "api key is not allowed to call method")
+	productInfoMethodPfx = "/" + pb.ProductInfo_ServiceDesc.ServiceName + "/"
+)
+
+// Stored key, the secret itself is never kept. Хранимый ключ, сам секрет не сохраняется
+type apiKeyRecord struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Methods  []string  `json:"methods"`
+	Salt     []byte    `json:"salt"`
+	Hash     []byte    `json:"hash"`
+	Created  time.Time `json:"create_time"`
+	Expires  time.Time `json:"expire_time"` // Zero for key without expiry. Нулевое для бессрочного ключа
+	LastUsed time.Time `json:"last_used_time"`
+	Revoked  bool      `json:"revoked"`
+
+	// SHA-256 of recently verified key, so argon2id is not computed for each call.
+	// SHA-256 недавно проверенного ключа, чтобы argon2id не вычислялся на каждый вызов.
+	verified      [sha256.Size]byte
+	verifiedUntil time.Time
+	// Failed and in-progress verifications by caller. Неудачные и выполняемые проверки по вызывающим
+	failed map[string]*apiKeyFailures
+}
+
+// Failed verifications since window start and verifications in progress.
+// Неудачные проверки с начала окна и выполняемые проверки.
+type apiKeyFailures struct {
+	failures int
+	since    time.Time
+	hashing  int
+}
+
+// Returns failures of caller, counters of other callers whose window is over are dropped.
+// Возвращаем неудачи вызывающего, счетчики других вызывающих с истекшим окном удаляются.
+func (r *apiKeyRecord) failures(caller string, now time.Time) *apiKeyFailures {
+	if r.failed == nil {
+		r.failed = make(map[string]*apiKeyFailures)
+	}
+	for c, f := range r.failed {
+		if f.hashing == 0 && !now.Before(f.since.Add(apiKeyFailureWindow)) {
+			delete(r.failed, c)
+		}
+	}
+	f, ok := r.failed[caller]
+	if !ok {
+		f = &apiKeyFailures{since: now}
+		r.failed[caller] = f
+	} else if !now.Before(f.since.Add(apiKeyFailureWindow)) {
+		f.failures, f.since = 0, now
+	}
+	return f
+}
+
+// Store of API keys, it is saved to file after each change if file is set.
+// Last-used time is kept in memory and saved with the next change of keys.
+// Хранилище API ключей, сохраняется в файл после каждого изменения, если файл задан.
+// Время последнего использования хранится в памяти и сохраняется при следующем изменении ключей.
+type apiKeyStore struct {
+	file string
+
+	mu   sync.Mutex
+	keys map[string]*apiKeyRecord
+	now  func() time.Time
+}
+
+// Creates store and loads keys from file if it exists. Создаем хранилище и загружаем ключи из файла, если он есть
+func newAPIKeyStore(file string) (*apiKeyStore, error) {
+	s := &apiKeyStore{file: file, keys: make(map[string]*apiKeyRecord), now: time.Now}
+	if file == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*apiKeyRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		s.keys[r.ID] = r
+	}
+	return s, nil
+}
+
+// Creates key allowed to call methods, zero expires means key without expiry.
+// Создаем ключ, которому разрешен вызов методов, нулевой expires - бессрочный ключ.
+func (s *apiKeyStore) create(name string, methods []string, expires time.Time) (*apiKeyRecord, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	salt := make([]byte, 16)
+	for _, b := range [][]byte{id, secret, salt} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+	}
+	r := &apiKeyRecord{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Methods: methods,
+		Salt:    salt,
+		Created: s.now().UTC(),
+		Expires: expires,
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	r.Hash = hashAPIKeySecret(encoded, salt)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[r.ID] = r
+	if err := s.save(); err != nil {
+		delete(s.keys, r.ID)
+		return nil, "", err
+	}
+	return r.copy(), apiKeyPrefix + r.ID + "." + encoded, nil
+}
+
+// Returns all keys sorted by creation time. Возвращаем все ключи по порядку создания
+func (s *apiKeyStore) list() []*apiKeyRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*apiKeyRecord, 0, len(s.keys))
+	for _, r := range s.keys {
+		out = append(out, r.copy())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Created.Equal(out[j].Created) {
+			return out[i].Created.Before(out[j].Created)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Revokes key, revoked key stays in list. Отзываем ключ, отозванный ключ остается в списке
+func (s *apiKeyStore) revoke(id string) (*apiKeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.keys[id]
+	if !ok {
+		return nil, errAPIKeyNotFound
+	}
+	if !r.Revoked {
+		r.Revoked = true
+		if err := s.save(); err != nil {
+			r.Revoked = false
+			return nil, err
+		}
+	}
+	return r.copy(), nil
+}
+
+// Checks key of caller and its scope for method, claims of key are returned.
+// Проверяем ключ вызывающего и его область для метода, возвращаются утверждения ключа.
+func (s *apiKeyStore) authenticate(key, method, caller string) (*tokenClaims, error) {
+	id, secret, ok := parseAPIKey(key)
+	if !ok {
+		return nil, errInvalidToken
+	}
+	sum := sha256.Sum256([]byte(key))
+	now := s.now()
+
+	s.mu.Lock()
+	r, found := s.keys[id]
+	if !found || r.Revoked || (!r.Expires.IsZero() && !now.Before(r.Expires)) {
+		s.mu.Unlock()
+		return nil, errInvalidToken
+	}
+	cached := now.Before(r.verifiedUntil) && subtle.ConstantTimeCompare(sum[:], r.verified[:]) == 1
+	var f *apiKeyFailures
+	if !cached {
+		f = r.failures(caller, now)
+		// Recently verified key passes above, guesses are rejected. Недавно проверенный ключ проходит выше, подбор отклоняется
+		if f.failures+f.hashing >= apiKeyMaxFailures {
+			s.mu.Unlock()
+			return nil, errInvalidToken
+		}
+		f.hashing++
+	}
+	salt, hash := r.Salt, r.Hash
+	s.mu.Unlock()
+
+	// Hashing is slow by design, so it is done without lock. Хэширование медленное, поэтому выполняется без блокировки
+	match := cached || subtle.ConstantTimeCompare(hashAPIKeySecret(secret, salt), hash) == 1
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !cached {
+		f.hashing--
+		if !match {
+			f.failures++
+			return nil, errInvalidToken
+		}
+		r.verified, r.verifiedUntil = sum, now.Add(apiKeyVerifiedTTL)
+	}
+	if r.Revoked {
+		return nil, errInvalidToken
+	}
+	if !r.allows(method) {
+		return nil, errAPIKeyNotAllowed
+	}
+	r.LastUsed = now.UTC()
+	claims := &tokenClaims{Subject: "apikey:" + r.ID, ClientID: r.Name}
+	if !r.Expires.IsZero() {
+		claims.ExpiresAt = r.Expires.Unix()
+	}
+	return claims, nil
+}
+
+// Writes keys to temporary file and renames it, so file is never half-written. Called with s.mu held.
+// Записываем ключи во временный файл и переименовываем его, поэтому файл не бывает записан наполовину.
+func (s *apiKeyStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	records := make([]*apiKeyRecord, 0, len(s.keys))
+	for _, r := range s.keys {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), filepath.Base(s.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
+
+// Copy without verification cache. Копия без кэша проверки
+func (r *apiKeyRecord) copy() *apiKeyRecord {
+	c := *r
+	c.Methods = append([]string(nil), r.Methods...)
+	c.verified, c.verifiedUntil, c.failed = [sha256.Size]byte{}, time.Time{}, nil
+	return &c
+}
+
+func (r *apiKeyRecord) allows(method string) bool {
+	for _, m := range r.Methods {
+		if m == method || (m == "*" && strings.HasPrefix(method, productInfoMethodPfx)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts record to message without secret. Преобразуем запись в сообщение без секрета
+func (r *apiKeyRecord) proto() *pb.ApiKey {
+	return &pb.ApiKey{
+		Id:           r.ID,
+		Name:         r.Name,
+		Methods:      r.Methods,
+		CreateTime:   timestampOrNil(r.Created),
+		ExpireTime:   timestampOrNil(r.Expires),
+		LastUsedTime: timestampOrNil(r.LastUsed),
+		Revoked:      r.Revoked,
+	}
+}
+
+func hashAPIKeySecret(secret string, salt []byte) []byte {
+	return argon2.IDKey([]byte(secret), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+}
+
+// Splits key into id and secret. Разделяем ключ на id и секрет
+func parseAPIKey(key string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), ".")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+// Normalizes methods of key to full names, short name "getProduct" means method of ProductInfo.
+// Приводим методы ключа к полным именам, короткое имя "getProduct" означает метод ProductInfo.
+func normalizeAPIKeyMethods(methods []string) ([]string, error) {
+	known := make(map[string]bool)
+	for _, m := range pb.ProductInfo_ServiceDesc.Methods {
+		known[productInfoMethodPfx+m.MethodName] = true
+	}
+	out := make([]string, 0, len(methods))
+	for _, m := range methods {
+		if m != "*" {
+			m = fullMethodName(m)
+		}
+		if m != "*" && !known[m] {
+			return nil, errors.New("unknown method " + m)
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// Full name of method, short name "getProduct" means method of ProductInfo.
+// Полное имя метода, короткое имя "getProduct" означает метод ProductInfo.
+func fullMethodName(m string) string {
+	if strings.HasPrefix(m, "/") {
+		return m
+	}
+	return productInfoMethodPfx + m
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func callWithAuthorization(a *authenticator, method, authorization string) (*tokenClaims, error) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", authorization))
+	var claims *tokenClaims
+	_, err := a.ensureValidToken(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			claims, _ = claimsFromContext(ctx)
+			return nil, nil
+		})
+	return claims, err
+}
+
+func TestAPIKeys_Authenticate(t *testing.T) {
+	store, err := newAPIKeyStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	admin := &apiKeyAdminServer{store: store}
+	res, err := admin.CreateApiKey(context.Background(), &pb.CreateApiKeyRequest{
+		Name:       "catalog-reader",
+		Methods:    []string{"getProduct", "/ecommerce.ProductInfo/listProducts"},
+		ExpireTime: timestamppb.New(now.Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := res.Key
+	a := &authenticator{apiKeys: store}
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		want          codes.Code
+	}{
+		{"allowed method", "/ecommerce.ProductInfo/getProduct", "ApiKey " + key, codes.OK},
+		{"scheme is case-insensitive", "/ecommerce.ProductInfo/listProducts", "apikey " + key, codes.OK},
+		{"method out of scope", "/ecommerce.ProductInfo/addProduct", "ApiKey " + key, codes.PermissionDenied},
+		{"wrong secret", "/ecommerce.ProductInfo/getProduct", "ApiKey " + key[:len(key)-2] + "xx", codes.Unauthenticated},
+		{"unknown key", "/ecommerce.ProductInfo/getProduct", "ApiKey pik_0000000000000000.secret", codes.Unauthenticated},
+		{"key as bearer token", "/ecommerce.ProductInfo/getProduct", "Bearer " + key, codes.Unauthenticated},
+		{"unknown scheme", "/ecommerce.ProductInfo/getProduct", "Basic " + key, codes.Unauthenticated},
+		{"static token still works", "/ecommerce.ProductInfo/getProduct", "Bearer blablatok-tokblabla-blablatok", codes.OK},
+	}
+	for _, test := range tests {
+		if _, err := callWithAuthorization(a, test.method, test.authorization); status.Code(err) != test.want {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.want)
+		}
+	}
+
+	claims, err := callWithAuthorization(a, "/ecommerce.ProductInfo/getProduct", "ApiKey "+key)
+	if err != nil || claims == nil || claims.Subject != "apikey:"+res.ApiKey.Id || claims.ClientID != "catalog-reader" {
+		t.Errorf("claims of key: %+v, %v", claims, err)
+	}
+	list, _ := admin.ListApiKeys(context.Background(), &pb.ListApiKeysRequest{})
+	if len(list.ApiKeys) != 1 || !list.ApiKeys[0].LastUsedTime.AsTime().Equal(now.UTC().Truncate(time.Nanosecond)) {
+		t.Errorf("last used time is not tracked: %v", list.ApiKeys)
+	}
+
+	// Keys are not bound to certificate, though tokens must be. Ключи не привязываются к сертификату, в отличие от токенов
+	if _, err := callWithAuthorization(a, "/ecommerce.ProductInfo/getProduct", "ApiKey "+key); err != nil || a.allowUnbound {
+		t.Errorf("key with bound tokens required: got %v", err)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := callWithAuthorization(a, "/ecommerce.ProductInfo/getProduct", "ApiKey "+key); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expired key: got %v", err)
+	}
+}
+
+func TestAPIKeys_FailedVerifications(t *testing.T) {
+	store, err := newAPIKeyStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	r, key, err := store.create("catalog-reader", []string{"*"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const method = "/ecommerce.ProductInfo/getProduct"
+	const attacker, owner = "addr:192.0.2.1", "cert:catalog.blablatov.local"
+	failures := func(caller string) int {
+		if f, ok := store.keys[r.ID].failed[caller]; ok {
+			return f.failures
+		}
+		return 0
+	}
+	// Verified key keeps working during guesses. Проверенный ключ продолжает работать во время подбора
+	if _, err := store.authenticate(key, method, owner); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < apiKeyMaxFailures; i++ {
+		store.authenticate(apiKeyPrefix+r.ID+".guess", method, attacker)
+	}
+	if failures(attacker) != apiKeyMaxFailures {
+		t.Fatalf("got %d failures, want %d", failures(attacker), apiKeyMaxFailures)
+	}
+	// Guess above limit is not hashed. Попытка сверх лимита не хэшируется
+	if _, err := store.authenticate(apiKeyPrefix+r.ID+".guess", method, attacker); status.Code(err) != codes.Unauthenticated || failures(attacker) != apiKeyMaxFailures {
+		t.Errorf("guess above limit: got %v, %d failures", err, failures(attacker))
+	}
+	if _, err := store.authenticate(key, method, owner); err != nil {
+		t.Errorf("verified key during guesses: got %v", err)
+	}
+	// Key is not locked out for other callers after its verification expires.
+	// Ключ не блокируется для других вызывающих после истечения его проверки.
+	now = now.Add(apiKeyVerifiedTTL / 2)
+	store.authenticate(apiKeyPrefix+r.ID+".guess", method, attacker)
+	now = now.Add(apiKeyVerifiedTTL / 2)
+	if _, err := store.authenticate(key, method, owner); err != nil || failures(owner) != 0 {
+		t.Errorf("key of owner during guesses of other caller: got %v, %d failures", err, failures(owner))
+	}
+
+	now = now.Add(apiKeyFailureWindow)
+	if _, err := store.authenticate(apiKeyPrefix+r.ID+".guess", method, attacker); status.Code(err) != codes.Unauthenticated || failures(attacker) != 1 {
+		t.Errorf("guess after window: got %v, %d failures", err, failures(attacker))
+	}
+	if _, ok := store.keys[r.ID].failed[owner]; ok {
+		t.Errorf("counter of owner is kept after window")
+	}
+}
+
+func TestAPIKeyAdmin_CreateListRevoke(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "api_keys.json")
+	store, err := newAPIKeyStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := &apiKeyAdminServer{store: store}
+	ctx := context.Background()
+
+	_, err = admin.CreateApiKey(ctx, &pb.CreateApiKeyRequest{Methods: []string{"getProduct", "dropTables"},
+		ExpireTime: timestamppb.New(time.Now().Add(-time.Minute))})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("invalid request: got %v", err)
+	}
+	var fields []string
+	for _, d := range status.Convert(err).Details() {
+		if br, ok := d.(*epb.BadRequest); ok {
+			for _, v := range br.FieldViolations {
+				fields = append(fields, v.Field)
+			}
+		}
+	}
+	if strings.Join(fields, ",") != "name,methods,expire_time" {
+		t.Errorf("got violations of %v", fields)
+	}
+
+	res, err := admin.CreateApiKey(ctx, &pb.CreateApiKeyRequest{Name: "importer", Methods: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.RevokeApiKey(ctx, &pb.RevokeApiKeyRequest{Id: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("revoke of missing key: got %v", err)
+	}
+	revoked, err := admin.RevokeApiKey(ctx, &pb.RevokeApiKeyRequest{Id: res.ApiKey.Id})
+	if err != nil || !revoked.Revoked {
+		t.Fatalf("revoke: %v, %v", revoked, err)
+	}
+
+	// Keys are restored from file, secret is not saved. Ключи восстанавливаются из файла, секрет не сохраняется
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, secret, _ := parseAPIKey(res.Key); strings.Contains(string(data), secret) {
+		t.Error("secret of key is saved")
+	}
+	reloaded, err := newAPIKeyStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := reloaded.list()
+	if len(keys) != 1 || keys[0].Name != "importer" || !keys[0].Revoked {
+		t.Errorf("reloaded keys: %+v", keys)
+	}
+	a := &authenticator{apiKeys: reloaded}
+	if _, err := callWithAuthorization(a, "/ecommerce.ProductInfo/addProduct", "ApiKey "+res.Key); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("revoked key: got %v", err)
+	}
+}
+
+func TestAdminGuard_APIKeyAdmin(t *testing.T) {
+	if !isAdminMethod("/ecommerce.ApiKeyAdmin/createApiKey") {
+		t.Error("ApiKeyAdmin is not guarded")
+	}
+	r := &apiKeyRecord{Methods: []string{"*"}}
+	if r.allows("/ecommerce.ApiKeyAdmin/createApiKey") {
+		t.Error(`"*" allows management of keys`)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var errAuditWrite = status.Errorf(codes.Internal, "failed to write audit log")
+
+// Max length of audit entry. Максимальная длина записи журнала аудита
+const maxAuditLineLen = 16 << 20
+
+// Last line without newline, it is left by crash during write of entry whose change was not applied.
+// Последняя строка без перевода строки, ее оставляет сбой при записи, изменение такой записи не применялось.
+type tornAuditEntryError struct {
+	line   int
+	offset int64 // Size of complete entries. Размер полных записей
+}
+
+func (e *tornAuditEntryError) Error() string {
+	return fmt.Sprintf("line %d: incomplete entry at offset %d", e.line, e.offset)
+}
+
+// Entry of audit log, one JSON line. Hash covers the entry without hash, including hash of the previous entry,
+// so change, insertion or removal of any entry breaks the chain.
+// Запись журнала аудита, одна строка JSON. Хеш покрывает запись без хеша, включая хеш предыдущей записи,
+// поэтому изменение, вставка или удаление любой записи разрывает цепочку.
+type auditEntry struct {
+	Seq          int64                  `json:"seq"`
+	Time         time.Time              `json:"time"`
+	Method       string                 `json:"method"`
+	CertSubject  string                 `json:"cert_subject,omitempty"`
+	CertSerial   string                 `json:"cert_serial,omitempty"`
+	TokenSubject string                 `json:"token_subject,omitempty"`
+	ProductID    string                 `json:"product_id"`
+	Diff         map[string]auditChange `json:"diff"`
+	PrevHash     string                 `json:"prev_hash"`
+	Hash         string                 `json:"hash,omitempty"`
+}
+
+// Values of changed field in protojson, absent value is default. Значения измененного поля в protojson
+type auditChange struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Append-only hash-chained log of product changes. Журнал изменений товаров с цепочкой хешей, только дополняемый
+type auditLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	sync func() error
+	seq  int64
+	head string // Hash of the last entry. Хеш последней записи
+	now  func() time.Time
+}
+
+// Opens audit log for append, the existing chain is verified first. Incomplete last entry left by crash is moved
+// to file with suffix .torn, other errors of chain fail. Nil log if path is empty.
+// Открываем журнал аудита для дополнения, сначала проверяется существующая цепочка. Неполная последняя запись,
+// оставленная сбоем, переносится в файл с суффиксом .torn, прочие ошибки цепочки не допускаются. Журнал nil, если путь пуст.
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	seq, head, err := verifyAuditLog(f)
+	var torn *tornAuditEntryError
+	if errors.As(err, &torn) {
+		err = quarantineTornEntry(f, path+".torn", torn.offset)
+		if err == nil {
+			log.Printf("Audit log %s: %v is moved to %s.torn", path, torn, path)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &auditLog{w: f, sync: f.Sync, seq: seq, head: head, now: time.Now}, nil
+}
+
+// Appends bytes of f after offset to quarantine file and truncates f to offset.
+// Дописываем байты f после offset в файл карантина и обрезаем f до offset.
+func quarantineTornEntry(f *os.File, quarantine string, offset int64) error {
+	q, err := os.OpenFile(quarantine, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		q.Close()
+		return err
+	}
+	if _, err := io.Copy(q, f); err != nil {
+		q.Close()
+		return err
+	}
+	if _, err := q.Write([]byte("\n")); err != nil {
+		q.Close()
+		return err
+	}
+	if err := q.Close(); err != nil {
+		return err
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Records change of product by caller, before or after is nil for created or deleted product.
+// Called with server.mu held before the change is applied, so failed write leaves product unchanged.
+// Записываем изменение товара вызывающим, before или after равен nil для созданного или удаленного товара.
+// Вызывается под server.mu до применения изменения, поэтому при ошибке записи товар не меняется.
+func (l *auditLog) record(ctx context.Context, method string, before, after *pb.Product) error {
+	if l == nil {
+		return nil
+	}
+	e := &auditEntry{Method: productInfoMethodPfx + method}
+	if cert, ok := peerCertificate(ctx); ok {
+		e.CertSubject, e.CertSerial = cert.Subject.String(), cert.SerialNumber.Text(16)
+	}
+	if claims, ok := claimsFromContext(ctx); ok {
+		e.TokenSubject = claims.Subject
+	}
+	if after != nil {
+		e.ProductID = after.Id
+	} else {
+		e.ProductID = before.GetId()
+	}
+	diff, err := productDiff(before, after)
+	if err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+		return errAuditWrite
+	}
+	e.Diff = diff
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Seq, e.Time, e.PrevHash = l.seq+1, l.now().UTC(), l.head
+	if e.Hash, err = auditHash(e); err == nil {
+		var line []byte
+		if line, err = json.Marshal(e); err == nil {
+			// One write per entry, so entries are not interleaved. Одна запись на строку, строки не перемешиваются
+			if _, err = l.w.Write(append(line, '\n')); err == nil && l.sync != nil {
+				err = l.sync()
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+		return errAuditWrite
+	}
+	l.seq, l.head = e.Seq, e.Hash
+	return nil
+}
+
+func auditHash(e *auditEntry) (string, error) {
+	c := *e
+	c.Hash = ""
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Fields of products that differ, by protojson names. Отличающиеся поля товаров по именам protojson
+func productDiff(before, after *pb.Product) (map[string]auditChange, error) {
+	b, err := productFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := productFields(after)
+	if err != nil {
+		return nil, err
+	}
+	diff := make(map[string]auditChange)
+	for name, v := range b {
+		if !bytes.Equal(v, a[name]) {
+			diff[name] = auditChange{Before: v, After: a[name]}
+		}
+	}
+	for name, v := range a {
+		if _, ok := b[name]; !ok {
+			diff[name] = auditChange{After: v}
+		}
+	}
+	return diff, nil
+}
+
+func productFields(p *pb.Product) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if p == nil {
+		return fields, nil
+	}
+	b, err := protojson.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	// protojson output is not stable, values are compared compacted. Вывод protojson нестабилен, значения сжимаются
+	for name, v := range fields {
+		var c bytes.Buffer
+		if err := json.Compact(&c, v); err != nil {
+			return nil, err
+		}
+		fields[name] = c.Bytes()
+	}
+	return fields, nil
+}
+
+// Verifies chain of audit log, returns number and hash of the last entry or error at the first broken line.
+// Last line without newline gives *tornAuditEntryError with number and hash of the entry before it.
+// Проверяем цепочку журнала аудита, возвращаем номер и хеш последней записи или ошибку первой нарушенной строки.
+// Последняя строка без перевода строки дает *tornAuditEntryError с номером и хешем записи перед ней.
+func verifyAuditLog(r io.Reader) (seq int64, head string, err error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		switch {
+		case err == io.EOF && len(data) == 0:
+			return seq, head, nil
+		case err == io.EOF:
+			return seq, head, &tornAuditEntryError{line: line, offset: offset}
+		case err != nil:
+			return 0, "", err
+		case len(data) > maxAuditLineLen:
+			return 0, "", fmt.Errorf("line %d: entry is longer than %d bytes", line, maxAuditLineLen)
+		}
+		offset += int64(len(data))
+		e := &auditEntry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return 0, "", fmt.Errorf("line %d: %v", line, err)
+		}
+		hash, err := auditHash(e)
+		switch {
+		case err != nil:
+			return 0, "", fmt.Errorf("line %d: %v", line, err)
+		case e.Seq != seq+1:
+			return 0, "", fmt.Errorf("line %d: sequence %d follows %d", line, e.Seq, seq)
+		case e.PrevHash != head:
+			return 0, "", fmt.Errorf("line %d: previous hash does not match entry %d", line, seq)
+		case e.Hash != hash:
+			return 0, "", fmt.Errorf("line %d: hash does not match entry", line)
+		}
+		seq, head = e.Seq, e.Hash
+	}
+}
+
+// Verification command, prints head of intact log. Команда проверки, печатает последнюю запись целого журнала
+func verifyAuditFile(path string, out io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	seq, head, err := verifyAuditLog(f)
+	if err != nil {
+		return fmt.Errorf("audit log is broken: %v", err)
+	}
+	fmt.Fprintf(out, "audit log is intact: %d entries, head %s\n", seq, head)
+	return nil
+}
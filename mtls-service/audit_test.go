@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func readAuditEntries(t *testing.T, path string) ([]string, []*auditEntry) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	var entries []*auditEntry
+	for _, line := range lines {
+		e := &auditEntry{}
+		if err := json.Unmarshal([]byte(line), e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return lines, entries
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{audit: audit}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "localhost"}, SerialNumber: big.NewInt(0x2a)}
+	ctx := context.WithValue(peerContext(cert), claimsKey{}, &tokenClaims{Subject: "catalog-bot"})
+
+	id, err := srv.AddProduct(ctx, &pb.Product{Name: "Sumsung S10", Price: 700})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.UpdateProduct(ctx, &pb.Product{Id: id.Value, Name: "Sumsung S10", Price: 650}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.DeleteProduct(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	_, entries := readAuditEntries(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	e := entries[1]
+	if e.Method != "/ecommerce.ProductInfo/updateProduct" || e.CertSubject != "CN=localhost" || e.CertSerial != "2a" ||
+		e.TokenSubject != "catalog-bot" || e.ProductID != id.Value {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	// Only changed price is recorded, in both fields. Записывается только измененная цена, в обоих полях
+	if c, ok := e.Diff["price"]; len(e.Diff) != 2 || !ok || string(c.Before) != "700" || string(c.After) != "650" ||
+		string(e.Diff["priceMoney"].After) != `{"currencyCode":"RUB","units":"650"}` {
+		t.Errorf("diff of update: %+v", e.Diff)
+	}
+	if c := entries[2].Diff["name"]; string(c.Before) != `"Sumsung S10"` || c.After != nil {
+		t.Errorf("diff of delete: %+v", entries[2].Diff)
+	}
+
+	// Reopened log continues the chain. Открытый заново журнал продолжает цепочку
+	audit, err = openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.audit = audit
+	if _, err := srv.AddProduct(ctx, &pb.Product{Name: "Apple"}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := verifyAuditFile(path, &out); err != nil || !strings.Contains(out.String(), "4 entries") {
+		t.Errorf("verification of intact log: %q, %v", out.String(), err)
+	}
+}
+
+func TestVerifyAuditLog_Tampered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{audit: audit}
+	for _, name := range []string{"Apple", "Sumsung", "Xiaomi"} {
+		if _, err := srv.AddProduct(context.Background(), &pb.Product{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines, _ := readAuditEntries(t, path)
+
+	for name, tampered := range map[string][]string{
+		"changed entry":   {lines[0], strings.Replace(lines[1], "Sumsung", "Nokia", 1), lines[2]},
+		"removed entry":   {lines[0], lines[2]},
+		"swapped entries": {lines[0], lines[2], lines[1]},
+	} {
+		_, _, err := verifyAuditLog(strings.NewReader(strings.Join(tampered, "\n") + "\n"))
+		if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+			t.Errorf("%s: got %v, want error at line 2", name, err)
+		}
+	}
+
+	// Rehashed entry still breaks the link to the next one. Пересчитанный хеш разрывает связь со следующей записью
+	e := &auditEntry{}
+	json.Unmarshal([]byte(lines[1]), e)
+	e.Diff["name"] = auditChange{After: json.RawMessage(`"Nokia"`)}
+	e.Hash, _ = auditHash(e)
+	forged, _ := json.Marshal(e)
+	_, _, err = verifyAuditLog(strings.NewReader(strings.Join([]string{lines[0], string(forged), lines[2]}, "\n") + "\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("rehashed entry: got %v, want error at line 3", err)
+	}
+
+	// Service does not append to broken log. Сервис не дополняет нарушенный журнал
+	ioutil.WriteFile(path, []byte(lines[0]+"\n"+lines[2]+"\n"), 0600)
+	if _, err := openAuditLog(path); err == nil {
+		t.Error("broken log is opened")
+	}
+}
+
+func TestAuditLog_TornEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{audit: audit}
+	for _, name := range []string{"Apple", "Sumsung"} {
+		if _, err := srv.AddProduct(context.Background(), &pb.Product{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines, _ := readAuditEntries(t, path)
+	torn := lines[1][:len(lines[1])/2]
+
+	// Crash during write of the second entry. Сбой при записи второй записи
+	ioutil.WriteFile(path, []byte(lines[0]+"\n"+torn), 0600)
+	audit, err = openAuditLog(path)
+	if err != nil {
+		t.Fatalf("log with torn entry is not opened: %v", err)
+	}
+	if data, err := ioutil.ReadFile(path + ".torn"); err != nil || string(data) != torn+"\n" {
+		t.Errorf("quarantined entry: got %q, %v, want %q", data, err, torn)
+	}
+	srv = &server{audit: audit}
+	if _, err := srv.AddProduct(context.Background(), &pb.Product{Name: "Xiaomi"}); err != nil {
+		t.Fatal(err)
+	}
+	_, entries := readAuditEntries(t, path)
+	if len(entries) != 2 || entries[1].Seq != 2 || entries[1].PrevHash != entries[0].Hash {
+		t.Errorf("chain after torn entry: %+v", entries)
+	}
+	var out bytes.Buffer
+	if err := verifyAuditFile(path, &out); err != nil {
+		t.Errorf("verify after torn entry: %v", err)
+	}
+
+	// Complete entry with broken hash is not repaired. Полная запись с нарушенным хешем не исправляется
+	ioutil.WriteFile(path, []byte(lines[0]+"\n"+strings.Replace(lines[1], "Sumsung", "Nokia", 1)+"\n"+torn), 0600)
+	if _, err := openAuditLog(path); err == nil || !strings.Contains(err.Error(), "line 2:") {
+		t.Errorf("broken log with torn entry: got %v, want error at line 2", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk is full") }
+
+func TestAuditLog_WriteFailure(t *testing.T) {
+	srv := &server{audit: &auditLog{w: failingWriter{}, now: time.Now}}
+	_, err := srv.AddProduct(context.Background(), &pb.Product{Name: "Apple"})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("got %v, want Internal", err)
+	}
+	// Change is not applied without audit entry. Изменение не применяется без записи аудита
+	if len(srv.products().(*memoryStore).products) != 0 || srv.feed.current() != 0 {
+		t.Error("product is added without audit entry")
+	}
+}
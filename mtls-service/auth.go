@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"strings"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errUnboundToken             = status.Errorf(codes.Unauthenticated, "token is not bound to client certificate")
+	errIntrospectionUnavailable = status.Errorf(codes.Unavailable, "token introspection is unavailable")
+)
+
+// Checks access tokens of calls. Проверяет токены доступа вызовов
+type authenticator struct {
+	// Verifier of JWT, static token is accepted only if it and introspector are nil.
+	// Проверка JWT, статический токен принимается, только если она и introspector равны nil.
+	jwt *jwtVerifier
+	// Introspection of opaque tokens. Проверка непрозрачных токенов
+	introspector *introspector
+	// Accepts verified tokens without cnf "x5t#S256" claim. Принимает проверенные токены без утверждения cnf "x5t#S256"
+	allowUnbound bool
+	// Store of API keys, scheme "ApiKey" is rejected if nil. Хранилище API ключей, при nil схема "ApiKey" отклоняется
+	apiKeys *apiKeyStore
+}
+
+func newAuthenticator(cfg *config) (*authenticator, error) {
+	a := &authenticator{allowUnbound: cfg.AllowUnboundTokens}
+	if cfg.JWT != nil {
+		v, err := newJWTVerifier(*cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = v
+	}
+	if cfg.Introspection != nil {
+		i, err := newIntrospector(*cfg.Introspection)
+		if err != nil {
+			return nil, err
+		}
+		a.introspector = i
+	}
+	apiKeys, err := newAPIKeyStore(cfg.APIKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	a.apiKeys = apiKeys
+	return a, nil
+}
+
+type claimsKey struct{}
+
+// Returns claims of verified token of call. Возвращаем утверждения проверенного токена вызова
+func claimsFromContext(ctx context.Context) (*tokenClaims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*tokenClaims)
+	return claims, ok
+}
+
+// Validates the authorization. Подтверждение авторизации
+func valid(authorization []string) bool {
+	if len(authorization) < 1 {
+		return false
+	}
+	token := strings.TrimPrefix(authorization[0], "Bearer ")
+	// Performs validation of token matching an arbitrary string.
+	// Выполняем проверку токена, соответствующего произвольной строке.
+	return token == "blablatok-tokblabla-blablatok"
+}
+
+// Checking token. Определяем функцию ensureValidToken для проверки подлинности токена.
+// Если тот отсутствует или недействителен, тогда перехватчик блокирует выполнение и возвращает ошибку.
+// Или вызывается следующий обработчик, которому передается контекст и интерфейс.
+func (a *authenticator) ensureValidToken(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, errMissingMetadata
+	}
+
+	ctx, err := a.authenticate(ctx, info.FullMethod, md["authorization"])
+	if err != nil {
+		return nil, err
+	}
+	// Continue execution of handler after ensuring a valid token. Токен ок
+	return handler(ctx, req)
+}
+
+// Stream interceptor checks token of ProductInfo streams, other streams (reflection, health) are not checked.
+// Потоковый перехватчик проверяет токен потоков ProductInfo, остальные потоки (reflection, health) не проверяются.
+func (a *authenticator) stream(srv interface{}, ss grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !strings.HasPrefix(info.FullMethod, productInfoMethodPfx) {
+		return handler(srv, ss)
+	}
+	md, ok := metadata.FromIncomingContext(ss.Context())
+	if !ok {
+		return errMissingMetadata
+	}
+	ctx, err := a.authenticate(ss.Context(), info.FullMethod, md["authorization"])
+	if err != nil {
+		return err
+	}
+	wrapped := grpc_middleware.WrapServerStream(ss)
+	wrapped.WrappedContext = ctx
+	return handler(srv, wrapped)
+}
+
+// Dispatches on scheme of authorization: "ApiKey" is checked by store of keys,
+// "Bearer" or value without scheme is checked as token. Claims are added to context.
+// Выбираем проверку по схеме авторизации: "ApiKey" проверяется хранилищем ключей,
+// "Bearer" или значение без схемы - как токен. Утверждения добавляются в контекст.
+func (a *authenticator) authenticate(ctx context.Context, method string, authorization []string) (context.Context, error) {
+	if len(authorization) < 1 {
+		return nil, errInvalidToken
+	}
+	scheme, credential, found := strings.Cut(authorization[0], " ")
+	if !found {
+		scheme, credential = "Bearer", scheme
+	}
+	var claims *tokenClaims
+	var err error
+	switch {
+	case strings.EqualFold(scheme, "ApiKey"):
+		if a.apiKeys == nil {
+			return nil, errInvalidToken
+		}
+		if claims, err = a.apiKeys.authenticate(credential, method, callerIdentity(ctx)); err != nil {
+			return nil, err
+		}
+	case strings.EqualFold(scheme, "Bearer"):
+		if claims, err = a.authenticateToken(ctx, credential); err != nil {
+			return nil, err
+		}
+		if claims == nil {
+			return ctx, nil
+		}
+		// API keys are not bound, they are scoped to methods instead. API ключи не привязываются, их ограничивают методы
+		if err := a.checkBinding(ctx, claims); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errInvalidToken
+	}
+	return context.WithValue(ctx, claimsKey{}, claims), nil
+}
+
+// Checks token by JWT signature, introspection or static value, static token has no claims and is accepted
+// only without verifiers of tokens. Проверяем токен подписью JWT, на сервере авторизации или статическим значением,
+// у статического токена нет утверждений, он принимается только без проверки токенов.
+func (a *authenticator) authenticateToken(ctx context.Context, token string) (*tokenClaims, error) {
+	var claims *tokenClaims
+	var err error
+	switch {
+	case a.jwt != nil && isJWT(token):
+		if claims, err = a.jwt.verify(token); err != nil {
+			log.Printf("Rejected token: %v", err)
+			return nil, errInvalidToken
+		}
+	case a.introspector != nil:
+		if claims, err = a.introspector.introspect(ctx, token); err != nil {
+			// Fails closed. Отказ при недоступности сервера авторизации
+			log.Printf("Token introspection: %v", err)
+			return nil, errIntrospectionUnavailable
+		}
+		if claims == nil {
+			return nil, errInvalidToken
+		}
+	case a.jwt != nil:
+		// Static token is rejected once tokens are verified. Статический токен отклоняется, если токены проверяются
+		return nil, errInvalidToken
+	default:
+		if !valid([]string{token}) {
+			return nil, errInvalidToken
+		}
+	}
+	return claims, nil
+}
+
+// Bound token is valid only with the client certificate it was issued to (RFC 8705),
+// so token stolen from one client can't be replayed with another certificate.
+// Привязанный токен действителен только с клиентским сертификатом, которому выдан (RFC 8705),
+// поэтому украденный у одного клиента токен нельзя использовать с другим сертификатом.
+func (a *authenticator) checkBinding(ctx context.Context, claims *tokenClaims) error {
+	if claims.Cnf == nil || claims.Cnf.X5tS256 == "" {
+		if a.allowUnbound {
+			return nil
+		}
+		return errUnboundToken
+	}
+	cert, ok := peerCertificate(ctx)
+	if !ok {
+		return errUnboundToken
+	}
+	if subtle.ConstantTimeCompare([]byte(certThumbprint(cert)), []byte(claims.Cnf.X5tS256)) != 1 {
+		return errUnboundToken
+	}
+	return nil
+}
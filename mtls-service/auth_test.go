@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Issuer of test tokens signed by ES256. Издатель тестовых токенов, подписанных ES256
+type testIssuer struct {
+	key     *ecdsa.PrivateKey
+	keyFile string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "issuer.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{key: key, keyFile: keyFile}
+}
+
+func (i *testIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, i.key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestAuthenticator_CertBoundTokens(t *testing.T) {
+	issuer := newTestIssuer(t)
+	owner := &x509.Certificate{Raw: []byte("certificate of owner")}
+	thief := &x509.Certificate{Raw: []byte("certificate of thief")}
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://auth.local", "aud": "productinfo", "sub": "mtls-client", "exp": exp}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	bound := issuer.sign(t, claims(map[string]interface{}{"cnf": map[string]string{"x5t#S256": certThumbprint(owner)}}))
+	unbound := issuer.sign(t, claims(nil))
+	expired := issuer.sign(t, claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}))
+	foreign := issuer.sign(t, claims(map[string]interface{}{"iss": "https://evil.local"}))
+	forged := bound[:len(bound)-4] + "AAAA"
+
+	tests := []struct {
+		name         string
+		allowUnbound bool
+		token        string
+		cert         *x509.Certificate
+		want         codes.Code
+	}{
+		{"bound token of owner", false, bound, owner, codes.OK},
+		{"bound token replayed by thief", false, bound, thief, codes.Unauthenticated},
+		{"bound token is checked when binding is optional", true, bound, thief, codes.Unauthenticated},
+		{"unbound token", false, unbound, owner, codes.Unauthenticated},
+		{"unbound token when binding is optional", true, unbound, owner, codes.OK},
+		{"static token", false, "blablatok-tokblabla-blablatok", owner, codes.Unauthenticated},
+		{"static token when binding is optional", true, "blablatok-tokblabla-blablatok", owner, codes.Unauthenticated},
+		{"expired token", true, expired, owner, codes.Unauthenticated},
+		{"token of other issuer", true, foreign, owner, codes.Unauthenticated},
+		{"forged signature", true, forged, owner, codes.Unauthenticated},
+	}
+	for _, test := range tests {
+		v, err := newJWTVerifier(jwtConfig{Issuer: "https://auth.local", Audience: "productinfo", PublicKeyFile: issuer.keyFile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := &authenticator{jwt: v, allowUnbound: test.allowUnbound}
+		ctx := metadata.NewIncomingContext(peerContext(test.cert), metadata.Pairs("authorization", "Bearer "+test.token))
+		var subject string
+		_, err = a.ensureValidToken(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/ecommerce.ProductInfo/getProduct"},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				if claims, ok := claimsFromContext(ctx); ok {
+					subject = claims.Subject
+				}
+				return nil, nil
+			})
+		if status.Code(err) != test.want {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.want)
+		}
+		if test.want == codes.OK && subject != "mtls-client" {
+			t.Errorf("%s: claims are not in context", test.name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// Configuration of service, read from JSON file set by flag -config
+// Конфигурация сервиса, считывается из JSON файла, заданного флагом -config
+type config struct {
+	// Address of gRPC-Web listener, it is disabled if empty
+	// Адрес прослушивателя gRPC-Web, если пустой - gRPC-Web отключен
+	GRPCWebAddr string `json:"grpc_web_addr"`
+	// Origins allowed by CORS for gRPC-Web, "*" allows any origin
+	// Источники, разрешенные CORS для gRPC-Web, "*" разрешает любой
+	CORSAllowedOrigins []string `json:"cors_allowed_origins"`
+	// Enables server reflection for grpcurl. Включает reflection сервера для grpcurl
+	Reflection bool `json:"reflection"`
+	// Enables channelz service. Включает сервис channelz
+	Channelz bool `json:"channelz"`
+	// Client certificate identities (CN or SAN) allowed to call reflection and channelz
+	// Идентификаторы клиентских сертификатов (CN или SAN), которым доступны reflection и channelz
+	AdminIdentities []string `json:"admin_identities"`
+	// Certificate identities of gateways allowed to forward verified certificates of their callers
+	// Идентификаторы сертификатов шлюзов, которым разрешено передавать проверенные сертификаты вызывающих
+	TrustedGateways []string `json:"trusted_gateways"`
+	// Validation of JWT access tokens, static token is accepted only if it and introspection are nil
+	// Проверка токенов доступа JWT, статический токен принимается, только если она и introspection равны nil
+	JWT *jwtConfig `json:"jwt"`
+	// Accepts JWT and introspected tokens not bound to client certificate by cnf "x5t#S256" claim (RFC 8705),
+	// for migration of clients. Принимает токены JWT и проверенные на сервере авторизации токены, не привязанные
+	// к клиентскому сертификату утверждением cnf "x5t#S256" (RFC 8705), для перехода клиентов.
+	AllowUnboundTokens bool `json:"allow_unbound_tokens"`
+	// Introspection of opaque tokens, static token is accepted only if it and jwt are nil
+	// Проверка непрозрачных токенов, статический токен принимается, только если она и jwt равны nil
+	Introspection *introspectionConfig `json:"introspection"`
+	// File of API keys managed by ApiKeyAdmin, keys are kept only in memory if empty
+	// Файл API ключей, управляемых ApiKeyAdmin, если пусто - ключи хранятся только в памяти
+	APIKeysFile string `json:"api_keys_file"`
+	// Token-bucket limits per client identity, calls are unlimited if nil
+	// Лимиты корзины токенов для каждого клиента, при nil вызовы не ограничены
+	RateLimits *rateLimitConfig `json:"rate_limits"`
+	// Limits of in-flight calls of the whole service, calls are unlimited if nil
+	// Лимиты одновременных вызовов всего сервиса, при nil вызовы не ограничены
+	Concurrency *concurrencyConfig `json:"concurrency"`
+	// Time response of AddProduct is remembered by idempotency key, 24h if empty
+	// Время хранения ответа AddProduct по ключу идемпотентности, 24h, если пусто
+	IdempotencyWindow duration `json:"idempotency_window"`
+	// Directory of idempotency keys shared by replicas, keys are kept in memory of each replica if empty
+	// Каталог ключей идемпотентности, общий для реплик, при пустом значении ключи хранятся в памяти каждой реплики
+	IdempotencyDir string `json:"idempotency_dir"`
+	// Number of changes kept for WatchProducts, 1000 if zero. Количество изменений, хранимых для WatchProducts
+	WatchHistory int `json:"watch_history"`
+	// Receivers of signed product events and settings of delivery, defaults if nil
+	// Получатели подписанных событий товаров и настройки доставки, при nil - значения по умолчанию
+	Webhooks *webhookConfig `json:"webhooks"`
+	// File of webhook endpoints registered by WebhookAdmin, they are kept only in memory if empty
+	// Файл точек вебхуков, зарегистрированных WebhookAdmin, если пусто - точки хранятся только в памяти
+	WebhookEndpointsFile string `json:"webhook_endpoints_file"`
+	// Append-only file of hash-chained product changes, changes are not audited if empty
+	// Дополняемый файл изменений товаров с цепочкой хешей, при пустом значении изменения не записываются
+	AuditLog string `json:"audit_log"`
+	// Key of page tokens shared by replicas, random on each start if empty
+	// Ключ токенов страниц, общий для реплик, при пустом значении случайный при каждом запуске
+	PageTokenKey string `json:"page_token_key"`
+	// ISO 4217 currency of float price set by old clients for new products, RUB if empty
+	// Валюта ISO 4217 цены float, заданной старыми клиентами для новых товаров, RUB, если пусто
+	DefaultCurrency string `json:"default_currency"`
+}
+
+// Duration written as string of time.ParseDuration, for example "30s"
+// Длительность, записанная строкой time.ParseDuration, например "30s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// Reads config from file, empty path gives default config
+// Считываем конфигурацию из файла, при пустом пути - конфигурация по умолчанию
+func loadConfig(path string) (*config, error) {
+	cfg := &config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/money"
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+)
+
+// Filter of products in the spirit of AIP-160, for example `price < 1000 AND name:"Samsung*"`.
+// Comparisons are joined by AND, OR, NOT and parentheses, AND binds tighter than OR, adjacent terms are joined by AND.
+// Фильтр товаров в духе AIP-160, например `price < 1000 AND name:"Samsung*"`. Сравнения объединяются AND, OR,
+// NOT и скобками, AND связывает сильнее OR, соседние условия объединяются AND.
+
+// Limits of filter, deep nesting would exhaust stack of parser. Ограничения фильтра, глубокая вложенность исчерпает стек
+const (
+	maxFilterLength = 2048
+	maxFilterDepth  = 32
+)
+
+// Types of filtered fields. Типы фильтруемых полей
+type filterType int
+
+const (
+	filterString filterType = iota
+	filterNumber
+	filterTimestamp
+)
+
+func (t filterType) String() string {
+	switch t {
+	case filterNumber:
+		return "number"
+	case filterTimestamp:
+		return "timestamp"
+	}
+	return "string"
+}
+
+// Fields of product allowed in filter. Поля товара, допустимые в фильтре
+var filterFields = map[string]filterType{
+	"id":          filterString,
+	"name":        filterString,
+	"description": filterString,
+	"price":       filterNumber,
+	"currency":    filterString,
+	"create_time": filterTimestamp,
+}
+
+// Operators allowed by type, ":" is case-insensitive match of string with * wildcard.
+// Операторы, допустимые для типа, ":" - сопоставление строки без учета регистра с подстановкой *.
+var filterOperators = map[filterType]string{
+	filterString:    "= != :",
+	filterNumber:    "= != < <= > >=",
+	filterTimestamp: "= != < <= > >=",
+}
+
+// Node of filter AST. Узел дерева фильтра
+type filterExpr interface {
+	match(p *pb.Product) bool
+}
+
+type andExpr struct{ left, right filterExpr }
+
+func (e *andExpr) match(p *pb.Product) bool { return e.left.match(p) && e.right.match(p) }
+
+type orExpr struct{ left, right filterExpr }
+
+func (e *orExpr) match(p *pb.Product) bool { return e.left.match(p) || e.right.match(p) }
+
+type notExpr struct{ x filterExpr }
+
+func (e *notExpr) match(p *pb.Product) bool { return !e.x.match(p) }
+
+// Comparison of field with typed value. Сравнение поля с типизированным значением
+type compareExpr struct {
+	field  string
+	op     string
+	str    string
+	amount *moneypb.Money
+	time   time.Time
+}
+
+func (e *compareExpr) match(p *pb.Product) bool {
+	switch e.field {
+	case "price":
+		// Amounts are compared exactly in any currency. Суммы сравниваются точно в любой валюте
+		return compareOrdered(money.CompareAmount(priceOf(p), e.amount), e.op)
+	case "create_time":
+		return compareOrdered(compareInt(p.CreateTime.AsTime().UnixNano(), e.time.UnixNano()), e.op)
+	}
+	var s string
+	switch e.field {
+	case "id":
+		s = p.Id
+	case "name":
+		s = p.Name
+	case "description":
+		s = p.Description
+	case "currency":
+		s = priceOf(p).CurrencyCode
+	}
+	switch e.op {
+	case "=":
+		return s == e.str
+	case "!=":
+		return s != e.str
+	}
+	return matchWildcard(strings.ToLower(s), strings.ToLower(e.str))
+}
+
+func compareOrdered(c int, op string) bool {
+	switch op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// Matches pattern with * as any sequence, pattern without * matches substring.
+// Сопоставляем шаблон, где * - любая последовательность, шаблон без * совпадает с подстрокой.
+func matchWildcard(s, pattern string) bool {
+	if !strings.Contains(pattern, "*") {
+		return strings.Contains(s, pattern)
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
+
+// Error of filter at position of source. Ошибка фильтра в позиции исходного текста
+type filterError struct {
+	column int // 1-based column in runes. Номер столбца в символах, начиная с 1
+	msg    string
+}
+
+func (e *filterError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.column, e.msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokNumber
+	tokOperator
+	tokLParen
+	tokRParen
+)
+
+type filterToken struct {
+	kind  tokenKind
+	text  string // Value of token, unquoted for string. Значение токена, для строки без кавычек
+	start int    // Byte offset in source. Смещение в байтах в исходном тексте
+}
+
+func (t filterToken) describe() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return "'" + t.text + "'"
+}
+
+type filterParser struct {
+	src    string
+	tokens []filterToken
+	next   int
+	depth  int
+}
+
+// Parses and type-checks filter, nil expression for empty filter. Разбираем и проверяем типы фильтра
+func parseFilter(src string) (filterExpr, error) {
+	if len(src) > maxFilterLength {
+		return nil, &filterError{column: 1, msg: fmt.Sprintf("filter is longer than %d bytes", maxFilterLength)}
+	}
+	p := &filterParser{src: src}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t.start, "unexpected %s", t.describe())
+	}
+	return e, nil
+}
+
+func (p *filterParser) errorf(offset int, format string, args ...interface{}) error {
+	return &filterError{column: utf8.RuneCountInString(p.src[:offset]) + 1, msg: fmt.Sprintf(format, args...)}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '*' || r == '-'
+}
+
+func (p *filterParser) lex() error {
+	src := p.src
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '(':
+			p.tokens = append(p.tokens, filterToken{kind: tokLParen, text: "(", start: i})
+			i++
+		case r == ')':
+			p.tokens = append(p.tokens, filterToken{kind: tokRParen, text: ")", start: i})
+			i++
+		case strings.ContainsRune("<>=!:", r):
+			op := src[i : i+1]
+			if i+1 < len(src) && src[i+1] == '=' && r != '=' && r != ':' {
+				op = src[i : i+2]
+			}
+			if op == "!" {
+				return p.errorf(i, "unexpected '!', did you mean '!='")
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokOperator, text: op, start: i})
+			i += len(op)
+		case r == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != '"'; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				b.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return p.errorf(i, "string is not terminated")
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokString, text: b.String(), start: i})
+			i = j + 1
+		case isWordRune(r):
+			j := i
+			for j < len(src) {
+				r, size := utf8.DecodeRuneInString(src[j:])
+				if !isWordRune(r) {
+					break
+				}
+				j += size
+			}
+			kind := tokWord
+			// Words like "inf" are not numbers. Слова вроде "inf" не являются числами
+			if n, err := strconv.ParseFloat(src[i:j], 64); err == nil && !math.IsInf(n, 0) && !math.IsNaN(n) {
+				kind = tokNumber
+			}
+			p.tokens = append(p.tokens, filterToken{kind: kind, text: src[i:j], start: i})
+			i = j
+		default:
+			return p.errorf(i, "unexpected character %q", r)
+		}
+	}
+	p.tokens = append(p.tokens, filterToken{kind: tokEOF, start: len(src)})
+	return nil
+}
+
+func (p *filterParser) peek() filterToken { return p.tokens[p.next] }
+
+func (p *filterParser) take() filterToken {
+	t := p.tokens[p.next]
+	if t.kind != tokEOF {
+		p.next++
+	}
+	return t
+}
+
+func isKeyword(t filterToken, keyword string) bool { return t.kind == tokWord && t.text == keyword }
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for isKeyword(p.peek(), "OR") {
+		p.take()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if isKeyword(t, "AND") {
+			p.take()
+		} else if t.kind == tokEOF || t.kind == tokRParen || isKeyword(t, "OR") {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left, right}
+	}
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	if isKeyword(p.peek(), "NOT") {
+		p.take()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterExpr, error) {
+	t := p.take()
+	switch {
+	case t.kind == tokLParen:
+		if p.depth++; p.depth > maxFilterDepth {
+			return nil, p.errorf(t.start, "filter is nested deeper than %d", maxFilterDepth)
+		}
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.take(); c.kind != tokRParen {
+			return nil, p.errorf(c.start, "expected ')' to close '(' at column %d, got %s",
+				utf8.RuneCountInString(p.src[:t.start])+1, c.describe())
+		}
+		p.depth--
+		return e, nil
+	case t.kind == tokWord && !isKeyword(t, "AND") && !isKeyword(t, "OR") && !isKeyword(t, "NOT"):
+		return p.parseComparison(t)
+	}
+	return nil, p.errorf(t.start, "expected field or '(', got %s", t.describe())
+}
+
+// Parses and type-checks comparison of field. Разбираем сравнение поля и проверяем типы
+func (p *filterParser) parseComparison(field filterToken) (filterExpr, error) {
+	typ, ok := filterFields[field.text]
+	if !ok {
+		return nil, p.errorf(field.start, "unknown field %q, allowed fields are id, name, description, price, currency and create_time", field.text)
+	}
+	op := p.take()
+	if op.kind != tokOperator {
+		return nil, p.errorf(op.start, "expected operator after %s, got %s", field.text, op.describe())
+	}
+	if !strings.Contains(" "+filterOperators[typ]+" ", " "+op.text+" ") {
+		return nil, p.errorf(op.start, "operator %s is not supported by %s field %s", op.text, typ, field.text)
+	}
+	v := p.take()
+	if v.kind != tokString && v.kind != tokNumber && (v.kind != tokWord || isKeyword(v, "AND") || isKeyword(v, "OR") || isKeyword(v, "NOT")) {
+		return nil, p.errorf(v.start, "expected value after %s %s, got %s", field.text, op.text, v.describe())
+	}
+	e := &compareExpr{field: field.text, op: op.text, str: v.text}
+	switch typ {
+	case filterNumber:
+		// XXX is ISO 4217 code of no currency. XXX - код ISO 4217 отсутствия валюты
+		if v.kind != tokNumber {
+			return nil, p.errorf(v.start, "%s is a number, got %s", field.text, v.describe())
+		}
+		amount, err := money.Parse(v.text, "XXX")
+		if err != nil {
+			return nil, p.errorf(v.start, "%s is a decimal number with at most 9 fractional digits, got %s", field.text, v.describe())
+		}
+		e.amount = amount
+	case filterTimestamp:
+		t, err := time.Parse(time.RFC3339Nano, v.text)
+		if err != nil {
+			return nil, p.errorf(v.start, "%s is a timestamp in RFC 3339, got %s", field.text, v.describe())
+		}
+		e.time = t
+	}
+	return e, nil
+}
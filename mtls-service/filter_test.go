@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestParseFilter(t *testing.T) {
+	products := []*pb.Product{
+		{Id: "1", Name: "Samsung Galaxy S10", Price: 700, CreateTime: &timestamppb.Timestamp{Seconds: 1700000000}},
+		{Id: "2", Name: "Samsung Galaxy S23", Price: 1200, Description: "флагман", CreateTime: &timestamppb.Timestamp{Seconds: 1800000000}},
+		{Id: "3", Name: "Apple iPhone", Price: 999.5},
+		{Id: "4", Name: "Xiaomi Redmi", Price: 300, Description: "Budget phone"},
+	}
+	for _, tc := range []struct {
+		filter string
+		want   string
+	}{
+		{``, "1234"},
+		{`price < 1000 AND name:"Samsung*"`, "1"},
+		{`price < 1000 name:"samsung*"`, "1"},
+		{`name:galaxy OR price >= 999.5`, "123"},
+		{`name:galaxy AND price > 1000 OR id = 4`, "24"},
+		{`name:galaxy AND (price > 1000 OR id = 1)`, "12"},
+		{`NOT name:Samsung*`, "34"},
+		{`description:ФЛАГ*`, "2"},
+		{`name:*S*0`, "1"},
+		{`name = "Apple iPhone"`, "3"},
+		{`name != "Apple iPhone" AND price != 300`, "12"},
+		{`create_time > "2024-01-01T00:00:00Z"`, "2"},
+		{`price = -1`, ""},
+	} {
+		e, err := parseFilter(tc.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tc.filter, err)
+			continue
+		}
+		var got string
+		for _, p := range products {
+			if e == nil || e.match(p) {
+				got += p.Id
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%s: matched %q, want %q", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestParseFilter_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		column int
+		msg    string
+	}{
+		{`colour = red`, 1, "unknown field"},
+		{`price:100`, 6, "operator : is not supported by number field price"},
+		{`name < "b"`, 6, "operator < is not supported"},
+		{`price < cheap`, 9, "price is a number"},
+		{`create_time > yesterday`, 15, "timestamp"},
+		{`price < 1000 AND`, 17, "expected field or '('"},
+		{`(price < 1000`, 14, "expected ')' to close '(' at column 1"},
+		{`name:"Samsung`, 6, "string is not terminated"},
+		{`name = Самсунг ) `, 16, "unexpected ')'"},
+		{`price ! 5`, 7, "did you mean '!='"},
+		{`price`, 6, "expected operator"},
+		{`name = AND`, 8, "expected value"},
+		{`price < 5 & name:a`, 11, "unexpected character"},
+		{strings.Repeat("(", 40) + "price < 5" + strings.Repeat(")", 40), 33, "nested deeper"},
+	} {
+		_, err := parseFilter(tc.filter)
+		fe, ok := err.(*filterError)
+		if !ok || fe.column != tc.column || !strings.Contains(fe.msg, tc.msg) {
+			t.Errorf("%s: got %v, want column %d: %s", tc.filter, err, tc.column, tc.msg)
+		}
+	}
+}
+
+func TestListProducts_Filter(t *testing.T) {
+	srv := &server{}
+	addTestProducts(srv,
+		&pb.Product{Name: "Samsung S10", Price: 700},
+		&pb.Product{Name: "Samsung S23", Price: 1200},
+		&pb.Product{Name: "Samsung A5", Price: 200},
+		&pb.Product{Name: "Apple", Price: 900},
+	)
+	ctx := context.Background()
+	in := &pb.ListProductsRequest{Filter: `price < 1000 AND name:"Samsung*"`, OrderBy: "price", PageSize: 1}
+	first, err := srv.ListProducts(ctx, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.TotalSize != 2 || first.Products[0].Name != "Samsung A5" {
+		t.Errorf("first page: %v", first)
+	}
+	in.PageToken = first.NextPageToken
+	if next, err := srv.ListProducts(ctx, in); err != nil || next.Products[0].Name != "Samsung S10" || next.NextPageToken != "" {
+		t.Errorf("next page: %v, %v", next, err)
+	}
+
+	// Token is bound to filter. Токен привязан к фильтру
+	in.Filter = `name:"Samsung*"`
+	if _, err := srv.ListProducts(ctx, in); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("token with other filter: got %v", err)
+	}
+
+	// Syntax error points at position. Синтаксическая ошибка указывает на позицию
+	_, err = srv.ListProducts(ctx, &pb.ListProductsRequest{Filter: `price < 1000 AND`})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+	br, ok := status.Convert(err).Details()[0].(*epb.BadRequest)
+	if !ok || br.FieldViolations[0].Field != "filter" || !strings.HasPrefix(br.FieldViolations[0].Description, "column 17:") {
+		t.Errorf("details: %v", status.Convert(err).Details())
+	}
+}
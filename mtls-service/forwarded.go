@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata with DER certificate of caller verified by gateway. Метаданные с DER сертификатом вызывающего, проверенным шлюзом
+const forwardedCertHeader = "x-forwarded-client-cert-bin"
+
+var (
+	errUntrustedForwarder = status.Errorf(codes.PermissionDenied,
+		"forwarded client certificate is accepted only from trusted_gateways")
+	errForwardedCert = status.Errorf(codes.Unauthenticated, "forwarded client certificate is not valid")
+)
+
+// Replaces peer of call from trusted gateway with caller certificate forwarded by the gateway, so certificate
+// binding of tokens, rate limits, idempotency keys and priorities apply to the caller, not to the gateway.
+// The forwarded certificate is verified again with CA of service.
+// Заменяет удостоверение вызова от доверенного шлюза на сертификат вызывающего, переданный шлюзом, поэтому
+// привязка токенов, лимиты, ключи идемпотентности и приоритеты относятся к вызывающему, а не к шлюзу.
+// Переданный сертификат повторно проверяется удостоверяющим центром сервиса.
+type forwardedCerts struct {
+	gateways map[string]bool // Identities of gateway certificates. Идентификаторы сертификатов шлюзов
+	roots    *x509.CertPool
+}
+
+func newForwardedCerts(gateways []string, roots *x509.CertPool) *forwardedCerts {
+	f := &forwardedCerts{gateways: make(map[string]bool), roots: roots}
+	for _, id := range gateways {
+		f.gateways[id] = true
+	}
+	return f
+}
+
+func (f *forwardedCerts) unary(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := f.context(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (f *forwardedCerts) stream(srv interface{}, ss grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := f.context(ss.Context())
+	if err != nil {
+		return err
+	}
+	wrapped := grpc_middleware.WrapServerStream(ss)
+	wrapped.WrappedContext = ctx
+	return handler(srv, wrapped)
+}
+
+// Returns context with peer of forwarded certificate, ctx if nothing is forwarded.
+// Возвращаем контекст с удостоверением переданного сертификата, ctx, если ничего не передано.
+func (f *forwardedCerts) context(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(forwardedCertHeader)
+	if len(values) == 0 {
+		return ctx, nil
+	}
+	gateway, ok := peerCertificate(ctx)
+	if !ok || !f.trusted(gateway) {
+		return nil, errUntrustedForwarder
+	}
+	if len(values) != 1 {
+		return nil, errForwardedCert
+	}
+	cert, err := x509.ParseCertificate([]byte(values[0]))
+	if err != nil {
+		return nil, errForwardedCert
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:     f.roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, errForwardedCert
+	}
+	p, _ := peer.FromContext(ctx)
+	return peer.NewContext(ctx, &peer.Peer{
+		Addr: p.Addr,
+		AuthInfo: credentials.TLSInfo{
+			State:          tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: chains},
+			CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+		},
+	}), nil
+}
+
+func (f *forwardedCerts) trusted(cert *x509.Certificate) bool {
+	for _, id := range certIdentities(cert) {
+		if f.gateways[id] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+
+	"github.com/blablatov/stream-mtls-grpc/internal/testcerts"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func parseTestCert(t *testing.T, der []byte) *x509.Certificate {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestForwardedCerts(t *testing.T) {
+	certs := testcerts.New(t, "gateway.blablatov.local")
+	gateway := parseTestCert(t, certs.Client.Certificate[0])
+	caller := parseTestCert(t, certs.IssueClient(t, "alice").Certificate[0])
+	stranger := parseTestCert(t, testcerts.New(t, "alice").Client.Certificate[0])
+	f := newForwardedCerts([]string{"gateway.blablatov.local"}, certs.CAPool)
+
+	forward := func(from *x509.Certificate, cert []byte) context.Context {
+		return metadata.NewIncomingContext(peerContext(from), metadata.Pairs(forwardedCertHeader, string(cert)))
+	}
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		want     codes.Code
+		identity string
+	}{
+		{"caller of gateway", forward(gateway, caller.Raw), codes.OK, "cert:alice"},
+		{"call without forwarded certificate", peerContext(gateway), codes.OK, "cert:gateway.blablatov.local"},
+		{"forwarded by untrusted peer", forward(caller, caller.Raw), codes.PermissionDenied, ""},
+		{"certificate of other CA", forward(gateway, stranger.Raw), codes.Unauthenticated, ""},
+		{"malformed certificate", forward(gateway, []byte("not a certificate")), codes.Unauthenticated, ""},
+	}
+	for _, test := range tests {
+		var identity string
+		_, err := f.unary(test.ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/ecommerce.ProductInfo/getProduct"},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				identity = callerIdentity(ctx)
+				return nil, nil
+			})
+		if status.Code(err) != test.want || identity != test.identity {
+			t.Errorf("%s: got %v, %q, want %v, %q", test.name, err, identity, test.want, test.identity)
+		}
+	}
+
+	// Token bound to caller certificate is accepted through gateway. Токен, привязанный к сертификату вызывающего, принимается через шлюз
+	as, _, endpoint := newTestAuthServer(t, 0)
+	i, err := newIntrospector(introspectionConfig{URL: endpoint, ClientID: "productinfo", ClientSecret: "resource-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{introspector: i}
+	for _, test := range []struct {
+		owner *x509.Certificate
+		want  codes.Code
+	}{{caller, codes.OK}, {gateway, codes.Unauthenticated}} {
+		ctx := metadata.NewIncomingContext(peerContext(gateway), metadata.Pairs(
+			forwardedCertHeader, string(caller.Raw), "authorization", "Bearer "+as.Issue("mtls-client", "", test.owner)))
+		_, err := f.unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/ecommerce.ProductInfo/getProduct"},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return a.ensureValidToken(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/ecommerce.ProductInfo/getProduct"},
+					func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+			})
+		if status.Code(err) != test.want {
+			t.Errorf("token bound to %s: got %v, want %v", test.owner.Subject.CommonName, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+	// Flag of frame with trailers. Флаг фрейма с трейлерами
+	grpcWebTrailerFlag = 0x80
+	// Max size of request message, default of gRPC-server. Максимальный размер сообщения запроса, как у gRPC-сервера
+	grpcWebMaxRecvMsgSize = 4 << 20
+)
+
+var errGRPCWebTooLarge = status.Errorf(codes.ResourceExhausted,
+	"gRPC-Web message larger than max (%d bytes)", grpcWebMaxRecvMsgSize)
+
+// Handler of gRPC-Web requests (binary and text/base64) for browser clients.
+// Unary methods of services are called through the same interceptor as on gRPC-server.
+// Обработчик запросов gRPC-Web (двоичных и text/base64) для браузерных клиентов.
+// Унарные методы сервисов вызываются через тот же перехватчик, что и на gRPC-сервере.
+type grpcWebHandler struct {
+	methods        map[string]grpcWebMethod
+	interceptor    grpc.UnaryServerInterceptor
+	allowedOrigins []string
+}
+
+type grpcWebMethod struct {
+	srv  interface{}
+	desc grpc.MethodDesc
+}
+
+func newGRPCWebHandler(interceptor grpc.UnaryServerInterceptor, allowedOrigins []string) *grpcWebHandler {
+	return &grpcWebHandler{
+		methods:        make(map[string]grpcWebMethod),
+		interceptor:    interceptor,
+		allowedOrigins: allowedOrigins,
+	}
+}
+
+// RegisterService implements grpc.ServiceRegistrar, so generated Register functions can be used.
+// Реализует grpc.ServiceRegistrar, чтобы использовать сгенерированные функции регистрации.
+func (h *grpcWebHandler) RegisterService(sd *grpc.ServiceDesc, srv interface{}) {
+	for _, m := range sd.Methods {
+		h.methods["/"+sd.ServiceName+"/"+m.MethodName] = grpcWebMethod{srv: srv, desc: m}
+	}
+}
+
+func (h *grpcWebHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		switch h.originAllowed(origin) {
+		case originListed:
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Add("Vary", "Origin")
+		case originAny:
+			// Any origin gets no credentials of browser. Любой источник не получает учетных данных браузера
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		default:
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "grpc-status, grpc-message, grpc-status-details-bin, idempotent-replayed")
+	}
+	// CORS preflight request. Предварительный запрос CORS
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "content-type, x-grpc-web, x-user-agent, authorization, grpc-timeout, idempotency-key, x-priority")
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+	if !text && !strings.HasPrefix(contentType, grpcWebContentType) {
+		http.Error(w, "unsupported content type "+contentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	respContentType := grpcWebContentType + "+proto"
+	if text {
+		respContentType = grpcWebTextContentType + "+proto"
+	}
+	w.Header().Set("Content-Type", respContentType)
+
+	stream := &grpcWebStream{method: r.URL.Path}
+	resp, err := h.invoke(w, r, text, stream)
+	if err != nil {
+		log.Printf("gRPC-Web %s: %v", r.URL.Path, err)
+	}
+	header, md := stream.metadata()
+	for k, v := range header {
+		for _, s := range v {
+			w.Header().Add(k, s)
+		}
+	}
+	var out bytes.Buffer
+	if resp != nil {
+		writeFrame(&out, 0, resp, text)
+	}
+	writeFrame(&out, grpcWebTrailerFlag, trailer(status.Convert(err), md), text)
+	if _, err := w.Write(out.Bytes()); err != nil {
+		log.Printf("failed to write gRPC-Web response: %v", err)
+	}
+}
+
+// Decodes request frame and calls method. Декодируем фрейм запроса и вызываем метод
+func (h *grpcWebHandler) invoke(w http.ResponseWriter, r *http.Request, text bool, stream *grpcWebStream) ([]byte, error) {
+	m, ok := h.methods[r.URL.Path]
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "unknown method %s", r.URL.Path)
+	}
+	// Body is limited by frame of max message, base64 of text mode is longer.
+	// Тело ограничено фреймом максимального сообщения, base64 текстового режима длиннее.
+	limit := int64(5 + grpcWebMaxRecvMsgSize)
+	if text {
+		limit = int64(base64.StdEncoding.EncodedLen(int(limit)))
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		if int64(len(body)) == limit {
+			return nil, errGRPCWebTooLarge
+		}
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	if text {
+		if body, err = decodeBase64Chunks(body); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid base64 body: %v", err)
+		}
+	}
+	if len(body) < 5 {
+		return nil, status.Errorf(codes.InvalidArgument, "malformed gRPC-Web frame")
+	}
+	if body[0] != 0 {
+		return nil, status.Errorf(codes.Unimplemented, "compressed gRPC-Web messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(body[1:5])
+	if length > grpcWebMaxRecvMsgSize {
+		return nil, errGRPCWebTooLarge
+	}
+	if uint32(len(body)-5) < length {
+		return nil, status.Errorf(codes.InvalidArgument, "malformed gRPC-Web frame")
+	}
+	msg := body[5 : 5+length]
+
+	dec := func(v interface{}) error {
+		if err := proto.Unmarshal(msg, v.(proto.Message)); err != nil {
+			return status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		return nil
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), incomingMetadata(r.Header))
+	ctx = grpc.NewContextWithServerTransportStream(ctx, stream)
+	// Address and certificate of caller as on gRPC-server, for token binding, rate limits and audit.
+	// Адрес и сертификат вызывающего, как на gRPC-сервере, для привязки токенов, лимитов и аудита.
+	ctx = peer.NewContext(ctx, requestPeer(r))
+	if v := r.Header.Get("grpc-timeout"); v != "" {
+		timeout, err := parseTimeout(v)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	resp, err := m.desc.Handler(m.srv, ctx, dec, h.interceptor)
+	if err != nil {
+		return nil, err
+	}
+	out, err := proto.Marshal(resp.(proto.Message))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return out, nil
+}
+
+// Kinds of allowed origin. Виды разрешенного источника
+const (
+	originDenied = iota
+	// Origin is listed and gets credentials. Источник указан явно и получает учетные данные
+	originListed
+	// Origin is allowed by "*" without credentials. Источник разрешен "*" без учетных данных
+	originAny
+)
+
+func (h *grpcWebHandler) originAllowed(origin string) int {
+	allowed := originDenied
+	for _, o := range h.allowedOrigins {
+		switch o {
+		case origin:
+			return originListed
+		case "*":
+			allowed = originAny
+		}
+	}
+	return allowed
+}
+
+// Peer of HTTP request, client certificate is set if it was given and verified.
+// Участник HTTP-запроса, сертификат клиента задается, если он предъявлен и проверен.
+func requestPeer(r *http.Request) *peer.Peer {
+	p := &peer.Peer{Addr: remoteAddr(r.RemoteAddr)}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS, CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity}}
+	}
+	return p
+}
+
+// Address of HTTP client in host:port form. Адрес HTTP-клиента в виде host:port
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
+
+// Parses grpc-timeout header: at most 8 digits and unit H, M, S, m, u or n.
+// Разбираем заголовок grpc-timeout: не более 8 цифр и единица H, M, S, m, u или n.
+func parseTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", v)
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, ok := units[v[len(v)-1]]
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", v)
+	}
+	if max := int64(math.MaxInt64 / unit); n > max {
+		n = max
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// Converts HTTP headers to gRPC metadata, skipping transport ones
+// Преобразуем заголовки HTTP в метаданные gRPC, пропуская транспортные
+func incomingMetadata(header http.Header) metadata.MD {
+	md := metadata.MD{}
+	for k, v := range header {
+		k = strings.ToLower(k)
+		switch k {
+		case "content-type", "content-length", "connection", "origin", "x-grpc-web", "x-user-agent", "accept", "accept-encoding", "user-agent", "host", "grpc-timeout":
+			continue
+		}
+		md.Append(k, v...)
+	}
+	return md
+}
+
+// Trailers of response in gRPC-Web format. Трейлеры ответа в формате gRPC-Web
+func trailer(s *status.Status, md metadata.MD) []byte {
+	var b bytes.Buffer
+	for k, v := range md {
+		for _, value := range v {
+			fmt.Fprintf(&b, "%s: %s\r\n", k, value)
+		}
+	}
+	fmt.Fprintf(&b, "grpc-status: %d\r\n", s.Code())
+	if s.Message() != "" {
+		fmt.Fprintf(&b, "grpc-message: %s\r\n", url.PathEscape(s.Message()))
+	}
+	if len(s.Details()) > 0 {
+		if details, err := proto.Marshal(s.Proto()); err == nil {
+			fmt.Fprintf(&b, "grpc-status-details-bin: %s\r\n", base64.RawStdEncoding.EncodeToString(details))
+		}
+	}
+	return b.Bytes()
+}
+
+// Collects header and trailer set by interceptors and handlers with grpc.SetHeader and grpc.SetTrailer.
+// Собирает заголовки и трейлеры, заданные перехватчиками и обработчиками через grpc.SetHeader и grpc.SetTrailer.
+type grpcWebStream struct {
+	method string
+
+	mu      sync.Mutex
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+func (s *grpcWebStream) Method() string {
+	return s.method
+}
+
+func (s *grpcWebStream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *grpcWebStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *grpcWebStream) SetTrailer(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+func (s *grpcWebStream) metadata() (header, trailer metadata.MD) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.header, s.trailer
+}
+
+func writeFrame(out *bytes.Buffer, flag byte, data []byte, text bool) {
+	frame := make([]byte, 5+len(data))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	copy(frame[5:], data)
+	if text {
+		out.WriteString(base64.StdEncoding.EncodeToString(frame))
+		return
+	}
+	out.Write(frame)
+}
+
+// Text body may be several concatenated base64 chunks with padding
+// Текстовое тело может состоять из нескольких base64 частей с выравниванием
+func decodeBase64Chunks(body []byte) ([]byte, error) {
+	var out []byte
+	s := strings.TrimSpace(string(body))
+	for len(s) > 0 {
+		n := strings.IndexByte(s, '=')
+		if n < 0 {
+			n = len(s)
+		} else {
+			for n < len(s) && s[n] == '=' {
+				n++
+			}
+		}
+		chunk, err := base64.StdEncoding.DecodeString(s[:n])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk...)
+		s = s[n:]
+	}
+	return out, nil
+}
@@ -0,0 +1,264 @@
+// Testing gRPC-Web handler with plain net/http client
+// Тестирование обработчика gRPC-Web обычным клиентом net/http
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+const testToken = "Bearer blablatok-tokblabla-blablatok"
+
+func newTestGRPCWebServer() *httptest.Server {
+	web := newGRPCWebHandler(grpc_middleware.ChainUnaryServer(
+		grpc.UnaryServerInterceptor((&authenticator{}).ensureValidToken),
+	), []string{"https://admin.example.com"})
+	pb.RegisterProductInfoServer(web, &server{})
+	return httptest.NewServer(web)
+}
+
+// Sends gRPC-Web request, returns message and trailers of response
+// Отправляем запрос gRPC-Web, возвращаем сообщение и трейлеры ответа
+func callGRPCWeb(t *testing.T, url, contentType, token string, req proto.Message) ([]byte, string) {
+	msg, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+	body := frame
+	if text {
+		body = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+
+	r, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("X-Grpc-Web", "1")
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got HTTP status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text {
+		if data, err = decodeBase64Chunks(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var message []byte
+	var trailers string
+	for len(data) >= 5 {
+		n := binary.BigEndian.Uint32(data[1:5])
+		if data[0]&grpcWebTrailerFlag != 0 {
+			trailers = string(data[5 : 5+n])
+		} else {
+			message = data[5 : 5+n]
+		}
+		data = data[5+n:]
+	}
+	return message, trailers
+}
+
+func TestGRPCWeb_AddAndGetProduct(t *testing.T) {
+	ts := newTestGRPCWebServer()
+	defer ts.Close()
+
+	for _, contentType := range []string{"application/grpc-web+proto", "application/grpc-web-text"} {
+		msg, trailers := callGRPCWeb(t, ts.URL+"/ecommerce.ProductInfo/addProduct", contentType, testToken,
+			&pb.Product{Name: "Sumsung S9999", Description: "Samsung Galaxy S9999", Price: 7777.0})
+		if !strings.Contains(trailers, "grpc-status: 0") {
+			t.Fatalf("%s addProduct: unexpected trailers %q", contentType, trailers)
+		}
+		id := &pb.ProductID{}
+		if err := proto.Unmarshal(msg, id); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, trailers = callGRPCWeb(t, ts.URL+"/ecommerce.ProductInfo/getProduct", contentType, testToken, id)
+		if !strings.Contains(trailers, "grpc-status: 0") {
+			t.Fatalf("%s getProduct: unexpected trailers %q", contentType, trailers)
+		}
+		product := &pb.Product{}
+		if err := proto.Unmarshal(msg, product); err != nil {
+			t.Fatal(err)
+		}
+		if product.Name != "Sumsung S9999" {
+			t.Errorf("%s: unexpected product %v", contentType, product)
+		}
+	}
+}
+
+func TestGRPCWeb_Errors(t *testing.T) {
+	ts := newTestGRPCWebServer()
+	defer ts.Close()
+
+	var tests = []struct {
+		method, token string
+		want          codes.Code
+	}{
+		{"/ecommerce.ProductInfo/getProduct", "", codes.Unauthenticated},
+		{"/ecommerce.ProductInfo/getProduct", "Bearer wrong", codes.Unauthenticated},
+		{"/ecommerce.ProductInfo/getProduct", testToken, codes.NotFound},
+		{"/ecommerce.ProductInfo/unknown", testToken, codes.Unimplemented},
+	}
+	for _, test := range tests {
+		_, trailers := callGRPCWeb(t, ts.URL+test.method, "application/grpc-web+proto", test.token, &pb.ProductID{Value: "1"})
+		want := fmt.Sprintf("grpc-status: %d\r\n", test.want)
+		if !strings.Contains(trailers, want) {
+			t.Errorf("%s with token %q: got trailers %q, want %q", test.method, test.token, trailers, want)
+		}
+	}
+}
+
+func TestGRPCWeb_TooLarge(t *testing.T) {
+	ts := newTestGRPCWebServer()
+	defer ts.Close()
+
+	// Message over the limit, and body over the limit with short frame length.
+	// Сообщение больше предела и тело больше предела с коротким фреймом.
+	large := &pb.ProductID{Value: strings.Repeat("x", grpcWebMaxRecvMsgSize)}
+	for _, contentType := range []string{"application/grpc-web+proto", "application/grpc-web-text+proto"} {
+		_, trailers := callGRPCWeb(t, ts.URL+"/ecommerce.ProductInfo/getProduct", contentType, testToken, large)
+		want := fmt.Sprintf("grpc-status: %d\r\n", codes.ResourceExhausted)
+		if !strings.Contains(trailers, want) {
+			t.Errorf("%s: got trailers %q, want %q", contentType, trailers, want)
+		}
+	}
+	frame := make([]byte, 5+grpcWebMaxRecvMsgSize+1)
+	binary.BigEndian.PutUint32(frame[1:5], 1)
+	r, err := http.NewRequest(http.MethodPost, ts.URL+"/ecommerce.ProductInfo/getProduct", bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/grpc-web+proto")
+	r.Header.Set("Authorization", testToken)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("grpc-status: %d\r\n", codes.ResourceExhausted); !bytes.Contains(data, []byte(want)) {
+		t.Errorf("body over limit: got %q, want %q", data, want)
+	}
+}
+
+func TestGRPCWeb_CORS(t *testing.T) {
+	ts := newTestGRPCWebServer()
+	defer ts.Close()
+
+	var tests = []struct {
+		origin string
+		want   int
+	}{
+		{"https://admin.example.com", http.StatusNoContent},
+		{"https://evil.example.com", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest(http.MethodOptions, ts.URL+"/ecommerce.ProductInfo/addProduct", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Origin", test.origin)
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("preflight from %s: got %d, want %d", test.origin, resp.StatusCode, test.want)
+		}
+		if test.want == http.StatusNoContent && resp.Header.Get("Access-Control-Allow-Origin") != test.origin {
+			t.Errorf("preflight from %s: missing Access-Control-Allow-Origin", test.origin)
+		}
+	}
+
+	// Origin allowed by "*" gets no credentials. Источник, разрешенный "*", не получает учетных данных
+	r := httptest.NewRequest(http.MethodOptions, "/ecommerce.ProductInfo/addProduct", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	w := httptest.NewRecorder()
+	newGRPCWebHandler(nil, []string{"https://admin.example.com", "*"}).ServeHTTP(w, r)
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("any origin: got headers %v", w.Header())
+	}
+}
+
+func TestGRPCWeb_PeerAndTimeout(t *testing.T) {
+	var got context.Context
+	web := newGRPCWebHandler(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		got = ctx
+		return handler(ctx, req)
+	}, nil)
+	pb.RegisterProductInfoServer(web, &server{})
+	ts := httptest.NewServer(web)
+	defer ts.Close()
+
+	msg, err := proto.Marshal(&pb.ProductID{Value: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := append([]byte{0, 0, 0, 0, byte(len(msg))}, msg...)
+	r, _ := http.NewRequest(http.MethodPost, ts.URL+"/ecommerce.ProductInfo/getProduct", bytes.NewReader(frame))
+	r.Header.Set("Content-Type", grpcWebContentType)
+	r.Header.Set("grpc-timeout", "5S")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if p, ok := peer.FromContext(got); !ok || !strings.HasPrefix(p.Addr.String(), "127.0.0.1:") {
+		t.Errorf("got peer %v, want address of client", p)
+	}
+	if deadline, ok := got.Deadline(); !ok || time.Until(deadline) > 5*time.Second {
+		t.Errorf("got deadline %v, %v, want within 5s", deadline, ok)
+	}
+	if md, _ := metadata.FromIncomingContext(got); len(md.Get("grpc-timeout")) > 0 {
+		t.Error("grpc-timeout is passed as metadata")
+	}
+
+	for _, v := range []string{"", "5", "S", "123456789S", "-1S", "5x"} {
+		if _, err := parseTimeout(v); err == nil {
+			t.Errorf("parseTimeout(%q): want error", v)
+		}
+	}
+	if d, err := parseTimeout("250m"); err != nil || d != 250*time.Millisecond {
+		t.Errorf("parseTimeout(250m) = %v, %v", d, err)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	// Metadata header with idempotency key of call. Заголовок метаданных с ключом идемпотентности вызова
+	idempotencyKeyHeader = "idempotency-key"
+	// Header of replayed response. Заголовок повторно отданного ответа
+	idempotentReplayHeader = "idempotent-replayed"
+	maxIdempotencyKeyLen   = 255
+	// Time a key is remembered if not set by config. Время хранения ключа, если не задано конфигурацией
+	defaultIdempotencyWindow = 24 * time.Hour
+	// Time a call in progress holds its key, after it the key may be taken by a retry.
+	// Время, на которое выполняемый вызов занимает ключ, после него ключ может занять повтор.
+	idempotencyLease = 30 * time.Second
+	// Interval of checks of call in progress. Интервал проверок выполняемого вызова
+	idempotencyPollInterval = 20 * time.Millisecond
+	// Lock of key in directory older than timeout is left by crashed replica.
+	// Блокировка ключа в каталоге старше таймаута оставлена упавшей репликой.
+	idempotencyLockTimeout      = 10 * time.Second
+	idempotencyLockPollInterval = time.Millisecond
+)
+
+// Methods made idempotent by key, other methods are idempotent by nature.
+// Методы, которые ключ делает идемпотентными, остальные идемпотентны сами по себе.
+var idempotentMethods = map[string]bool{
+	"/ecommerce.ProductInfo/addProduct": true,
+}
+
+// Remembers responses by idempotency key of each client, so retried call returns the original response
+// instead of doing the work again. Failed calls are not remembered, so they may be retried.
+// Keys are kept in memory of the process unless a directory shared by replicas is set, so with several
+// replicas and no shared directory a retry reaching another replica is done again.
+// Запоминает ответы по ключу идемпотентности каждого клиента, поэтому повторный вызов возвращает исходный ответ,
+// а не выполняется снова. Неудачные вызовы не запоминаются, поэтому их можно повторить.
+// Ключи хранятся в памяти процесса, если не задан каталог, общий для реплик, поэтому при нескольких
+// репликах без общего каталога повтор, попавший на другую реплику, выполняется снова.
+type idempotencyStore struct {
+	window  time.Duration
+	backend idempotencyBackend
+
+	mu        sync.Mutex
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// Storage of idempotency records, shared by replicas or local. Хранилище записей идемпотентности, общее или локальное
+type idempotencyBackend interface {
+	// Stores rec unless key has unexpired record, which is returned then.
+	// Сохраняет rec, если у ключа нет неистекшей записи, иначе возвращает ее.
+	reserve(key string, rec *idempotencyRecord, now time.Time) (existing *idempotencyRecord, err error)
+	// Replaces record of owner with rec. Заменяет запись владельца на rec
+	complete(key string, rec *idempotencyRecord) error
+	// Drops record of owner. Удаляет запись владельца
+	release(key, owner string) error
+	// Drops expired records. Удаляет истекшие записи
+	sweep(now time.Time) error
+}
+
+// Record of key: call in progress while Resp is empty, then its response.
+// Запись ключа: вызов выполняется, пока Resp пуст, затем его ответ.
+type idempotencyRecord struct {
+	Owner   string    `json:"owner"` // Random ID of call doing the work. Случайный ID выполняющего вызова
+	Hash    []byte    `json:"hash"`
+	Resp    []byte    `json:"resp,omitempty"` // Marshaled anypb.Any. Сериализованный anypb.Any
+	Expires time.Time `json:"expires"`        // Lease of call in progress, then end of window. Аренда вызова, затем конец окна
+}
+
+func (r *idempotencyRecord) expired(now time.Time) bool { return !now.Before(r.Expires) }
+
+// Keys are remembered in dir shared by replicas, or in memory if dir is empty.
+// Ключи запоминаются в каталоге, общем для реплик, или в памяти, если dir пуст.
+func newIdempotencyStore(window time.Duration, dir string) (*idempotencyStore, error) {
+	if window == 0 {
+		window = defaultIdempotencyWindow
+	}
+	var backend idempotencyBackend = &memoryIdempotency{records: make(map[string]*idempotencyRecord)}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		backend = dirIdempotency(dir)
+	}
+	return &idempotencyStore{window: window, backend: backend, now: time.Now}, nil
+}
+
+// Unary interceptor, it goes after authentication, as keys are scoped to client identity.
+// Унарный перехватчик, идет после аутентификации, так как ключи относятся к клиенту.
+func (s *idempotencyStore) unary(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !idempotentMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get(idempotencyKeyHeader)
+	if len(keys) == 0 {
+		return handler(ctx, req)
+	}
+	if len(keys) > 1 || keys[0] == "" || len(keys[0]) > maxIdempotencyKeyLen {
+		return nil, status.Errorf(codes.InvalidArgument, "%s must be a single value of 1 to %d characters",
+			idempotencyKeyHeader, maxIdempotencyKeyLen)
+	}
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return handler(ctx, req)
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	hash := sha256.Sum256(data)
+	name := sha256.Sum256([]byte(callerIdentity(ctx) + "\x00" + info.FullMethod + "\x00" + keys[0]))
+	key := hex.EncodeToString(name[:])
+	owner, err := uuid.NewV4()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+
+	for {
+		now := s.now()
+		s.sweep(now)
+		rec := &idempotencyRecord{Owner: owner.String(), Hash: hash[:], Expires: now.Add(idempotencyLease)}
+		existing, err := s.backend.reserve(key, rec, now)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "idempotency store: %v", err)
+		}
+		if existing == nil {
+			resp, err := handler(ctx, req)
+			s.finish(key, rec, resp, err)
+			return resp, err
+		}
+		if !bytes.Equal(existing.Hash, hash[:]) {
+			return nil, idempotencyKeyReused(keys[0])
+		}
+		if len(existing.Resp) > 0 {
+			var a anypb.Any
+			if err := proto.Unmarshal(existing.Resp, &a); err != nil {
+				return nil, status.Errorf(codes.Internal, "idempotency store: %v", err)
+			}
+			resp, err := a.UnmarshalNew()
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "idempotency store: %v", err)
+			}
+			_ = grpc.SetHeader(ctx, metadata.Pairs(idempotentReplayHeader, "true"))
+			return resp, nil
+		}
+		// The same call is in progress, possibly on other replica, its result is awaited. If it fails,
+		// its record is dropped or its lease expires, and this call is done again.
+		// Тот же вызов выполняется, возможно, на другой реплике, ждем его результата. Если он неудачен,
+		// его запись удаляется или истекает аренда, и этот вызов выполняется снова.
+		select {
+		case <-time.After(idempotencyPollInterval):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// Remembers response of successful call, forgets failed one. Запоминаем ответ успешного вызова, забываем неудачный
+func (s *idempotencyStore) finish(key string, rec *idempotencyRecord, resp interface{}, err error) {
+	msg, ok := resp.(proto.Message)
+	if err == nil && ok {
+		a, err := anypb.New(msg)
+		if err == nil {
+			var data []byte
+			if data, err = proto.Marshal(a); err == nil {
+				done := &idempotencyRecord{Owner: rec.Owner, Hash: rec.Hash, Resp: data, Expires: s.now().Add(s.window)}
+				if err = s.backend.complete(key, done); err == nil {
+					return
+				}
+			}
+		}
+		log.Printf("idempotency store: response is not remembered: %v", err)
+	}
+	if err := s.backend.release(key, rec.Owner); err != nil {
+		log.Printf("idempotency store: %v", err)
+	}
+}
+
+// Drops expired keys once a minute. Удаляем истекшие ключи раз в минуту
+func (s *idempotencyStore) sweep(now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) < time.Minute {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.mu.Unlock()
+	if err := s.backend.sweep(now); err != nil {
+		log.Printf("idempotency store: %v", err)
+	}
+}
+
+// Records in memory of one process. Записи в памяти одного процесса
+type memoryIdempotency struct {
+	mu      sync.Mutex
+	records map[string]*idempotencyRecord
+}
+
+func (m *memoryIdempotency) reserve(key string, rec *idempotencyRecord, now time.Time) (*idempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.records[key]; ok && !r.expired(now) {
+		return r, nil
+	}
+	m.records[key] = rec
+	return nil, nil
+}
+
+func (m *memoryIdempotency) complete(key string, rec *idempotencyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.records[key]; ok && r.Owner == rec.Owner {
+		m.records[key] = rec
+	}
+	return nil
+}
+
+func (m *memoryIdempotency) release(key, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.records[key]; ok && r.Owner == owner {
+		delete(m.records, key)
+	}
+	return nil
+}
+
+func (m *memoryIdempotency) sweep(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, r := range m.records {
+		if r.expired(now) {
+			delete(m.records, key)
+		}
+	}
+	return nil
+}
+
+// Records in files of directory shared by replicas, for example on a network volume. Each change of a record
+// is made under lock file of its key created exclusively, and record is replaced by rename of complete
+// temporary file, so records are never half-written and expired records are taken over by one replica only.
+// Записи в файлах каталога, общего для реплик, например, на сетевом томе. Каждое изменение записи выполняется
+// под файлом блокировки ее ключа, создаваемым монопольно, запись заменяется переименованием полностью записанного
+// временного файла, поэтому записи не бывают записаны наполовину, а истекшую запись занимает только одна реплика.
+type dirIdempotency string
+
+func (d dirIdempotency) path(key string) string { return filepath.Join(string(d), key+".json") }
+
+// Takes lock of key and returns its release. Lock of crashed replica is broken after idempotencyLockTimeout,
+// it is far longer than a change of record.
+// Занимаем блокировку ключа и возвращаем ее освобождение. Блокировка упавшей реплики снимается после
+// idempotencyLockTimeout, он много больше времени изменения записи.
+func (d dirIdempotency) lock(key string) (func(), error) {
+	path := filepath.Join(string(d), key+".lock")
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > idempotencyLockTimeout {
+			breakLock(path, info)
+			continue
+		}
+		time.Sleep(idempotencyLockPollInterval)
+	}
+}
+
+// Removes stale lock by rename, so lock taken by other replica meanwhile is put back, not removed.
+// Удаляем устаревшую блокировку переименованием, поэтому блокировка, занятая в это время другой репликой,
+// возвращается, а не удаляется.
+func breakLock(path string, stale fs.FileInfo) {
+	tomb := fmt.Sprintf("%s.%d.stale", path, time.Now().UnixNano())
+	if err := os.Rename(path, tomb); err != nil {
+		return
+	}
+	if info, err := os.Stat(tomb); err == nil && !os.SameFile(info, stale) {
+		os.Link(tomb, path)
+	}
+	os.Remove(tomb)
+}
+
+func (d dirIdempotency) reserve(key string, rec *idempotencyRecord, now time.Time) (*idempotencyRecord, error) {
+	unlock, err := d.lock(key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	existing, err := d.read(d.path(key))
+	if err == nil && !existing.expired(now) {
+		return existing, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return nil, d.write(key, rec)
+}
+
+func (d dirIdempotency) complete(key string, rec *idempotencyRecord) error {
+	unlock, err := d.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if r, err := d.read(d.path(key)); err != nil || r.Owner != rec.Owner {
+		return err // Lease of call expired and key is taken. Аренда вызова истекла, ключ занят
+	}
+	return d.write(key, rec)
+}
+
+func (d dirIdempotency) release(key, owner string) error {
+	unlock, err := d.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	path := d.path(key)
+	r, err := d.read(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil || r.Owner != owner {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (d dirIdempotency) sweep(now time.Time) error {
+	paths, err := filepath.Glob(filepath.Join(string(d), "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if r, err := d.read(path); err != nil || !r.expired(now) {
+			continue
+		}
+		// Checked again under lock, the key may be taken meanwhile. Проверяется повторно под блокировкой
+		key := strings.TrimSuffix(filepath.Base(path), ".json")
+		unlock, err := d.lock(key)
+		if err != nil {
+			return err
+		}
+		if r, err := d.read(path); err == nil && r.expired(now) {
+			os.Remove(path)
+		}
+		unlock()
+	}
+	return nil
+}
+
+func (d dirIdempotency) read(path string) (*idempotencyRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r idempotencyRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &r, nil
+}
+
+// Writes record to temporary file and renames it. Called with lock of key held.
+// Записываем запись во временный файл и переименовываем его. Вызывается под блокировкой ключа.
+func (d dirIdempotency) write(key string, rec *idempotencyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(string(d), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path(key))
+}
+
+// FailedPrecondition for key reused with other request. FailedPrecondition для ключа, использованного с другим запросом
+func idempotencyKeyReused(key string) error {
+	st := status.New(codes.FailedPrecondition, "idempotency key is reused with different request")
+	ds, err := st.WithDetails(&epb.PreconditionFailure{Violations: []*epb.PreconditionFailure_Violation{{
+		Type:        "IDEMPOTENCY_KEY",
+		Subject:     key,
+		Description: "the key was used with different request, a new key is required",
+	}}})
+	if err != nil {
+		return st.Err()
+	}
+	return ds.Err()
+}
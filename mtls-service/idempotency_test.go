@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const addProductMethod = "/ecommerce.ProductInfo/addProduct"
+
+func keyContext(ctx context.Context, key string) context.Context {
+	return metadata.NewIncomingContext(ctx, metadata.Pairs(idempotencyKeyHeader, key))
+}
+
+func newTestIdempotencyStore(t *testing.T, window time.Duration, dir string) *idempotencyStore {
+	s, err := newIdempotencyStore(window, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func addWithKey(s *idempotencyStore, srv *server, ctx context.Context, p *pb.Product) (string, error) {
+	resp, err := s.unary(ctx, p, &grpc.UnaryServerInfo{FullMethod: addProductMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.AddProduct(ctx, req.(*pb.Product))
+		})
+	if err != nil {
+		return "", err
+	}
+	return resp.(*pb.ProductID).Value, nil
+}
+
+func TestIdempotency_AddProduct(t *testing.T) {
+	s := newTestIdempotencyStore(t, time.Hour, "")
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	srv := &server{}
+	alice := peerContext(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	bob := peerContext(&x509.Certificate{Subject: pkix.Name{CommonName: "bob"}})
+	product := func() *pb.Product { return &pb.Product{Name: "Sumsung S10", Price: 700} }
+
+	first, err := addWithKey(s, srv, keyContext(alice, "key-1"), product())
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried, err := addWithKey(s, srv, keyContext(alice, "key-1"), product())
+	if err != nil || retried != first {
+		t.Errorf("retry: got %q, %v, want original %q", retried, err, first)
+	}
+	if n := len(srv.products().(*memoryStore).products); n != 1 {
+		t.Errorf("got %d products after retry, want 1", n)
+	}
+
+	_, err = addWithKey(s, srv, keyContext(alice, "key-1"), &pb.Product{Name: "Apple"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("reused key: got %v, want FailedPrecondition", err)
+	}
+	if d := status.Convert(err).Details(); len(d) != 1 || d[0].(*epb.PreconditionFailure).Violations[0].Subject != "key-1" {
+		t.Errorf("details of reused key: %v", d)
+	}
+
+	// Keys of different clients don't collide. Ключи разных клиентов не пересекаются
+	if other, err := addWithKey(s, srv, keyContext(bob, "key-1"), product()); err != nil || other == first {
+		t.Errorf("key of other client: got %q, %v", other, err)
+	}
+	// Calls without key are not deduplicated. Вызовы без ключа не объединяются
+	addWithKey(s, srv, alice, product())
+	addWithKey(s, srv, alice, product())
+	if n := len(srv.products().(*memoryStore).products); n != 4 {
+		t.Errorf("got %d products, want 4", n)
+	}
+
+	// Key is forgotten after window. Ключ забывается после окна
+	now = now.Add(time.Hour)
+	if again, err := addWithKey(s, srv, keyContext(alice, "key-1"), &pb.Product{Name: "Apple"}); err != nil || again == first {
+		t.Errorf("key after window: got %q, %v", again, err)
+	}
+}
+
+func TestIdempotency_FailuresAreNotRemembered(t *testing.T) {
+	s := newTestIdempotencyStore(t, 0, "")
+	var calls int32
+	call := func(fail bool) error {
+		_, err := s.unary(keyContext(context.Background(), "key"), &pb.Product{Name: "x"}, &grpc.UnaryServerInfo{FullMethod: addProductMethod},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				if fail {
+					return nil, status.Errorf(codes.Unavailable, "try again")
+				}
+				return &pb.ProductID{Value: "id"}, nil
+			})
+		return err
+	}
+	if err := call(true); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v", err)
+	}
+	if err := call(false); err != nil {
+		t.Fatalf("retry after failure: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("got %d calls, want 2", calls)
+	}
+
+	for _, key := range []string{"", string(make([]byte, maxIdempotencyKeyLen+1))} {
+		_, err := s.unary(keyContext(context.Background(), key), &pb.Product{}, &grpc.UnaryServerInfo{FullMethod: addProductMethod},
+			func(ctx context.Context, req interface{}) (interface{}, error) { return &pb.ProductID{}, nil })
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("key of %d bytes: got %v", len(key), err)
+		}
+	}
+}
+
+func TestIdempotency_ConcurrentDuplicates(t *testing.T) {
+	s := newTestIdempotencyStore(t, 0, "")
+	var calls int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	ids := make([]string, 5)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := s.unary(keyContext(context.Background(), "key"), &pb.Product{Name: "x"}, &grpc.UnaryServerInfo{FullMethod: addProductMethod},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					<-release
+					return &pb.ProductID{Value: "id-" + string(rune('0'+atomic.AddInt32(&calls, 1)))}, nil
+				})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = resp.(*pb.ProductID).Value
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("got %d calls of concurrent duplicates, want 1", calls)
+	}
+	for _, id := range ids {
+		if id != "id-1" {
+			t.Errorf("got responses %v", ids)
+			break
+		}
+	}
+}
+
+// Retry reaching other replica returns the original response with shared directory.
+// Повтор, попавший на другую реплику, возвращает исходный ответ при общем каталоге.
+func TestIdempotency_SharedAcrossReplicas(t *testing.T) {
+	dir := t.TempDir()
+	replicas := []*idempotencyStore{newTestIdempotencyStore(t, time.Hour, dir), newTestIdempotencyStore(t, time.Hour, dir)}
+	srv := &server{}
+	ctx := keyContext(context.Background(), "key-1")
+	product := func() *pb.Product { return &pb.Product{Name: "Sumsung S10", Price: 700} }
+
+	first, err := addWithKey(replicas[0], srv, ctx, product())
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried, err := addWithKey(replicas[1], srv, ctx, product())
+	if err != nil || retried != first {
+		t.Errorf("retry on other replica: got %q, %v, want original %q", retried, err, first)
+	}
+	if n := len(srv.products().(*memoryStore).products); n != 1 {
+		t.Errorf("got %d products after retry, want 1", n)
+	}
+	if _, err := addWithKey(replicas[1], srv, ctx, &pb.Product{Name: "Apple"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("reused key on other replica: got %v, want FailedPrecondition", err)
+	}
+
+	// Retry waits for call in progress on other replica. Повтор ждет вызова, выполняемого на другой реплике
+	var calls int32
+	release := make(chan struct{})
+	call := func(s *idempotencyStore) (interface{}, error) {
+		return s.unary(keyContext(context.Background(), "key-2"), &pb.Product{Name: "x"}, &grpc.UnaryServerInfo{FullMethod: addProductMethod},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return &pb.ProductID{Value: "id-2"}, nil
+			})
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := call(replicas[0])
+		done <- err
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	resp, err := call(replicas[1])
+	if id, ok := resp.(*pb.ProductID); err != nil || !ok || id.Value != "id-2" || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("concurrent retry: got %v, %v after %d calls", resp, err, calls)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	// Failed call is forgotten by all replicas. Неудачный вызов забывается всеми репликами
+	_, err = replicas[0].unary(keyContext(context.Background(), "key-3"), &pb.Product{}, &grpc.UnaryServerInfo{FullMethod: addProductMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, status.Error(codes.Unavailable, "try again")
+		})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := replicas[1].unary(keyContext(context.Background(), "key-3"), &pb.Product{}, &grpc.UnaryServerInfo{FullMethod: addProductMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return &pb.ProductID{Value: "id-3"}, nil
+		}); err != nil {
+		t.Errorf("retry of failed call on other replica: %v", err)
+	}
+}
+
+func TestDirIdempotency_ConcurrentReplicas(t *testing.T) {
+	dir := t.TempDir()
+	replicas := []idempotencyBackend{dirIdempotency(dir), dirIdempotency(dir)}
+	now := time.Now()
+	const key = "key"
+	if _, err := replicas[0].reserve(key, &idempotencyRecord{Owner: "expired", Expires: now.Add(-time.Second)}, now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired record is taken over by one call only. Истекшую запись занимает только один вызов
+	const calls = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var owners []string
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			owner := fmt.Sprint("owner-", i)
+			existing, err := replicas[i%2].reserve(key, &idempotencyRecord{Owner: owner, Expires: now.Add(time.Minute)}, now)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if existing == nil {
+				mu.Lock()
+				owners = append(owners, owner)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(owners) != 1 {
+		t.Fatalf("expired record is taken by %v", owners)
+	}
+
+	// Completion of expired lease does not replace record of new owner, while others keep taking it.
+	// Завершение истекшей аренды не заменяет запись нового владельца, пока другие продолжают ее занимать.
+	later := now.Add(2 * time.Minute)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 0 {
+				if err := replicas[0].complete(key, &idempotencyRecord{Owner: owners[0], Resp: []byte("late"), Expires: later.Add(time.Hour)}); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if _, err := replicas[i%2].reserve(key, &idempotencyRecord{Owner: fmt.Sprint("retry-", i), Expires: later.Add(time.Minute)}, later); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	r, err := dirIdempotency(dir).read(dirIdempotency(dir).path(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Owner == owners[0] && string(r.Resp) != "late" {
+		t.Errorf("record of %s is replaced partially: %+v", r.Owner, r)
+	}
+	if r.Owner != owners[0] && len(r.Resp) != 0 {
+		t.Errorf("late completion replaced record of %s", r.Owner)
+	}
+	if locks, _ := filepath.Glob(filepath.Join(dir, "*.lock")); len(locks) != 0 {
+		t.Errorf("locks are left: %v", locks)
+	}
+
+	// Lock of crashed replica is broken after timeout. Блокировка упавшей реплики снимается после таймаута
+	lock := filepath.Join(dir, key+".lock")
+	if err := ioutil.WriteFile(lock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * idempotencyLockTimeout)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := replicas[1].release(key, r.Owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dirIdempotency(dir).path(key)); !os.IsNotExist(err) {
+		t.Errorf("record is not released after stale lock: %v", err)
+	}
+}
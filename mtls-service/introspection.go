@@ -0,0 +1,219 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of introspection. Значения по умолчанию проверки токенов
+const (
+	defaultIntrospectionCacheSize   = 10000
+	defaultIntrospectionCacheTTL    = time.Minute
+	defaultIntrospectionNegativeTTL = 10 * time.Second
+	defaultIntrospectionTimeout     = 2 * time.Second
+)
+
+// Introspection of opaque tokens (RFC 7662). Проверка непрозрачных токенов (RFC 7662)
+type introspectionConfig struct {
+	// Introspection endpoint and credentials of service. Конечная точка проверки и учетные данные сервиса
+	URL          string `json:"url"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// Resource ID expected in "aud", client_id if empty; expected "iss", not checked if empty.
+	// ID ресурса, ожидаемый в "aud", client_id, если пусто; ожидаемый "iss", не проверяется, если пусто.
+	Audience string `json:"audience"`
+	Issuer   string `json:"issuer"`
+	// CA of endpoint, system roots if empty. УЦ конечной точки, системные корневые, если пусто
+	CAFile string `json:"ca_file"`
+	// Maximum of cached tokens. Максимум кэшированных токенов
+	CacheSize int `json:"cache_size"`
+	// Active token is cached for CacheTTL but not after its expiry, inactive one for NegativeCacheTTL.
+	// Активный токен кэшируется на CacheTTL, но не дольше срока действия, неактивный - на NegativeCacheTTL.
+	CacheTTL         duration `json:"cache_ttl"`
+	NegativeCacheTTL duration `json:"negative_cache_ttl"`
+	// Timeout of call to endpoint, token is rejected on timeout. Таймаут вызова, по истечении токен отклоняется
+	Timeout duration `json:"timeout"`
+}
+
+var errIntrospectionFailed = errors.New("introspection failed")
+
+// Introspects tokens with cache. Проверяет токены с кэшем
+type introspector struct {
+	cfg    introspectionConfig
+	client *http.Client
+	cache  *lruCache
+	now    func() time.Time
+}
+
+func newIntrospector(cfg introspectionConfig) (*introspector, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("introspection: url is required")
+	}
+	if cfg.Audience == "" {
+		cfg.Audience = cfg.ClientID
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = defaultIntrospectionCacheSize
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = duration(defaultIntrospectionCacheTTL)
+	}
+	if cfg.NegativeCacheTTL == 0 {
+		cfg.NegativeCacheTTL = duration(defaultIntrospectionNegativeTTL)
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = duration(defaultIntrospectionTimeout)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("introspection: failed to append ca certs")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &introspector{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport, Timeout: time.Duration(cfg.Timeout)},
+		cache:  newLRUCache(cfg.CacheSize),
+		now:    time.Now,
+	}, nil
+}
+
+// Returns claims of active token, nil for inactive one. Errors are not cached, so the call fails closed.
+// Возвращаем утверждения активного токена, nil для неактивного. Ошибки не кэшируются, вызов отклоняется.
+func (i *introspector) introspect(ctx context.Context, token string) (*tokenClaims, error) {
+	key := sha256.Sum256([]byte(token))
+	now := i.now()
+	if claims, ok := i.cache.get(key, now); ok {
+		return claims, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(i.cfg.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.cfg.URL,
+		strings.NewReader(url.Values{"token": {token}, "token_type_hint": {"access_token"}}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(i.cfg.ClientID, i.cfg.ClientSecret)
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errIntrospectionFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: HTTP status %d", errIntrospectionFailed, resp.StatusCode)
+	}
+	var res struct {
+		Active bool `json:"active"`
+		tokenClaims
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("%w: %v", errIntrospectionFailed, err)
+	}
+
+	now = i.now()
+	if !res.Active || !i.accepts(&res.tokenClaims, now) {
+		i.cache.add(key, nil, now.Add(time.Duration(i.cfg.NegativeCacheTTL)))
+		return nil, nil
+	}
+	claims := &res.tokenClaims
+	expires := now.Add(time.Duration(i.cfg.CacheTTL))
+	if exp := time.Unix(claims.ExpiresAt, 0); claims.ExpiresAt != 0 && exp.Before(expires) {
+		expires = exp
+	}
+	i.cache.add(key, claims, expires)
+	return claims, nil
+}
+
+// Active token is valid for the service only if it is issued for it and is within its lifetime.
+// Активный токен действителен для сервиса, только если выдан для него и находится в сроке действия.
+func (i *introspector) accepts(claims *tokenClaims, now time.Time) bool {
+	switch {
+	case claims.ExpiresAt != 0 && now.Unix() >= claims.ExpiresAt:
+		return false
+	case claims.NotBefore != 0 && now.Unix() < claims.NotBefore:
+		return false
+	case i.cfg.Issuer != "" && claims.Issuer != i.cfg.Issuer:
+		return false
+	}
+	return claims.Audience.contains(i.cfg.Audience)
+}
+
+// Bounded LRU cache of introspection results keyed by hash of token, so tokens are not kept in memory.
+// Ограниченный LRU кэш результатов проверки по хэшу токена, поэтому сами токены в памяти не хранятся.
+type lruCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List // Front is the most recently used. Спереди - последний использованный
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type cacheEntry struct {
+	key     [sha256.Size]byte
+	claims  *tokenClaims // nil for inactive token. nil для неактивного токена
+	expires time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, order: list.New(), entries: make(map[[sha256.Size]byte]*list.Element)}
+}
+
+func (c *lruCache) get(key [sha256.Size]byte, now time.Time) (*tokenClaims, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.claims, true
+}
+
+func (c *lruCache) add(key [sha256.Size]byte, claims *tokenClaims, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value = &cacheEntry{key: key, claims: claims, expires: expires}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, claims: claims, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
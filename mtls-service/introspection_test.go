@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blablatov/stream-mtls-grpc/internal/authserver"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Authorization server counting introspection calls. Сервер авторизации, считающий вызовы проверки
+func newTestAuthServer(t *testing.T, delay time.Duration) (*authserver.Server, *int32, string) {
+	as := authserver.New()
+	as.Issuer, as.Audience = "https://auth.local", "productinfo"
+	as.AddResource("productinfo", "resource-secret")
+	var calls int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(delay)
+		as.ServeHTTP(w, r)
+	}))
+	t.Cleanup(hs.Close)
+	return as, &calls, hs.URL + "/introspect"
+}
+
+func callWithToken(a *authenticator, ctx context.Context, token string) error {
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+	_, err := a.ensureValidToken(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/ecommerce.ProductInfo/getProduct"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			if _, ok := claimsFromContext(ctx); !ok {
+				return nil, status.Error(codes.Internal, "no claims")
+			}
+			return nil, nil
+		})
+	return err
+}
+
+func TestIntrospection_CachesResults(t *testing.T) {
+	as, calls, endpoint := newTestAuthServer(t, 0)
+	i, err := newIntrospector(introspectionConfig{URL: endpoint, ClientID: "productinfo", ClientSecret: "resource-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{introspector: i, allowUnbound: true}
+	token := as.Issue("mtls-client", "products:read", nil)
+
+	for n := 0; n < 3; n++ {
+		if err := callWithToken(a, context.Background(), token); err != nil {
+			t.Fatalf("active token: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("got %d introspection calls for active token, want 1", n)
+	}
+
+	// Inactive result is cached too. Неактивный результат тоже кэшируется
+	for n := 0; n < 3; n++ {
+		if err := callWithToken(a, context.Background(), "unknown"); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("unknown token: got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("got %d introspection calls, want 2", n)
+	}
+
+	// Revoked token is seen after cache entry expires. Отозванный токен виден после истечения записи кэша
+	as.Revoke(token)
+	i.now = func() time.Time { return time.Now().Add(defaultIntrospectionCacheTTL) }
+	if err := callWithToken(a, context.Background(), token); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("revoked token: got %v", err)
+	}
+}
+
+func TestIntrospection_FailsClosed(t *testing.T) {
+	as, _, endpoint := newTestAuthServer(t, 200*time.Millisecond)
+	i, err := newIntrospector(introspectionConfig{URL: endpoint, ClientID: "productinfo", ClientSecret: "resource-secret",
+		Timeout: duration(50 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{introspector: i, allowUnbound: true}
+	token := as.Issue("mtls-client", "", nil)
+	if err := callWithToken(a, context.Background(), token); status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v, want Unavailable on timeout", err)
+	}
+	if i.cache.len() != 0 {
+		t.Error("failure is cached")
+	}
+
+	// Wrong credentials of service fail closed too. Неверные учетные данные сервиса тоже приводят к отказу
+	i.cfg.ClientSecret, i.cfg.Timeout = "wrong", duration(time.Second)
+	if err := callWithToken(a, context.Background(), token); status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v, want Unavailable on rejected introspection", err)
+	}
+}
+
+func TestIntrospection_CertBoundToken(t *testing.T) {
+	as, _, endpoint := newTestAuthServer(t, 0)
+	i, err := newIntrospector(introspectionConfig{URL: endpoint, ClientID: "productinfo", ClientSecret: "resource-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{introspector: i}
+	owner := &x509.Certificate{Raw: []byte("certificate of owner")}
+	thief := &x509.Certificate{Raw: []byte("certificate of thief")}
+	token := as.Issue("mtls-client", "", owner)
+
+	if err := callWithToken(a, peerContext(owner), token); err != nil {
+		t.Errorf("owner: %v", err)
+	}
+	if err := callWithToken(a, peerContext(thief), token); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("thief: got %v", err)
+	}
+	// Binding is required by default, static token is rejected with introspection.
+	// Привязка требуется по умолчанию, статический токен отклоняется при проверке на сервере авторизации.
+	if err := callWithToken(a, peerContext(owner), as.Issue("mtls-client", "", nil)); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("unbound token: got %v", err)
+	}
+	if err := callWithToken(a, peerContext(owner), "blablatok-tokblabla-blablatok"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("static token: got %v", err)
+	}
+}
+
+func TestLRUCache_Eviction(t *testing.T) {
+	c := newLRUCache(2)
+	now := time.Now()
+	key := func(s string) [sha256.Size]byte { return sha256.Sum256([]byte(s)) }
+	c.add(key("a"), &tokenClaims{Subject: "a"}, now.Add(time.Minute))
+	c.add(key("b"), &tokenClaims{Subject: "b"}, now.Add(time.Minute))
+	c.get(key("a"), now) // "b" becomes the least recently used. "b" становится самым давним
+	c.add(key("c"), nil, now.Add(time.Minute))
+
+	if _, ok := c.get(key("b"), now); ok {
+		t.Error("least recently used entry is not evicted")
+	}
+	if claims, ok := c.get(key("a"), now); !ok || claims.Subject != "a" {
+		t.Error("recently used entry is evicted")
+	}
+	if claims, ok := c.get(key("c"), now); !ok || claims != nil {
+		t.Error("negative entry is lost")
+	}
+	if _, ok := c.get(key("a"), now.Add(time.Minute)); ok || c.len() != 1 {
+		t.Error("expired entry is returned")
+	}
+}
+
+func TestIntrospection_AudienceIssuer(t *testing.T) {
+	as, _, endpoint := newTestAuthServer(t, 0)
+	tests := []struct {
+		name             string
+		issuer, audience string
+		cfg              introspectionConfig
+		active           bool
+	}{
+		{"token of service", "https://auth.local", "productinfo", introspectionConfig{Issuer: "https://auth.local"}, true},
+		{"audience defaults to client_id", "https://auth.local", "productinfo", introspectionConfig{}, true},
+		{"token of other resource", "https://auth.local", "billing", introspectionConfig{}, false},
+		{"token without audience", "https://auth.local", "", introspectionConfig{}, false},
+		{"configured audience", "https://auth.local", "products", introspectionConfig{Audience: "products"}, true},
+		{"token of other issuer", "https://evil.local", "productinfo", introspectionConfig{Issuer: "https://auth.local"}, false},
+	}
+	for _, test := range tests {
+		cfg := test.cfg
+		cfg.URL, cfg.ClientID, cfg.ClientSecret = endpoint, "productinfo", "resource-secret"
+		i, err := newIntrospector(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		as.Issuer, as.Audience = test.issuer, test.audience
+		claims, err := i.introspect(context.Background(), as.Issue("mtls-client", "", nil))
+		if err != nil || (claims != nil) != test.active {
+			t.Errorf("%s: got %+v, %v, want active %v", test.name, claims, err, test.active)
+		}
+	}
+
+	// Token is not valid before nbf. Токен недействителен до nbf
+	i, err := newIntrospector(introspectionConfig{URL: endpoint, ClientID: "productinfo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	early := &tokenClaims{Audience: audience{"productinfo"}, NotBefore: now.Add(time.Minute).Unix()}
+	if i.accepts(early, now) || !i.accepts(early, now.Add(time.Minute)) {
+		t.Error("nbf is not checked")
+	}
+}
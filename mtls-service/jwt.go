@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Validation of JWT access tokens. Проверка токенов доступа JWT
+type jwtConfig struct {
+	// Expected "iss" and "aud" claims, not checked if empty. Ожидаемые "iss" и "aud", не проверяются, если пустые
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// PEM file of public key or certificate of issuer, RS256 and ES256 are supported.
+	// PEM файл открытого ключа или сертификата издателя, поддерживаются RS256 и ES256.
+	PublicKeyFile string `json:"public_key_file"`
+}
+
+// Claims of access token used by service. Утверждения токена доступа, используемые сервисом
+type tokenClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Scope     string   `json:"scope"`
+	ClientID  string   `json:"client_id"`
+	// Confirmation of certificate-bound token (RFC 8705). Подтверждение токена, привязанного к сертификату
+	Cnf *struct {
+		X5tS256 string `json:"x5t#S256"`
+	} `json:"cnf"`
+}
+
+// Claim "aud" is a string or array of strings. Утверждение "aud" - строка или массив строк
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Verifies signature and claims of JWT. Проверяет подпись и утверждения JWT
+type jwtVerifier struct {
+	cfg jwtConfig
+	key crypto.PublicKey
+	now func() time.Time
+}
+
+func newJWTVerifier(cfg jwtConfig) (*jwtVerifier, error) {
+	data, err := ioutil.ReadFile(cfg.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", cfg.PublicKeyFile)
+	}
+	var key crypto.PublicKey
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	default:
+		if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	return &jwtVerifier{cfg: cfg, key: key, now: time.Now}, nil
+}
+
+// Looks like compact JWS, opaque tokens have no dots. Похож на компактный JWS, у непрозрачных токенов нет точек
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verifies token and returns its claims. Проверяем токен и возвращаем его утверждения
+func (v *jwtVerifier) verify(token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := v.key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) != nil {
+			return nil, errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		// Signature of ES256 is r || s of 32 bytes each. Подпись ES256 - r || s по 32 байта
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key %T", v.key)
+	}
+
+	claims := &tokenClaims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+	now := v.now().Unix()
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return nil, errors.New("token is expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("token is not valid yet")
+	}
+	if v.cfg.Issuer != "" && claims.Issuer != v.cfg.Issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if v.cfg.Audience != "" && !claims.Audience.contains(v.cfg.Audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// Thumbprint of certificate for cnf "x5t#S256" claim. Отпечаток сертификата для утверждения cnf "x5t#S256"
+func certThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
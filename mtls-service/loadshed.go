@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata header with priority of call: "critical", "normal" (default) or "low". Limiter goes before
+// authentication, so "critical" is honored only for client certificates of priority_identities.
+// Заголовок метаданных с приоритетом вызова: "critical", "normal" (по умолчанию) или "low". Ограничитель идет
+// до аутентификации, поэтому "critical" учитывается только для клиентских сертификатов из priority_identities.
+const priorityHeader = "x-priority"
+
+// Defaults of adaptive limit. Значения по умолчанию адаптивного лимита
+const (
+	defaultAdaptiveInitialLimit = 20
+	defaultAdaptiveMinLimit     = 1
+	defaultAdaptiveMaxLimit     = 1000
+	defaultAdaptiveTolerance    = 2.0
+	defaultAdaptiveBackoff      = 0.9
+	// Latency baseline is renewed after this number of calls of method. Базовая задержка обновляется через столько вызовов
+	adaptiveBaselineWindow = 100
+	// Latency below this is never a congestion, so scheduler jitter of fast calls doesn't lower the limit.
+	// Задержка меньше этой не считается перегрузкой, чтобы колебания быстрых вызовов не снижали лимит.
+	adaptiveLatencyFloor = time.Millisecond
+)
+
+// Share of limit available to priority, low-priority calls are shed first.
+// Доля лимита, доступная приоритету, вызовы низкого приоритета отбрасываются первыми.
+var priorityShares = map[string]float64{
+	"critical": 1,
+	"normal":   0.9,
+	"low":      0.5,
+}
+
+var errOverloaded = status.Errorf(codes.Unavailable, "server is overloaded, retry later")
+
+// Limits of in-flight calls. Лимиты одновременных вызовов
+type concurrencyConfig struct {
+	// Maximum of in-flight calls of each method, unlimited if zero. Максимум одновременных вызовов каждого метода
+	MaxInFlight int `json:"max_in_flight"`
+	// Maximum by full or short method name, overrides MaxInFlight. Максимум по имени метода, заменяет MaxInFlight
+	Methods map[string]int `json:"methods"`
+	// Limit of all in-flight calls adapted to latency, disabled if nil.
+	// Лимит всех одновременных вызовов, подстраиваемый под задержку, отключен при nil.
+	Adaptive *adaptiveConfig `json:"adaptive"`
+	// Client certificate identities (CN or SAN) allowed to raise priority, others get at most "normal".
+	// Идентификаторы клиентских сертификатов (CN или SAN), которым разрешено повышать приоритет, остальным - не выше "normal".
+	PriorityIdentities []string `json:"priority_identities"`
+}
+
+// AIMD limit: latency above Tolerance times the baseline or DeadlineExceeded multiplies limit by Backoff,
+// otherwise limit grows by one while at least half of it is used.
+// Лимит AIMD: задержка выше базовой в Tolerance раз или DeadlineExceeded умножает лимит на Backoff,
+// иначе лимит растет на единицу, пока занята хотя бы его половина.
+type adaptiveConfig struct {
+	InitialLimit int     `json:"initial_limit"`
+	MinLimit     int     `json:"min_limit"`
+	MaxLimit     int     `json:"max_limit"`
+	Tolerance    float64 `json:"latency_tolerance"`
+	Backoff      float64 `json:"backoff"`
+}
+
+// Sheds calls above limits with Unavailable, so clients back off and retry.
+// Отбрасывает вызовы сверх лимитов с Unavailable, чтобы клиенты повторили их позже.
+type concurrencyLimiter struct {
+	maxInFlight        int
+	methods            map[string]int
+	adaptive           *adaptiveLimit
+	priorityIdentities map[string]bool
+
+	mu       sync.Mutex
+	inFlight map[string]int
+	total    int
+	now      func() time.Time
+}
+
+// Latency-driven limit of all calls. Лимит всех вызовов, управляемый задержкой
+type adaptiveLimit struct {
+	cfg       adaptiveConfig
+	limit     float64
+	baselines map[string]*latencyBaseline
+}
+
+// Minimal latency of method over the last window. Минимальная задержка метода за последнее окно
+type latencyBaseline struct {
+	min       time.Duration
+	windowMin time.Duration
+	samples   int
+}
+
+// Creates limiter, nil config gives limiter without limits. Создаем ограничитель, при nil - без ограничений
+func newConcurrencyLimiter(cfg *concurrencyConfig) (*concurrencyLimiter, error) {
+	l := &concurrencyLimiter{methods: make(map[string]int), inFlight: make(map[string]int), priorityIdentities: make(map[string]bool), now: time.Now}
+	if cfg == nil {
+		return l, nil
+	}
+	if cfg.MaxInFlight < 0 {
+		return nil, fmt.Errorf("concurrency: max_in_flight must not be negative, got %d", cfg.MaxInFlight)
+	}
+	l.maxInFlight = cfg.MaxInFlight
+	for method, max := range cfg.Methods {
+		if max <= 0 {
+			return nil, fmt.Errorf("concurrency: %s: limit must be positive, got %d", method, max)
+		}
+		l.methods[fullMethodName(method)] = max
+	}
+	for _, id := range cfg.PriorityIdentities {
+		l.priorityIdentities[id] = true
+	}
+	if cfg.Adaptive != nil {
+		a, err := newAdaptiveLimit(*cfg.Adaptive)
+		if err != nil {
+			return nil, err
+		}
+		l.adaptive = a
+	}
+	return l, nil
+}
+
+func newAdaptiveLimit(cfg adaptiveConfig) (*adaptiveLimit, error) {
+	if cfg.InitialLimit == 0 {
+		cfg.InitialLimit = defaultAdaptiveInitialLimit
+	}
+	if cfg.MinLimit == 0 {
+		cfg.MinLimit = defaultAdaptiveMinLimit
+	}
+	if cfg.MaxLimit == 0 {
+		cfg.MaxLimit = defaultAdaptiveMaxLimit
+	}
+	if cfg.Tolerance == 0 {
+		cfg.Tolerance = defaultAdaptiveTolerance
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = defaultAdaptiveBackoff
+	}
+	switch {
+	case cfg.MinLimit < 1 || cfg.MinLimit > cfg.MaxLimit:
+		return nil, fmt.Errorf("concurrency: adaptive: invalid limits %d..%d", cfg.MinLimit, cfg.MaxLimit)
+	case cfg.InitialLimit < cfg.MinLimit || cfg.InitialLimit > cfg.MaxLimit:
+		return nil, fmt.Errorf("concurrency: adaptive: initial limit %d is out of %d..%d", cfg.InitialLimit, cfg.MinLimit, cfg.MaxLimit)
+	case cfg.Tolerance <= 1:
+		return nil, fmt.Errorf("concurrency: adaptive: latency tolerance must be above 1, got %v", cfg.Tolerance)
+	case cfg.Backoff <= 0 || cfg.Backoff >= 1:
+		return nil, fmt.Errorf("concurrency: adaptive: backoff must be in (0, 1), got %v", cfg.Backoff)
+	}
+	return &adaptiveLimit{cfg: cfg, limit: float64(cfg.InitialLimit), baselines: make(map[string]*latencyBaseline)}, nil
+}
+
+// Unary interceptor, it goes first so shed calls cost nothing. Admin calls are never shed.
+// Унарный перехватчик, идет первым, чтобы отброшенные вызовы ничего не стоили. Вызовы администратора не отбрасываются.
+func (l *concurrencyLimiter) unary(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	if isAdminMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	if !l.acquire(info.FullMethod, l.priorityShare(ctx)) {
+		return nil, errOverloaded
+	}
+	// Call is released even if handler panics. Вызов освобождается, даже если обработчик паникует
+	start := l.now()
+	defer func() { l.release(info.FullMethod, l.now().Sub(start), status.Code(err)) }()
+	return handler(ctx, req)
+}
+
+func (l *concurrencyLimiter) acquire(method string, share float64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	max, ok := l.methods[method]
+	if !ok {
+		max = l.maxInFlight
+	}
+	if max > 0 && l.inFlight[method] >= sharedLimit(float64(max), share) {
+		return false
+	}
+	if l.adaptive != nil && l.total >= sharedLimit(l.adaptive.limit, share) {
+		return false
+	}
+	l.inFlight[method]++
+	l.total++
+	return true
+}
+
+func (l *concurrencyLimiter) release(method string, latency time.Duration, code codes.Code) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.adaptive != nil {
+		l.adaptive.update(method, latency, code == codes.DeadlineExceeded, l.total)
+	}
+	l.total--
+	if l.inFlight[method]--; l.inFlight[method] == 0 {
+		delete(l.inFlight, method)
+	}
+}
+
+// Adapts limit to latency of finished call. Called with l.mu held.
+// Подстраиваем лимит под задержку завершенного вызова. Вызывается под l.mu.
+func (a *adaptiveLimit) update(method string, latency time.Duration, timedOut bool, inFlight int) {
+	b, ok := a.baselines[method]
+	if !ok {
+		b = &latencyBaseline{}
+		a.baselines[method] = b
+	}
+	threshold := b.min
+	if threshold < adaptiveLatencyFloor {
+		threshold = adaptiveLatencyFloor
+	}
+	congested := timedOut || (b.min > 0 && float64(latency) > a.cfg.Tolerance*float64(threshold))
+	b.observe(latency)
+
+	switch {
+	case congested:
+		a.limit = math.Max(float64(a.cfg.MinLimit), a.limit*a.cfg.Backoff)
+	case float64(inFlight)*2 >= a.limit:
+		a.limit = math.Min(float64(a.cfg.MaxLimit), a.limit+1)
+	}
+}
+
+func (b *latencyBaseline) observe(latency time.Duration) {
+	if b.min == 0 || latency < b.min {
+		b.min = latency
+	}
+	if b.samples == 0 || latency < b.windowMin {
+		b.windowMin = latency
+	}
+	// Baseline follows lasting change of latency, for example after move of store.
+	// Базовая задержка следует за устойчивым изменением задержки, например после переноса хранилища.
+	if b.samples++; b.samples == adaptiveBaselineWindow {
+		b.min, b.samples = b.windowMin, 0
+	}
+}
+
+// Number of calls admitted for share of limit, at least one. Число допускаемых вызовов для доли лимита, не меньше одного
+func sharedLimit(limit, share float64) int {
+	n := int(limit * share)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Share of limit by priority header of call, priority above normal needs allowed client certificate.
+// Доля лимита по заголовку приоритета вызова, приоритет выше обычного требует разрешенного клиентского сертификата.
+func (l *concurrencyLimiter) priorityShare(ctx context.Context) float64 {
+	normal := priorityShares["normal"]
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get(priorityHeader)
+	if len(v) == 0 {
+		return normal
+	}
+	share, ok := priorityShares[strings.ToLower(v[0])]
+	switch {
+	case !ok:
+		return normal
+	case share <= normal:
+		return share
+	}
+	if cert, ok := peerCertificate(ctx); ok {
+		for _, id := range certIdentities(cert) {
+			if l.priorityIdentities[id] {
+				return share
+			}
+		}
+	}
+	return normal
+}
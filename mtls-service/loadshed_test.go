@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Holds calls in flight until release is called. Держит вызовы выполняющимися до вызова release
+type blockingCalls struct {
+	l       *concurrencyLimiter
+	wg      sync.WaitGroup
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func newBlockingCalls(l *concurrencyLimiter) *blockingCalls {
+	return &blockingCalls{l: l, started: make(chan struct{}, 100), unblock: make(chan struct{})}
+}
+
+func (b *blockingCalls) start(t *testing.T, method, priority string) {
+	t.Helper()
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.l.unary(priorityContext(priority), nil, &grpc.UnaryServerInfo{FullMethod: method},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				b.started <- struct{}{}
+				<-b.unblock
+				return nil, nil
+			})
+	}()
+	select {
+	case <-b.started:
+	case <-time.After(time.Second):
+		t.Fatalf("call of %s is not started", method)
+	}
+}
+
+func (b *blockingCalls) release() {
+	close(b.unblock)
+	b.wg.Wait()
+}
+
+// Client allowed to raise priority. Клиент, которому разрешено повышать приоритет
+var checkoutCert = &x509.Certificate{Subject: pkix.Name{CommonName: "checkout.blablatov.local"}}
+
+func priorityContext(priority string) context.Context {
+	if priority == "" {
+		return context.Background()
+	}
+	return metadata.NewIncomingContext(peerContext(checkoutCert), metadata.Pairs(priorityHeader, priority))
+}
+
+func callLimiter(l *concurrencyLimiter, method, priority string) error {
+	_, err := l.unary(priorityContext(priority), nil, &grpc.UnaryServerInfo{FullMethod: method},
+		func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+	return err
+}
+
+func TestConcurrencyLimiter_PerMethod(t *testing.T) {
+	l, err := newConcurrencyLimiter(&concurrencyConfig{MaxInFlight: 10, Methods: map[string]int{"addProduct": 2},
+		PriorityIdentities: []string{"checkout.blablatov.local"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := newBlockingCalls(l)
+	calls.start(t, "/ecommerce.ProductInfo/addProduct", "critical")
+	calls.start(t, "/ecommerce.ProductInfo/addProduct", "critical")
+
+	if err := callLimiter(l, "/ecommerce.ProductInfo/addProduct", "critical"); status.Code(err) != codes.Unavailable {
+		t.Errorf("over limit of method: got %v, want Unavailable", err)
+	}
+	if err := callLimiter(l, "/ecommerce.ProductInfo/getProduct", ""); err != nil {
+		t.Errorf("other method: %v", err)
+	}
+	if err := callLimiter(l, "/grpc.channelz.v1.Channelz/GetTopChannels", ""); err != nil {
+		t.Errorf("admin method is shed: %v", err)
+	}
+	calls.release()
+	if err := callLimiter(l, "/ecommerce.ProductInfo/addProduct", ""); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+	if len(l.inFlight) != 0 || l.total != 0 {
+		t.Errorf("calls are not released: %v, %d", l.inFlight, l.total)
+	}
+}
+
+func TestConcurrencyLimiter_Priority(t *testing.T) {
+	l, err := newConcurrencyLimiter(&concurrencyConfig{MaxInFlight: 4, PriorityIdentities: []string{"checkout.blablatov.local"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := newBlockingCalls(l)
+	defer calls.release()
+	method := "/ecommerce.ProductInfo/listProducts"
+	calls.start(t, method, "")
+	calls.start(t, method, "")
+
+	// Low priority gets half of limit, normal 90%, critical the whole limit.
+	// Низкий приоритет получает половину лимита, обычный 90%, критичный - весь лимит.
+	if err := callLimiter(l, method, "low"); status.Code(err) != codes.Unavailable {
+		t.Errorf("low priority: got %v, want Unavailable", err)
+	}
+	calls.start(t, method, "normal")
+	if err := callLimiter(l, method, "NORMAL"); status.Code(err) != codes.Unavailable {
+		t.Errorf("normal priority: got %v, want Unavailable", err)
+	}
+	// Critical priority of client not allowed to raise it is normal.
+	// Критичный приоритет клиента, которому не разрешено его повышать, считается обычным.
+	other := metadata.NewIncomingContext(context.Background(), metadata.Pairs(priorityHeader, "critical"))
+	if _, err := l.unary(other, nil, &grpc.UnaryServerInfo{FullMethod: method},
+		func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }); status.Code(err) != codes.Unavailable {
+		t.Errorf("critical priority of unknown client: got %v, want Unavailable", err)
+	}
+	if err := callLimiter(l, method, "critical"); err != nil {
+		t.Errorf("critical priority: %v", err)
+	}
+}
+
+func TestConcurrencyLimiter_ReleasesOnPanic(t *testing.T) {
+	l, err := newConcurrencyLimiter(&concurrencyConfig{MaxInFlight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() { recover() }()
+		l.unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/ecommerce.ProductInfo/getProduct"},
+			func(ctx context.Context, req interface{}) (interface{}, error) { panic("handler failed") })
+	}()
+	if len(l.inFlight) != 0 || l.total != 0 {
+		t.Errorf("call is not released after panic: %v, %d", l.inFlight, l.total)
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	a, err := newAdaptiveLimit(adaptiveConfig{InitialLimit: 10, MinLimit: 2, MaxLimit: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	method := "/ecommerce.ProductInfo/getProduct"
+	a.update(method, 10*time.Millisecond, false, 10)
+	a.update(method, 10*time.Millisecond, false, 10)
+	a.update(method, 10*time.Millisecond, false, 10)
+	if a.limit != 12 {
+		t.Errorf("limit is not increased up to max: %v", a.limit)
+	}
+	a.update(method, 10*time.Millisecond, false, 1)
+	if a.limit != 12 {
+		t.Errorf("limit is increased while mostly unused: %v", a.limit)
+	}
+
+	// Latency above tolerance decreases limit multiplicatively down to min.
+	// Задержка выше допустимой уменьшает лимит мультипликативно до минимума.
+	a.update(method, 50*time.Millisecond, false, 10)
+	if a.limit != 12*defaultAdaptiveBackoff {
+		t.Errorf("limit on congestion: got %v", a.limit)
+	}
+	for i := 0; i < 50; i++ {
+		a.update(method, time.Microsecond, true, 10)
+	}
+	if a.limit != 2 {
+		t.Errorf("limit is not kept at min: %v", a.limit)
+	}
+
+	// Fast calls are not congested by jitter. Быстрые вызовы не считаются перегрузкой из-за колебаний
+	fast := "/ecommerce.ProductInfo/listProducts"
+	a.update(fast, 10*time.Microsecond, false, 2)
+	a.update(fast, 100*time.Microsecond, false, 2)
+	if a.limit != 4 {
+		t.Errorf("jitter of fast call lowers limit: %v", a.limit)
+	}
+
+	for _, cfg := range []adaptiveConfig{{MinLimit: 5, MaxLimit: 2}, {Tolerance: 0.5}, {Backoff: 1.5}, {InitialLimit: 5000}} {
+		if _, err := newAdaptiveLimit(cfg); err == nil {
+			t.Errorf("invalid config %+v is accepted", cfg)
+		}
+	}
+}
+
+func TestConcurrencyLimiter_AdaptiveSheds(t *testing.T) {
+	l, err := newConcurrencyLimiter(&concurrencyConfig{Adaptive: &adaptiveConfig{InitialLimit: 2, MinLimit: 1},
+		PriorityIdentities: []string{"checkout.blablatov.local"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := newBlockingCalls(l)
+	defer calls.release()
+	calls.start(t, "/ecommerce.ProductInfo/getProduct", "critical")
+	calls.start(t, "/ecommerce.ProductInfo/addProduct", "critical")
+	if err := callLimiter(l, "/ecommerce.ProductInfo/listProducts", "critical"); status.Code(err) != codes.Unavailable {
+		t.Errorf("over adaptive limit: got %v, want Unavailable", err)
+	}
+}
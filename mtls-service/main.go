@@ -4,19 +4,24 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"flag"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
 	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/money"
 	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	_ "google.golang.org/grpc/encoding/gzip"
-	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 )
 
@@ -26,6 +31,8 @@ var (
 	caFile             = filepath.Join("..", "mcerts", "ca.crt")
 	errMissingMetadata = status.Errorf(codes.InvalidArgument, "missing metadata")
 	errInvalidToken    = status.Errorf(codes.Unauthenticated, "invalid token")
+	configFile         = flag.String("config", "", "path to JSON config file")
+	verifyAudit        = flag.String("verify-audit", "", "verify chain of audit log file and exit")
 )
 
 const (
@@ -35,6 +42,20 @@ const (
 func main() {
 	log.SetPrefix("Server event: ")
 	log.SetFlags(log.Lshortfile)
+	flag.Parse()
+
+	// Verification command of audit log. Команда проверки журнала аудита
+	if *verifyAudit != "" {
+		if err := verifyAuditFile(*verifyAudit, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("failed to load config: %s", err)
+	}
 
 	// Read and analyze opened/closed keys, creates certificate to TLS
 	// Считываем и анализируем открытый/закрытый ключи, создаем сертификат, чтобы включить TLS
@@ -57,6 +78,65 @@ func main() {
 		log.Fatalf("failed to append client certs")
 	}
 
+	auth, err := newAuthenticator(cfg)
+	if err != nil {
+		log.Fatalf("failed to set up token validation: %s", err)
+	}
+
+	limiter, err := newRateLimiter(cfg.RateLimits)
+	if err != nil {
+		log.Fatalf("failed to set up rate limits: %s", err)
+	}
+	shedder, err := newConcurrencyLimiter(cfg.Concurrency)
+	if err != nil {
+		log.Fatalf("failed to set up concurrency limits: %s", err)
+	}
+
+	// Retried AddProduct returns the original response. Повторный AddProduct возвращает исходный ответ
+	idempotency, err := newIdempotencyStore(time.Duration(cfg.IdempotencyWindow), cfg.IdempotencyDir)
+	if err != nil {
+		log.Fatalf("failed to set up idempotency keys: %s", err)
+	}
+
+	// Product events are posted to webhooks. События товаров отправляются вебхукам
+	hooks, err := newWebhookDispatcher(cfg.Webhooks, cfg.WebhookEndpointsFile)
+	if err != nil {
+		log.Fatalf("failed to set up webhooks: %s", err)
+	}
+
+	if cfg.DefaultCurrency != "" && !money.IsCurrency(cfg.DefaultCurrency) {
+		log.Fatalf("failed to set up prices: unknown default_currency %q", cfg.DefaultCurrency)
+	}
+
+	// Changes of products are attributed to callers. Изменения товаров приписываются вызывающим
+	audit, err := openAuditLog(cfg.AuditLog)
+	if err != nil {
+		log.Fatalf("failed to open audit log: %s", err)
+	}
+
+	// Debug services are available only to admin. Отладочные сервисы доступны только администратору
+	admin := &adminGuard{identities: cfg.AdminIdentities}
+	// Calls of gateway are made on behalf of its callers. Вызовы шлюза выполняются от имени его вызывающих
+	forwarded := newForwardedCerts(cfg.TrustedGateways, certPool)
+
+	// Interceptors are shared by gRPC and gRPC-Web. Перехватчики общие для gRPC и gRPC-Web
+	interceptor := grpc_middleware.ChainUnaryServer(
+		// Caller forwarded by gateway is seen by all other interceptors. Вызывающего через шлюз видят все перехватчики
+		grpc.UnaryServerInterceptor(forwarded.unary),
+		// Overload is shed before any work on call. Перегрузка отбрасывается до любой работы над вызовом
+		grpc.UnaryServerInterceptor(shedder.unary),
+		grpc.UnaryServerInterceptor(admin.unary),
+		// Registers unary interceptor to gRPC-server
+		// Будет направлять все клиентские запросы к функции ensureValidBasicCredentials
+		grpc.UnaryServerInterceptor(auth.ensureValidToken),
+		// Limits are applied to authenticated caller. Лимиты применяются к аутентифицированному клиенту
+		grpc.UnaryServerInterceptor(limiter.unary),
+		grpc.UnaryServerInterceptor(idempotency.unary),
+		// Регистрация дополнительного унарного перехватчика на gRPC-сервере
+		// Будет направлять все клиентские запросы к функции orderUnaryServerInterceptor
+		grpc.UnaryServerInterceptor(orderUnaryServerInterceptor),
+	)
+
 	opts := []grpc.ServerOption{
 		// Enable TLS for all incoming connections. Включаем TLS для всех входящих соединений путем.
 		grpc.Creds( // Create the TLS credentials. Создание аутентификационных данных TLS.
@@ -66,14 +146,8 @@ func main() {
 				ClientCAs:    certPool,
 			},
 			)),
-		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-			// Registers unary interceptor to gRPC-server
-			// Будет направлять все клиентские запросы к функции ensureValidBasicCredentials
-			grpc.UnaryServerInterceptor(ensureValidToken),
-			// Регистрация дополнительного унарного перехватчика на gRPC-сервере
-			// Будет направлять все клиентские запросы к функции orderUnaryServerInterceptor
-			grpc.UnaryServerInterceptor(orderUnaryServerInterceptor),
-		)),
+		grpc.UnaryInterceptor(interceptor),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(forwarded.stream, admin.stream, auth.stream)),
 	}
 
 	// Creates new gRPC-server, send him auth data
@@ -82,7 +156,46 @@ func main() {
 
 	// Registers created service to gRPC-server via generated AP
 	// Регистрируем реализованный сервис на только что созданном gRPCсервере с помощью сгенерированных AP
-	pb.RegisterProductInfoServer(s, &server{})
+	srv := &server{
+		feed:     changeFeed{history: cfg.WatchHistory},
+		audit:    audit,
+		pages:    pageTokens{key: []byte(cfg.PageTokenKey)},
+		currency: cfg.DefaultCurrency,
+	}
+	pb.RegisterProductInfoServer(s, srv)
+	// API keys are managed only over gRPC by admin. API ключами управляет только администратор по gRPC
+	pb.RegisterApiKeyAdminServer(s, &apiKeyAdminServer{store: auth.apiKeys})
+	// Webhooks are registered, deliveries are listed and replayed by admin. Вебхуки регистрирует, доставки просматривает и повторяет администратор
+	pb.RegisterWebhookAdminServer(s, &webhookAdminServer{hooks: hooks})
+	go hooks.run(context.Background(), &srv.feed)
+	registerDebugServices(s, cfg)
+	// Health is checked by balancing clients to skip replica that is not serving.
+	// Здоровье проверяют балансирующие клиенты, чтобы пропускать не обслуживающую реплику.
+	healthpb.RegisterHealthServer(s, health.NewServer())
+
+	// gRPC-Web for browser clients, token is checked by the same interceptor
+	// gRPC-Web для браузерных клиентов, токен проверяется тем же перехватчиком
+	if cfg.GRPCWebAddr != "" {
+		web := newGRPCWebHandler(interceptor, cfg.CORSAllowedOrigins)
+		pb.RegisterProductInfoServer(web, srv)
+		webServer := &http.Server{
+			Addr:    cfg.GRPCWebAddr,
+			Handler: web,
+			// Browsers may not have client certificate, given one is verified for token binding.
+			// У браузеров может не быть сертификата клиента, предъявленный проверяется для привязки токенов.
+			TLSConfig: &tls.Config{
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+				Certificates: []tls.Certificate{cert},
+				ClientCAs:    certPool,
+			},
+		}
+		go func() {
+			log.Printf("Starting gRPC-Web listener on " + cfg.GRPCWebAddr)
+			if err := webServer.ListenAndServeTLS("", ""); err != nil {
+				log.Fatalf("failed to serve gRPC-Web: %v", err)
+			}
+		}()
+	}
 
 	lis, err := net.Listen("tcp", port) // Listen of port. Начинаем прослушивать порт 50051.
 	if err != nil {
@@ -97,34 +210,6 @@ func main() {
 	}
 }
 
-// Validates the authorization. Подтверждение авторизации
-func valid(authorization []string) bool {
-	if len(authorization) < 1 {
-		return false
-	}
-	token := strings.TrimPrefix(authorization[0], "Bearer ")
-	// Performs validation of token matching an arbitrary string.
-	// Выполняем проверку токена, соответствующего произвольной строке.
-	return token == "blablatok-tokblabla-blablatok"
-}
-
-// Checking token. Определяем функцию ensureValidToken для проверки подлинности токена.
-// Если тот отсутствует или недействителен, тогда перехватчик блокирует выполнение и возвращает ошибку.
-// Или вызывается следующий обработчик, которому передается контекст и интерфейс.
-func ensureValidToken(ctx context.Context, req interface{},
-	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return nil, errMissingMetadata
-	}
-
-	if !valid(md["authorization"]) {
-		return nil, errInvalidToken
-	}
-	// Continue execution of handler after ensuring a valid token. Токен ок
-	return handler(ctx, req)
-}
-
 // Server : Unary Interceptor
 // Серверный унарный перехватчик в gRPC
 func orderUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Page sizes of ListProducts (AIP-158). Размеры страниц ListProducts
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// Fields of products allowed in order_by. Поля товаров, допустимые в order_by
+var orderByFields = map[string]bool{"name": true, "price": true, "create_time": true}
+
+// Parses order_by (AIP-132), for example "price desc, name". Разбираем order_by, например "price desc, name"
+func parseOrderBy(s string) ([]orderField, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var order []orderField
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ",") {
+		words := strings.Fields(part)
+		if len(words) == 0 || len(words) > 2 || (len(words) == 2 && words[1] != "desc" && words[1] != "asc") {
+			return nil, fmt.Errorf("invalid order %q, want field with optional asc or desc", strings.TrimSpace(part))
+		}
+		if !orderByFields[words[0]] {
+			return nil, fmt.Errorf("products can't be ordered by %q, allowed fields are name, price and create_time", words[0])
+		}
+		if seen[words[0]] {
+			return nil, fmt.Errorf("field %q is repeated", words[0])
+		}
+		seen[words[0]] = true
+		order = append(order, orderField{name: words[0], desc: len(words) == 2 && words[1] == "desc"})
+	}
+	return order, nil
+}
+
+// Normalized order_by, tokens are bound to it. Нормализованный order_by, к нему привязаны токены
+func formatOrderBy(order []orderField) string {
+	parts := make([]string, len(order))
+	for i, f := range order {
+		parts[i] = f.name
+		if f.desc {
+			parts[i] += " desc"
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Content of page token: query it belongs to and sort key of the last product.
+// Содержимое токена страницы: запрос, к которому он относится, и ключ сортировки последнего товара.
+type pageCursor struct {
+	OrderBy string `json:"o,omitempty"`
+	Filter  string `json:"f,omitempty"`
+	ID      string `json:"i"`
+	Name    string `json:"n,omitempty"`
+	// Price of the last product. Цена последнего товара
+	Units      int64  `json:"u,omitempty"`
+	Nanos      int32  `json:"z,omitempty"`
+	Currency   string `json:"c,omitempty"`
+	CreateTime int64  `json:"t,omitempty"`
+}
+
+// Signs page tokens, so client can't forge cursor. Key is random if not set by config,
+// then tokens are valid only on this replica until restart.
+// Подписывает токены страниц, поэтому клиент не может подделать курсор. Ключ случайный, если не задан
+// конфигурацией, тогда токены действительны только на этой реплике до перезапуска.
+type pageTokens struct {
+	once sync.Once
+	key  []byte
+}
+
+const pageTokenMACSize = 16
+
+var errInvalidPageToken = errors.New("page_token is invalid or expired")
+
+func (t *pageTokens) init() {
+	t.once.Do(func() {
+		if len(t.key) == 0 {
+			t.key = make([]byte, 32)
+			if _, err := rand.Read(t.key); err != nil {
+				panic(err)
+			}
+		}
+	})
+}
+
+func (t *pageTokens) mac(payload []byte) []byte {
+	t.init()
+	m := hmac.New(sha256.New, t.key)
+	m.Write(payload)
+	return m.Sum(nil)[:pageTokenMACSize]
+}
+
+// Signed opaque token of cursor. Подписанный непрозрачный токен курсора
+func (t *pageTokens) seal(cursor interface{}) (string, error) {
+	payload, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(payload, t.mac(payload)...)), nil
+}
+
+// Verifies token and decodes its cursor. Проверяем токен и декодируем его курсор
+func (t *pageTokens) open(token string, cursor interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) <= pageTokenMACSize {
+		return errInvalidPageToken
+	}
+	payload, sum := b[:len(b)-pageTokenMACSize], b[len(b)-pageTokenMACSize:]
+	if !hmac.Equal(sum, t.mac(payload)) {
+		return errInvalidPageToken
+	}
+	if err := json.Unmarshal(payload, cursor); err != nil {
+		return errInvalidPageToken
+	}
+	return nil
+}
+
+// Opaque token of page after product. Непрозрачный токен страницы после товара
+func (t *pageTokens) encode(orderBy, filter string, last *pb.Product) (string, error) {
+	price := priceOf(last)
+	return t.seal(&pageCursor{
+		OrderBy:    orderBy,
+		Filter:     filter,
+		ID:         last.Id,
+		Name:       last.Name,
+		Units:      price.Units,
+		Nanos:      price.Nanos,
+		Currency:   price.CurrencyCode,
+		CreateTime: last.CreateTime.AsTime().UnixNano(),
+	})
+}
+
+// Returns sort key of the last product of previous page. Возвращаем ключ сортировки последнего товара предыдущей страницы
+func (t *pageTokens) decode(token, orderBy, filter string) (*pb.Product, error) {
+	c := &pageCursor{}
+	if err := t.open(token, c); err != nil {
+		return nil, err
+	}
+	if c.OrderBy != orderBy || c.Filter != filter {
+		return nil, errors.New("order_by and filter must match the request of page_token")
+	}
+	ct := &timestamppb.Timestamp{Seconds: c.CreateTime / 1e9, Nanos: int32(c.CreateTime % 1e9)}
+	price := &moneypb.Money{CurrencyCode: c.Currency, Units: c.Units, Nanos: c.Nanos}
+	return &pb.Product{Id: c.ID, Name: c.Name, PriceMoney: price, CreateTime: ct}, nil
+}
+
+// Number of products in page of page_size. Количество товаров на странице размера page_size
+func pageLimit(size int32) int {
+	switch {
+	case size <= 0:
+		return defaultPageSize
+	case size > maxPageSize:
+		return maxPageSize
+	}
+	return int(size)
+}
+
+// Query of request, InvalidArgument with violated fields if request is invalid.
+// Запрос страницы, InvalidArgument с нарушенными полями, если запрос некорректен.
+func (s *server) listQuery(in *pb.ListProductsRequest) (listQuery, string, error) {
+	var violations []*epb.BadRequest_FieldViolation
+	q := listQuery{limit: pageLimit(in.PageSize)}
+	if in.PageSize < 0 {
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "page_size", Description: "page_size must not be negative"})
+	}
+	order, err := parseOrderBy(in.OrderBy)
+	if err != nil {
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "order_by", Description: err.Error()})
+	}
+	q.order = order
+	orderBy := formatOrderBy(order)
+	if q.filter, err = parseFilter(in.Filter); err != nil {
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "filter", Description: err.Error()})
+	}
+	if in.PageToken != "" && len(violations) == 0 {
+		if q.after, err = s.pages.decode(in.PageToken, orderBy, in.Filter); err != nil {
+			violations = append(violations, &epb.BadRequest_FieldViolation{Field: "page_token", Description: err.Error()})
+		}
+	}
+	if len(violations) > 0 {
+		st := status.New(codes.InvalidArgument, "Invalid list request received")
+		if ds, err := st.WithDetails(&epb.BadRequest{FieldViolations: violations}); err == nil {
+			st = ds
+		}
+		return q, "", st.Err()
+	}
+	return q, orderBy, nil
+}
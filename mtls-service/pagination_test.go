@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Puts products created one second apart. Добавляем товары, созданные с разницей в секунду
+func addTestProducts(srv *server, products ...*pb.Product) {
+	for _, p := range products {
+		n := len(srv.products().(*memoryStore).products)
+		p.Id, p.CreateTime = fmt.Sprintf("id-%04d", n), &timestamppb.Timestamp{Seconds: int64(1700000000 + n)}
+		srv.products().put(p)
+	}
+}
+
+// Reads all pages, returns names of products. Читаем все страницы, возвращаем названия товаров
+func listAllPages(t *testing.T, srv *server, in *pb.ListProductsRequest) (names []string, pages int) {
+	for {
+		out, err := srv.ListProducts(context.Background(), in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.TotalSize != 5 {
+			t.Errorf("total_size %d, want 5", out.TotalSize)
+		}
+		for _, p := range out.Products {
+			names = append(names, p.Name)
+		}
+		pages++
+		if out.NextPageToken == "" {
+			return names, pages
+		}
+		in.PageToken = out.NextPageToken
+	}
+}
+
+func TestListProducts_Pages(t *testing.T) {
+	srv := &server{}
+	addTestProducts(srv,
+		&pb.Product{Name: "Sumsung S10", Price: 700},
+		&pb.Product{Name: "Apple", Price: 900},
+		&pb.Product{Name: "Xiaomi", Price: 300},
+		&pb.Product{Name: "Nokia", Price: 300},
+		&pb.Product{Name: "Huawei", Price: 500},
+	)
+
+	for _, tc := range []struct {
+		orderBy string
+		want    string
+	}{
+		{"name", "Apple,Huawei,Nokia,Sumsung S10,Xiaomi"},
+		{"price desc, name", "Apple,Sumsung S10,Huawei,Nokia,Xiaomi"},
+		{"price, name desc", "Xiaomi,Nokia,Huawei,Sumsung S10,Apple"},
+		{"create_time desc", "Huawei,Nokia,Xiaomi,Apple,Sumsung S10"},
+	} {
+		names, pages := listAllPages(t, srv, &pb.ListProductsRequest{PageSize: 2, OrderBy: tc.orderBy})
+		if got := strings.Join(names, ","); got != tc.want || pages != 3 {
+			t.Errorf("order_by %q: got %s in %d pages, want %s in 3", tc.orderBy, got, pages, tc.want)
+		}
+	}
+
+	// Product added between pages is not skipped. Товар, добавленный между страницами, не пропускается
+	first, _ := srv.ListProducts(context.Background(), &pb.ListProductsRequest{PageSize: 2, OrderBy: "name"})
+	addTestProducts(srv, &pb.Product{Name: "Lenovo"})
+	next, err := srv.ListProducts(context.Background(), &pb.ListProductsRequest{PageSize: 2, OrderBy: "name", PageToken: first.NextPageToken})
+	if err != nil || next.Products[0].Name != "Lenovo" {
+		t.Errorf("page after change: %v, %v", next, err)
+	}
+
+	// Default page holds all products. Страница по умолчанию вмещает все товары
+	if out, _ := srv.ListProducts(context.Background(), &pb.ListProductsRequest{}); len(out.Products) != 6 || out.NextPageToken != "" {
+		t.Errorf("default page: %v", out)
+	}
+}
+
+func TestListProducts_InvalidRequest(t *testing.T) {
+	srv := &server{}
+	addTestProducts(srv, &pb.Product{Name: "Apple"}, &pb.Product{Name: "Nokia"})
+	out, err := srv.ListProducts(context.Background(), &pb.ListProductsRequest{PageSize: 1, OrderBy: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := out.NextPageToken
+	forged := []byte(token)
+	forged[2] ^= 1
+
+	for _, tc := range []struct {
+		in    *pb.ListProductsRequest
+		field string
+	}{
+		{&pb.ListProductsRequest{PageSize: -1}, "page_size"},
+		{&pb.ListProductsRequest{OrderBy: "description"}, "order_by"},
+		{&pb.ListProductsRequest{OrderBy: "name sideways"}, "order_by"},
+		{&pb.ListProductsRequest{OrderBy: "name, name desc"}, "order_by"},
+		{&pb.ListProductsRequest{PageToken: "bm90IGEgdG9rZW4"}, "page_token"},
+		{&pb.ListProductsRequest{PageToken: string(forged), OrderBy: "name"}, "page_token"},
+		// Token belongs to other order. Токен относится к другому порядку
+		{&pb.ListProductsRequest{PageToken: token, OrderBy: "price"}, "page_token"},
+	} {
+		_, err := srv.ListProducts(context.Background(), tc.in)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: got %v, want InvalidArgument", tc.in, err)
+			continue
+		}
+		d := status.Convert(err).Details()
+		if br, ok := d[0].(*epb.BadRequest); !ok || br.FieldViolations[0].Field != tc.field {
+			t.Errorf("%v: details %v, want violation of %s", tc.in, d, tc.field)
+		}
+	}
+
+	// Token of other key is rejected. Токен другого ключа отклоняется
+	other := &server{pages: pageTokens{key: []byte("other")}}
+	if _, err := other.ListProducts(context.Background(), &pb.ListProductsRequest{PageToken: token, OrderBy: "name"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("token of other key: got %v", err)
+	}
+	// Equivalent order_by keeps token valid. Равнозначный order_by сохраняет токен действительным
+	if _, err := srv.ListProducts(context.Background(), &pb.ListProductsRequest{PageToken: token, OrderBy: " name asc "}); err != nil {
+		t.Errorf("token with equivalent order_by: %v", err)
+	}
+}
+
+func TestListProducts_PageSizeCoerced(t *testing.T) {
+	srv := &server{}
+	for i := 0; i < maxPageSize+1; i++ {
+		srv.products().put(&pb.Product{Id: fmt.Sprintf("%04d", i)})
+	}
+	out, err := srv.ListProducts(context.Background(), &pb.ListProductsRequest{PageSize: 5000})
+	if err != nil || len(out.Products) != maxPageSize || out.NextPageToken == "" {
+		t.Errorf("got %d products, token %q, %v", len(out.Products), out.NextPageToken, err)
+	}
+}
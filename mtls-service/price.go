@@ -0,0 +1,76 @@
+package main
+
+import (
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/money"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Migration from float price to price_money. Both fields are stored and returned, so old clients keep working:
+// price_money is the source of truth when it is set. Price is taken in currency of product only if price_money
+// is not set, or it is sent back unchanged while price is changed to non-zero value: old Go clients keep
+// price_money they don't know as unknown field, and new clients leave price zero.
+// Переход с цены float на price_money. Оба поля хранятся и возвращаются, поэтому старые клиенты продолжают работать:
+// price_money - источник истины, когда задано. Цена принимается в валюте товара, только если price_money не задано
+// или отправлено без изменений при цене, измененной на ненулевую: старые клиенты на Go хранят неизвестное им
+// price_money и отправляют его без изменений, а новые клиенты оставляют цену нулевой.
+
+// Sets consistent price and price_money of written product, before is nil for new product.
+// Задаем согласованные price и price_money записываемого товара, before равен nil для нового товара.
+func (s *server) migratePrice(in, before *pb.Product) error {
+	var err error
+	switch {
+	case in.PriceMoney == nil && before != nil && before.PriceMoney != nil && in.Price == before.Price:
+		// Price is not changed by old client dropping price_money. Цена не изменена старым клиентом без price_money
+		in.PriceMoney = before.PriceMoney
+	case in.PriceMoney == nil, oldClientPrice(in, before):
+		currency := s.currency
+		if currency == "" {
+			currency = money.DefaultCurrency
+		}
+		if before != nil && before.PriceMoney != nil {
+			currency = before.PriceMoney.CurrencyCode
+		}
+		if in.PriceMoney, err = money.FromFloat32(in.Price, currency); err != nil {
+			return invalidPrice("price", err)
+		}
+	default:
+		if err = money.Validate(in.PriceMoney); err != nil {
+			return invalidPrice("price_money", err)
+		}
+	}
+	in.Price = money.Float32(in.PriceMoney)
+	return nil
+}
+
+// Reports whether price is changed by old client sending stored price_money back.
+// Сообщаем, изменена ли цена старым клиентом, отправившим сохраненное price_money обратно.
+func oldClientPrice(in, before *pb.Product) bool {
+	return before != nil && in.Price != 0 && in.Price != before.Price && proto.Equal(in.PriceMoney, before.PriceMoney)
+}
+
+func invalidPrice(field string, err error) error {
+	st := status.New(codes.InvalidArgument, "Invalid information received")
+	if ds, dErr := st.WithDetails(&epb.BadRequest{FieldViolations: []*epb.BadRequest_FieldViolation{
+		{Field: field, Description: err.Error()},
+	}}); dErr == nil {
+		st = ds
+	}
+	return st.Err()
+}
+
+// Price of product, float price of product stored before migration is taken in default currency.
+// Цена товара, цена float товара, сохраненного до перехода, берется в валюте по умолчанию.
+func priceOf(p *pb.Product) *moneypb.Money {
+	if p.PriceMoney != nil {
+		return p.PriceMoney
+	}
+	if m, err := money.FromFloat32(p.Price, money.DefaultCurrency); err == nil {
+		return m
+	}
+	return &moneypb.Money{}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/money"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func mustParse(t *testing.T, amount, currency string) *pb.Product {
+	t.Helper()
+	m, err := money.Parse(amount, currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pb.Product{Name: amount + " " + currency, PriceMoney: m}
+}
+
+func getProduct(t *testing.T, srv *server, id string) *pb.Product {
+	t.Helper()
+	p, err := srv.GetProduct(context.Background(), &pb.ProductID{Value: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPriceMigration(t *testing.T) {
+	ctx := context.Background()
+	srv := &server{currency: "USD"}
+
+	// Old client sets only float price, it is taken in default currency.
+	// Старый клиент задает только цену float, она принимается в валюте по умолчанию.
+	old, err := srv.AddProduct(ctx, &pb.Product{Name: "Sumsung S10", Price: 700.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := getProduct(t, srv, old.Value); money.Format(p.PriceMoney) != "700.50 USD" || p.Price != 700.5 {
+		t.Errorf("price of old client: %v", p)
+	}
+
+	// Float price is filled from exact price_money. Цена float заполняется из точной price_money
+	id, err := srv.AddProduct(ctx, mustParse(t, "7776.9999", "EUR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := getProduct(t, srv, id.Value)
+	if money.Format(p.PriceMoney) != "7776.9999 EUR" || p.Price != 7777 {
+		t.Errorf("price of new client: %v", p)
+	}
+
+	// Old client keeps price_money as unknown field and changes float price.
+	// Старый клиент хранит price_money как неизвестное поле и изменяет цену float.
+	if _, err := srv.UpdateProduct(ctx, &pb.Product{Id: id.Value, Name: p.Name, Price: 6000.25, PriceMoney: p.PriceMoney}); err != nil {
+		t.Fatal(err)
+	}
+	if p := getProduct(t, srv, id.Value); money.Format(p.PriceMoney) != "6000.25 EUR" {
+		t.Errorf("price changed by old client: %v", p)
+	}
+	// New client changes price_money and keeps float price as read. Новый клиент изменяет price_money
+	next := mustParse(t, "7776.9999", "EUR")
+	next.Id, next.Price = id.Value, 6000.25
+	if _, err := srv.UpdateProduct(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	if p := getProduct(t, srv, id.Value); money.Format(p.PriceMoney) != "7776.9999 EUR" || p.Price != 7777 {
+		t.Errorf("price changed by new client: %v", p)
+	}
+	// New client sends price_money unchanged and leaves float price zero, price stays.
+	// Новый клиент отправляет price_money без изменений и оставляет цену float нулевой, цена сохраняется.
+	if _, err := srv.UpdateProduct(ctx, &pb.Product{Id: id.Value, Name: p.Name, PriceMoney: next.PriceMoney}); err != nil {
+		t.Fatal(err)
+	}
+	if p := getProduct(t, srv, id.Value); money.Format(p.PriceMoney) != "7776.9999 EUR" || p.Price != 7777 {
+		t.Errorf("price_money unchanged by new client: %v", p)
+	}
+	// Old REST client drops price_money and sends float price as read, exact price stays.
+	// Старый REST клиент отбрасывает price_money и отправляет цену float как прочитал, точная цена остается.
+	if _, err := srv.UpdateProduct(ctx, &pb.Product{Id: id.Value, Name: "Renamed", Price: 7777}); err != nil {
+		t.Fatal(err)
+	}
+	if p := getProduct(t, srv, id.Value); money.Format(p.PriceMoney) != "7776.9999 EUR" || p.Name != "Renamed" {
+		t.Errorf("product renamed by old client: %v", p)
+	}
+
+	// Exact amounts are filtered and ordered, though float prices are equal.
+	// Точные суммы фильтруются и упорядочиваются, хотя цены float равны.
+	srv.AddProduct(ctx, mustParse(t, "7777", "RUB"))
+	out, err := srv.ListProducts(ctx, &pb.ListProductsRequest{Filter: `price >= 7776.9999 AND currency = "EUR"`})
+	if err != nil || len(out.Products) != 1 || out.Products[0].Id != id.Value {
+		t.Errorf("filter by exact price: %v, %v", out, err)
+	}
+	out, err = srv.ListProducts(ctx, &pb.ListProductsRequest{OrderBy: "price desc", PageSize: 1})
+	if err != nil || out.Products[0].Name != "7777 RUB" {
+		t.Fatalf("order by exact price: %v, %v", out, err)
+	}
+	out, err = srv.ListProducts(ctx, &pb.ListProductsRequest{OrderBy: "price desc", PageSize: 1, PageToken: out.NextPageToken})
+	if err != nil || out.Products[0].Id != id.Value {
+		t.Errorf("next page by exact price: %v, %v", out, err)
+	}
+}
+
+func TestPriceMigration_Invalid(t *testing.T) {
+	srv := &server{}
+	for _, tc := range []struct {
+		in    *pb.Product
+		field string
+	}{
+		{mustParse(t, "1", "RUB"), ""},
+		{&pb.Product{Name: "Ruble of 1991", PriceMoney: &moneypb.Money{CurrencyCode: "RUR", Units: 1}}, "price_money"},
+		{&pb.Product{Name: "Negative nanos", PriceMoney: &moneypb.Money{CurrencyCode: "USD", Units: 1, Nanos: -5}}, "price_money"},
+		{&pb.Product{Name: "Too expensive", Price: 3e38}, "price"},
+	} {
+		_, err := srv.AddProduct(context.Background(), tc.in)
+		if tc.field == "" {
+			if err != nil {
+				t.Errorf("%v: %v", tc.in, err)
+			}
+			continue
+		}
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: got %v, want InvalidArgument", tc.in, err)
+			continue
+		}
+		if br, ok := status.Convert(err).Details()[0].(*epb.BadRequest); !ok || br.FieldViolations[0].Field != tc.field {
+			t.Errorf("%v: details %v, want violation of %s", tc.in, status.Convert(err).Details(), tc.field)
+		}
+	}
+}
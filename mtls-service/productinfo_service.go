@@ -4,39 +4,41 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
 
 	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
 	"github.com/gofrs/uuid"
 	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Implements server. Сервер используется для реализации productinfo_service
 type server struct {
-	productMap map[string]*pb.Product
+	mu sync.RWMutex // Guards store, it is used by gRPC and gRPC-Web. Защищает хранилище
+	// Products, in memory if nil. Товары, в памяти, если nil
+	store     productStore
+	storeOnce sync.Once
+	// Changes of store for watch. Изменения хранилища для наблюдения
+	feed changeFeed
+	// Cursors of ListProducts pages. Курсоры страниц ListProducts
+	pages pageTokens
+	// Who changed products, nil if disabled. Кто изменил товары, nil, если отключен
+	audit *auditLog
+	// Currency of float price of new products, money.DefaultCurrency if empty.
+	// Валюта цены float новых товаров, money.DefaultCurrency, если пусто.
+	currency string
 }
 
 // Method add of product. Метод сервера AddProduct, добавить товар
 func (s *server) AddProduct(ctx context.Context, in *pb.Product) (*pb.ProductID, error) {
-
-	// Bad request, generate and sends of error to client.
-	// Некорректный запрос. Сгенерировать и отправить клиенту ошибку.
-	if in.Name == "-1" {
-		log.Printf("Order ID is invalid! -> Received Order Name %s", in.Id)
-		// Creates state with code of error. Создаем состояние с кодом ошибки InvalidArgument.
-		errorStatus := status.New(codes.InvalidArgument, "Invalid information received")
-		// Describes type of error. Описываем тип ошибки BadRequest_FieldViolation
-		ds, err := errorStatus.WithDetails(
-			&epb.BadRequest_FieldViolation{
-				Field:       "Name",
-				Description: fmt.Sprintf("Order Name received is not valid %s : %s", in.Id, in.Description),
-			},
-		)
-		if err != nil {
-			return nil, errorStatus.Err()
-		}
-		return nil, ds.Err()
+	if err := validateProduct(in); err != nil {
+		return nil, err
+	}
+	if err := s.migratePrice(in, nil); err != nil {
+		return nil, err
 	}
 
 	out, err := uuid.NewV4()
@@ -44,18 +46,120 @@ func (s *server) AddProduct(ctx context.Context, in *pb.Product) (*pb.ProductID,
 		return nil, status.Errorf(codes.Internal, " %v\nError while generating Product ID", err)
 	}
 	in.Id = out.String()
-	if s.productMap == nil {
-		s.productMap = make(map[string]*pb.Product)
+	in.CreateTime = timestamppb.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.audit.record(ctx, "addProduct", nil, in); err != nil {
+		return nil, err
 	}
-	s.productMap[in.Id] = in
+	s.products().put(in)
+	s.feed.append(pb.ProductEvent_CREATED, in)
 	return &pb.ProductID{Value: in.Id}, status.New(codes.OK, "").Err()
 }
 
 // Method get of product. Метод сервера GetProduct получить товар
 func (s *server) GetProduct(ctx context.Context, in *pb.ProductID) (*pb.Product, error) {
-	value, exists := s.productMap[in.Value]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, exists := s.products().get(in.Value)
 	if exists {
 		return value, status.New(codes.OK, "").Err()
 	}
 	return nil, status.Errorf(codes.NotFound, "%v\nProduct does not exist.", in.Value)
 }
+
+// Method update of product, replaces product with the same ID. Метод сервера UpdateProduct, заменяет товар
+func (s *server) UpdateProduct(ctx context.Context, in *pb.Product) (*pb.Product, error) {
+	if err := validateProduct(in); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before, exists := s.products().get(in.Id)
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "%v\nProduct does not exist.", in.Id)
+	}
+	// Creation time is kept by service. Время создания хранится сервисом
+	in.CreateTime = before.CreateTime
+	if err := s.migratePrice(in, before); err != nil {
+		return nil, err
+	}
+	if err := s.audit.record(ctx, "updateProduct", before, in); err != nil {
+		return nil, err
+	}
+	s.products().put(in)
+	s.feed.append(pb.ProductEvent_UPDATED, in)
+	return in, nil
+}
+
+// Method delete of product. Метод сервера DeleteProduct, удалить товар
+func (s *server) DeleteProduct(ctx context.Context, in *pb.ProductID) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	product, exists := s.products().get(in.Value)
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "%v\nProduct does not exist.", in.Value)
+	}
+	if err := s.audit.record(ctx, "deleteProduct", product, nil); err != nil {
+		return nil, err
+	}
+	s.products().delete(in.Value)
+	s.feed.append(pb.ProductEvent_DELETED, product)
+	return &emptypb.Empty{}, nil
+}
+
+// Method list of products, page of filtered products in order of order_by.
+// Метод сервера ListProducts, страница отфильтрованных товаров в порядке order_by.
+func (s *server) ListProducts(ctx context.Context, in *pb.ListProductsRequest) (*pb.ListProductsResponse, error) {
+	q, orderBy, err := s.listQuery(in)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// One more product tells if there is the next page. Лишний товар показывает, есть ли следующая страница
+	limit := q.limit
+	q.limit++
+	products, total := s.products().list(q)
+	out := &pb.ListProductsResponse{Products: products, Revision: s.feed.current(), TotalSize: int32(total)}
+	if len(products) > limit {
+		out.Products = products[:limit]
+		if out.NextPageToken, err = s.pages.encode(orderBy, in.Filter, out.Products[limit-1]); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to encode page token: %v", err)
+		}
+	}
+	return out, nil
+}
+
+// Store of products, in memory by default. Хранилище товаров, по умолчанию в памяти
+func (s *server) products() productStore {
+	s.storeOnce.Do(func() {
+		if s.store == nil {
+			s.store = &memoryStore{}
+		}
+	})
+	return s.store
+}
+
+// Validates product of request. Проверка товара из запроса
+func validateProduct(in *pb.Product) error {
+	// Bad request, generate and sends of error to client.
+	// Некорректный запрос. Сгенерировать и отправить клиенту ошибку.
+	if in.Name == "-1" {
+		log.Printf("Order ID is invalid! -> Received Order Name %s", in.Id)
+		// Creates state with code of error. Создаем состояние с кодом ошибки InvalidArgument.
+		errorStatus := status.New(codes.InvalidArgument, "Invalid information received")
+		// Describes type of error. Описываем тип ошибки BadRequest_FieldViolation
+		ds, err := errorStatus.WithDetails(
+			&epb.BadRequest_FieldViolation{
+				Field:       "Name",
+				Description: fmt.Sprintf("Order Name received is not valid %s : %s", in.Id, in.Description),
+			},
+		)
+		if err != nil {
+			return errorStatus.Err()
+		}
+		return ds.Err()
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Idle buckets are dropped not more often than this. Простаивающие корзины удаляются не чаще этого
+const rateLimitSweepInterval = time.Minute
+
+// Limit of token bucket. Лимит корзины токенов
+type rateLimit struct {
+	// Requests per second. Запросов в секунду
+	Rate float64 `json:"rate"`
+	// Size of bucket, that is how many requests may come at once, Rate rounded up if zero.
+	// Размер корзины, то есть сколько запросов может прийти сразу, при нуле - Rate с округлением вверх.
+	Burst int `json:"burst"`
+}
+
+// Rate limits per client identity. Ограничения частоты запросов для каждого клиента
+type rateLimitConfig struct {
+	// Limit of methods not listed in Methods, they are unlimited if nil.
+	// Лимит методов, не перечисленных в Methods, при nil они не ограничены.
+	Default *rateLimit `json:"default"`
+	// Limits by full or short method name, for example "addProduct".
+	// Лимиты по полному или короткому имени метода, например "addProduct".
+	Methods map[string]rateLimit `json:"methods"`
+}
+
+// Token-bucket rate limiter, each client has a bucket per method. Client is identified by subject of token
+// or API key, otherwise by client certificate, otherwise by address.
+// Ограничитель частоты по схеме корзины токенов, у каждого клиента корзина на каждый метод. Клиент определяется
+// субъектом токена или API ключа, иначе клиентским сертификатом, иначе адресом.
+type rateLimiter struct {
+	defaultLimit *rateLimit
+	methods      map[string]rateLimit
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucketKey struct {
+	identity string
+	method   string
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Creates limiter, nil config gives limiter without limits. Создаем ограничитель, при nil - без ограничений
+func newRateLimiter(cfg *rateLimitConfig) (*rateLimiter, error) {
+	l := &rateLimiter{methods: make(map[string]rateLimit), buckets: make(map[bucketKey]*bucket), now: time.Now}
+	if cfg == nil {
+		return l, nil
+	}
+	if cfg.Default != nil {
+		limit, err := cfg.Default.normalize()
+		if err != nil {
+			return nil, fmt.Errorf("rate_limits: default: %w", err)
+		}
+		l.defaultLimit = &limit
+	}
+	for method, limit := range cfg.Methods {
+		limit, err := limit.normalize()
+		if err != nil {
+			return nil, fmt.Errorf("rate_limits: %s: %w", method, err)
+		}
+		l.methods[fullMethodName(method)] = limit
+	}
+	return l, nil
+}
+
+func (r rateLimit) normalize() (rateLimit, error) {
+	if r.Rate <= 0 || math.IsInf(r.Rate, 0) || math.IsNaN(r.Rate) {
+		return r, fmt.Errorf("rate must be positive, got %v", r.Rate)
+	}
+	if r.Burst < 0 {
+		return r, fmt.Errorf("burst must not be negative, got %d", r.Burst)
+	}
+	if r.Burst == 0 {
+		r.Burst = int(math.Ceil(r.Rate))
+	}
+	return r, nil
+}
+
+// Unary interceptor, it goes after authentication to see subject of token. Remaining quota is sent in trailers.
+// Унарный перехватчик, идет после аутентификации, чтобы видеть субъект токена. Остаток квоты передается в трейлерах.
+func (l *rateLimiter) unary(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	limit, ok := l.limitFor(info.FullMethod)
+	if !ok {
+		return handler(ctx, req)
+	}
+	identity := callerIdentity(ctx)
+	remaining, wait, allowed := l.take(bucketKey{identity: identity, method: info.FullMethod}, limit)
+	// Fails only without transport stream, as in tests. Ошибка только без транспортного потока, как в тестах
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(
+		"x-ratelimit-limit", strconv.Itoa(limit.Burst),
+		"x-ratelimit-remaining", strconv.Itoa(remaining),
+	))
+	if !allowed {
+		return nil, rateLimitExceeded(identity, info.FullMethod, limit, wait)
+	}
+	return handler(ctx, req)
+}
+
+func (l *rateLimiter) limitFor(method string) (rateLimit, bool) {
+	if limit, ok := l.methods[method]; ok {
+		return limit, true
+	}
+	if l.defaultLimit != nil {
+		return *l.defaultLimit, true
+	}
+	return rateLimit{}, false
+}
+
+// Takes a token from bucket, returns remaining tokens and wait for the next one if bucket is empty.
+// Берем токен из корзины, возвращаем остаток и ожидание следующего токена, если корзина пуста.
+func (l *rateLimiter) take(key bucketKey, limit rateLimit) (remaining int, wait time.Duration, allowed bool) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, limit)
+	if b.tokens < 1 {
+		return 0, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return int(b.tokens), 0, true
+}
+
+func (b *bucket) refill(now time.Time, limit rateLimit) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+		b.last = now
+	}
+}
+
+// Drops buckets that became full, so memory doesn't grow with number of clients. Called with l.mu held.
+// Удаляем заполнившиеся корзины, чтобы память не росла с числом клиентов. Вызывается под l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		limit, ok := l.limitFor(key.method)
+		if !ok {
+			delete(l.buckets, key)
+			continue
+		}
+		b.refill(now, limit)
+		if b.tokens >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Identity of caller for rate limiting. Идентификатор вызывающего для ограничения частоты
+func callerIdentity(ctx context.Context) string {
+	if claims, ok := claimsFromContext(ctx); ok && claims.Subject != "" {
+		return "sub:" + claims.Subject
+	}
+	if cert, ok := peerCertificate(ctx); ok {
+		if ids := certIdentities(cert); len(ids) > 0 {
+			return "cert:" + ids[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		return "addr:" + host
+	}
+	return "anonymous"
+}
+
+// ResourceExhausted with delay of retry and violated quota. ResourceExhausted с задержкой повтора и нарушенной квотой
+func rateLimitExceeded(identity, method string, limit rateLimit, wait time.Duration) error {
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	ds, err := st.WithDetails(
+		&epb.RetryInfo{RetryDelay: durationpb.New(wait)},
+		&epb.QuotaFailure{Violations: []*epb.QuotaFailure_Violation{{
+			Subject:     identity,
+			Description: fmt.Sprintf("limit of %g requests per second with burst %d for %s", limit.Rate, limit.Burst, method),
+		}}},
+	)
+	if err != nil {
+		return st.Err()
+	}
+	return ds.Err()
+}
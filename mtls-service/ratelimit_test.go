@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/grpc-ecosystem/go-grpc-middleware"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestRateLimiter_TokenBucket(t *testing.T) {
+	l, err := newRateLimiter(&rateLimitConfig{
+		Default: &rateLimit{Rate: 1, Burst: 2},
+		Methods: map[string]rateLimit{"addProduct": {Rate: 0.5}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	alice := peerContext(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	bob := peerContext(&x509.Certificate{Subject: pkix.Name{CommonName: "bob"}})
+	call := func(ctx context.Context, method string) error {
+		_, err := l.unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/ecommerce.ProductInfo/" + method},
+			func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+		return err
+	}
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		method string
+		want   codes.Code
+	}{
+		{"burst 1 of 2", alice, "getProduct", codes.OK},
+		{"burst 2 of 2", alice, "getProduct", codes.OK},
+		{"bucket is empty", alice, "getProduct", codes.ResourceExhausted},
+		{"other client has own bucket", bob, "getProduct", codes.OK},
+		{"other method has own bucket", alice, "listProducts", codes.OK},
+		{"method limit, burst is rounded up rate", alice, "addProduct", codes.OK},
+		{"method limit is exhausted", alice, "addProduct", codes.ResourceExhausted},
+	}
+	for _, test := range tests {
+		if err := call(test.ctx, test.method); status.Code(err) != test.want {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.want)
+		}
+	}
+
+	err = call(alice, "addProduct")
+	var retry *epb.RetryInfo
+	var quota *epb.QuotaFailure
+	for _, d := range status.Convert(err).Details() {
+		switch d := d.(type) {
+		case *epb.RetryInfo:
+			retry = d
+		case *epb.QuotaFailure:
+			quota = d
+		}
+	}
+	if retry == nil || retry.RetryDelay.AsDuration() != 2*time.Second {
+		t.Errorf("retry info: got %v", retry)
+	}
+	if quota == nil || len(quota.Violations) != 1 || quota.Violations[0].Subject != "cert:alice" {
+		t.Errorf("quota failure: got %v", quota)
+	}
+
+	// Bucket is refilled with time. Корзина наполняется со временем
+	now = now.Add(time.Second)
+	if err := call(alice, "getProduct"); err != nil {
+		t.Errorf("after refill: %v", err)
+	}
+	if err := call(alice, "getProduct"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("after refill of one token: got %v", err)
+	}
+
+	// Full buckets are dropped. Полные корзины удаляются
+	now = now.Add(rateLimitSweepInterval)
+	call(bob, "getProduct")
+	if n := len(l.buckets); n != 1 {
+		t.Errorf("got %d buckets after sweep, want 1", n)
+	}
+}
+
+func TestRateLimiter_Identity(t *testing.T) {
+	ctx := context.WithValue(peerContext(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}),
+		claimsKey{}, &tokenClaims{Subject: "apikey:0123"})
+	if id := callerIdentity(ctx); id != "sub:apikey:0123" {
+		t.Errorf("subject of token: got %q", id)
+	}
+	if id := callerIdentity(context.Background()); id != "anonymous" {
+		t.Errorf("unknown caller: got %q", id)
+	}
+}
+
+func TestRateLimiter_Config(t *testing.T) {
+	for _, cfg := range []*rateLimitConfig{
+		{Default: &rateLimit{Rate: 0}},
+		{Methods: map[string]rateLimit{"addProduct": {Rate: 1, Burst: -1}}},
+	} {
+		if _, err := newRateLimiter(cfg); err == nil {
+			t.Errorf("invalid config %+v is accepted", cfg)
+		}
+	}
+	l, err := newRateLimiter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.limitFor("/ecommerce.ProductInfo/addProduct"); ok {
+		t.Error("limiter without config has limits")
+	}
+}
+
+// Remaining quota is sent in trailers of gRPC and gRPC-Web. Остаток квоты передается в трейлерах gRPC и gRPC-Web
+func TestRateLimiter_Trailers(t *testing.T) {
+	l, err := newRateLimiter(&rateLimitConfig{Methods: map[string]rateLimit{"listProducts": {Rate: 1, Burst: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := bufconn.Listen(bufSize)
+	s := grpc.NewServer(grpc.UnaryInterceptor(l.unary))
+	pb.RegisterProductInfoServer(s, &server{})
+	go s.Serve(lis)
+	defer s.Stop()
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.Dial()
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := pb.NewProductInfoClient(conn)
+
+	for _, want := range []string{"1", "0", "0"} {
+		var trailer metadata.MD
+		_, err := c.ListProducts(context.Background(), &pb.ListProductsRequest{}, grpc.Trailer(&trailer))
+		if got := trailer.Get("x-ratelimit-remaining"); len(got) != 1 || got[0] != want {
+			t.Errorf("remaining: got %v, want %s (%v)", got, want, err)
+		}
+		if got := trailer.Get("x-ratelimit-limit"); len(got) != 1 || got[0] != "2" {
+			t.Errorf("limit: got %v", got)
+		}
+	}
+
+	web := newGRPCWebHandler(grpc_middleware.ChainUnaryServer(
+		grpc.UnaryServerInterceptor((&authenticator{}).ensureValidToken),
+		grpc.UnaryServerInterceptor(l.unary),
+	), nil)
+	pb.RegisterProductInfoServer(web, &server{})
+	ts := httptest.NewServer(web)
+	defer ts.Close()
+	_, trailers := callGRPCWeb(t, ts.URL+"/ecommerce.ProductInfo/listProducts", "application/grpc-web+proto", testToken, &pb.ListProductsRequest{})
+	if !strings.Contains(trailers, "x-ratelimit-remaining: 1\r\n") || !strings.Contains(trailers, "grpc-status: 0\r\n") {
+		t.Errorf("gRPC-Web trailers: %q", trailers)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Full-text search over name and description of products. Words are lowercased, stemmed by language of
+// their script and looked up in inverted index, products are ranked by BM25 with name weighing more.
+// Полнотекстовый поиск по названию и описанию товаров. Слова приводятся к нижнему регистру и к основе
+// по языку их алфавита и ищутся в инвертированном индексе, товары ранжируются по BM25, название весит больше.
+
+const (
+	maxQueryLength = 1024
+	// Term of name weighs as much as three terms of description. Слово названия весит как три слова описания
+	nameWeight = 3
+	// Parameters of BM25. Параметры BM25
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Words too common to search. Слишком частые для поиска слова
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"for": true, "from": true, "in": true, "is": true, "it": true, "of": true, "on": true, "or": true,
+	"the": true, "this": true, "to": true, "with": true,
+	"а": true, "в": true, "во": true, "и": true, "из": true, "к": true, "на": true, "не": true,
+	"о": true, "от": true, "по": true, "с": true, "со": true, "это": true, "для": true,
+}
+
+// Word of text: stemmed term and its position in characters. Слово текста: основа и его позиция в символах
+type textToken struct {
+	term       string
+	start, end int
+}
+
+// Splits text into words of letters and digits, stop words are dropped.
+// Разбиваем текст на слова из букв и цифр, частые слова отбрасываются.
+func analyze(text string) []textToken {
+	var tokens []textToken
+	var word []rune
+	start := 0
+	flush := func(end int) {
+		if len(word) > 0 {
+			if w := strings.ReplaceAll(string(word), "ё", "е"); !stopWords[w] {
+				tokens = append(tokens, textToken{term: stem(w), start: start, end: end})
+			}
+			word = word[:0]
+		}
+	}
+	i := 0
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if len(word) == 0 {
+				start = i
+			}
+			word = append(word, unicode.ToLower(r))
+		} else {
+			flush(i)
+		}
+		i++
+	}
+	flush(i)
+	return tokens
+}
+
+// Stems word by its script, words of mixed scripts or with digits like "s9999" are kept.
+// Приводим слово к основе по его алфавиту, слова смешанных алфавитов или с цифрами, как "s9999", сохраняются.
+func stem(w string) string {
+	latin, cyrillic := true, true
+	for _, r := range w {
+		latin = latin && r >= 'a' && r <= 'z'
+		cyrillic = cyrillic && unicode.Is(unicode.Cyrillic, r)
+	}
+	switch {
+	case latin:
+		return stemEnglish(w)
+	case cyrillic:
+		return stemRussian(w)
+	}
+	return w
+}
+
+// Frequency of term in fields of product. Частота слова в полях товара
+type termFrequency struct{ name, description int }
+
+// Weighted frequency and length for BM25. Взвешенные частота и длина для BM25
+func (f termFrequency) weighted() float64 { return float64(nameWeight*f.name + f.description) }
+
+// Inverted index of products, zero value is ready to use. Calls are guarded by server.mu as store.
+// Инвертированный индекс товаров, нулевое значение готово к работе. Вызовы защищены server.mu, как и хранилище.
+type searchIndex struct {
+	postings map[string]map[string]termFrequency
+	// Terms and lengths of indexed products. Слова и длины проиндексированных товаров
+	docs map[string]indexedProduct
+	// Sum of weighted lengths. Сумма взвешенных длин
+	length float64
+	// Changed by each change of indexed products, as it changes scores. Меняется при каждом изменении товаров, как и баллы
+	revision uint64
+}
+
+type indexedProduct struct {
+	terms  []string
+	length float64
+}
+
+// Indexes product replacing its previous version. Индексируем товар, заменяя его предыдущую версию
+func (x *searchIndex) put(p *pb.Product) {
+	x.delete(p.Id)
+	if x.postings == nil {
+		x.postings = make(map[string]map[string]termFrequency)
+		x.docs = make(map[string]indexedProduct)
+	}
+	freq := make(map[string]termFrequency)
+	var size termFrequency
+	for _, t := range analyze(p.Name) {
+		f := freq[t.term]
+		f.name++
+		freq[t.term] = f
+		size.name++
+	}
+	for _, t := range analyze(p.Description) {
+		f := freq[t.term]
+		f.description++
+		freq[t.term] = f
+		size.description++
+	}
+	doc := indexedProduct{length: size.weighted()}
+	for term, f := range freq {
+		if x.postings[term] == nil {
+			x.postings[term] = make(map[string]termFrequency)
+		}
+		x.postings[term][p.Id] = f
+		doc.terms = append(doc.terms, term)
+	}
+	x.docs[p.Id] = doc
+	x.length += doc.length
+	x.revision++
+}
+
+func (x *searchIndex) delete(id string) {
+	doc, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(x.postings[term], id)
+		if len(x.postings[term]) == 0 {
+			delete(x.postings, term)
+		}
+	}
+	delete(x.docs, id)
+	x.length -= doc.length
+	x.revision++
+}
+
+// Found product. Найденный товар
+type searchHit struct {
+	id    string
+	score float64
+}
+
+// Ranks products having any of terms, the best first. Ранжируем товары с любым из слов, лучшие первыми
+func (x *searchIndex) search(terms []string) ([]searchHit, uint64) {
+	if len(x.docs) == 0 {
+		return nil, x.revision
+	}
+	n := float64(len(x.docs))
+	avg := x.length / n
+	scores := make(map[string]float64)
+	for _, term := range terms {
+		postings := x.postings[term]
+		df := float64(len(postings))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id, f := range postings {
+			tf := f.weighted()
+			norm := 1 - bm25B
+			if avg > 0 {
+				norm += bm25B * x.docs[id].length / avg
+			}
+			scores[id] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+	hits := make([]searchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, searchHit{id: id, score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].before(hits[j]) })
+	return hits, x.revision
+}
+
+// Order of results: higher score first, ID breaks ties. Порядок результатов: сначала больший балл, ID различает равные
+func (h searchHit) before(o searchHit) bool {
+	if h.score != o.score {
+		return h.score > o.score
+	}
+	return h.id < o.id
+}
+
+// Spans of words of text matching terms. Диапазоны слов текста, совпавших со словами запроса
+func highlight(text string, terms map[string]bool) []*pb.TextSpan {
+	var spans []*pb.TextSpan
+	for _, t := range analyze(text) {
+		if terms[t.term] {
+			spans = append(spans, &pb.TextSpan{Start: int32(t.start), End: int32(t.end)})
+		}
+	}
+	return spans
+}
+
+// Content of search page token. Score of the last result is valid only at revision of index, so the token
+// is rejected after products are changed.
+// Содержимое токена страницы поиска. Балл последнего результата действителен только при ревизии индекса,
+// поэтому токен отклоняется после изменения товаров.
+type searchCursor struct {
+	Query    string  `json:"q"`
+	Filter   string  `json:"f,omitempty"`
+	ID       string  `json:"i"`
+	Score    float64 `json:"s"`
+	Revision uint64  `json:"r"`
+}
+
+// InvalidArgument for search request. InvalidArgument для запроса поиска
+func invalidSearchRequest(violations []*epb.BadRequest_FieldViolation) error {
+	st := status.New(codes.InvalidArgument, "Invalid search request received")
+	if ds, err := st.WithDetails(&epb.BadRequest{FieldViolations: violations}); err == nil {
+		st = ds
+	}
+	return st.Err()
+}
+
+// Method of full-text search. Метод полнотекстового поиска SearchProducts
+func (s *server) SearchProducts(ctx context.Context, in *pb.SearchProductsRequest) (*pb.SearchProductsResponse, error) {
+	var violations []*epb.BadRequest_FieldViolation
+	terms := analyze(in.Query)
+	switch {
+	case len(in.Query) > maxQueryLength:
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "query", Description: "query is longer than 1024 bytes"})
+	case strings.TrimSpace(in.Query) == "":
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "query", Description: "query must not be empty"})
+	}
+	if in.PageSize < 0 {
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "page_size", Description: "page_size must not be negative"})
+	}
+	filter, err := parseFilter(in.Filter)
+	if err != nil {
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "filter", Description: err.Error()})
+	}
+	var after *searchCursor
+	if in.PageToken != "" && len(violations) == 0 {
+		c := &searchCursor{}
+		if err := s.pages.open(in.PageToken, c); err != nil {
+			violations = append(violations, &epb.BadRequest_FieldViolation{Field: "page_token", Description: err.Error()})
+		} else if c.Query != in.Query || c.Filter != in.Filter {
+			violations = append(violations, &epb.BadRequest_FieldViolation{Field: "page_token", Description: "query and filter must match the request of page_token"})
+		} else {
+			after = c
+		}
+	}
+	if len(violations) > 0 {
+		return nil, invalidSearchRequest(violations)
+	}
+
+	matched := make(map[string]bool)
+	var queryTerms []string
+	for _, t := range terms {
+		if !matched[t.term] {
+			matched[t.term] = true
+			queryTerms = append(queryTerms, t.term)
+		}
+	}
+	limit := pageLimit(in.PageSize)
+	out := &pb.SearchProductsResponse{}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hits, revision := s.products().search(queryTerms)
+	if after != nil && after.Revision != revision {
+		return nil, invalidSearchRequest([]*epb.BadRequest_FieldViolation{{Field: "page_token",
+			Description: "products are changed since page_token was issued, the search must be started again"}})
+	}
+	for _, h := range hits {
+		p, ok := s.products().get(h.id)
+		if !ok || (filter != nil && !filter.match(p)) {
+			continue
+		}
+		out.TotalSize++
+		if (after != nil && !(searchHit{id: after.ID, score: after.Score}).before(h)) || len(out.Results) > limit {
+			continue
+		}
+		r := &pb.SearchResult{Product: p, Score: h.score}
+		for _, f := range []struct{ name, text string }{{"name", p.Name}, {"description", p.Description}} {
+			if spans := highlight(f.text, matched); len(spans) > 0 {
+				r.Highlights = append(r.Highlights, &pb.Highlight{Field: f.name, Spans: spans})
+			}
+		}
+		out.Results = append(out.Results, r)
+	}
+	// One more result tells if there is the next page. Лишний результат показывает, есть ли следующая страница
+	if len(out.Results) > limit {
+		out.Results = out.Results[:limit]
+		last := out.Results[limit-1]
+		if out.NextPageToken, err = s.pages.seal(&searchCursor{
+			Query: in.Query, Filter: in.Filter, ID: last.Product.Id, Score: last.Score, Revision: revision,
+		}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to encode page token: %v", err)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Names of found products in order. Названия найденных товаров по порядку
+func searchNames(t *testing.T, srv *server, query string) []string {
+	t.Helper()
+	out, err := srv.SearchProducts(context.Background(), &pb.SearchProductsRequest{Query: query})
+	if err != nil {
+		t.Fatalf("search %q: %v", query, err)
+	}
+	names := []string{}
+	for _, r := range out.Results {
+		names = append(names, r.Product.Name)
+	}
+	return names
+}
+
+func TestSearchProducts(t *testing.T) {
+	ctx := context.Background()
+	srv := &server{}
+	var ids []string
+	for _, p := range []*pb.Product{
+		{Name: "Samsung Galaxy S9999", Description: "Samsung Galaxy S9999 is the latest smart phone", Price: 900},
+		{Name: "Apple iPhone", Description: "Smart phones by Apple", Price: 1000},
+		{Name: "Phone case", Description: "Case for Samsung phones", Price: 10},
+		{Name: "Смартфон Xiaomi", Description: "Новейшие смартфоны с быстрой зарядкой", Price: 300},
+	} {
+		id, err := srv.AddProduct(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id.Value)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		// Match of name ranks higher. Совпадение в названии ранжируется выше
+		{"phone", []string{"Phone case", "Apple iPhone", "Samsung Galaxy S9999"}},
+		{"S9999", []string{"Samsung Galaxy S9999"}},
+		{"galaxies", []string{"Samsung Galaxy S9999"}},
+		{"смартфоны", []string{"Смартфон Xiaomi"}},
+		{"быстрая зарядка", []string{"Смартфон Xiaomi"}},
+		{"the", []string{}},
+		{"tablet", []string{}},
+	} {
+		if got := searchNames(t, srv, tc.query); len(got) != len(tc.want) || (len(got) > 0 && got[0] != tc.want[0]) {
+			t.Errorf("search %q: got %q, want %q", tc.query, got, tc.want)
+		}
+	}
+
+	out, err := srv.SearchProducts(ctx, &pb.SearchProductsRequest{Query: "Смартфоны"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := out.Results[0].Highlights
+	if len(h) != 2 || h[0].Field != "name" || h[0].Spans[0].Start != 0 || h[0].Spans[0].End != 8 ||
+		h[1].Field != "description" || h[1].Spans[0].Start != 9 || h[1].Spans[0].End != 18 {
+		t.Errorf("highlights %v", h)
+	}
+
+	// Index follows updates and deletes. Индекс следует за обновлениями и удалениями
+	if _, err := srv.UpdateProduct(ctx, &pb.Product{Id: ids[0], Name: "Samsung Tab", Description: "Tablet", Price: 500}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.DeleteProduct(ctx, &pb.ProductID{Value: ids[2]}); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchNames(t, srv, "galaxy"); len(got) != 0 {
+		t.Errorf("galaxy after update: %q", got)
+	}
+	if got := searchNames(t, srv, "tablets"); len(got) != 1 || got[0] != "Samsung Tab" {
+		t.Errorf("tablets after update: %q", got)
+	}
+	if got := searchNames(t, srv, "case phone"); len(got) != 1 || got[0] != "Apple iPhone" {
+		t.Errorf("case phone after delete: %q", got)
+	}
+}
+
+func TestSearchProducts_Pages(t *testing.T) {
+	srv := &server{}
+	addTestProducts(srv,
+		&pb.Product{Name: "Phone", Price: 100},
+		&pb.Product{Name: "Smart phone", Price: 200},
+		&pb.Product{Name: "Phone case", Description: "Case for phone", Price: 10},
+		&pb.Product{Name: "Tablet", Price: 300},
+	)
+
+	var names []string
+	in := &pb.SearchProductsRequest{Query: "phones", PageSize: 1, Filter: "price >= 100"}
+	for pages := 1; ; pages++ {
+		out, err := srv.SearchProducts(context.Background(), in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.TotalSize != 2 || len(out.Results) != 1 {
+			t.Fatalf("page %d: %v", pages, out)
+		}
+		names = append(names, out.Results[0].Product.Name)
+		if out.NextPageToken == "" {
+			break
+		}
+		if pages == 2 {
+			t.Fatal("more than 2 pages")
+		}
+		in.PageToken = out.NextPageToken
+	}
+	if len(names) != 2 || names[0] != "Phone" || names[1] != "Smart phone" {
+		t.Errorf("pages: %q", names)
+	}
+
+	// Token is stale after products are changed, as scores change. Токен устаревает после изменения товаров, как и баллы
+	first, err := srv.SearchProducts(context.Background(), &pb.SearchProductsRequest{Query: "phones", PageSize: 1})
+	if err != nil || first.NextPageToken == "" {
+		t.Fatalf("first page: %v, %v", first, err)
+	}
+	addTestProducts(srv, &pb.Product{Name: "Phone phone phone", Price: 50})
+	_, err = srv.SearchProducts(context.Background(), &pb.SearchProductsRequest{Query: "phones", PageSize: 1, PageToken: first.NextPageToken})
+	if d := status.Convert(err).Details(); status.Code(err) != codes.InvalidArgument || len(d) != 1 ||
+		d[0].(*epb.BadRequest).FieldViolations[0].Field != "page_token" {
+		t.Errorf("stale page token: got %v", err)
+	}
+
+	for _, tc := range []struct {
+		in    *pb.SearchProductsRequest
+		field string
+	}{
+		{&pb.SearchProductsRequest{Query: " "}, "query"},
+		{&pb.SearchProductsRequest{Query: "phone", PageSize: -1}, "page_size"},
+		{&pb.SearchProductsRequest{Query: "phone", Filter: "price <"}, "filter"},
+		{&pb.SearchProductsRequest{Query: "phone", PageToken: "bm90IGEgdG9rZW4"}, "page_token"},
+		// Token belongs to other query. Токен относится к другому запросу
+		{&pb.SearchProductsRequest{Query: "tablet", Filter: "price >= 100", PageToken: in.PageToken}, "page_token"},
+	} {
+		_, err := srv.SearchProducts(context.Background(), tc.in)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: got %v, want InvalidArgument", tc.in, err)
+			continue
+		}
+		d := status.Convert(err).Details()
+		if br, ok := d[0].(*epb.BadRequest); !ok || br.FieldViolations[0].Field != tc.field {
+			t.Errorf("%v: details %v, want violation of %s", tc.in, d, tc.field)
+		}
+	}
+}
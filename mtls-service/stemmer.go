@@ -0,0 +1,269 @@
+package main
+
+import "strings"
+
+// Stemmers reduce forms of word to common stem, so "phones" finds "phone" and "телефоны" finds "телефон".
+// English is the Porter algorithm, Russian is the Snowball algorithm, both take lowercase word.
+// Стеммеры приводят формы слова к общей основе, поэтому "phones" находит "phone", а "телефоны" - "телефон".
+// Для английского используется алгоритм Портера, для русского - алгоритм Snowball, оба принимают слово в нижнем регистре.
+
+// Checks that letter at i is consonant, y after consonant is vowel. Проверяет, что буква согласная, y после согласной - гласная
+func isConsonant(w string, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(w, i-1)
+	}
+	return true
+}
+
+// Measure m of word [C](VC)^m[V]. Мера m слова [C](VC)^m[V]
+func measure(w string) int {
+	n, i := 0, 0
+	for i < len(w) && isConsonant(w, i) {
+		i++
+	}
+	for i < len(w) {
+		for i < len(w) && !isConsonant(w, i) {
+			i++
+		}
+		if i == len(w) {
+			break
+		}
+		for i < len(w) && isConsonant(w, i) {
+			i++
+		}
+		n++
+	}
+	return n
+}
+
+func hasVowel(w string) bool {
+	for i := range w {
+		if !isConsonant(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func endsDoubleConsonant(w string) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && isConsonant(w, n-1)
+}
+
+// Ends with consonant-vowel-consonant, the last is not w, x or y. Оканчивается на согласную-гласную-согласную
+func endsCVC(w string) bool {
+	n := len(w)
+	return n >= 3 && isConsonant(w, n-3) && !isConsonant(w, n-2) && isConsonant(w, n-1) && !strings.ContainsRune("wxy", rune(w[n-1]))
+}
+
+type suffixRule struct{ suffix, replacement string }
+
+// Longer suffixes go first, only the first matching suffix is tried. Длинные суффиксы идут первыми
+var (
+	porterStep2 = []suffixRule{
+		{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"}, {"izer", "ize"},
+		{"bli", "ble"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"},
+		{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"},
+		{"fulness", "ful"}, {"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"}, {"logi", "log"},
+	}
+	porterStep3 = []suffixRule{
+		{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"}, {"ical", "ic"}, {"ful", ""}, {"ness", ""},
+	}
+	porterStep4 = []string{
+		"ement", "ment", "ent", "ance", "ence", "able", "ible", "ant", "al", "er", "ic",
+		"ism", "ate", "iti", "ous", "ive", "ize", "ion", "ou",
+	}
+)
+
+// Replaces the first matching suffix if measure of stem is above min. Заменяем первый совпавший суффикс
+func replaceSuffix(w string, rules []suffixRule, min int) string {
+	for _, r := range rules {
+		if strings.HasSuffix(w, r.suffix) {
+			if stem := w[:len(w)-len(r.suffix)]; measure(stem) > min {
+				return stem + r.replacement
+			}
+			return w
+		}
+	}
+	return w
+}
+
+// Stem of English word, words with other than ASCII letters are not changed.
+// Основа английского слова, слова не только из латинских букв не меняются.
+func stemEnglish(w string) string {
+	if len(w) <= 2 {
+		return w
+	}
+	for i := 0; i < len(w); i++ {
+		if w[i] < 'a' || w[i] > 'z' {
+			return w
+		}
+	}
+
+	// Step 1a, plurals. Шаг 1a, множественное число
+	switch {
+	case strings.HasSuffix(w, "sses"), strings.HasSuffix(w, "ies"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ss"):
+	case strings.HasSuffix(w, "s"):
+		w = w[:len(w)-1]
+	}
+
+	// Step 1b, -ed and -ing. Шаг 1b, -ed и -ing
+	if strings.HasSuffix(w, "eed") {
+		if measure(w[:len(w)-3]) > 0 {
+			w = w[:len(w)-1]
+		}
+	} else {
+		stem := ""
+		if strings.HasSuffix(w, "ed") {
+			stem = w[:len(w)-2]
+		} else if strings.HasSuffix(w, "ing") {
+			stem = w[:len(w)-3]
+		}
+		if stem != "" && hasVowel(stem) {
+			w = stem
+			switch {
+			case strings.HasSuffix(w, "at"), strings.HasSuffix(w, "bl"), strings.HasSuffix(w, "iz"):
+				w += "e"
+			case endsDoubleConsonant(w) && !strings.ContainsRune("lsz", rune(w[len(w)-1])):
+				w = w[:len(w)-1]
+			case measure(w) == 1 && endsCVC(w):
+				w += "e"
+			}
+		}
+	}
+
+	// Step 1c, y to i. Шаг 1c, y в i
+	if strings.HasSuffix(w, "y") && hasVowel(w[:len(w)-1]) {
+		w = w[:len(w)-1] + "i"
+	}
+
+	w = replaceSuffix(w, porterStep2, 0)
+	w = replaceSuffix(w, porterStep3, 0)
+
+	// Step 4, suffixes of long stems. Шаг 4, суффиксы длинных основ
+	for _, suffix := range porterStep4 {
+		if strings.HasSuffix(w, suffix) {
+			stem := w[:len(w)-len(suffix)]
+			if measure(stem) > 1 && (suffix != "ion" || strings.HasSuffix(stem, "s") || strings.HasSuffix(stem, "t")) {
+				w = stem
+			}
+			break
+		}
+	}
+
+	// Step 5, final e and ll. Шаг 5, конечные e и ll
+	if strings.HasSuffix(w, "e") {
+		stem := w[:len(w)-1]
+		if m := measure(stem); m > 1 || (m == 1 && !endsCVC(stem)) {
+			w = stem
+		}
+	}
+	if measure(w) > 1 && endsDoubleConsonant(w) && strings.HasSuffix(w, "l") {
+		w = w[:len(w)-1]
+	}
+	return w
+}
+
+// Endings of Snowball Russian stemmer, endings of the first groups must follow а or я.
+// Окончания русского стеммера Snowball, окончания первых групп должны следовать за а или я.
+var (
+	ruGerund1     = []string{"в", "вши", "вшись"}
+	ruGerund2     = []string{"ив", "ивши", "ившись", "ыв", "ывши", "ывшись"}
+	ruReflexive   = []string{"ся", "сь"}
+	ruAdjective   = []string{"ее", "ие", "ые", "ое", "ими", "ыми", "ей", "ий", "ый", "ой", "ем", "им", "ым", "ом", "его", "ого", "ему", "ому", "их", "ых", "ую", "юю", "ая", "яя", "ою", "ею"}
+	ruParticiple1 = []string{"ем", "нн", "вш", "ющ", "щ"}
+	ruParticiple2 = []string{"ивш", "ывш", "ующ"}
+	ruVerb1       = []string{"ла", "на", "ете", "йте", "ли", "й", "л", "ем", "н", "ло", "но", "ет", "ют", "ны", "ть", "ешь", "нно"}
+	ruVerb2       = []string{"ила", "ыла", "ена", "ейте", "уйте", "ите", "или", "ыли", "ей", "уй", "ил", "ыл", "им", "ым", "ен", "ило", "ыло", "ено", "ят", "ует", "уют", "ит", "ыт", "ены", "ить", "ыть", "ишь", "ую", "ю"}
+	ruNoun        = []string{"а", "ев", "ов", "ие", "ье", "е", "иями", "ями", "ами", "еи", "ии", "и", "ией", "ей", "ой", "ий", "й", "иям", "ям", "ием", "ем", "ам", "ом", "о", "у", "ах", "иях", "ях", "ы", "ь", "ию", "ью", "ю", "ия", "ья", "я"}
+	ruDerivation  = []string{"ост", "ость"}
+	ruSuperlative = []string{"ейш", "ейше"}
+)
+
+func isRussianVowel(r rune) bool { return strings.ContainsRune("аеиоуыэюя", r) }
+
+// Length of the longest ending of w within region from start, 0 if none.
+// Endings of group1 must follow а or я within region.
+// Длина самого длинного окончания w в области от start, 0, если его нет.
+// Окончания group1 должны следовать за а или я в области.
+func russianEnding(w []rune, start int, group1, group2 []string) int {
+	best := 0
+	try := func(endings []string, preceded bool) {
+		for _, e := range endings {
+			n := len([]rune(e))
+			i := len(w) - n
+			if n <= best || i < start || string(w[i:]) != e {
+				continue
+			}
+			if preceded && (i-1 < start || (w[i-1] != 'а' && w[i-1] != 'я')) {
+				continue
+			}
+			best = n
+		}
+	}
+	try(group1, true)
+	try(group2, false)
+	return best
+}
+
+// Stem of Russian word in lowercase. Основа русского слова в нижнем регистре
+func stemRussian(word string) string {
+	w := []rune(strings.ReplaceAll(word, "ё", "е"))
+	// RV is region after the first vowel, R2 is region after the second vowel-consonant pair.
+	// RV - область после первой гласной, R2 - область после второй пары гласная-согласная.
+	rv, r1, r2 := len(w), len(w), len(w)
+	for i, r := range w {
+		if isRussianVowel(r) {
+			rv = i + 1
+			break
+		}
+	}
+	for i := rv; i < len(w); i++ {
+		if !isRussianVowel(w[i]) {
+			r1 = i + 1
+			break
+		}
+	}
+	for i := r1 + 1; i < len(w); i++ {
+		if isRussianVowel(w[i-1]) && !isRussianVowel(w[i]) {
+			r2 = i + 1
+			break
+		}
+	}
+	cut := func(n int) { w = w[:len(w)-n] }
+
+	// Step 1, inflections. Шаг 1, окончания
+	if n := russianEnding(w, rv, ruGerund1, ruGerund2); n > 0 {
+		cut(n)
+	} else {
+		cut(russianEnding(w, rv, nil, ruReflexive))
+		if n := russianEnding(w, rv, nil, ruAdjective); n > 0 {
+			cut(n)
+			cut(russianEnding(w, rv, ruParticiple1, ruParticiple2))
+		} else if n := russianEnding(w, rv, ruVerb1, ruVerb2); n > 0 {
+			cut(n)
+		} else {
+			cut(russianEnding(w, rv, nil, ruNoun))
+		}
+	}
+	// Step 2, final и. Шаг 2, конечная и
+	cut(russianEnding(w, rv, nil, []string{"и"}))
+	// Step 3, derivational suffix. Шаг 3, словообразующий суффикс
+	cut(russianEnding(w, r2, nil, ruDerivation))
+	// Step 4, superlative, double н and soft sign. Шаг 4, превосходная степень, двойная н и мягкий знак
+	if n := russianEnding(w, rv, nil, ruSuperlative); n > 0 {
+		cut(n)
+	}
+	switch {
+	case russianEnding(w, rv, nil, []string{"нн"}) > 0:
+		cut(1)
+	case russianEnding(w, rv, nil, []string{"ь"}) > 0:
+		cut(1)
+	}
+	return string(w)
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestStem(t *testing.T) {
+	for word, want := range map[string]string{
+		"phones":          "phone",
+		"running":         "run",
+		"hoping":          "hope",
+		"connection":      "connect",
+		"generalizations": "gener",
+		"galaxies":        "galaxi",
+		"galaxy":          "galaxi",
+		"relational":      "relat",
+		"s9999":           "s9999",
+		"телефонов":       "телефон",
+		"смартфоном":      "смартфон",
+		"новейший":        "нов",
+		"флагманские":     "флагманск",
+		"быстрая":         "быстр",
+		"красивость":      "красив",
+		"ёлки":            "елк",
+		"iphoneы":         "iphoneы",
+	} {
+		if got := stem(word); got != want {
+			t.Errorf("stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/blablatov/stream-mtls-grpc/productinfo/money"
+)
+
+// Storage of products. Calls are guarded by server.mu, so implementations need no locking.
+// Хранилище товаров. Вызовы защищены server.mu, поэтому реализациям не нужна блокировка.
+type productStore interface {
+	get(id string) (*pb.Product, bool)
+	// Adds or replaces product with the same ID. Добавляет или заменяет товар с тем же ID
+	put(p *pb.Product)
+	delete(id string) (*pb.Product, bool)
+	// Returns page of matching products in order after cursor and number of all matching products.
+	// Возвращает страницу подходящих товаров по порядку после курсора и количество всех подходящих товаров.
+	list(q listQuery) ([]*pb.Product, int)
+	// Returns products having any of stemmed terms, the most relevant first, and revision of index,
+	// scores are comparable only at the same revision.
+	// Возвращает товары с любым из приведенных к основе слов, самые релевантные первыми, и ревизию индекса,
+	// баллы сравнимы только при одной ревизии.
+	search(terms []string) ([]searchHit, uint64)
+}
+
+// Query of products page. Запрос страницы товаров
+type listQuery struct {
+	// Products matching filter, all if nil. Товары, подходящие под фильтр, все, если nil
+	filter filterExpr
+	order  []orderField
+	// The last product of previous page, nil for the first page. Последний товар предыдущей страницы
+	after *pb.Product
+	limit int
+}
+
+// Field of order_by. Поле order_by
+type orderField struct {
+	name string
+	desc bool
+}
+
+// Compares products by order, ID breaks ties. Сравниваем товары по порядку, ID различает равные
+func compareProducts(a, b *pb.Product, order []orderField) int {
+	for _, f := range order {
+		var c int
+		switch f.name {
+		case "name":
+			c = strings.Compare(a.Name, b.Name)
+		case "price":
+			pa, pb := priceOf(a), priceOf(b)
+			if c = money.CompareAmount(pa, pb); c == 0 {
+				c = strings.Compare(pa.CurrencyCode, pb.CurrencyCode)
+			}
+		case "create_time":
+			c = compareInt(a.CreateTime.AsTime().UnixNano(), b.CreateTime.AsTime().UnixNano())
+		}
+		if f.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a.Id, b.Id)
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Products in memory, zero value is ready to use. Товары в памяти, нулевое значение готово к работе
+type memoryStore struct {
+	products map[string]*pb.Product
+	// Kept in sync by put and delete. Синхронизируется в put и delete
+	index searchIndex
+}
+
+func (m *memoryStore) get(id string) (*pb.Product, bool) {
+	p, ok := m.products[id]
+	return p, ok
+}
+
+func (m *memoryStore) put(p *pb.Product) {
+	if m.products == nil {
+		m.products = make(map[string]*pb.Product)
+	}
+	m.products[p.Id] = p
+	m.index.put(p)
+}
+
+func (m *memoryStore) delete(id string) (*pb.Product, bool) {
+	p, ok := m.products[id]
+	delete(m.products, id)
+	m.index.delete(id)
+	return p, ok
+}
+
+func (m *memoryStore) list(q listQuery) ([]*pb.Product, int) {
+	page := make([]*pb.Product, 0, len(m.products))
+	total := 0
+	for _, p := range m.products {
+		if q.filter != nil && !q.filter.match(p) {
+			continue
+		}
+		total++
+		if q.after == nil || compareProducts(p, q.after, q.order) > 0 {
+			page = append(page, p)
+		}
+	}
+	sort.Slice(page, func(i, j int) bool { return compareProducts(page[i], page[j], q.order) < 0 })
+	if q.limit > 0 && len(page) > q.limit {
+		page = page[:q.limit]
+	}
+	return page, total
+}
+
+func (m *memoryStore) search(terms []string) ([]searchHit, uint64) {
+	return m.index.search(terms)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Number of events kept for watch if not set by config. Количество хранимых событий, если не задано конфигурацией
+const defaultWatchHistory = 1000
+
+// Start revision of watch of only new changes. Начальная ревизия наблюдения только новых изменений
+const currentRevision = -1
+
+// Log of product changes in commit order, the oldest events are compacted above history.
+// Changes are appended under server.mu, so revisions follow order of commits.
+// Журнал изменений товаров в порядке фиксации, самые старые события удаляются сверх history.
+// Изменения добавляются под server.mu, поэтому ревизии следуют порядку фиксации.
+type changeFeed struct {
+	history int
+
+	mu       sync.Mutex
+	revision int64
+	events   []*pb.ProductEvent // Events up to revision. События до revision
+	changed  chan struct{}      // Closed by the next change. Закрывается следующим изменением
+}
+
+func (f *changeFeed) append(t pb.ProductEvent_Type, product *pb.Product) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revision++
+	f.events = append(f.events, &pb.ProductEvent{
+		Type:       t,
+		Revision:   f.revision,
+		Product:    product,
+		CommitTime: timestamppb.New(time.Now()),
+	})
+	history := f.history
+	if history <= 0 {
+		history = defaultWatchHistory
+	}
+	if len(f.events) > history {
+		f.events = append(f.events[:0:0], f.events[len(f.events)-history:]...)
+	}
+	if f.changed != nil {
+		close(f.changed)
+		f.changed = nil
+	}
+}
+
+func (f *changeFeed) current() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.revision
+}
+
+// Returns revision before the first kept event. Возвращаем ревизию перед первым хранимым событием
+func (f *changeFeed) compacted() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.revision - int64(len(f.events))
+}
+
+// Returns events after revision, or channel closed by the next change if there are no events.
+// Возвращаем события после ревизии или канал, закрываемый следующим изменением, если событий нет.
+func (f *changeFeed) since(revision int64) ([]*pb.ProductEvent, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if revision < 0 || revision > f.revision {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "revision %d is out of 0 to %d", revision, f.revision)
+	}
+	// Revision before the first kept event. Ревизия перед первым хранимым событием
+	compacted := f.revision - int64(len(f.events))
+	if revision < compacted {
+		return nil, nil, revisionCompacted(revision, compacted)
+	}
+	if revision == f.revision {
+		if f.changed == nil {
+			f.changed = make(chan struct{})
+		}
+		return nil, f.changed, nil
+	}
+	return f.events[revision-compacted:], nil, nil
+}
+
+// OutOfRange for compacted revision, the watch must be restarted from a new list of products.
+// OutOfRange для удаленной ревизии, наблюдение нужно начать заново с нового списка товаров.
+func revisionCompacted(revision, compacted int64) error {
+	st := status.Newf(codes.OutOfRange, "revision %d is compacted, the oldest available is %d", revision, compacted)
+	ds, err := st.WithDetails(&epb.ErrorInfo{
+		Reason:   "REVISION_COMPACTED",
+		Domain:   pb.ProductInfo_ServiceDesc.ServiceName,
+		Metadata: map[string]string{"compact_revision": strconv.FormatInt(compacted, 10)},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return ds.Err()
+}
+
+// Method watch of products. Метод сервера WatchProducts, наблюдение за товарами
+func (s *server) WatchProducts(in *pb.WatchRequest, stream pb.ProductInfo_WatchProductsServer) error {
+	cursor := in.StartRevision
+	if cursor == currentRevision {
+		cursor = s.feed.current()
+	}
+	// Headers tell client that changes after cursor are watched. Заголовки сообщают клиенту, что изменения наблюдаются
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		events, changed, err := s.feed.since(cursor)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+			cursor = e.Revision
+		}
+		if changed == nil {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Starts server of products with watch, stream token is checked. Запускаем сервер товаров с наблюдением
+func newWatchClient(t *testing.T, srv *server) pb.ProductInfoClient {
+	lis := bufconn.Listen(bufSize)
+	s := grpc.NewServer(grpc.StreamInterceptor((&authenticator{}).stream))
+	pb.RegisterProductInfoServer(s, srv)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(getBufDialer(lis)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewProductInfoClient(conn)
+}
+
+func watchContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return metadata.AppendToOutgoingContext(ctx, "authorization", testToken)
+}
+
+func TestWatchProducts(t *testing.T) {
+	srv := &server{}
+	c := newWatchClient(t, srv)
+	ctx := watchContext(t)
+
+	id, err := c.AddProduct(ctx, &pb.Product{Name: "Sumsung S10", Price: 700})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := c.ListProducts(ctx, &pb.ListProductsRequest{})
+	if err != nil || list.Revision != 1 {
+		t.Fatalf("revision of list: %v, %v", list, err)
+	}
+
+	// Watch from revision of list gets later changes in order. Наблюдение с ревизии списка получает изменения по порядку
+	stream, err := c.WatchProducts(ctx, &pb.WatchRequest{StartRevision: list.Revision})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c.UpdateProduct(ctx, &pb.Product{Id: id.Value, Name: "Sumsung S10+", Price: 800})
+		c.DeleteProduct(ctx, id)
+	}()
+	want := []pb.ProductEvent_Type{pb.ProductEvent_UPDATED, pb.ProductEvent_DELETED}
+	for i, typ := range want {
+		e, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != typ || e.Revision != int64(i+2) || e.Product.Id != id.Value || e.CommitTime == nil {
+			t.Errorf("event %d: got %v", i, e)
+		}
+	}
+
+	// Watch from revision 0 gets all changes. Наблюдение с ревизии 0 получает все изменения
+	stream, err = c.WatchProducts(ctx, &pb.WatchRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := stream.Recv(); err != nil || e.Type != pb.ProductEvent_CREATED || e.Revision != 1 {
+		t.Errorf("watch from revision 0: got %v, %v", e, err)
+	}
+
+	// Watch from current revision gets only new changes. Наблюдение с текущей ревизии получает только новые изменения
+	stream, err = c.WatchProducts(ctx, &pb.WatchRequest{StartRevision: currentRevision})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	c.AddProduct(ctx, &pb.Product{Name: "Apple"})
+	if e, err := stream.Recv(); err != nil || e.Type != pb.ProductEvent_CREATED || e.Revision != 4 {
+		t.Errorf("new event: got %v, %v", e, err)
+	}
+}
+
+func TestWatchProducts_Compacted(t *testing.T) {
+	srv := &server{feed: changeFeed{history: 2}}
+	c := newWatchClient(t, srv)
+	ctx := watchContext(t)
+	for i := 0; i < 4; i++ {
+		if _, err := c.AddProduct(ctx, &pb.Product{Name: "Apple"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream, err := c.WatchProducts(ctx, &pb.WatchRequest{StartRevision: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	if status.Code(err) != codes.OutOfRange {
+		t.Fatalf("compacted revision: got %v, want OutOfRange", err)
+	}
+	if d := status.Convert(err).Details(); len(d) != 1 || d[0].(*epb.ErrorInfo).Metadata["compact_revision"] != "2" {
+		t.Errorf("details of compacted revision: %v", d)
+	}
+
+	// The oldest kept revision is still available. Самая старая хранимая ревизия еще доступна
+	stream, _ = c.WatchProducts(ctx, &pb.WatchRequest{StartRevision: 2})
+	if e, err := stream.Recv(); err != nil || e.Revision != 3 {
+		t.Errorf("watch from compact revision: got %v, %v", e, err)
+	}
+
+	for _, revision := range []int64{10, -2} {
+		stream, _ = c.WatchProducts(ctx, &pb.WatchRequest{StartRevision: revision})
+		if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("revision %d: got %v, want InvalidArgument", revision, err)
+		}
+	}
+	// Revision 0 is compacted too. Ревизия 0 тоже удалена
+	stream, _ = c.WatchProducts(ctx, &pb.WatchRequest{})
+	if _, err := stream.Recv(); status.Code(err) != codes.OutOfRange {
+		t.Errorf("revision 0: got %v, want OutOfRange", err)
+	}
+}
+
+func TestWatchProducts_RequiresToken(t *testing.T) {
+	c := newWatchClient(t, &server{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := c.WatchProducts(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer wrong"), &pb.WatchRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v, want Unauthenticated", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Implements WebhookAdmin, it is protected by admin guard. Реализует WebhookAdmin, защищен проверкой администратора
+type webhookAdminServer struct {
+	pb.UnimplementedWebhookAdminServer
+	hooks *webhookDispatcher
+}
+
+// Method registration of webhook endpoint. Метод сервера CreateWebhookEndpoint, зарегистрировать точку вебхука
+func (s *webhookAdminServer) CreateWebhookEndpoint(ctx context.Context, in *pb.CreateWebhookEndpointRequest) (*pb.CreateWebhookEndpointResponse, error) {
+	var violations []*epb.BadRequest_FieldViolation
+	if !validWebhookURL(in.Url) {
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "url", Description: "url must be absolute http or https url"})
+	}
+	types, err := webhookEventTypes(in.Events)
+	if err != nil {
+		violations = append(violations, &epb.BadRequest_FieldViolation{Field: "events", Description: err.Error()})
+	}
+	if len(violations) > 0 {
+		st := status.New(codes.InvalidArgument, "Invalid webhook endpoint received")
+		if ds, err := st.WithDetails(&epb.BadRequest{FieldViolations: violations}); err == nil {
+			st = ds
+		}
+		return nil, st.Err()
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate secret")
+	}
+	ep := &webhookEndpoint{URL: in.Url, Secret: hex.EncodeToString(b), Events: in.Events, types: types}
+	if err := s.hooks.addEndpoint(ep); err != nil {
+		return nil, err
+	}
+	log.Printf("Registered webhook endpoint %s", ep.URL)
+	return &pb.CreateWebhookEndpointResponse{
+		Endpoint: &pb.WebhookEndpoint{Url: ep.URL, Events: ep.Events},
+		Secret:   ep.Secret,
+	}, nil
+}
+
+// Method list of webhook endpoints. Метод сервера ListWebhookEndpoints, список точек вебхуков
+func (s *webhookAdminServer) ListWebhookEndpoints(ctx context.Context, in *pb.ListWebhookEndpointsRequest) (*pb.ListWebhookEndpointsResponse, error) {
+	return &pb.ListWebhookEndpointsResponse{Endpoints: s.hooks.listEndpoints()}, nil
+}
+
+// Method delete of webhook endpoint. Метод сервера DeleteWebhookEndpoint, удалить точку вебхука
+func (s *webhookAdminServer) DeleteWebhookEndpoint(ctx context.Context, in *pb.DeleteWebhookEndpointRequest) (*emptypb.Empty, error) {
+	if err := s.hooks.removeEndpoint(in.Url); err != nil {
+		return nil, err
+	}
+	log.Printf("Deleted webhook endpoint %s", in.Url)
+	return &emptypb.Empty{}, nil
+}
+
+// Method list of webhook deliveries. Метод сервера ListWebhookDeliveries, список доставок вебхуков
+func (s *webhookAdminServer) ListWebhookDeliveries(ctx context.Context, in *pb.ListWebhookDeliveriesRequest) (*pb.ListWebhookDeliveriesResponse, error) {
+	return &pb.ListWebhookDeliveriesResponse{Deliveries: s.hooks.list(in.DeadOnly, in.Url)}, nil
+}
+
+// Method replay of webhook delivery. Метод сервера ReplayWebhookDelivery, повторить доставку вебхука
+func (s *webhookAdminServer) ReplayWebhookDelivery(ctx context.Context, in *pb.ReplayWebhookDeliveryRequest) (*pb.WebhookDelivery, error) {
+	d, err := s.hooks.replay(in.Id)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Replaying webhook delivery %s to %s", d.Id, d.Url)
+	return d, nil
+}
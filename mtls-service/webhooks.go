@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/gofrs/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Headers of webhook request. Заголовки запроса вебхука
+const (
+	webhookIDHeader        = "X-Webhook-Id"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	// "sha256=" and hex HMAC-SHA256 of "<timestamp>.<body>" with secret of endpoint.
+	// "sha256=" и hex HMAC-SHA256 от "<timestamp>.<body>" с секретом точки.
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// Defaults of webhooks. Значения по умолчанию вебхуков
+const (
+	defaultWebhookMaxAttempts    = 8
+	defaultWebhookInitialBackoff = time.Second
+	defaultWebhookMaxBackoff     = 5 * time.Minute
+	defaultWebhookTimeout        = 10 * time.Second
+	defaultWebhookWorkers        = 4
+	defaultWebhookMaxPending     = 1000
+	// Finished deliveries kept for admin. Завершенные доставки, хранимые для администратора
+	maxWebhookDeliveries = 1000
+)
+
+var (
+	errDeliveryNotFound          = status.Errorf(codes.NotFound, "webhook delivery does not exist")
+	errDeliveryPending           = status.Errorf(codes.FailedPrecondition, "webhook delivery is pending")
+	errDeliveryLost              = status.Errorf(codes.FailedPrecondition, "events of webhook delivery are compacted, products must be listed again")
+	errWebhookQueueFull          = status.Errorf(codes.ResourceExhausted, "webhook queue is full")
+	errWebhookEndpointExists     = status.Errorf(codes.AlreadyExists, "webhook endpoint already exists")
+	errWebhookEndpointNotFound   = status.Errorf(codes.NotFound, "webhook endpoint does not exist")
+	errWebhookEndpointConfigured = status.Errorf(codes.FailedPrecondition, "webhook endpoint is set by config of service")
+)
+
+// Webhooks receiving product events. Вебхуки, получающие события товаров
+type webhookConfig struct {
+	Endpoints []webhookEndpoint `json:"endpoints"`
+	// Attempts of delivery before it is dead, 8 if zero. Попытки доставки, после которых она недоставлена
+	MaxAttempts    int      `json:"max_attempts"`
+	InitialBackoff duration `json:"initial_backoff"`
+	MaxBackoff     duration `json:"max_backoff"`
+	// Timeout of each attempt. Таймаут каждой попытки
+	Timeout duration `json:"timeout"`
+	// Deliveries sent at once, 4 if zero. Одновременно отправляемые доставки, 4, если ноль
+	Workers int `json:"workers"`
+	// Deliveries queued or waiting for retry, above it new deliveries are dead, 1000 if zero.
+	// Доставки в очереди или ожидании повтора, сверх этого новые доставки недоставлены, 1000, если ноль.
+	MaxPending int `json:"max_pending"`
+}
+
+type webhookEndpoint struct {
+	URL string `json:"url"`
+	// Secret of HMAC signature. Секрет подписи HMAC
+	Secret string `json:"secret"`
+	// Types of events, all if empty, for example "CREATED". Типы событий, все, если пусто
+	Events []string `json:"events"`
+
+	types      map[pb.ProductEvent_Type]bool
+	configured bool // Set by config, not by admin. Задан конфигурацией, а не администратором
+}
+
+// Delivers product events to webhooks by a fixed number of workers, each delivery is retried with exponential
+// backoff and goes to dead-letter list when attempts are exhausted, receiver rejects it with 4xx, the queue is full
+// or its events are compacted before they are sent.
+// Доставляет события товаров вебхукам фиксированным числом обработчиков, каждая доставка повторяется
+// с экспоненциальной задержкой и попадает в список недоставленных, когда попытки исчерпаны, получатель отклоняет ее
+// с 4xx, очередь заполнена или ее события удалены из ленты до отправки.
+type webhookDispatcher struct {
+	cfg    webhookConfig
+	file   string // File of endpoints registered by admin. Файл точек, зарегистрированных администратором
+	client *http.Client
+	// Deliveries to send, capacity is MaxPending, so sends don't block. Доставки к отправке, емкость MaxPending
+	queue chan *webhookDelivery
+
+	mu         sync.Mutex
+	endpoints  []*webhookEndpoint
+	deliveries map[string]*webhookDelivery
+	order      []string // IDs in order of creation. ID в порядке создания
+	pending    int      // Deliveries in queue or waiting for retry. Доставки в очереди или ожидании повтора
+	now        func() time.Time
+}
+
+type webhookDelivery struct {
+	endpoint *webhookEndpoint
+	// Guarded by webhookDispatcher.mu. Защищено webhookDispatcher.mu
+	info *pb.WebhookDelivery
+}
+
+// Creates dispatcher with endpoints of config and endpoints registered by admin and saved to file, defaults
+// are used if cfg is nil. Registered endpoints are kept only in memory if file is empty.
+// Создаем диспетчер с точками конфигурации и точками, зарегистрированными администратором и сохраненными в файл,
+// при cfg равном nil используются значения по умолчанию. Если файл пуст, точки хранятся только в памяти.
+func newWebhookDispatcher(cfg *webhookConfig, file string) (*webhookDispatcher, error) {
+	if cfg == nil {
+		cfg = &webhookConfig{}
+	}
+	c := *cfg
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = duration(defaultWebhookInitialBackoff)
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = duration(defaultWebhookMaxBackoff)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = duration(defaultWebhookTimeout)
+	}
+	if c.Workers == 0 {
+		c.Workers = defaultWebhookWorkers
+	}
+	if c.MaxPending == 0 {
+		c.MaxPending = defaultWebhookMaxPending
+	}
+	if c.MaxAttempts < 0 || c.InitialBackoff < 0 || c.MaxBackoff < c.InitialBackoff || c.Timeout < 0 {
+		return nil, errors.New("webhooks: invalid retry settings")
+	}
+	if c.Workers < 0 || c.MaxPending < 0 {
+		return nil, errors.New("webhooks: invalid workers or max_pending")
+	}
+	d := &webhookDispatcher{
+		cfg:        c,
+		file:       file,
+		client:     &http.Client{Timeout: time.Duration(c.Timeout)},
+		queue:      make(chan *webhookDelivery, c.MaxPending),
+		deliveries: make(map[string]*webhookDelivery),
+		now:        time.Now,
+	}
+	for _, e := range cfg.Endpoints {
+		ep, err := checkWebhookEndpoint(e)
+		if err != nil {
+			return nil, err
+		}
+		ep.configured = true
+		if err := d.appendEndpoint(ep); err != nil {
+			return nil, fmt.Errorf("webhooks: %s is repeated", e.URL)
+		}
+	}
+	registered, err := loadWebhookEndpoints(file)
+	if err != nil {
+		return nil, fmt.Errorf("webhooks: %s: %v", file, err)
+	}
+	for _, e := range registered {
+		ep, err := checkWebhookEndpoint(e)
+		if err != nil {
+			return nil, fmt.Errorf("webhooks: %s: %v", file, err)
+		}
+		// Endpoint added to config later replaces registered one. Точка, добавленная позже в конфигурацию, заменяет зарегистрированную
+		if err := d.appendEndpoint(ep); err != nil {
+			log.Printf("Webhook endpoint %s of %s is set by config", e.URL, file)
+		}
+	}
+	return d, nil
+}
+
+func checkWebhookEndpoint(e webhookEndpoint) (*webhookEndpoint, error) {
+	if !validWebhookURL(e.URL) {
+		return nil, fmt.Errorf("webhooks: invalid url %q", e.URL)
+	}
+	if e.Secret == "" {
+		return nil, fmt.Errorf("webhooks: secret of %s is required", e.URL)
+	}
+	types, err := webhookEventTypes(e.Events)
+	if err != nil {
+		return nil, fmt.Errorf("webhooks: %v of %s", err, e.URL)
+	}
+	e.types = types
+	return &e, nil
+}
+
+func loadWebhookEndpoints(file string) ([]webhookEndpoint, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []webhookEndpoint
+	if err := json.Unmarshal(data, &endpoints); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Parses names of event types. Разбираем имена типов событий
+func webhookEventTypes(names []string) (map[pb.ProductEvent_Type]bool, error) {
+	types := make(map[pb.ProductEvent_Type]bool)
+	for _, name := range names {
+		t, ok := pb.ProductEvent_Type_value[name]
+		if !ok || t == int32(pb.ProductEvent_TYPE_UNSPECIFIED) {
+			return nil, fmt.Errorf("unknown event %q", name)
+		}
+		types[pb.ProductEvent_Type(t)] = true
+	}
+	return types, nil
+}
+
+// Adds endpoint, URL of each endpoint is unique. Добавляем точку, URL каждой точки уникален
+func (d *webhookDispatcher) addEndpoint(ep *webhookEndpoint) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.appendEndpoint(ep); err != nil {
+		return err
+	}
+	if err := d.save(); err != nil {
+		d.endpoints = d.endpoints[:len(d.endpoints)-1]
+		return err
+	}
+	return nil
+}
+
+// Called with d.mu held or before run. Вызывается под d.mu или до run
+func (d *webhookDispatcher) appendEndpoint(ep *webhookEndpoint) error {
+	for _, e := range d.endpoints {
+		if e.URL == ep.URL {
+			return errWebhookEndpointExists
+		}
+	}
+	d.endpoints = append(d.endpoints, ep)
+	return nil
+}
+
+// Removes endpoint added by admin, its pending deliveries are finished. Удаляем точку, добавленную администратором
+func (d *webhookDispatcher) removeEndpoint(url string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, e := range d.endpoints {
+		if e.URL != url {
+			continue
+		}
+		if e.configured {
+			return errWebhookEndpointConfigured
+		}
+		endpoints := d.endpoints
+		d.endpoints = append(d.endpoints[:i:i], d.endpoints[i+1:]...)
+		if err := d.save(); err != nil {
+			d.endpoints = endpoints
+			return err
+		}
+		return nil
+	}
+	return errWebhookEndpointNotFound
+}
+
+// Writes endpoints registered by admin to temporary file and renames it, so file is never half-written.
+// Called with d.mu held. Записываем точки, зарегистрированные администратором, во временный файл
+// и переименовываем его, поэтому файл не бывает записан наполовину. Вызывается под d.mu.
+func (d *webhookDispatcher) save() error {
+	if d.file == "" {
+		return nil
+	}
+	registered := make([]*webhookEndpoint, 0, len(d.endpoints))
+	for _, e := range d.endpoints {
+		if !e.configured {
+			registered = append(registered, e)
+		}
+	}
+	data, err := json.MarshalIndent(registered, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Temporary file is created with mode 0600, secrets are not readable by others.
+	// Временный файл создается с режимом 0600, секреты недоступны другим.
+	tmp, err := ioutil.TempFile(filepath.Dir(d.file), filepath.Base(d.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.file)
+}
+
+func (d *webhookDispatcher) listEndpoints() []*pb.WebhookEndpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]*pb.WebhookEndpoint, len(d.endpoints))
+	for i, e := range d.endpoints {
+		out[i] = &pb.WebhookEndpoint{Url: e.URL, Events: append([]string(nil), e.Events...), Configured: e.configured}
+	}
+	return out
+}
+
+// Sends changes of feed to webhooks until ctx is done. Отправляем изменения ленты вебхукам, пока ctx не завершен
+func (d *webhookDispatcher) run(ctx context.Context, feed *changeFeed) {
+	for i := 0; i < d.cfg.Workers; i++ {
+		go d.work(ctx)
+	}
+	cursor := feed.current()
+	for {
+		var changed <-chan struct{}
+		cursor, changed = d.dispatch(feed, cursor)
+		if changed == nil {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Queues deliveries of events after cursor, returns new cursor and channel of the next change if there are no events.
+// Ставим в очередь доставки событий после cursor, возвращаем новый cursor и канал следующего изменения, если событий нет.
+func (d *webhookDispatcher) dispatch(feed *changeFeed, cursor int64) (int64, <-chan struct{}) {
+	events, changed, err := feed.since(cursor)
+	if status.Code(err) == codes.OutOfRange {
+		// Dispatcher fell behind compaction, the lost events are dead letters. Диспетчер отстал от удаления событий
+		compacted := feed.compacted()
+		d.lost(cursor+1, compacted)
+		return compacted, nil
+	}
+	if err != nil {
+		log.Printf("webhooks: %v", err)
+		return feed.current(), nil
+	}
+	d.mu.Lock()
+	endpoints := append([]*webhookEndpoint(nil), d.endpoints...)
+	d.mu.Unlock()
+	for _, e := range events {
+		for _, ep := range endpoints {
+			if len(ep.types) == 0 || ep.types[e.Type] {
+				d.enqueue(ep, e)
+			}
+		}
+		cursor = e.Revision
+	}
+	return cursor, changed
+}
+
+// Records events lost by compaction as dead delivery of each endpoint. Записываем удаленные события как недоставленные
+func (d *webhookDispatcher) lost(from, to int64) {
+	log.Printf("webhooks: events of revisions %d to %d are compacted before they were sent", from, to)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, ep := range d.endpoints {
+		w, err := d.newDelivery(ep, nil)
+		if err != nil {
+			log.Printf("webhooks: %v", err)
+			return
+		}
+		w.info.State, w.info.LastError = pb.WebhookDelivery_DEAD, "events are compacted before they were sent"
+		w.info.LostFromRevision, w.info.LostToRevision = from, to
+		d.add(w)
+	}
+}
+
+func (d *webhookDispatcher) enqueue(ep *webhookEndpoint, e *pb.ProductEvent) {
+	d.mu.Lock()
+	w, err := d.newDelivery(ep, e)
+	if err != nil {
+		d.mu.Unlock()
+		log.Printf("webhooks: %v", err)
+		return
+	}
+	queued := d.pending < d.cfg.MaxPending
+	if queued {
+		d.pending++
+	} else {
+		w.info.State, w.info.LastError = pb.WebhookDelivery_DEAD, "webhook queue is full"
+		log.Printf("webhooks: delivery %s to %s is dead: queue is full", w.info.Id, w.info.Url)
+	}
+	d.add(w)
+	d.mu.Unlock()
+	if queued {
+		d.queue <- w
+	}
+}
+
+// Called with d.mu held. Вызывается под d.mu
+func (d *webhookDispatcher) newDelivery(ep *webhookEndpoint, e *pb.ProductEvent) (*webhookDelivery, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	now := timestamppb.New(d.now())
+	return &webhookDelivery{endpoint: ep, info: &pb.WebhookDelivery{
+		Id:         id.String(),
+		Url:        ep.URL,
+		Event:      e,
+		State:      pb.WebhookDelivery_PENDING,
+		CreateTime: now,
+		UpdateTime: now,
+	}}, nil
+}
+
+// Called with d.mu held. Вызывается под d.mu
+func (d *webhookDispatcher) add(w *webhookDelivery) {
+	d.deliveries[w.info.Id] = w
+	d.order = append(d.order, w.info.Id)
+	d.evict()
+}
+
+// Drops the oldest finished deliveries above limit, delivered ones first. Called with d.mu held.
+// Удаляем самые старые завершенные доставки сверх лимита, сначала доставленные. Вызывается под d.mu
+func (d *webhookDispatcher) evict() {
+	for _, state := range []pb.WebhookDelivery_State{pb.WebhookDelivery_DELIVERED, pb.WebhookDelivery_DEAD} {
+		for i := 0; i < len(d.order) && len(d.order) > maxWebhookDeliveries; {
+			if w := d.deliveries[d.order[i]]; w.info.State == state {
+				delete(d.deliveries, d.order[i])
+				d.order = append(d.order[:i], d.order[i+1:]...)
+				continue
+			}
+			i++
+		}
+	}
+}
+
+// Sends queued deliveries until ctx is done. Отправляем доставки из очереди, пока ctx не завершен
+func (d *webhookDispatcher) work(ctx context.Context) {
+	for {
+		select {
+		case w := <-d.queue:
+			d.attempt(ctx, w)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Makes attempt of delivery, failed one is queued again after backoff. Выполняем попытку доставки
+func (d *webhookDispatcher) attempt(ctx context.Context, w *webhookDelivery) {
+	payload, err := protojson.Marshal(w.info.Event)
+	if err != nil {
+		d.finish(w, 0, err)
+		return
+	}
+	code, err := d.post(ctx, w, payload)
+	if ctx.Err() != nil {
+		return
+	}
+	if attempts, retry := d.finish(w, code, err); retry {
+		time.AfterFunc(d.backoff(attempts), func() { d.queue <- w })
+	}
+}
+
+// Records result of attempt, returns number of attempts and true if delivery must be retried.
+// Записываем результат попытки, возвращаем число попыток и true, если доставку нужно повторить.
+func (d *webhookDispatcher) finish(w *webhookDelivery, code int, err error) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info := w.info
+	info.Attempts++
+	info.LastStatusCode = int32(code)
+	info.UpdateTime = timestamppb.New(d.now())
+	retry := err != nil && int(info.Attempts) < d.cfg.MaxAttempts && retryableWebhookStatus(code)
+	switch {
+	case err == nil:
+		info.State, info.LastError = pb.WebhookDelivery_DELIVERED, ""
+	case retry:
+		info.LastError = err.Error()
+	default:
+		info.State, info.LastError = pb.WebhookDelivery_DEAD, err.Error()
+		log.Printf("webhooks: delivery %s to %s is dead after %d attempts: %v", info.Id, info.Url, info.Attempts, err)
+	}
+	if !retry {
+		d.pending--
+	}
+	return int(info.Attempts), retry
+}
+
+// Exponential backoff with jitter. Экспоненциальная задержка со случайным разбросом
+func (d *webhookDispatcher) backoff(attempt int) time.Duration {
+	delay := time.Duration(d.cfg.InitialBackoff)
+	for i := 1; i < attempt && delay < time.Duration(d.cfg.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if delay > time.Duration(d.cfg.MaxBackoff) {
+		delay = time.Duration(d.cfg.MaxBackoff)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Server errors, timeouts and throttling are retried, other 4xx are rejected by receiver.
+// Ошибки сервера, таймауты и ограничения повторяются, остальные 4xx отклонены получателем.
+func retryableWebhookStatus(code int) bool {
+	return code == 0 || code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+// Posts signed event, returns HTTP status, 0 if there is no response. Отправляем подписанное событие
+func (d *webhookDispatcher) post(ctx context.Context, w *webhookDelivery, payload []byte) (int, error) {
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookIDHeader, w.info.Id)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(w.endpoint.Secret, timestamp, payload))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Signature binds body to timestamp, so receiver may reject old requests.
+// Подпись связывает тело с меткой времени, поэтому получатель может отклонять старые запросы.
+func webhookSignature(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns copies of deliveries in order of creation. Возвращаем копии доставок в порядке создания
+func (d *webhookDispatcher) list(deadOnly bool, url string) []*pb.WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []*pb.WebhookDelivery
+	for _, id := range d.order {
+		info := d.deliveries[id].info
+		if (deadOnly && info.State != pb.WebhookDelivery_DEAD) || (url != "" && info.Url != url) {
+			continue
+		}
+		out = append(out, proto.Clone(info).(*pb.WebhookDelivery))
+	}
+	return out
+}
+
+// Sends finished delivery again from the first attempt. Отправляем завершенную доставку заново с первой попытки
+func (d *webhookDispatcher) replay(id string) (*pb.WebhookDelivery, error) {
+	d.mu.Lock()
+	w, ok := d.deliveries[id]
+	switch {
+	case !ok:
+		d.mu.Unlock()
+		return nil, errDeliveryNotFound
+	case w.info.State == pb.WebhookDelivery_PENDING:
+		d.mu.Unlock()
+		return nil, errDeliveryPending
+	case w.info.Event == nil:
+		d.mu.Unlock()
+		return nil, errDeliveryLost
+	case d.pending >= d.cfg.MaxPending:
+		d.mu.Unlock()
+		return nil, errWebhookQueueFull
+	}
+	d.pending++
+	w.info.State, w.info.Attempts = pb.WebhookDelivery_PENDING, 0
+	w.info.UpdateTime = timestamppb.New(d.now())
+	out := proto.Clone(w.info).(*pb.WebhookDelivery)
+	d.mu.Unlock()
+	d.queue <- w
+	return out, nil
+}
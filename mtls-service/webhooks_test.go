@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Starts dispatcher of feed with fast retries. Запускаем диспетчер ленты с быстрыми повторами
+func newTestDispatcher(t *testing.T, feed *changeFeed, endpoints ...webhookEndpoint) *webhookDispatcher {
+	return runTestDispatcher(t, feed, &webhookConfig{Endpoints: endpoints})
+}
+
+func runTestDispatcher(t *testing.T, feed *changeFeed, cfg *webhookConfig) *webhookDispatcher {
+	cfg.MaxAttempts, cfg.Timeout = 3, duration(time.Second)
+	cfg.InitialBackoff, cfg.MaxBackoff = duration(time.Millisecond), duration(10*time.Millisecond)
+	d, err := newWebhookDispatcher(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go d.run(ctx, feed)
+	// The dispatcher waits for the next change. Диспетчер ждет следующего изменения
+	for {
+		feed.mu.Lock()
+		waiting := feed.changed != nil
+		feed.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return d
+}
+
+// Waits until all deliveries are finished. Ждем завершения всех доставок
+func waitDeliveries(t *testing.T, d *webhookDispatcher, n int) []*pb.WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list := d.list(false, "")
+		finished := len(list) == n
+		for _, w := range list {
+			finished = finished && w.State != pb.WebhookDelivery_PENDING
+		}
+		if finished {
+			return list
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries are not finished: %v", list)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhooks_Delivery(t *testing.T) {
+	const secret = "s3cret"
+	received := make(chan *pb.ProductEvent, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		want := "sha256=" + webhookSignature(secret, r.Header.Get(webhookTimestampHeader), body)
+		if r.Header.Get(webhookSignatureHeader) != want || r.Header.Get(webhookIDHeader) == "" {
+			t.Errorf("bad signature %q of %s", r.Header.Get(webhookSignatureHeader), body)
+		}
+		e := &pb.ProductEvent{}
+		if err := protojson.Unmarshal(body, e); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	}))
+	defer receiver.Close()
+
+	feed := &changeFeed{}
+	d := newTestDispatcher(t, feed, webhookEndpoint{URL: receiver.URL, Secret: secret, Events: []string{"CREATED"}})
+	feed.append(pb.ProductEvent_CREATED, &pb.Product{Id: "1", Name: "Apple"})
+	// Filtered event is not sent. Отфильтрованное событие не отправляется
+	feed.append(pb.ProductEvent_DELETED, &pb.Product{Id: "1"})
+
+	select {
+	case e := <-received:
+		if e.Type != pb.ProductEvent_CREATED || e.Product.Name != "Apple" || e.Revision != 1 {
+			t.Errorf("got event %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event is not delivered")
+	}
+	list := waitDeliveries(t, d, 1)
+	if w := list[0]; w.State != pb.WebhookDelivery_DELIVERED || w.Attempts != 1 || w.LastStatusCode != http.StatusOK {
+		t.Errorf("got delivery %v", w)
+	}
+}
+
+func TestWebhooks_RetryDeadLetterAndReplay(t *testing.T) {
+	var calls, failures int32 = 0, 1 << 30
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	feed := &changeFeed{}
+	d := newTestDispatcher(t, feed, webhookEndpoint{URL: receiver.URL, Secret: "s"})
+	feed.append(pb.ProductEvent_CREATED, &pb.Product{Id: "1"})
+
+	// Retries are exhausted, delivery is dead. Повторы исчерпаны, доставка недоставлена
+	w := waitDeliveries(t, d, 1)[0]
+	if w.State != pb.WebhookDelivery_DEAD || w.Attempts != 3 || w.LastStatusCode != http.StatusServiceUnavailable || w.LastError == "" {
+		t.Fatalf("got delivery %v", w)
+	}
+	if dead := d.list(true, ""); len(dead) != 1 {
+		t.Errorf("dead letters: %v", dead)
+	}
+
+	// Replay after receiver is fixed. Повтор после исправления получателя
+	atomic.StoreInt32(&failures, 1)
+	if _, err := d.replay(w.Id); err != nil {
+		t.Fatal(err)
+	}
+	w = waitDeliveries(t, d, 1)[0]
+	if w.State != pb.WebhookDelivery_DELIVERED || w.Attempts != 2 || w.LastError != "" {
+		t.Errorf("replayed delivery: %v", w)
+	}
+	if n := atomic.LoadInt32(&calls); n != 5 {
+		t.Errorf("got %d calls of receiver, want 5", n)
+	}
+	if _, err := d.replay("unknown"); status.Code(err) != codes.NotFound {
+		t.Errorf("replay of unknown delivery: got %v", err)
+	}
+}
+
+func TestWebhooks_RejectedIsDead(t *testing.T) {
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+
+	feed := &changeFeed{}
+	d := newTestDispatcher(t, feed, webhookEndpoint{URL: receiver.URL, Secret: "s"})
+	feed.append(pb.ProductEvent_CREATED, &pb.Product{Id: "1"})
+	w := waitDeliveries(t, d, 1)[0]
+	if w.State != pb.WebhookDelivery_DEAD || w.Attempts != 1 || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("rejected delivery is retried: %v", w)
+	}
+}
+
+// Pending deliveries are bounded, deliveries above the bound are dead. Ожидающие доставки ограничены
+func TestWebhooks_QueueFull(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer receiver.Close()
+
+	feed := &changeFeed{}
+	d := runTestDispatcher(t, feed, &webhookConfig{
+		Endpoints:  []webhookEndpoint{{URL: receiver.URL, Secret: "s"}},
+		Workers:    1,
+		MaxPending: 2,
+	})
+	for i := 0; i < 4; i++ {
+		feed.append(pb.ProductEvent_CREATED, &pb.Product{Id: "1"})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.list(false, "")) != 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	dead := d.list(true, "")
+	if len(dead) != 2 || dead[0].Event.Revision != 3 || dead[0].LastError != "webhook queue is full" || dead[0].Attempts != 0 {
+		t.Errorf("deliveries above max_pending: %v", dead)
+	}
+	if _, err := d.replay(dead[0].Id); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("replay with full queue: got %v, want ResourceExhausted", err)
+	}
+	close(release)
+	for i, w := range waitDeliveries(t, d, 4)[:2] {
+		if w.State != pb.WebhookDelivery_DELIVERED {
+			t.Errorf("delivery %d: %v", i, w)
+		}
+	}
+	if _, err := d.replay(dead[0].Id); err != nil {
+		t.Errorf("replay after queue is drained: %v", err)
+	}
+}
+
+// Events compacted before they are sent are dead letters. События, удаленные до отправки, недоставлены
+func TestWebhooks_LostByCompaction(t *testing.T) {
+	d, err := newWebhookDispatcher(&webhookConfig{Endpoints: []webhookEndpoint{
+		{URL: "http://a.example", Secret: "s"},
+		{URL: "http://b.example", Secret: "s"},
+	}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := &changeFeed{history: 2}
+	for i := 0; i < 4; i++ {
+		feed.append(pb.ProductEvent_CREATED, &pb.Product{Id: "1"})
+	}
+	cursor, _ := d.dispatch(feed, 0)
+	if cursor != 2 {
+		t.Errorf("cursor after compacted events: %d, want 2", cursor)
+	}
+	dead := d.list(true, "")
+	if len(dead) != 2 {
+		t.Fatalf("dead letters of lost events: %v", dead)
+	}
+	for _, w := range dead {
+		if w.LostFromRevision != 1 || w.LostToRevision != 2 || w.Event != nil {
+			t.Errorf("dead letter of lost events: %v", w)
+		}
+	}
+	if _, err := d.replay(dead[0].Id); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("replay of lost events: got %v, want FailedPrecondition", err)
+	}
+	// Kept events are queued. Хранимые события ставятся в очередь
+	if cursor, _ = d.dispatch(feed, cursor); cursor != 4 || len(d.queue) != 4 {
+		t.Errorf("after kept events: cursor %d, %d queued", cursor, len(d.queue))
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d, _ := newWebhookDispatcher(&webhookConfig{InitialBackoff: duration(time.Second), MaxBackoff: duration(5 * time.Second)}, "")
+	// Delay doubles up to max backoff, jitter keeps at least half of it. Задержка удваивается до максимума
+	for i, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := d.backoff(i + 1); got < max/2 || got > max {
+			t.Errorf("attempt %d: backoff %v is out of %v to %v", i+1, got, max/2, max)
+		}
+	}
+}
+
+func TestNewWebhookDispatcher_Invalid(t *testing.T) {
+	for _, cfg := range []*webhookConfig{
+		{Endpoints: []webhookEndpoint{{URL: "ftp://example.com", Secret: "s"}}},
+		{Endpoints: []webhookEndpoint{{URL: "http://example.com"}}},
+		{Endpoints: []webhookEndpoint{{URL: "http://example.com", Secret: "s", Events: []string{"RENAMED"}}}},
+		{MaxBackoff: duration(time.Millisecond), InitialBackoff: duration(time.Second)},
+	} {
+		if _, err := newWebhookDispatcher(cfg, ""); err == nil {
+			t.Errorf("config %+v is accepted", cfg)
+		}
+	}
+	d, err := newWebhookDispatcher(nil, "")
+	if err != nil || d.cfg.Workers != defaultWebhookWorkers || d.cfg.MaxAttempts != defaultWebhookMaxAttempts {
+		t.Errorf("webhooks without config: %+v, %v", d, err)
+	}
+}
+
+func TestWebhookAdmin_WithoutConfig(t *testing.T) {
+	d, _ := newWebhookDispatcher(nil, "")
+	s := &webhookAdminServer{hooks: d}
+	ctx := context.Background()
+	if _, err := s.CreateWebhookEndpoint(ctx, &pb.CreateWebhookEndpointRequest{Url: "https://hooks.example"}); err != nil {
+		t.Errorf("create without webhooks config: %v", err)
+	}
+	if out, err := s.ListWebhookEndpoints(ctx, &pb.ListWebhookEndpointsRequest{}); err != nil || len(out.Endpoints) != 1 {
+		t.Errorf("endpoints without webhooks config: %v, %v", out, err)
+	}
+	if !isAdminMethod("/ecommerce.WebhookAdmin/ListWebhookDeliveries") {
+		t.Error("WebhookAdmin is not protected by admin guard")
+	}
+}
+
+func TestWebhookAdmin(t *testing.T) {
+	d, _ := newWebhookDispatcher(&webhookConfig{}, "")
+	for _, w := range []*pb.WebhookDelivery{
+		{Id: "1", Url: "http://a.example", State: pb.WebhookDelivery_PENDING},
+		{Id: "2", Url: "http://b.example", State: pb.WebhookDelivery_DEAD},
+	} {
+		d.deliveries[w.Id] = &webhookDelivery{info: w}
+		d.order = append(d.order, w.Id)
+	}
+	s := &webhookAdminServer{hooks: d}
+	ctx := context.Background()
+	out, err := s.ListWebhookDeliveries(ctx, &pb.ListWebhookDeliveriesRequest{Url: "http://a.example"})
+	if err != nil || len(out.Deliveries) != 1 || out.Deliveries[0].Id != "1" {
+		t.Errorf("deliveries of url: %v, %v", out, err)
+	}
+	// Pending delivery is still being sent. Ожидающая доставка еще отправляется
+	if _, err := s.ReplayWebhookDelivery(ctx, &pb.ReplayWebhookDeliveryRequest{Id: "1"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("replay of pending delivery: got %v, want FailedPrecondition", err)
+	}
+}
+
+func TestWebhookAdmin_Endpoints(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		received <- r
+	}))
+	defer receiver.Close()
+
+	feed := &changeFeed{}
+	d := newTestDispatcher(t, feed, webhookEndpoint{URL: "http://configured.example", Secret: "s", Events: []string{"DELETED"}})
+	s := &webhookAdminServer{hooks: d}
+	ctx := context.Background()
+
+	for _, in := range []*pb.CreateWebhookEndpointRequest{
+		{Url: "ftp://example.com"},
+		{Url: receiver.URL, Events: []string{"RENAMED"}},
+	} {
+		_, err := s.CreateWebhookEndpoint(ctx, in)
+		if d := status.Convert(err).Details(); status.Code(err) != codes.InvalidArgument || len(d) != 1 {
+			t.Errorf("invalid endpoint %v: got %v", in, err)
+		}
+	}
+	created, err := s.CreateWebhookEndpoint(ctx, &pb.CreateWebhookEndpointRequest{Url: receiver.URL, Events: []string{"CREATED"}})
+	if err != nil || created.Secret == "" {
+		t.Fatalf("create: %v, %v", created, err)
+	}
+	if _, err := s.CreateWebhookEndpoint(ctx, &pb.CreateWebhookEndpointRequest{Url: receiver.URL}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("repeated endpoint: got %v, want AlreadyExists", err)
+	}
+	list, err := s.ListWebhookEndpoints(ctx, &pb.ListWebhookEndpointsRequest{})
+	if err != nil || len(list.Endpoints) != 2 || !list.Endpoints[0].Configured || list.Endpoints[1].Url != receiver.URL || list.Endpoints[1].Configured {
+		t.Errorf("endpoints: %v, %v", list, err)
+	}
+
+	// Registered endpoint gets events signed with its secret. Зарегистрированная точка получает события, подписанные ее секретом
+	feed.append(pb.ProductEvent_CREATED, &pb.Product{Id: "1"})
+	select {
+	case r := <-received:
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(webhookSignatureHeader) != "sha256="+webhookSignature(created.Secret, r.Header.Get(webhookTimestampHeader), body) {
+			t.Errorf("bad signature of registered endpoint")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event is not delivered to registered endpoint")
+	}
+
+	if _, err := s.DeleteWebhookEndpoint(ctx, &pb.DeleteWebhookEndpointRequest{Url: "http://configured.example"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("delete of configured endpoint: got %v, want FailedPrecondition", err)
+	}
+	if _, err := s.DeleteWebhookEndpoint(ctx, &pb.DeleteWebhookEndpointRequest{Url: receiver.URL}); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	if _, err := s.DeleteWebhookEndpoint(ctx, &pb.DeleteWebhookEndpointRequest{Url: receiver.URL}); status.Code(err) != codes.NotFound {
+		t.Errorf("delete of unknown endpoint: got %v, want NotFound", err)
+	}
+}
+
+func TestWebhookAdmin_EndpointsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "webhook_endpoints.json")
+	d, err := newWebhookDispatcher(nil, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &webhookAdminServer{hooks: d}
+	ctx := context.Background()
+	kept, err := s.CreateWebhookEndpoint(ctx, &pb.CreateWebhookEndpointRequest{Url: "https://kept.example", Events: []string{"CREATED"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"https://deleted.example", "https://configured.example"} {
+		if _, err := s.CreateWebhookEndpoint(ctx, &pb.CreateWebhookEndpointRequest{Url: url}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.DeleteWebhookEndpoint(ctx, &pb.DeleteWebhookEndpointRequest{Url: "https://deleted.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("file of endpoints: %v, %v", info, err)
+	}
+
+	// Registered endpoints survive restart, endpoint of config replaces registered one.
+	// Зарегистрированные точки сохраняются после перезапуска, точка конфигурации заменяет зарегистрированную.
+	restarted, err := newWebhookDispatcher(&webhookConfig{Endpoints: []webhookEndpoint{{URL: "https://configured.example", Secret: "s"}}}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range restarted.endpoints {
+		got = append(got, fmt.Sprintf("%s %v %v", e.URL, e.configured, e.Events))
+		if e.URL == kept.Endpoint.Url && (e.Secret != kept.Secret || !e.types[pb.ProductEvent_CREATED] || e.types[pb.ProductEvent_DELETED]) {
+			t.Errorf("restored endpoint %s: %+v", e.URL, e)
+		}
+	}
+	if want := "https://configured.example true []|https://kept.example false [CREATED]"; strings.Join(got, "|") != want {
+		t.Errorf("endpoints after restart: got %q, want %q", got, want)
+	}
+
+	if err := ioutil.WriteFile(file, []byte(`[{"url": "ftp://example.com", "secret": "s"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newWebhookDispatcher(nil, file); err == nil {
+		t.Error("invalid endpoint of file is accepted")
+	}
+}
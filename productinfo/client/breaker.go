@@ -0,0 +1,240 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Defaults of circuit breaker. Значения по умолчанию автоматического выключателя
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 10 * time.Second
+	DefaultHalfOpenProbes   = 1
+)
+
+// CircuitState is a state of circuit breaker of method. Состояние автоматического выключателя метода
+type CircuitState int
+
+const (
+	// CircuitClosed passes calls. Пропускает вызовы
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails calls at once with ErrCircuitOpen. Сразу завершает вызовы с ErrCircuitOpen
+	CircuitOpen
+	// CircuitHalfOpen passes probe calls to check if service is back.
+	// Пропускает пробные вызовы, чтобы проверить, вернулся ли сервис.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// ErrCircuitOpen is returned without call while circuit of method is open, so the caller may fall back
+// to cached data. Its gRPC status is Unavailable.
+// Возвращается без вызова, пока выключатель метода разомкнут, поэтому вызывающий может использовать
+// кэшированные данные. Его статус gRPC - Unavailable.
+var ErrCircuitOpen error = circuitOpenError{}
+
+type circuitOpenError struct{}
+
+func (circuitOpenError) Error() string {
+	return "productinfo: circuit breaker is open"
+}
+
+func (circuitOpenError) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, "circuit breaker is open")
+}
+
+// CircuitBreaker of each method opens after FailureThreshold failed calls in a row, then fails calls at once for
+// OpenTimeout. After that it is half-open: HalfOpenProbes calls are passed, it is closed if all of them succeed
+// and open again on the first failure. Zero fields get defaults.
+// Автоматический выключатель каждого метода размыкается после FailureThreshold неудачных вызовов подряд и затем
+// сразу завершает вызовы в течение OpenTimeout. После этого он полуразомкнут: пропускаются HalfOpenProbes вызовов,
+// он замыкается, если все они успешны, и снова размыкается при первой ошибке. Нулевые поля получают значения по умолчанию.
+type CircuitBreaker struct {
+	FailureThreshold int
+	// FailureCodes are counted as failures, Unavailable, DeadlineExceeded, Internal and Unknown if empty.
+	// Коды, считающиеся ошибками, при пустом списке - Unavailable, DeadlineExceeded, Internal и Unknown.
+	FailureCodes   []codes.Code
+	OpenTimeout    time.Duration
+	HalfOpenProbes int
+	// OnStateChange is called on each transition of state. Вызывается при каждой смене состояния
+	OnStateChange func(method string, from, to CircuitState)
+}
+
+// Circuit breakers of methods. Автоматические выключатели методов
+type breakers struct {
+	cfg      CircuitBreaker
+	failures map[codes.Code]bool
+
+	mu      sync.Mutex
+	methods map[string]*circuit
+	now     func() time.Time
+}
+
+type circuit struct {
+	state    CircuitState
+	failures int       // Failures in a row while closed. Ошибки подряд в замкнутом состоянии
+	openedAt time.Time // Time of opening. Время размыкания
+	probes   int       // Probes passed while half-open. Пропущенные пробы в полуразомкнутом состоянии
+	passed   int       // Succeeded probes. Успешные пробы
+	// Generation of state, result of call started in other state is ignored.
+	// Поколение состояния, результат вызова, начатого в другом состоянии, игнорируется.
+	generation int
+}
+
+type transition struct {
+	method   string
+	from, to CircuitState
+}
+
+func newBreakers(cfg CircuitBreaker) *breakers {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = DefaultFailureThreshold
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = DefaultOpenTimeout
+	}
+	if cfg.HalfOpenProbes <= 0 {
+		cfg.HalfOpenProbes = DefaultHalfOpenProbes
+	}
+	if len(cfg.FailureCodes) == 0 {
+		cfg.FailureCodes = []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown}
+	}
+	b := &breakers{cfg: cfg, failures: make(map[codes.Code]bool), methods: make(map[string]*circuit), now: time.Now}
+	for _, c := range cfg.FailureCodes {
+		b.failures[c] = true
+	}
+	return b
+}
+
+// Interceptor goes first, so retries and hedged attempts of call are one result for breaker.
+// Перехватчик идет первым, поэтому повторы и попытки хеджирования вызова - один результат для выключателя.
+func (b *breakers) unary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	generation, ok := b.allow(method)
+	if !ok {
+		return ErrCircuitOpen
+	}
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	// Call cancelled by caller says nothing about service. Отмененный вызывающим вызов ничего не говорит о сервисе
+	if ctx.Err() == context.Canceled {
+		b.release(method, generation)
+		return err
+	}
+	b.record(method, generation, b.failures[status.Code(err)])
+	return err
+}
+
+// Decides if call is passed, returns generation of state. Решаем, пропустить ли вызов, возвращаем поколение состояния
+func (b *breakers) allow(method string) (int, bool) {
+	b.mu.Lock()
+	c := b.circuit(method)
+	var changed []transition
+	if c.state == CircuitOpen && !b.now().Before(c.openedAt.Add(b.cfg.OpenTimeout)) {
+		changed = append(changed, b.set(method, c, CircuitHalfOpen))
+	}
+	ok := true
+	switch c.state {
+	case CircuitOpen:
+		ok = false
+	case CircuitHalfOpen:
+		if ok = c.probes < b.cfg.HalfOpenProbes; ok {
+			c.probes++
+		}
+	}
+	generation := c.generation
+	b.mu.Unlock()
+	b.notify(changed)
+	return generation, ok
+}
+
+// Returns probe of cancelled call. Возвращаем пробу отмененного вызова
+func (b *breakers) release(method string, generation int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.circuit(method); c.generation == generation && c.state == CircuitHalfOpen {
+		c.probes--
+	}
+}
+
+func (b *breakers) record(method string, generation int, failed bool) {
+	b.mu.Lock()
+	c := b.circuit(method)
+	var changed []transition
+	if c.generation == generation {
+		switch {
+		case c.state == CircuitClosed && failed:
+			if c.failures++; c.failures >= b.cfg.FailureThreshold {
+				changed = append(changed, b.set(method, c, CircuitOpen))
+			}
+		case c.state == CircuitClosed:
+			c.failures = 0
+		case c.state == CircuitHalfOpen && failed:
+			changed = append(changed, b.set(method, c, CircuitOpen))
+		case c.state == CircuitHalfOpen:
+			if c.passed++; c.passed >= b.cfg.HalfOpenProbes {
+				changed = append(changed, b.set(method, c, CircuitClosed))
+			}
+		}
+	}
+	b.mu.Unlock()
+	b.notify(changed)
+}
+
+// Called with b.mu held. Вызывается под b.mu
+func (b *breakers) circuit(method string) *circuit {
+	c, ok := b.methods[method]
+	if !ok {
+		c = &circuit{}
+		b.methods[method] = c
+	}
+	return c
+}
+
+// Changes state, called with b.mu held. Меняем состояние, вызывается под b.mu
+func (b *breakers) set(method string, c *circuit, state CircuitState) transition {
+	t := transition{method: method, from: c.state, to: state}
+	c.state, c.failures, c.probes, c.passed = state, 0, 0, 0
+	c.generation++
+	if state == CircuitOpen {
+		c.openedAt = b.now()
+	}
+	return t
+}
+
+// Callback is called without lock, so it may read state. Обратный вызов выполняется без блокировки
+func (b *breakers) notify(changed []transition) {
+	if b.cfg.OnStateChange == nil {
+		return
+	}
+	for _, t := range changed {
+		b.cfg.OnStateChange(t.method, t.from, t.to)
+	}
+}
+
+func (b *breakers) state(method string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.methods[method]
+	if !ok {
+		return CircuitClosed
+	}
+	if c.state == CircuitOpen && !b.now().Before(c.openedAt.Add(b.cfg.OpenTimeout)) {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const getProductMethod = "/ecommerce.ProductInfo/getProduct"
+
+func callBreaker(b *breakers, method string, err error) error {
+	return b.unary(context.Background(), method, nil, nil, nil,
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			return err
+		})
+}
+
+func TestBreakers_States(t *testing.T) {
+	var changes []string
+	b := newBreakers(CircuitBreaker{FailureThreshold: 3, OpenTimeout: time.Minute, HalfOpenProbes: 2,
+		OnStateChange: func(method string, from, to CircuitState) { changes = append(changes, from.String()+">"+to.String()) }})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	unavailable := status.Error(codes.Unavailable, "down")
+
+	// Errors of request and success don't open circuit. Ошибки запроса и успех не размыкают выключатель
+	callBreaker(b, getProductMethod, unavailable)
+	callBreaker(b, getProductMethod, unavailable)
+	callBreaker(b, getProductMethod, status.Error(codes.NotFound, "no"))
+	callBreaker(b, getProductMethod, unavailable)
+	callBreaker(b, getProductMethod, unavailable)
+	if s := b.state(getProductMethod); s != CircuitClosed {
+		t.Fatalf("got %s after failures not in a row", s)
+	}
+	callBreaker(b, getProductMethod, unavailable)
+	if s := b.state(getProductMethod); s != CircuitOpen {
+		t.Fatalf("got %s after 3 failures in a row", s)
+	}
+	if err := callBreaker(b, getProductMethod, nil); err != ErrCircuitOpen {
+		t.Errorf("call of open circuit: got %v", err)
+	}
+	if status.Code(ErrCircuitOpen) != codes.Unavailable {
+		t.Errorf("status of open circuit: %v", status.Code(ErrCircuitOpen))
+	}
+	// Circuits are per method. Выключатели свои у каждого метода
+	if err := callBreaker(b, "/ecommerce.ProductInfo/listProducts", nil); err != nil {
+		t.Errorf("other method: %v", err)
+	}
+
+	// Failed probe opens circuit again. Неудачная проба снова размыкает выключатель
+	now = now.Add(time.Minute)
+	if err := callBreaker(b, getProductMethod, unavailable); err != unavailable {
+		t.Fatalf("probe: got %v", err)
+	}
+	if s := b.state(getProductMethod); s != CircuitOpen {
+		t.Fatalf("got %s after failed probe", s)
+	}
+
+	// Circuit is closed after all probes succeed. Выключатель замыкается после успеха всех проб
+	now = now.Add(time.Minute)
+	g1, ok1 := b.allow(getProductMethod)
+	g2, ok2 := b.allow(getProductMethod)
+	if _, ok3 := b.allow(getProductMethod); !ok1 || !ok2 || ok3 {
+		t.Fatalf("half-open circuit passed probes %v, %v, %v, want 2", ok1, ok2, ok3)
+	}
+	b.record(getProductMethod, g1, false)
+	if s := b.state(getProductMethod); s != CircuitHalfOpen {
+		t.Fatalf("got %s after one of two probes", s)
+	}
+	b.record(getProductMethod, g2, false)
+	if s := b.state(getProductMethod); s != CircuitClosed {
+		t.Fatalf("got %s after probes", s)
+	}
+
+	want := []string{"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed"}
+	if len(changes) != len(want) {
+		t.Fatalf("got transitions %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("got transitions %v, want %v", changes, want)
+		}
+	}
+}
+
+func TestBreakers_StaleResults(t *testing.T) {
+	b := newBreakers(CircuitBreaker{FailureThreshold: 1})
+	slow, _ := b.allow(getProductMethod)
+	callBreaker(b, getProductMethod, status.Error(codes.DeadlineExceeded, "slow"))
+	// Success of call started before opening doesn't close it. Успех вызова, начатого до размыкания, не замыкает его
+	b.record(getProductMethod, slow, false)
+	if s := b.state(getProductMethod); s != CircuitOpen {
+		t.Errorf("got %s after stale success", s)
+	}
+
+	// Cancelled call is not a failure. Отмененный вызов не ошибка
+	b = newBreakers(CircuitBreaker{FailureThreshold: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.unary(ctx, getProductMethod, nil, nil, nil,
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			return status.FromContextError(ctx.Err()).Err()
+		})
+	if s := b.state(getProductMethod); s != CircuitClosed {
+		t.Errorf("got %s after cancelled call", s)
+	}
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	srv := &testServer{failures: 1 << 30}
+	c := newTestClient(t, srv, Options{MaxRetries: -1, CircuitBreaker: &CircuitBreaker{FailureThreshold: 2}})
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetProduct(context.Background(), "id"); status.Code(err) != codes.Unavailable {
+			t.Fatalf("got %v, want Unavailable", err)
+		}
+	}
+	_, err := c.GetProduct(context.Background(), "id")
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 2 {
+		t.Errorf("open circuit called service: %d calls", calls)
+	}
+	if s := c.CircuitState(getProductMethod); s != CircuitOpen {
+		t.Errorf("got state %s", s)
+	}
+}
@@ -0,0 +1,208 @@
+package client
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Defaults of read cache. Значения по умолчанию кэша чтения
+const (
+	DefaultCacheTTL        = 30 * time.Second
+	DefaultCacheMaxEntries = 10000
+)
+
+// Cache of GetProduct results. A product is fresh for TTL, then for StaleWhileRevalidate it is returned at once
+// while it is refreshed in background, so reads survive short outages of service. Least recently used products
+// are evicted above MaxEntries. Products changed by the client are invalidated, changes of other clients are
+// invalidated by WatchProducts stream if WatchChanges is set. Zero TTL and MaxEntries get defaults.
+// Кэш результатов GetProduct. Товар свеж в течение TTL, затем в течение StaleWhileRevalidate возвращается сразу,
+// пока обновляется в фоне, поэтому чтение переживает короткие недоступности сервиса. Давно не читавшиеся товары
+// вытесняются сверх MaxEntries. Товары, измененные клиентом, удаляются из кэша, изменения других клиентов удаляются
+// по потоку WatchProducts, если задан WatchChanges. Нулевые TTL и MaxEntries получают значения по умолчанию.
+type Cache struct {
+	TTL                  time.Duration
+	StaleWhileRevalidate time.Duration
+	MaxEntries           int
+	WatchChanges         bool
+}
+
+// CacheStats are counters of cache. Счетчики кэша
+type CacheStats struct {
+	// Fresh products returned. Возвращенные свежие товары
+	Hits uint64
+	// Stale products returned while refreshed. Возвращенные устаревшие товары, пока они обновляются
+	StaleHits uint64
+	// Reads from service. Чтения из сервиса
+	Misses uint64
+	// Products evicted above MaxEntries. Товары, вытесненные сверх MaxEntries
+	Evictions uint64
+	// Products invalidated by changes. Товары, удаленные из кэша из-за изменений
+	Invalidations uint64
+	// Products in cache. Товары в кэше
+	Entries int
+}
+
+type productCache struct {
+	cfg Cache
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Front is the most recently used. Впереди - последний использованный
+	// IDs refreshed in background. Обновляемые в фоне ID
+	refreshing map[string]bool
+	// Clock is advanced by each invalidation, product read before invalidation of its ID or of all products
+	// is not stored. Invalidated IDs are bounded by MaxEntries, above it they are replaced by cleared.
+	// Часы увеличиваются при каждом удалении из кэша, товар, прочитанный до удаления его ID или всех товаров,
+	// не сохраняется. Удаленных ID не больше MaxEntries, сверх этого они заменяются на cleared.
+	clock       uint64
+	invalidated map[string]uint64 // Clock of last invalidation of ID. Часы последнего удаления ID
+	cleared     uint64            // Clock of last invalidation of all products. Часы последнего удаления всех товаров
+	now         func() time.Time
+	// Counters guarded by mu. Счетчики под mu
+	hits, staleHits, misses, evictions, invalidations uint64
+}
+
+type cacheEntry struct {
+	id      string
+	product *pb.Product
+	fetched time.Time
+}
+
+// Result of cache lookup. Результат поиска в кэше
+type cacheLookup int
+
+const (
+	cacheMiss cacheLookup = iota
+	cacheFresh
+	cacheStale
+	// Stale product the caller must refresh. Устаревший товар, который должен обновить вызывающий
+	cacheRefresh
+)
+
+func newProductCache(cfg Cache) *productCache {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultCacheTTL
+	}
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = DefaultCacheMaxEntries
+	}
+	return &productCache{
+		cfg:         cfg,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		refreshing:  make(map[string]bool),
+		invalidated: make(map[string]uint64),
+		now:         time.Now,
+	}
+}
+
+// Returns copy of product and clock of cache for put. Возвращаем копию товара и часы кэша для put
+func (c *productCache) get(id string) (*pb.Product, cacheLookup, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		c.misses++
+		return nil, cacheMiss, c.clock
+	}
+	e := el.Value.(*cacheEntry)
+	age := c.now().Sub(e.fetched)
+	result := cacheFresh
+	switch {
+	case age < c.cfg.TTL:
+		c.hits++
+	case age < c.cfg.TTL+c.cfg.StaleWhileRevalidate:
+		c.staleHits++
+		result = cacheStale
+		if !c.refreshing[id] {
+			c.refreshing[id] = true
+			result = cacheRefresh
+		}
+	default:
+		c.remove(el)
+		c.misses++
+		return nil, cacheMiss, c.clock
+	}
+	c.lru.MoveToFront(el)
+	return proto.Clone(e.product).(*pb.Product), result, c.clock
+}
+
+// Stores product read from service, unless the product is invalidated after get.
+// Сохраняем товар, прочитанный из сервиса, если товар не удален из кэша после get.
+func (c *productCache) put(id string, product *pb.Product, clock uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if clock < c.cleared || clock < c.invalidated[id] {
+		return
+	}
+	e := &cacheEntry{id: id, product: proto.Clone(product).(*pb.Product), fetched: c.now()}
+	if el, ok := c.entries[id]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[id] = c.lru.PushFront(e)
+	for c.lru.Len() > c.cfg.MaxEntries {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// Ends background refresh, product is nil if refresh failed. Завершаем фоновое обновление
+func (c *productCache) refreshed(id string, product *pb.Product, clock uint64) {
+	c.mu.Lock()
+	delete(c.refreshing, id)
+	c.mu.Unlock()
+	if product != nil {
+		c.put(id, product, clock)
+	}
+}
+
+func (c *productCache) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock++
+	if len(c.invalidated) >= c.cfg.MaxEntries {
+		c.cleared = c.clock
+		c.invalidated = make(map[string]uint64)
+	}
+	c.invalidated[id] = c.clock
+	if el, ok := c.entries[id]; ok {
+		c.remove(el)
+		c.invalidations++
+	}
+}
+
+func (c *productCache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock++
+	c.cleared = c.clock
+	c.invalidated = make(map[string]uint64)
+	c.invalidations += uint64(len(c.entries))
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Called with c.mu held. Вызывается под c.mu
+func (c *productCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).id)
+}
+
+func (c *productCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:          c.hits,
+		StaleHits:     c.staleHits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		Invalidations: c.invalidations,
+		Entries:       len(c.entries),
+	}
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+)
+
+func TestProductCache(t *testing.T) {
+	c := newProductCache(Cache{TTL: time.Minute, StaleWhileRevalidate: time.Minute, MaxEntries: 2})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	_, result, gen := c.get("a")
+	if result != cacheMiss {
+		t.Fatalf("empty cache: got %v", result)
+	}
+	c.put("a", &pb.Product{Id: "a", Name: "Apple"}, gen)
+	p, result, _ := c.get("a")
+	if result != cacheFresh || p.Name != "Apple" {
+		t.Fatalf("got %v, %v", p, result)
+	}
+	// Cached product is a copy. Кэшированный товар - копия
+	p.Name = "changed"
+	if p, _, _ := c.get("a"); p.Name != "Apple" {
+		t.Errorf("cached product is changed by caller: %v", p)
+	}
+
+	// Stale product is refreshed by one caller. Устаревший товар обновляет один вызывающий
+	now = now.Add(90 * time.Second)
+	_, first, gen := c.get("a")
+	_, second, _ := c.get("a")
+	if first != cacheRefresh || second != cacheStale {
+		t.Errorf("stale product: got %v, %v", first, second)
+	}
+	c.refreshed("a", &pb.Product{Id: "a", Name: "Apple 2"}, gen)
+	if p, result, _ := c.get("a"); result != cacheFresh || p.Name != "Apple 2" {
+		t.Errorf("after refresh: got %v, %v", p, result)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, result, _ := c.get("a"); result != cacheMiss {
+		t.Errorf("expired product: got %v", result)
+	}
+
+	// Least recently used product is evicted. Вытесняется давно не читавшийся товар
+	_, _, gen = c.get("a")
+	c.put("a", &pb.Product{Id: "a"}, gen)
+	c.put("b", &pb.Product{Id: "b"}, gen)
+	c.get("a")
+	c.put("c", &pb.Product{Id: "c"}, gen)
+	if _, result, _ := c.get("b"); result != cacheMiss {
+		t.Errorf("least recently used product is not evicted")
+	}
+	if _, result, _ := c.get("a"); result != cacheFresh {
+		t.Errorf("recently used product is evicted")
+	}
+
+	// Product read before its invalidation is not stored, invalidation of other product doesn't matter.
+	// Товар, прочитанный до его удаления из кэша, не сохраняется, удаление другого товара не мешает.
+	_, _, gen = c.get("d")
+	c.invalidate("d")
+	c.put("d", &pb.Product{Id: "d"}, gen)
+	if _, result, _ := c.get("d"); result != cacheMiss {
+		t.Errorf("product read before invalidation is stored")
+	}
+	_, _, gen = c.get("d")
+	c.invalidate("a")
+	c.put("d", &pb.Product{Id: "d"}, gen)
+	if _, result, _ := c.get("d"); result != cacheFresh {
+		t.Errorf("product is not stored after invalidation of other product")
+	}
+
+	s := c.stats()
+	if s.Evictions != 1 || s.Invalidations != 1 || s.StaleHits != 2 || s.Entries != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	// Product read before invalidation of all products is not stored. Товар, прочитанный до очистки кэша, не сохраняется
+	_, _, gen = c.get("e")
+	c.invalidateAll()
+	c.put("e", &pb.Product{Id: "e"}, gen)
+	if _, result, _ := c.get("e"); result != cacheMiss {
+		t.Errorf("product read before invalidation of all products is stored")
+	}
+}
+
+// Invalidated IDs are bounded, above MaxEntries earlier reads are not stored.
+// Удаленных ID ограниченное число, сверх MaxEntries ранее прочитанные товары не сохраняются.
+func TestProductCache_InvalidatedBound(t *testing.T) {
+	c := newProductCache(Cache{MaxEntries: 2})
+	_, _, gen := c.get("a")
+	for _, id := range []string{"x", "y", "z"} {
+		c.invalidate(id)
+	}
+	if n := len(c.invalidated); n > 2 {
+		t.Errorf("got %d invalidated IDs, want at most 2", n)
+	}
+	c.put("a", &pb.Product{Id: "a"}, gen)
+	if _, result, _ := c.get("a"); result != cacheMiss {
+		t.Errorf("product read before forgotten invalidations is stored")
+	}
+	_, _, gen = c.get("a")
+	c.put("a", &pb.Product{Id: "a"}, gen)
+	if _, result, _ := c.get("a"); result != cacheFresh {
+		t.Errorf("product read after invalidations is not stored")
+	}
+}
+
+func TestClient_Cache(t *testing.T) {
+	srv := &testServer{}
+	c := newTestClient(t, srv, Options{MaxRetries: -1, Cache: &Cache{TTL: time.Minute, StaleWhileRevalidate: time.Hour}})
+	now := time.Now()
+	c.cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	id, err := c.AddProduct(ctx, &pb.Product{Name: "Apple"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetProduct(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 1 {
+		t.Errorf("got %d calls of service, want 1", calls)
+	}
+	if s := c.CacheStats(); s.Hits != 2 || s.Misses != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	// Stale product is returned while service is down. Устаревший товар возвращается, пока сервис недоступен
+	atomic.StoreInt32(&srv.failures, 1<<30)
+	now = now.Add(time.Minute)
+	if p, err := c.GetProduct(ctx, id); err != nil || p.Name != "Apple" {
+		t.Fatalf("stale read during outage: %v, %v", p, err)
+	}
+
+	// Change by client invalidates product. Изменение клиентом удаляет товар из кэша
+	c.InvalidateCache(id)
+	if _, err := c.GetProduct(ctx, id); err == nil {
+		t.Error("invalidated product is read from cache")
+	}
+}
+
+func TestClient_CacheWatchChanges(t *testing.T) {
+	srv := &testServer{events: make(chan *pb.ProductEvent)}
+	c := newTestClient(t, srv, Options{Cache: &Cache{TTL: time.Hour, WatchChanges: true}})
+	ctx := context.Background()
+	id, err := c.AddProduct(ctx, &pb.Product{Name: "Apple"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.GetProduct(ctx, id)
+
+	// Change of other client invalidates cached product. Изменение другого клиента удаляет товар из кэша
+	select {
+	case srv.events <- &pb.ProductEvent{Type: pb.ProductEvent_UPDATED, Revision: 2, Product: &pb.Product{Id: id}}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch is not started")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.CacheStats().Invalidations == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("product is not invalidated by change feed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.GetProduct(ctx, id)
+	if calls := atomic.LoadInt32(&srv.calls); calls != 2 {
+		t.Errorf("got %d calls of service, want 2", calls)
+	}
+}
@@ -0,0 +1,468 @@
+// Package client is a Go client library of ProductInfo service over mTLS.
+// Пакет client - клиентская библиотека сервиса ProductInfo поверх mTLS.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"github.com/gofrs/uuid"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/oauth"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultTimeout is a deadline of call if context has no deadline.
+	// Крайний срок вызова, если у контекста он не задан.
+	DefaultTimeout = 5 * time.Second
+	// DefaultMaxRetries is a number of retries of calls on Unavailable.
+	// Количество повторов вызовов при Unavailable.
+	DefaultMaxRetries = 3
+	// DefaultBackoff is a base of exponential backoff between retries.
+	// Основа экспоненциальной задержки между повторами.
+	DefaultBackoff = 100 * time.Millisecond
+)
+
+// Size of pages read by ListProducts, the maximum of service. Размер страниц ListProducts, максимум сервиса
+const listPageSize = 1000
+
+// Metadata header with idempotency key of AddProduct. Заголовок метаданных с ключом идемпотентности AddProduct
+const idempotencyKeyHeader = "idempotency-key"
+
+// Priorities of calls, on overload service sheds low-priority calls first with Unavailable.
+// PriorityCritical is honored only for client certificates allowed by service, others get PriorityNormal.
+// Приоритеты вызовов, при перегрузке сервис первыми отбрасывает вызовы низкого приоритета с Unavailable.
+// PriorityCritical учитывается только для клиентских сертификатов, разрешенных сервисом, остальным - PriorityNormal.
+const (
+	PriorityCritical = "critical"
+	PriorityNormal   = "normal"
+	PriorityLow      = "low"
+)
+
+// Options of client. Параметры клиента
+type Options struct {
+	// Address of service, for example "localhost:50051" or "dns:///products.example.com:50051",
+	// DNS name resolves to all replicas of service. Адрес сервиса, имя DNS разрешается во все реплики сервиса
+	Address string
+	// Addresses of replicas used instead of Address. Адреса реплик, используемые вместо Address
+	Addresses []string
+	// LoadBalancing of calls between replicas, calls go to the first connected replica if nil.
+	// Балансировка вызовов между репликами, при nil вызовы идут в первую подключенную реплику.
+	LoadBalancing *LoadBalancing
+	// ServerName must match the name in the server certificate.
+	// Должно совпадать с именем в сертификате сервера.
+	ServerName string
+	// Client key pair and CA certificate files. Файлы пары ключей клиента и сертификата УЦ
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// TokenSource gives OAuth2 tokens for each call. Источник токенов OAuth2 для каждого вызова
+	TokenSource oauth2.TokenSource
+	// ClientCredentials obtains tokens from token endpoint instead of TokenSource,
+	// call rejected as Unauthenticated is retried once with new token.
+	// Получение токенов от конечной точки вместо TokenSource, вызов,
+	// отклоненный с Unauthenticated, повторяется один раз с новым токеном.
+	ClientCredentials *ClientCredentials
+	// APIKey is sent as "authorization: ApiKey <key>", it replaces TokenSource and ClientCredentials.
+	// API ключ передается как "authorization: ApiKey <key>", заменяет TokenSource и ClientCredentials.
+	APIKey string
+	// Timeout of call without deadline, DefaultTimeout if zero. Таймаут вызова без крайнего срока
+	Timeout time.Duration
+	// MaxRetries of calls on Unavailable, DefaultMaxRetries if zero, negative disables retries.
+	// gRPC makes at most 5 attempts. Not used with ServiceConfig.
+	// Количество повторов вызовов при Unavailable, отрицательное значение отключает повторы.
+	// gRPC делает не больше 5 попыток. Не используется с ServiceConfig.
+	MaxRetries int
+	// Backoff between retries, DefaultBackoff if zero. Not used with ServiceConfig.
+	// Задержка между повторами. Не используется с ServiceConfig.
+	Backoff time.Duration
+	// ServiceConfig is JSON of gRPC service config with retryPolicy, hedgingPolicy and timeout of methods,
+	// default one is built from MaxRetries and Backoff if empty.
+	// JSON конфигурации сервиса gRPC с retryPolicy, hedgingPolicy и timeout методов,
+	// если пусто - конфигурация по умолчанию строится из MaxRetries и Backoff.
+	ServiceConfig string
+	// CircuitBreaker of methods fails calls at once while service is down, disabled if nil.
+	// Автоматический выключатель методов сразу завершает вызовы, пока сервис недоступен, отключен при nil.
+	CircuitBreaker *CircuitBreaker
+	// Cache of GetProduct results, disabled if nil. Кэш результатов GetProduct, отключен при nil
+	Cache *Cache
+	// DialOptions are appended to options of connection. Дополнительные параметры соединения
+	DialOptions []grpc.DialOption
+}
+
+// Client of ProductInfo service. Клиент сервиса ProductInfo
+type Client struct {
+	conn     *grpc.ClientConn
+	rpc      pb.ProductInfoClient
+	timeout  time.Duration
+	breakers *breakers
+	cache    *productCache
+	// Stops watch of changes for cache. Останавливает наблюдение за изменениями для кэша
+	stopWatch context.CancelFunc
+}
+
+// New creates client and sets up a connection to the service.
+// Создает клиента и устанавливает соединение с сервисом.
+func New(ctx context.Context, opts Options) (*Client, error) {
+	if opts.Address == "" && len(opts.Addresses) == 0 {
+		return nil, errors.New("client: address is required")
+	}
+	tlsConfig, err := newTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultMaxRetries
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = DefaultBackoff
+	}
+
+	if opts.ServiceConfig == "" {
+		opts.ServiceConfig = defaultServiceConfig(opts)
+	}
+	hedgingPolicies, err := parseHedging(opts.ServiceConfig)
+	if err != nil {
+		return nil, err
+	}
+	if opts.LoadBalancing != nil {
+		if opts.ServiceConfig, err = withLoadBalancing(opts.ServiceConfig, opts.LoadBalancing); err != nil {
+			return nil, err
+		}
+	}
+
+	// Retries are made by gRPC inside each hedged attempt. Повторы выполняет gRPC внутри каждой попытки хеджирования
+	interceptors := []grpc.UnaryClientInterceptor{hedgeCalls(hedgingPolicies)}
+	var cb *breakers
+	if opts.CircuitBreaker != nil {
+		cb = newBreakers(*opts.CircuitBreaker)
+		interceptors = append([]grpc.UnaryClientInterceptor{cb.unary}, interceptors...)
+	}
+	if opts.ClientCredentials != nil && opts.APIKey == "" {
+		ts := newClientCredentialsSource(opts.ClientCredentials, tlsConfig)
+		opts.TokenSource = ts
+		interceptors = append(interceptors, retryUnauthenticated(ts))
+	}
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithChainUnaryInterceptor(interceptors...),
+		grpc.WithDefaultServiceConfig(opts.ServiceConfig),
+	}
+	switch {
+	case opts.APIKey != "":
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(apiKeyCredentials(opts.APIKey)))
+	case opts.TokenSource != nil:
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(oauth.TokenSource{TokenSource: opts.TokenSource}))
+	}
+	target := opts.Address
+	if len(opts.Addresses) > 0 {
+		// Static list of replicas is given by resolver of the connection. Статический список реплик задает резолвер соединения
+		r := staticResolver(opts.Addresses)
+		target = r.Scheme() + ":///replicas"
+		dialOpts = append(dialOpts, grpc.WithResolvers(r))
+	}
+	dialOpts = append(dialOpts, opts.DialOptions...)
+
+	conn, err := grpc.DialContext(ctx, target, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("client: did not connect: %w", err)
+	}
+	c := &Client{
+		conn:     conn,
+		rpc:      pb.NewProductInfoClient(conn),
+		timeout:  opts.Timeout,
+		breakers: cb,
+	}
+	if opts.Cache != nil {
+		c.cache = newProductCache(*opts.Cache)
+		if opts.Cache.WatchChanges {
+			var watchCtx context.Context
+			watchCtx, c.stopWatch = context.WithCancel(context.Background())
+			go c.watchChanges(watchCtx, opts.Backoff)
+		}
+	}
+	return c, nil
+}
+
+// Loads key pair and CA pool for mTLS. Загружаем пару ключей и пул сертификатов УЦ для mTLS
+func newTLSConfig(opts Options) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("client: could not load client key pair: %w", err)
+	}
+	ca, err := ioutil.ReadFile(opts.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("client: could not read ca certificate: %w", err)
+	}
+	certPool := x509.NewCertPool()
+	if ok := certPool.AppendCertsFromPEM(ca); !ok {
+		return nil, errors.New("client: failed to append ca certs")
+	}
+	return &tls.Config{
+		ServerName:   opts.ServerName,
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      certPool,
+	}, nil
+}
+
+// Conn returns connection of client. Возвращает соединение клиента
+func (c *Client) Conn() *grpc.ClientConn {
+	return c.conn
+}
+
+// CircuitState returns state of circuit breaker of method, for example "/ecommerce.ProductInfo/getProduct",
+// it is always closed without CircuitBreaker.
+// Возвращает состояние автоматического выключателя метода, без CircuitBreaker он всегда замкнут.
+func (c *Client) CircuitState(method string) CircuitState {
+	if c.breakers == nil {
+		return CircuitClosed
+	}
+	return c.breakers.state(method)
+}
+
+// InvalidateCache removes products from cache, all products if no ID is given.
+// Удаляет товары из кэша, все товары, если ID не заданы.
+func (c *Client) InvalidateCache(ids ...string) {
+	if c.cache == nil {
+		return
+	}
+	if len(ids) == 0 {
+		c.cache.invalidateAll()
+	}
+	for _, id := range ids {
+		c.cache.invalidate(id)
+	}
+}
+
+// CacheStats returns counters of cache, zero without Cache. Возвращает счетчики кэша, нулевые без Cache
+func (c *Client) CacheStats() CacheStats {
+	if c.cache == nil {
+		return CacheStats{}
+	}
+	return c.cache.stats()
+}
+
+// Close closes connection. Закрывает соединение
+func (c *Client) Close() error {
+	if c.stopWatch != nil {
+		c.stopWatch()
+	}
+	return c.conn.Close()
+}
+
+// AddProduct adds product and returns its ID. The call is sent with idempotency key, new one if ctx has no key,
+// so retries of it add product once.
+// Добавляет товар и возвращает его ID. Вызов передается с ключом идемпотентности, новым, если его нет в ctx,
+// поэтому его повторы добавляют товар один раз.
+func (c *Client) AddProduct(ctx context.Context, product *pb.Product) (string, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	if md, _ := metadata.FromOutgoingContext(ctx); len(md.Get(idempotencyKeyHeader)) == 0 {
+		key, err := uuid.NewV4()
+		if err != nil {
+			return "", fmt.Errorf("client: failed to generate idempotency key: %w", err)
+		}
+		ctx = WithIdempotencyKey(ctx, key.String())
+	}
+	res, err := c.rpc.AddProduct(ctx, product, grpc.UseCompressor(gzip.Name))
+	if err != nil {
+		return "", decodeError(err)
+	}
+	return res.Value, nil
+}
+
+// GetProduct returns product by ID, the call is retried on Unavailable or hedged by service config.
+// With Cache the product is read from service only if it isn't cached.
+// Возвращает товар по ID, вызов повторяется при Unavailable или хеджируется по конфигурации сервиса.
+// С Cache товар читается из сервиса, только если его нет в кэше.
+func (c *Client) GetProduct(ctx context.Context, id string) (*pb.Product, error) {
+	if c.cache == nil {
+		return c.getProduct(ctx, id)
+	}
+	product, result, clock := c.cache.get(id)
+	switch result {
+	case cacheFresh, cacheStale:
+		return product, nil
+	case cacheRefresh:
+		go c.refresh(id, clock)
+		return product, nil
+	}
+	product, err := c.getProduct(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.put(id, product, clock)
+	return product, nil
+}
+
+func (c *Client) getProduct(ctx context.Context, id string) (*pb.Product, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	product, err := c.rpc.GetProduct(ctx, &pb.ProductID{Value: id})
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return product, nil
+}
+
+// Refreshes stale product in background, it is kept if service is unavailable.
+// Обновляем устаревший товар в фоне, он сохраняется, если сервис недоступен.
+func (c *Client) refresh(id string, clock uint64) {
+	product, err := c.getProduct(context.Background(), id)
+	if status.Code(err) == codes.NotFound {
+		c.cache.invalidate(id)
+	}
+	c.cache.refreshed(id, product, clock)
+}
+
+// UpdateProduct replaces product with the same ID, the call is retried as it is idempotent.
+// Заменяет товар с тем же ID, вызов повторяется, так как идемпотентен.
+func (c *Client) UpdateProduct(ctx context.Context, product *pb.Product) (*pb.Product, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	res, err := c.rpc.UpdateProduct(ctx, product, grpc.UseCompressor(gzip.Name))
+	c.InvalidateCache(product.GetId())
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return res, nil
+}
+
+// DeleteProduct deletes product by ID. Удаляет товар по ID
+func (c *Client) DeleteProduct(ctx context.Context, id string) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	_, err := c.rpc.DeleteProduct(ctx, &pb.ProductID{Value: id})
+	c.InvalidateCache(id)
+	if err != nil {
+		return decodeError(err)
+	}
+	return nil
+}
+
+// ListOptions selects page and order of ListProductsPage. Задает страницу и порядок ListProductsPage
+type ListOptions struct {
+	// Maximum number of products in page, service default if zero. Максимум товаров на странице
+	PageSize int32
+	// NextPageToken of previous page, empty for the first page. NextPageToken предыдущей страницы
+	PageToken string
+	// Fields of order, for example "price desc, name", order by ID if empty.
+	// Поля порядка, например "price desc, name", порядок по ID, если пусто.
+	OrderBy string
+	// Expression of product fields, for example `price < 1000 AND name:"Samsung*"`, all products if empty.
+	// Выражение полей товара, например `price < 1000 AND name:"Samsung*"`, все товары, если пусто.
+	Filter string
+}
+
+// ListProductsPage returns one page of products, NextPageToken of response is empty on the last page.
+// Возвращает одну страницу товаров, NextPageToken ответа пуст на последней странице.
+func (c *Client) ListProductsPage(ctx context.Context, opts ListOptions) (*pb.ListProductsResponse, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	res, err := c.rpc.ListProducts(ctx, &pb.ListProductsRequest{
+		PageSize:  opts.PageSize,
+		PageToken: opts.PageToken,
+		OrderBy:   opts.OrderBy,
+		Filter:    opts.Filter,
+	})
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return res, nil
+}
+
+// ListProducts returns all products in order of orderBy, by ID if empty, reading them page by page.
+// Возвращает все товары в порядке orderBy, по ID, если пусто, читая их постранично.
+func (c *Client) ListProducts(ctx context.Context, orderBy ...string) ([]*pb.Product, error) {
+	return c.ListAllProducts(ctx, ListOptions{OrderBy: strings.Join(orderBy, ",")})
+}
+
+// ListAllProducts returns products of all pages from opts.PageToken, matching opts.Filter in order of opts.OrderBy.
+// Возвращает товары всех страниц начиная с opts.PageToken, подходящие под opts.Filter, в порядке opts.OrderBy.
+func (c *Client) ListAllProducts(ctx context.Context, opts ListOptions) ([]*pb.Product, error) {
+	if opts.PageSize == 0 {
+		opts.PageSize = listPageSize
+	}
+	var products []*pb.Product
+	for {
+		res, err := c.ListProductsPage(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, res.Products...)
+		if res.NextPageToken == "" {
+			return products, nil
+		}
+		opts.PageToken = res.NextPageToken
+	}
+}
+
+// SearchOptions selects page and filter of SearchProducts. Задает страницу и фильтр SearchProducts
+type SearchOptions struct {
+	// Maximum number of results in page, service default if zero. Максимум результатов на странице
+	PageSize int32
+	// NextPageToken of previous page, empty for the first page. It is rejected with InvalidArgument after
+	// products are changed, then the search starts from the first page.
+	// NextPageToken предыдущей страницы, пусто для первой. Отклоняется с InvalidArgument после изменения
+	// товаров, тогда поиск начинается с первой страницы.
+	PageToken string
+	// Expression of product fields like ListOptions.Filter. Выражение полей товара, как ListOptions.Filter
+	Filter string
+}
+
+// SearchProducts returns one page of products having words of query in name or description, the most relevant first.
+// Возвращает одну страницу товаров со словами запроса в названии или описании, самые релевантные первыми.
+func (c *Client) SearchProducts(ctx context.Context, query string, opts SearchOptions) (*pb.SearchProductsResponse, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	res, err := c.rpc.SearchProducts(ctx, &pb.SearchProductsRequest{
+		Query:     query,
+		PageSize:  opts.PageSize,
+		PageToken: opts.PageToken,
+		Filter:    opts.Filter,
+	})
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return res, nil
+}
+
+// Sets default deadline if context has no one. Задаем крайний срок по умолчанию, если его нет
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// WithIdempotencyKey sets key of AddProduct, calls with the same key add product once, so the caller
+// may retry it safely, for example after restart of import.
+// Задает ключ AddProduct, вызовы с одним ключом добавляют товар один раз, поэтому вызывающий
+// может безопасно повторить его, например после перезапуска импорта.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, idempotencyKeyHeader, key)
+}
+
+// WithPriority sets priority of calls made with ctx. Задает приоритет вызовов, сделанных с ctx
+func WithPriority(ctx context.Context, priority string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "x-priority", priority)
+}
@@ -0,0 +1,265 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blablatov/stream-mtls-grpc/internal/testcerts"
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"golang.org/x/oauth2"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testToken = "blablatok-tokblabla-blablatok"
+
+// Test server of ProductInfo. Тестовый сервер ProductInfo
+type testServer struct {
+	pb.UnimplementedProductInfoServer
+	mu       sync.Mutex
+	products map[string]*pb.Product
+	// Number of calls failed with Unavailable before success. Количество вызовов, завершаемых Unavailable
+	failures int32
+	calls    int32
+	delay    time.Duration
+	// Only first slowCalls calls are delayed if not zero. Если не ноль, задерживаются только первые вызовы
+	slowCalls int32
+	// Number of AddProduct calls failed with Unavailable after product is added, as if response is lost.
+	// Количество вызовов AddProduct, завершаемых Unavailable после добавления, как будто ответ потерян.
+	addFailures int32
+	addCalls    int32
+	// Idempotency keys of AddProduct calls and IDs added by them. Ключи идемпотентности и добавленные по ним ID
+	keys  []string
+	byKey map[string]string
+	added int
+	// Events sent to WatchProducts streams. События, передаваемые в потоки WatchProducts
+	events chan *pb.ProductEvent
+	// Checks token, testToken is valid if nil. Проверяет токен, при nil действителен testToken
+	validToken func(token string) bool
+}
+
+func (s *testServer) AddProduct(ctx context.Context, in *pb.Product) (*pb.ProductID, error) {
+	if in.Name == "-1" {
+		st, _ := status.New(codes.InvalidArgument, "Invalid information received").WithDetails(
+			&epb.BadRequest_FieldViolation{Field: "Name", Description: "Order Name received is not valid"})
+		return nil, st.Err()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	key := strings.Join(md.Get("idempotency-key"), ",")
+	s.mu.Lock()
+	s.keys = append(s.keys, key)
+	id, seen := s.byKey[key]
+	if !seen {
+		id = "id-" + in.Name
+		in.Id = id
+		s.products[id] = in
+		s.byKey[key] = id
+		s.added++
+	}
+	s.mu.Unlock()
+	if atomic.AddInt32(&s.addCalls, 1) <= s.addFailures {
+		return nil, status.Errorf(codes.Unavailable, "response is lost")
+	}
+	return &pb.ProductID{Value: id}, nil
+}
+
+func (s *testServer) GetProduct(ctx context.Context, in *pb.ProductID) (*pb.Product, error) {
+	n := atomic.AddInt32(&s.calls, 1)
+	if n <= s.failures {
+		return nil, status.Errorf(codes.Unavailable, "try again")
+	}
+	if s.delay > 0 && (s.slowCalls == 0 || n <= s.slowCalls) {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.products[in.Value]; ok {
+		return p, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "%v\nProduct does not exist.", in.Value)
+}
+
+// Pages of at most two products in ID order, token is offset. Страницы не более двух товаров по порядку ID
+func (s *testServer) ListProducts(ctx context.Context, in *pb.ListProductsRequest) (*pb.ListProductsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.products))
+	for id := range s.products {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	offset, _ := strconv.Atoi(in.PageToken)
+	out := &pb.ListProductsResponse{TotalSize: int32(len(ids))}
+	for _, id := range ids[offset:] {
+		if len(out.Products) == 2 {
+			out.NextPageToken = strconv.Itoa(offset + 2)
+			break
+		}
+		out.Products = append(out.Products, s.products[id])
+	}
+	return out, nil
+}
+
+func (s *testServer) WatchProducts(in *pb.WatchRequest, stream pb.ProductInfo_WatchProductsServer) error {
+	for {
+		select {
+		case e := <-s.events:
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Checks token of each call. Проверяем токен каждого вызова
+func (s *testServer) checkToken(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	valid := s.validToken
+	if valid == nil {
+		valid = func(token string) bool { return token == testToken }
+	}
+	if auth := md["authorization"]; len(auth) != 1 || !strings.HasPrefix(auth[0], "Bearer ") || !valid(auth[0][len("Bearer "):]) {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid token")
+	}
+	return handler(ctx, req)
+}
+
+func newTestClient(t *testing.T, srv *testServer, opts Options) *Client {
+	return newTestClientCerts(t, testcerts.New(t, "client"), srv, opts)
+}
+
+// Starts test server with health service, returns its address. Запускаем тестовый сервер с сервисом здоровья
+func startTestServer(t *testing.T, certs *testcerts.Certs, srv *testServer) (string, *health.Server) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(certs.ServerTLS())), grpc.UnaryInterceptor(srv.checkToken))
+	srv.products = make(map[string]*pb.Product)
+	srv.byKey = make(map[string]string)
+	pb.RegisterProductInfoServer(s, srv)
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String(), hs
+}
+
+func newTestClientCerts(t *testing.T, certs *testcerts.Certs, srv *testServer, opts Options) *Client {
+	if len(opts.Addresses) == 0 {
+		opts.Address, _ = startTestServer(t, certs, srv)
+	}
+	opts.ServerName = "localhost"
+	opts.CertFile, opts.KeyFile, opts.CAFile = certs.ClientCert, certs.ClientKey, certs.CAFile
+	if opts.ClientCredentials == nil {
+		opts.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: testToken})
+	}
+	c, err := New(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient_AddAndGetProduct(t *testing.T) {
+	c := newTestClient(t, &testServer{}, Options{})
+	ctx := context.Background()
+
+	id, err := c.AddProduct(ctx, &pb.Product{Name: "Sumsung S9999", Description: "Samsung Galaxy S9999", Price: 7777.0})
+	if err != nil {
+		t.Fatalf("AddProduct: %v", err)
+	}
+	product, err := c.GetProduct(ctx, id)
+	if err != nil {
+		t.Fatalf("GetProduct: %v", err)
+	}
+	if product.Name != "Sumsung S9999" {
+		t.Errorf("unexpected product %v", product)
+	}
+}
+
+func TestClient_ListProducts(t *testing.T) {
+	c := newTestClient(t, &testServer{}, Options{})
+	ctx := context.Background()
+	for _, name := range []string{"e", "a", "d", "b", "c"} {
+		if _, err := c.AddProduct(ctx, &pb.Product{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := c.ListProductsPage(ctx, ListOptions{PageSize: 2})
+	if err != nil || len(page.Products) != 2 || page.NextPageToken == "" || page.TotalSize != 5 {
+		t.Fatalf("first page: %v, %v", page, err)
+	}
+	// All pages are read. Читаются все страницы
+	products, err := c.ListProducts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range products {
+		names = append(names, p.Name)
+	}
+	if got := strings.Join(names, ""); got != "abcde" {
+		t.Errorf("got products %s, want abcde", got)
+	}
+}
+
+func TestClient_DecodeError(t *testing.T) {
+	c := newTestClient(t, &testServer{}, Options{})
+
+	_, err := c.AddProduct(context.Background(), &pb.Product{Name: "-1"})
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("got %T, want *Error", err)
+	}
+	if e.Code != codes.InvalidArgument || len(e.FieldViolations) != 1 || e.FieldViolations[0].Field != "Name" {
+		t.Errorf("unexpected error %v", e)
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("status.Code: got %s", status.Code(err))
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	srv := &testServer{failures: 2}
+	c := newTestClient(t, srv, Options{Backoff: time.Millisecond})
+
+	_, err := c.GetProduct(context.Background(), "unknown")
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want NotFound after retries", err)
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+}
+
+func TestClient_DefaultDeadline(t *testing.T) {
+	c := newTestClient(t, &testServer{delay: time.Second}, Options{Timeout: 50 * time.Millisecond})
+
+	_, err := c.GetProduct(context.Background(), "unknown")
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error is a decoded error of ProductInfo service with details of google.rpc model.
+// Декодированная ошибка сервиса ProductInfo с деталями модели google.rpc.
+type Error struct {
+	Code    codes.Code
+	Message string
+	// Invalid fields of request (BadRequest). Некорректные поля запроса
+	FieldViolations []*epb.BadRequest_FieldViolation
+	// Other details of error. Прочие детали ошибки
+	Details []interface{}
+
+	status *status.Status
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "productinfo: %s: %s", e.Code, e.Message)
+	for _, v := range e.FieldViolations {
+		fmt.Fprintf(&b, "; %s: %s", v.Field, v.Description)
+	}
+	return b.String()
+}
+
+// GRPCStatus keeps status.Code and status.FromError working with Error.
+// Позволяет использовать status.Code и status.FromError с Error.
+func (e *Error) GRPCStatus() *status.Status {
+	return e.status
+}
+
+// Decodes gRPC error to Error. Декодируем ошибку gRPC в Error
+func decodeError(err error) error {
+	// Open circuit is kept, so errors.Is works. Разомкнутый выключатель сохраняется для errors.Is
+	if err == ErrCircuitOpen {
+		return err
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	e := &Error{Code: s.Code(), Message: s.Message(), status: s}
+	for _, d := range s.Details() {
+		switch info := d.(type) {
+		// Server sends single field violation. Сервер отправляет отдельное нарушение поля
+		case *epb.BadRequest_FieldViolation:
+			e.FieldViolations = append(e.FieldViolations, info)
+		case *epb.BadRequest:
+			e.FieldViolations = append(e.FieldViolations, info.FieldViolations...)
+		default:
+			e.Details = append(e.Details, info)
+		}
+	}
+	return e
+}
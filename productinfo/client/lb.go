@@ -0,0 +1,350 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/health" // Registers client-side health checking. Регистрирует проверку здоровья
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+// Policies of load balancing. Политики балансировки нагрузки
+const (
+	// RoundRobin sends calls to replicas in turn. Отправляет вызовы репликам по очереди
+	RoundRobin = "round_robin"
+	// LeastRequest sends call to the less loaded of two random replicas.
+	// Отправляет вызов менее загруженной из двух случайных реплик.
+	LeastRequest = "least_request"
+)
+
+// Defaults of outlier ejection. Значения по умолчанию исключения выбросов
+const (
+	DefaultConsecutiveFailures = 5
+	DefaultBaseEjectionTime    = 30 * time.Second
+	DefaultMaxEjectionTime     = 5 * time.Minute
+	DefaultMaxEjectionPercent  = 50
+)
+
+// Name of balancer registered in gRPC. Имя балансировщика, зарегистрированного в gRPC
+const balancerName = "productinfo_lb"
+
+func init() {
+	balancer.Register(&lbBuilder{})
+}
+
+// LoadBalancing of calls between replicas of service. Балансировка вызовов между репликами сервиса
+type LoadBalancing struct {
+	// Policy is RoundRobin or LeastRequest. Политика RoundRobin или LeastRequest
+	Policy string
+	// HealthCheck excludes replicas not serving by grpc.health.v1 service.
+	// Исключает реплики, не обслуживающие по сервису grpc.health.v1.
+	HealthCheck bool
+	// OutlierEjection is disabled if nil. Исключение выбросов отключено при nil
+	OutlierEjection *OutlierEjection
+}
+
+// OutlierEjection excludes replica after ConsecutiveFailures calls failed with Unavailable, DeadlineExceeded,
+// Internal or Unknown. Replica is excluded for BaseEjectionTime multiplied by number of its ejections in a row,
+// but not longer than MaxEjectionTime. Not more than MaxEjectionPercent of replicas are excluded at once.
+// Исключает реплику после ConsecutiveFailures вызовов подряд с Unavailable, DeadlineExceeded, Internal или Unknown.
+// Реплика исключается на BaseEjectionTime, умноженное на число ее исключений подряд, но не дольше MaxEjectionTime.
+// Одновременно исключается не больше MaxEjectionPercent реплик. Нулевые поля получают значения по умолчанию.
+type OutlierEjection struct {
+	ConsecutiveFailures int
+	BaseEjectionTime    time.Duration
+	MaxEjectionTime     time.Duration
+	MaxEjectionPercent  int
+}
+
+// Config of balancer in loadBalancingConfig of service config. Конфигурация балансировщика в конфигурации сервиса
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	Policy              string `json:"policy"`
+	ConsecutiveFailures int    `json:"consecutiveFailures,omitempty"`
+	BaseEjectionTime    string `json:"baseEjectionTime,omitempty"`
+	MaxEjectionTime     string `json:"maxEjectionTime,omitempty"`
+	MaxEjectionPercent  int    `json:"maxEjectionPercent,omitempty"`
+
+	baseEjection time.Duration
+	maxEjection  time.Duration
+}
+
+// Adds balancer and health checking to service config. Добавляем балансировщик и проверку здоровья в конфигурацию сервиса
+func withLoadBalancing(config string, lb *LoadBalancing) (string, error) {
+	if lb.Policy != RoundRobin && lb.Policy != LeastRequest {
+		return "", fmt.Errorf("client: unknown load balancing policy %q", lb.Policy)
+	}
+	cfg := lbConfig{Policy: lb.Policy}
+	if o := lb.OutlierEjection; o != nil {
+		cfg.ConsecutiveFailures = o.ConsecutiveFailures
+		if cfg.ConsecutiveFailures == 0 {
+			cfg.ConsecutiveFailures = DefaultConsecutiveFailures
+		}
+		cfg.BaseEjectionTime, cfg.MaxEjectionTime = jsonDuration(o.BaseEjectionTime), jsonDuration(o.MaxEjectionTime)
+		cfg.MaxEjectionPercent = o.MaxEjectionPercent
+	}
+	sc := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(config), &sc); err != nil {
+		return "", fmt.Errorf("client: invalid service config: %w", err)
+	}
+	sc["loadBalancingConfig"] = []map[string]lbConfig{{balancerName: cfg}}
+	if lb.HealthCheck {
+		// Empty name is health of the whole server. Пустое имя - здоровье всего сервера
+		sc["healthCheckConfig"] = map[string]string{"serviceName": ""}
+	}
+	data, err := json.Marshal(sc)
+	return string(data), err
+}
+
+// Resolver of static list of replicas. Резолвер статического списка реплик
+func staticResolver(addresses []string) *manual.Resolver {
+	r := manual.NewBuilderWithScheme("productinfo-static")
+	state := resolver.State{}
+	for _, a := range addresses {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: a})
+	}
+	r.InitialState(state)
+	return r
+}
+
+type lbBuilder struct{}
+
+func (lbBuilder) Name() string {
+	return balancerName
+}
+
+func (lbBuilder) ParseConfig(data json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &lbConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Policy != RoundRobin && cfg.Policy != LeastRequest {
+		return nil, fmt.Errorf("unknown policy %q", cfg.Policy)
+	}
+	if cfg.ConsecutiveFailures < 0 || cfg.MaxEjectionPercent < 0 || cfg.MaxEjectionPercent > 100 {
+		return nil, errors.New("invalid outlier ejection")
+	}
+	if cfg.MaxEjectionPercent == 0 {
+		cfg.MaxEjectionPercent = DefaultMaxEjectionPercent
+	}
+	var err error
+	if cfg.baseEjection, err = parseJSONDuration(cfg.BaseEjectionTime, DefaultBaseEjectionTime); err != nil {
+		return nil, err
+	}
+	if cfg.maxEjection, err = parseJSONDuration(cfg.MaxEjectionTime, DefaultMaxEjectionTime); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func parseJSONDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	if d == 0 {
+		return def, nil
+	}
+	return d, nil
+}
+
+// Each connection gets its own base balancer and state of replicas.
+// Каждое соединение получает свой базовый балансировщик и состояние реплик.
+func (b lbBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	replicas := &replicaSet{stats: make(map[balancer.SubConn]*replicaStats), now: time.Now}
+	pb := &pickerBuilder{replicas: replicas}
+	return &lbBalancer{
+		Balancer: base.NewBalancerBuilder(balancerName, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		replicas: replicas,
+	}
+}
+
+// Base balancer that keeps ready subchannels, config is taken for picker.
+// Базовый балансировщик, хранящий готовые подканалы, конфигурация передается выбору.
+type lbBalancer struct {
+	balancer.Balancer
+	replicas *replicaSet
+}
+
+func (b *lbBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*lbConfig); ok {
+		b.replicas.setConfig(cfg)
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// State of replicas kept between pickers. Состояние реплик, сохраняемое между выборами
+type replicaSet struct {
+	mu    sync.Mutex
+	cfg   lbConfig
+	stats map[balancer.SubConn]*replicaStats
+	now   func() time.Time
+}
+
+type replicaStats struct {
+	outstanding int32 // Calls in progress. Выполняемые вызовы
+
+	// Guarded by replicaSet.mu. Защищены replicaSet.mu
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func (r *replicaSet) setConfig(cfg *lbConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfg = *cfg
+}
+
+func (r *replicaSet) policy() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg.Policy
+}
+
+// Keeps stats of ready subchannels only. Сохраняем статистику только готовых подканалов
+func (r *replicaSet) update(ready map[balancer.SubConn]base.SubConnInfo) []*replica {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for sc := range r.stats {
+		if _, ok := ready[sc]; !ok {
+			delete(r.stats, sc)
+		}
+	}
+	out := make([]*replica, 0, len(ready))
+	for sc := range ready {
+		s, ok := r.stats[sc]
+		if !ok {
+			s = &replicaStats{}
+			r.stats[sc] = s
+		}
+		out = append(out, &replica{sc: sc, stats: s})
+	}
+	return out
+}
+
+// Replicas not ejected now, all replicas if every one is ejected.
+// Реплики, не исключенные сейчас, все реплики, если исключены все.
+func (r *replicaSet) available(all []*replica) []*replica {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	out := make([]*replica, 0, len(all))
+	for _, rep := range all {
+		if !now.Before(rep.stats.ejectedUntil) {
+			out = append(out, rep)
+		}
+	}
+	if len(out) == 0 {
+		return all
+	}
+	return out
+}
+
+// Counts result of call and ejects replica after consecutive failures.
+// Учитываем результат вызова и исключаем реплику после нескольких ошибок подряд.
+func (r *replicaSet) record(s *replicaStats, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cfg.ConsecutiveFailures == 0 {
+		return
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+	default:
+		s.failures = 0
+		if err == nil && !r.now().Before(s.ejectedUntil) {
+			s.ejections = 0
+		}
+		return
+	}
+	if s.failures++; s.failures < r.cfg.ConsecutiveFailures {
+		return
+	}
+	now := r.now()
+	if now.Before(s.ejectedUntil) {
+		return
+	}
+	ejected := 0
+	for _, other := range r.stats {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > r.cfg.MaxEjectionPercent*len(r.stats) {
+		return
+	}
+	s.ejections++
+	d := r.cfg.baseEjection * time.Duration(s.ejections)
+	if d > r.cfg.maxEjection {
+		d = r.cfg.maxEjection
+	}
+	s.ejectedUntil, s.failures = now.Add(d), 0
+}
+
+type replica struct {
+	sc    balancer.SubConn
+	stats *replicaStats
+}
+
+type pickerBuilder struct {
+	replicas *replicaSet
+}
+
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	all := b.replicas.update(info.ReadySCs)
+	return &picker{replicas: b.replicas, all: all, leastRequest: b.replicas.policy() == LeastRequest, next: uint32(rand.Intn(len(all)))}
+}
+
+type picker struct {
+	replicas     *replicaSet
+	all          []*replica
+	leastRequest bool
+	next         uint32
+}
+
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	available := p.replicas.available(p.all)
+	var rep *replica
+	switch {
+	case p.leastRequest && len(available) > 1:
+		// Power of two random choices. Лучшая из двух случайных реплик
+		i := rand.Intn(len(available))
+		j := rand.Intn(len(available) - 1)
+		if j >= i {
+			j++
+		}
+		rep = available[i]
+		if atomic.LoadInt32(&available[j].stats.outstanding) < atomic.LoadInt32(&rep.stats.outstanding) {
+			rep = available[j]
+		}
+	default:
+		rep = available[int(atomic.AddUint32(&p.next, 1))%len(available)]
+	}
+	atomic.AddInt32(&rep.stats.outstanding, 1)
+	return balancer.PickResult{
+		SubConn: rep.sc,
+		Done: func(di balancer.DoneInfo) {
+			atomic.AddInt32(&rep.stats.outstanding, -1)
+			p.replicas.record(rep.stats, di.Err)
+		},
+	}, nil
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blablatov/stream-mtls-grpc/internal/testcerts"
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Replicas of service for tests of balancing. Реплики сервиса для тестов балансировки
+type testReplicas struct {
+	servers []*testServer
+	health  []*health.Server
+	client  *Client
+}
+
+func newTestReplicas(t *testing.T, servers []*testServer, lb *LoadBalancing, prepare func(*testReplicas)) *testReplicas {
+	certs := testcerts.New(t, "client")
+	r := &testReplicas{servers: servers}
+	var addresses []string
+	for _, srv := range servers {
+		addr, hs := startTestServer(t, certs, srv)
+		addresses = append(addresses, addr)
+		r.health = append(r.health, hs)
+	}
+	if prepare != nil {
+		prepare(r)
+	}
+	r.client = newTestClientCerts(t, certs, &testServer{}, Options{Addresses: addresses, LoadBalancing: lb, MaxRetries: -1})
+	return r
+}
+
+// Waits until the given replicas get calls, so they are connected. Ждем вызовов в заданные реплики, то есть их подключения
+func (r *testReplicas) waitReady(t *testing.T, replicas ...int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, i := range replicas {
+		for atomic.LoadInt32(&r.servers[i].addCalls) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("replica %d is not ready", i)
+			}
+			r.client.AddProduct(context.Background(), &pb.Product{Name: "warm-up"})
+		}
+	}
+}
+
+func (r *testReplicas) getProducts(n int) {
+	for i := 0; i < n; i++ {
+		r.client.GetProduct(context.Background(), "unknown")
+	}
+}
+
+func (r *testReplicas) calls() []int32 {
+	out := make([]int32, len(r.servers))
+	for i, srv := range r.servers {
+		out[i] = atomic.LoadInt32(&srv.calls)
+	}
+	return out
+}
+
+func TestLoadBalancing_RoundRobin(t *testing.T) {
+	r := newTestReplicas(t, []*testServer{{}, {}, {}}, &LoadBalancing{Policy: RoundRobin}, nil)
+	r.waitReady(t, 0, 1, 2)
+	r.getProducts(30)
+	for i, n := range r.calls() {
+		if n != 10 {
+			t.Errorf("replica %d got %d calls of 30, want 10: %v", i, n, r.calls())
+			break
+		}
+	}
+}
+
+func TestLoadBalancing_LeastRequest(t *testing.T) {
+	slow := &testServer{delay: time.Second}
+	r := newTestReplicas(t, []*testServer{slow, {}, {}}, &LoadBalancing{Policy: LeastRequest}, nil)
+	r.waitReady(t, 0, 1, 2)
+
+	// Slow replica keeps its calls outstanding, so new calls go to others.
+	// Медленная реплика держит свои вызовы, поэтому новые вызовы идут в другие.
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.client.GetProduct(context.Background(), "unknown")
+		}()
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+	if n := r.calls()[0]; n > 3 {
+		t.Errorf("slow replica got %d calls of 30: %v", n, r.calls())
+	}
+}
+
+func TestLoadBalancing_HealthCheck(t *testing.T) {
+	r := newTestReplicas(t, []*testServer{{}, {}, {}}, &LoadBalancing{Policy: RoundRobin, HealthCheck: true},
+		func(r *testReplicas) { r.health[0].SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING) })
+	r.waitReady(t, 1, 2)
+	r.getProducts(20)
+	if calls := r.calls(); calls[0] != 0 || calls[1] != 10 || calls[2] != 10 {
+		t.Errorf("calls of replicas with the first one not serving: %v", calls)
+	}
+
+	// Replica gets calls again when it is serving. Реплика снова получает вызовы, когда обслуживает
+	r.health[0].SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	r.waitReady(t, 0)
+}
+
+func TestLoadBalancing_OutlierEjection(t *testing.T) {
+	failing := &testServer{failures: 1 << 30}
+	r := newTestReplicas(t, []*testServer{failing, {}, {}}, &LoadBalancing{
+		Policy:          RoundRobin,
+		OutlierEjection: &OutlierEjection{ConsecutiveFailures: 2, BaseEjectionTime: time.Minute},
+	}, nil)
+	r.waitReady(t, 0, 1, 2)
+	r.getProducts(30)
+	if calls := r.calls(); calls[0] != 2 || calls[1]+calls[2] != 28 {
+		t.Errorf("failing replica is not ejected after 2 failures: %v", calls)
+	}
+}
+
+func TestWithLoadBalancing(t *testing.T) {
+	config, err := withLoadBalancing(defaultServiceConfig(Options{MaxRetries: 1}), &LoadBalancing{
+		Policy: LeastRequest, HealthCheck: true, OutlierEjection: &OutlierEjection{BaseEjectionTime: time.Second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sc struct {
+		MethodConfig        []methodConfig                `json:"methodConfig"`
+		LoadBalancingConfig []map[string]json.RawMessage  `json:"loadBalancingConfig"`
+		HealthCheckConfig   *struct{ ServiceName string } `json:"healthCheckConfig"`
+	}
+	if err := json.Unmarshal([]byte(config), &sc); err != nil {
+		t.Fatal(err)
+	}
+	if len(sc.MethodConfig) != 4 || sc.HealthCheckConfig == nil || len(sc.LoadBalancingConfig) != 1 {
+		t.Fatalf("unexpected service config %s", config)
+	}
+	parsed, err := lbBuilder{}.ParseConfig(sc.LoadBalancingConfig[0][balancerName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := parsed.(*lbConfig)
+	if cfg.Policy != LeastRequest || cfg.ConsecutiveFailures != DefaultConsecutiveFailures ||
+		cfg.baseEjection != time.Second || cfg.maxEjection != DefaultMaxEjectionTime || cfg.MaxEjectionPercent != DefaultMaxEjectionPercent {
+		t.Errorf("unexpected balancer config %+v", cfg)
+	}
+
+	if _, err := withLoadBalancing(config, &LoadBalancing{Policy: "random"}); err == nil {
+		t.Error("unknown policy is accepted")
+	}
+	for _, bad := range []string{`{"policy":"random"}`, `{"policy":"round_robin","maxEjectionPercent":101}`, `{"policy":"round_robin","baseEjectionTime":"x"}`} {
+		if _, err := (lbBuilder{}).ParseConfig(json.RawMessage(bad)); err == nil {
+			t.Errorf("invalid config %s is accepted", bad)
+		}
+	}
+}
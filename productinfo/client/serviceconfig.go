@@ -0,0 +1,223 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Per-method timeouts of default service config. Таймауты методов в конфигурации сервиса по умолчанию
+const (
+	DefaultReadTimeout  = 2 * time.Second
+	DefaultListTimeout  = 10 * time.Second
+	DefaultWriteTimeout = 5 * time.Second
+)
+
+// gRPC service config (https://github.com/grpc/grpc/blob/master/doc/service_config.md), only method config is used.
+// retryPolicy and timeout are applied by gRPC, hedgingPolicy is applied by client, as grpc-go doesn't support it.
+// Конфигурация сервиса gRPC, используется только конфигурация методов.
+// retryPolicy и timeout применяет gRPC, hedgingPolicy применяет клиент, так как grpc-go ее не поддерживает.
+type serviceConfig struct {
+	MethodConfig []methodConfig `json:"methodConfig"`
+}
+
+type methodConfig struct {
+	Name          []methodName   `json:"name"`
+	Timeout       string         `json:"timeout,omitempty"`
+	RetryPolicy   *retryPolicy   `json:"retryPolicy,omitempty"`
+	HedgingPolicy *hedgingPolicy `json:"hedgingPolicy,omitempty"`
+}
+
+// Method name, empty method means all methods of service. Имя метода, пустой метод - все методы сервиса
+type methodName struct {
+	Service string `json:"service"`
+	Method  string `json:"method,omitempty"`
+}
+
+type retryPolicy struct {
+	MaxAttempts          int      `json:"maxAttempts"`
+	InitialBackoff       string   `json:"initialBackoff"`
+	MaxBackoff           string   `json:"maxBackoff"`
+	BackoffMultiplier    float64  `json:"backoffMultiplier"`
+	RetryableStatusCodes []string `json:"retryableStatusCodes"`
+}
+
+// Hedged call sends up to MaxAttempts copies of request HedgingDelay apart and takes the first result,
+// so a slow server doesn't delay it. Suitable only for idempotent calls.
+// Хеджированный вызов отправляет до MaxAttempts копий запроса с интервалом HedgingDelay и берет первый результат,
+// поэтому медленный сервер его не задерживает. Подходит только для идемпотентных вызовов.
+type hedgingPolicy struct {
+	MaxAttempts         int      `json:"maxAttempts"`
+	HedgingDelay        string   `json:"hedgingDelay"`
+	NonFatalStatusCodes []string `json:"nonFatalStatusCodes"`
+}
+
+// Parsed hedging policy. Разобранная политика хеджирования
+type hedging struct {
+	maxAttempts int
+	delay       time.Duration
+	nonFatal    map[codes.Code]bool
+}
+
+// Builds default service config: calls are retried on Unavailable with exponential backoff and
+// have per-method timeouts. AddProduct is retried too, as it is sent with idempotency key. DeleteProduct
+// is not retried, as retry of delete done before lost response would fail with NotFound.
+// Создаем конфигурацию сервиса по умолчанию: вызовы повторяются при Unavailable с экспоненциальной задержкой
+// и имеют таймауты методов. AddProduct тоже повторяется, так как передается с ключом идемпотентности. DeleteProduct
+// не повторяется, так как повтор удаления, выполненного до потери ответа, завершился бы NotFound.
+func defaultServiceConfig(opts Options) string {
+	var retry *retryPolicy
+	if opts.MaxRetries > 0 {
+		retry = &retryPolicy{
+			MaxAttempts:          opts.MaxRetries + 1,
+			InitialBackoff:       jsonDuration(opts.Backoff),
+			MaxBackoff:           jsonDuration(opts.Backoff * 10),
+			BackoffMultiplier:    2,
+			RetryableStatusCodes: []string{"UNAVAILABLE"},
+		}
+	}
+	service := pb.ProductInfo_ServiceDesc.ServiceName
+	names := func(methods ...string) []methodName {
+		out := make([]methodName, len(methods))
+		for i, m := range methods {
+			out[i] = methodName{Service: service, Method: m}
+		}
+		return out
+	}
+	sc := serviceConfig{MethodConfig: []methodConfig{
+		{Name: names("getProduct"), Timeout: jsonDuration(DefaultReadTimeout), RetryPolicy: retry},
+		{Name: names("listProducts", "searchProducts"), Timeout: jsonDuration(DefaultListTimeout), RetryPolicy: retry},
+		{Name: names("addProduct", "updateProduct"), Timeout: jsonDuration(DefaultWriteTimeout), RetryPolicy: retry},
+		{Name: names("deleteProduct"), Timeout: jsonDuration(DefaultWriteTimeout)},
+	}}
+	data, err := json.Marshal(sc)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// Durations of service config are seconds with suffix "s". Длительности в конфигурации - секунды с суффиксом "s"
+func jsonDuration(d time.Duration) string {
+	return fmt.Sprintf("%gs", d.Seconds())
+}
+
+// Parses hedging policies by full method name, "/service/" key is used for all methods of service.
+// Разбираем политики хеджирования по полному имени метода, ключ "/service/" - для всех методов сервиса.
+func parseHedging(config string) (map[string]hedging, error) {
+	var sc serviceConfig
+	if err := json.Unmarshal([]byte(config), &sc); err != nil {
+		return nil, fmt.Errorf("client: invalid service config: %w", err)
+	}
+	policies := make(map[string]hedging)
+	for _, mc := range sc.MethodConfig {
+		if mc.HedgingPolicy == nil {
+			continue
+		}
+		if mc.RetryPolicy != nil {
+			return nil, fmt.Errorf("client: service config: retryPolicy and hedgingPolicy are mutually exclusive")
+		}
+		p := mc.HedgingPolicy
+		if p.MaxAttempts < 2 {
+			return nil, fmt.Errorf("client: service config: hedging maxAttempts must be at least 2, got %d", p.MaxAttempts)
+		}
+		delay, err := time.ParseDuration(p.HedgingDelay)
+		if p.HedgingDelay == "" {
+			delay, err = 0, nil
+		}
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("client: service config: invalid hedgingDelay %q", p.HedgingDelay)
+		}
+		h := hedging{maxAttempts: p.MaxAttempts, delay: delay, nonFatal: make(map[codes.Code]bool)}
+		for _, name := range p.NonFatalStatusCodes {
+			var code codes.Code
+			if err := code.UnmarshalJSON([]byte(`"` + strings.ToUpper(name) + `"`)); err != nil {
+				return nil, fmt.Errorf("client: service config: %w", err)
+			}
+			h.nonFatal[code] = true
+		}
+		for _, n := range mc.Name {
+			policies["/"+n.Service+"/"+n.Method] = h
+		}
+	}
+	return policies, nil
+}
+
+type hedgeResult struct {
+	reply proto.Message
+	err   error
+}
+
+// Interceptor of hedged calls. Перехватчик хеджированных вызовов
+func hedgeCalls(policies map[string]hedging) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		p, ok := policies[method]
+		if !ok {
+			p, ok = policies[method[:strings.LastIndex(method, "/")+1]]
+		}
+		out, isProto := reply.(proto.Message)
+		if !ok || !isProto {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		// Other attempts are cancelled after the first result. Остальные попытки отменяются после первого результата
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		results := make(chan hedgeResult, p.maxAttempts)
+		attempts, pending := 0, 0
+		send := func() {
+			attempts++
+			pending++
+			r := out.ProtoReflect().New().Interface()
+			go func() {
+				err := invoker(ctx, method, req, r, cc, opts...)
+				results <- hedgeResult{reply: r, err: err}
+			}()
+		}
+		send()
+		timer := time.NewTimer(p.delay)
+		defer timer.Stop()
+		var lastErr error
+		for {
+			select {
+			case <-timer.C:
+				if attempts < p.maxAttempts {
+					send()
+					timer.Reset(p.delay)
+				}
+			case r := <-results:
+				pending--
+				if r.err == nil {
+					proto.Merge(out, r.reply)
+					return nil
+				}
+				if !p.nonFatal[status.Code(r.err)] {
+					return r.err
+				}
+				// Non-fatal failure sends next attempt at once. Нефатальная ошибка сразу отправляет следующую попытку
+				lastErr = r.err
+				if attempts < p.maxAttempts {
+					send()
+					if !timer.Stop() {
+						select {
+						case <-timer.C:
+						default:
+						}
+					}
+					timer.Reset(p.delay)
+				} else if pending == 0 {
+					return lastErr
+				}
+			}
+		}
+	}
+}
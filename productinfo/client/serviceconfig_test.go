@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClient_AddProductIdempotencyKey(t *testing.T) {
+	srv := &testServer{addFailures: 2}
+	c := newTestClient(t, srv, Options{Backoff: time.Millisecond})
+
+	id, err := c.AddProduct(context.Background(), &pb.Product{Name: "Sumsung S10"})
+	if err != nil {
+		t.Fatalf("add with retries: %v", err)
+	}
+	if id != "id-Sumsung S10" || srv.added != 1 {
+		t.Errorf("got id %q and %d added products, want one", id, srv.added)
+	}
+	if len(srv.keys) != 3 || srv.keys[0] == "" || srv.keys[1] != srv.keys[0] || srv.keys[2] != srv.keys[0] {
+		t.Errorf("retries have different idempotency keys: %q", srv.keys)
+	}
+
+	// Key of caller is kept, new call gets new key. Ключ вызывающего сохраняется, новый вызов получает новый ключ
+	ctx := WithIdempotencyKey(context.Background(), "import-42")
+	c.AddProduct(ctx, &pb.Product{Name: "Apple"})
+	c.AddProduct(context.Background(), &pb.Product{Name: "Pear"})
+	if srv.keys[3] != "import-42" || srv.keys[4] == srv.keys[0] {
+		t.Errorf("got idempotency keys %q", srv.keys)
+	}
+}
+
+const hedgingConfig = `{
+  "methodConfig": [{
+    "name": [{"service": "ecommerce.ProductInfo", "method": "getProduct"}],
+    "timeout": "3s",
+    "hedgingPolicy": {"maxAttempts": 3, "hedgingDelay": "0.02s", "nonFatalStatusCodes": ["UNAVAILABLE"]}
+  }]
+}`
+
+func TestClient_Hedging(t *testing.T) {
+	srv := &testServer{delay: 2 * time.Second, slowCalls: 1}
+	c := newTestClient(t, srv, Options{ServiceConfig: hedgingConfig})
+
+	start := time.Now()
+	_, err := c.GetProduct(context.Background(), "unknown")
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want NotFound of hedged attempt", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("hedged call waited for slow attempt: %s", elapsed)
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 2 {
+		t.Errorf("got %d attempts, want 2", calls)
+	}
+}
+
+func TestClient_HedgingNonFatal(t *testing.T) {
+	srv := &testServer{failures: 3}
+	c := newTestClient(t, srv, Options{ServiceConfig: hedgingConfig})
+
+	// All attempts fail with non-fatal code. Все попытки завершаются нефатальной ошибкой
+	_, err := c.GetProduct(context.Background(), "unknown")
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want Unavailable", err)
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 3 {
+		t.Errorf("got %d attempts, want maxAttempts 3", calls)
+	}
+}
+
+func TestClient_ServiceConfigTimeout(t *testing.T) {
+	config := `{"methodConfig": [{"name": [{"service": "ecommerce.ProductInfo"}], "timeout": "0.05s"}]}`
+	c := newTestClient(t, &testServer{delay: time.Second}, Options{ServiceConfig: config})
+
+	start := time.Now()
+	if _, err := c.GetProduct(context.Background(), "unknown"); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("timeout of method is not applied: %s", elapsed)
+	}
+}
+
+func TestParseHedging(t *testing.T) {
+	policies, err := parseHedging(hedgingConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := policies["/ecommerce.ProductInfo/getProduct"]
+	if p.maxAttempts != 3 || p.delay != 20*time.Millisecond || !p.nonFatal[codes.Unavailable] {
+		t.Errorf("got policy %+v", p)
+	}
+	if _, err := parseHedging(defaultServiceConfig(Options{MaxRetries: 3, Backoff: DefaultBackoff})); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+
+	for _, invalid := range []string{
+		`{"methodConfig": [{"name": [{"service": "s"}], "hedgingPolicy": {"maxAttempts": 2}, "retryPolicy": {"maxAttempts": 2}}]}`,
+		`{"methodConfig": [{"name": [{"service": "s"}], "hedgingPolicy": {"maxAttempts": 1}}]}`,
+		`{"methodConfig": [{"name": [{"service": "s"}], "hedgingPolicy": {"maxAttempts": 2, "nonFatalStatusCodes": ["SLOW"]}}]}`,
+		`{"methodConfig": [{"name": [{"service": "s"}], "hedgingPolicy": {"maxAttempts": 2, "hedgingDelay": "soon"}}]}`,
+		`{"methodConfig": `,
+	} {
+		if _, err := parseHedging(invalid); err == nil {
+			t.Errorf("invalid config is accepted: %s", invalid)
+		}
+	}
+}
+
+func TestDefaultServiceConfig_DeleteNotRetried(t *testing.T) {
+	var sc serviceConfig
+	if err := json.Unmarshal([]byte(defaultServiceConfig(Options{MaxRetries: 3, Backoff: DefaultBackoff})), &sc); err != nil {
+		t.Fatal(err)
+	}
+	for _, mc := range sc.MethodConfig {
+		for _, n := range mc.Name {
+			if retried := mc.RetryPolicy != nil; retried != (n.Method != "deleteProduct") {
+				t.Errorf("%s: got retry policy %v", n.Method, mc.RetryPolicy)
+			}
+			if mc.Timeout == "" {
+				t.Errorf("%s: no timeout", n.Method)
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultRefreshBefore is how long before expiry token is refreshed.
+// За сколько до истечения срока токен обновляется.
+const DefaultRefreshBefore = 30 * time.Second
+
+// ClientCredentials configures tokens of OAuth2 client-credentials grant.
+// Параметры получения токенов OAuth2 по схеме client-credentials.
+type ClientCredentials struct {
+	// TokenURL is token endpoint of authorization server. Конечная точка токенов сервера авторизации
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// UseMTLS authenticates client to token endpoint with its certificate (RFC 8705),
+	// the secret is not needed then. CA of Options verifies the token endpoint.
+	// Клиент аутентифицируется на конечной точке токенов своим сертификатом (RFC 8705),
+	// секрет тогда не нужен. Конечная точка проверяется УЦ из Options.
+	UseMTLS bool
+	// RefreshBefore expiry, DefaultRefreshBefore if zero. За сколько до истечения срока обновлять токен
+	RefreshBefore time.Duration
+}
+
+// Caches token and refreshes it before expiry. Кэширует токен и обновляет его до истечения срока
+type refreshingTokenSource struct {
+	fetch  func() (*oauth2.Token, error)
+	before time.Duration
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// Builds token source of client-credentials grant. Создаем источник токенов схемы client-credentials
+func newClientCredentialsSource(cc *ClientCredentials, tlsConfig *tls.Config) *refreshingTokenSource {
+	conf := &clientcredentials.Config{
+		ClientID:     cc.ClientID,
+		ClientSecret: cc.ClientSecret,
+		TokenURL:     cc.TokenURL,
+		Scopes:       cc.Scopes,
+	}
+	ctx := context.Background()
+	if cc.UseMTLS {
+		// RFC 8705 sends client_id in body without secret. RFC 8705 передает client_id в теле без секрета
+		conf.AuthStyle = oauth2.AuthStyleInParams
+		// Name of token endpoint is taken from its URL. Имя конечной точки берется из ее URL
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = ""
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   DefaultTimeout,
+		})
+	}
+	before := cc.RefreshBefore
+	if before == 0 {
+		before = DefaultRefreshBefore
+	}
+	return &refreshingTokenSource{
+		fetch:  func() (*oauth2.Token, error) { return conf.Token(ctx) },
+		before: before,
+	}
+}
+
+// Token returns cached token or fetches new one. Возвращает кэшированный токен или получает новый
+func (s *refreshingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != nil && (s.token.Expiry.IsZero() || time.Now().Add(s.before).Before(s.token.Expiry)) {
+		return s.token, nil
+	}
+	token, err := s.fetch()
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	return token, nil
+}
+
+// Drops cached token, for example revoked one. Сбрасываем кэшированный токен, например отозванный
+func (s *refreshingTokenSource) invalidate() {
+	s.mu.Lock()
+	s.token = nil
+	s.mu.Unlock()
+}
+
+// Retries call once with new token if server rejected the token. It is safe for any method,
+// as rejected call is not handled by the service.
+// Повторяем вызов один раз с новым токеном, если сервер отклонил токен. Это безопасно для любого метода,
+// так как отклоненный вызов не обрабатывается сервисом.
+func retryUnauthenticated(ts *refreshingTokenSource) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if status.Code(err) != codes.Unauthenticated {
+			return err
+		}
+		ts.invalidate()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// API key of call. API ключ вызова
+type apiKeyCredentials string
+
+func (k apiKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "ApiKey " + string(k)}, nil
+}
+
+// Key is sent only over TLS. Ключ передается только по TLS
+func (k apiKeyCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blablatov/stream-mtls-grpc/internal/testcerts"
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Token endpoint of client-credentials grant. Конечная точка токенов схемы client-credentials
+type tokenServer struct {
+	expiresIn int
+
+	mu       sync.Mutex
+	issued   []string
+	revoked  map[string]bool
+	clients  []string // client_id of each request. client_id каждого запроса
+	secrets  []string
+	peerName string
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "client_credentials" {
+		http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.Form.Get("client_id"), r.Form.Get("client_secret")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients = append(s.clients, id)
+	s.secrets = append(s.secrets, secret)
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		s.peerName = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	token := fmt.Sprintf("token-%d", len(s.issued)+1)
+	s.issued = append(s.issued, token)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   s.expiresIn,
+	})
+}
+
+func (s *tokenServer) valid(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.issued {
+		if t == token {
+			return !s.revoked[token]
+		}
+	}
+	return false
+}
+
+func (s *tokenServer) revokeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked = make(map[string]bool)
+	for _, t := range s.issued {
+		s.revoked[t] = true
+	}
+}
+
+func (s *tokenServer) requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.issued)
+}
+
+func newTokenClient(t *testing.T, ts *tokenServer, cc ClientCredentials) (*Client, *testServer) {
+	hs := httptest.NewServer(ts)
+	t.Cleanup(hs.Close)
+	cc.TokenURL = hs.URL
+	srv := &testServer{validToken: ts.valid}
+	return newTestClient(t, srv, Options{ClientCredentials: &cc}), srv
+}
+
+func TestClientCredentials_CachesToken(t *testing.T) {
+	ts := &tokenServer{expiresIn: 3600}
+	c, _ := newTokenClient(t, ts, ClientCredentials{ClientID: "mtls-client", ClientSecret: "secret"})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.AddProduct(ctx, &pb.Product{Name: "Sumsung S9999"}); err != nil {
+			t.Fatalf("AddProduct: %v", err)
+		}
+	}
+	if n := ts.requests(); n != 1 {
+		t.Errorf("got %d token requests, want 1", n)
+	}
+	if ts.clients[0] != "mtls-client" || ts.secrets[0] != "secret" {
+		t.Errorf("unexpected client %q:%q", ts.clients[0], ts.secrets[0])
+	}
+}
+
+func TestClientCredentials_RefreshesBeforeExpiry(t *testing.T) {
+	// Token expires in a minute, it is refreshed two minutes before expiry, so on each call.
+	// Токен истекает через минуту, обновляется за две минуты до истечения, то есть при каждом вызове.
+	ts := &tokenServer{expiresIn: 60}
+	c, _ := newTokenClient(t, ts, ClientCredentials{ClientID: "mtls-client", RefreshBefore: 2 * time.Minute})
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.AddProduct(context.Background(), &pb.Product{Name: "Sumsung S9999"}); err != nil {
+			t.Fatalf("AddProduct: %v", err)
+		}
+	}
+	if n := ts.requests(); n != 2 {
+		t.Errorf("got %d token requests, want 2", n)
+	}
+}
+
+func TestClientCredentials_RetriesUnauthenticated(t *testing.T) {
+	ts := &tokenServer{expiresIn: 3600}
+	c, _ := newTokenClient(t, ts, ClientCredentials{ClientID: "mtls-client"})
+	ctx := context.Background()
+
+	if _, err := c.AddProduct(ctx, &pb.Product{Name: "first"}); err != nil {
+		t.Fatalf("AddProduct: %v", err)
+	}
+	// Cached token is revoked, call is retried once with new token.
+	// Кэшированный токен отозван, вызов повторяется один раз с новым токеном.
+	ts.revokeAll()
+	if _, err := c.AddProduct(ctx, &pb.Product{Name: "second"}); err != nil {
+		t.Fatalf("AddProduct after revocation: %v", err)
+	}
+	if n := ts.requests(); n != 2 {
+		t.Errorf("got %d token requests, want 2", n)
+	}
+}
+
+func TestClientCredentials_RetriesOnlyOnce(t *testing.T) {
+	ts := &tokenServer{expiresIn: 3600}
+	hs := httptest.NewServer(ts)
+	t.Cleanup(hs.Close)
+	// Server rejects any token. Сервер отклоняет любой токен
+	srv := &testServer{validToken: func(string) bool { return false }}
+	c := newTestClient(t, srv, Options{ClientCredentials: &ClientCredentials{TokenURL: hs.URL, ClientID: "mtls-client"}})
+
+	_, err := c.AddProduct(context.Background(), &pb.Product{Name: "Sumsung S9999"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("got %v, want Unauthenticated", err)
+	}
+	if n := ts.requests(); n != 2 {
+		t.Errorf("got %d token requests, want 2", n)
+	}
+}
+
+func TestClientCredentials_MTLS(t *testing.T) {
+	certs := testcerts.New(t, "mtls-client")
+	ts := &tokenServer{expiresIn: 3600}
+	hs := httptest.NewUnstartedServer(ts)
+	hs.TLS = &tls.Config{
+		Certificates: []tls.Certificate{certs.Server},
+		ClientCAs:    certs.CAPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	hs.StartTLS()
+	t.Cleanup(hs.Close)
+
+	srv := &testServer{validToken: ts.valid}
+	c := newTestClientCerts(t, certs, srv, Options{ClientCredentials: &ClientCredentials{
+		TokenURL: hs.URL,
+		ClientID: "mtls-client",
+		UseMTLS:  true,
+	}})
+	if _, err := c.AddProduct(context.Background(), &pb.Product{Name: "Sumsung S9999"}); err != nil {
+		t.Fatalf("AddProduct: %v", err)
+	}
+	if ts.peerName != "mtls-client" || ts.clients[0] != "mtls-client" || ts.secrets[0] != "" {
+		t.Errorf("unexpected client authentication: cert %q, client_id %q, secret %q", ts.peerName, ts.clients[0], ts.secrets[0])
+	}
+}
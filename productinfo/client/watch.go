@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/blablatov/stream-mtls-grpc/mtls-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CurrentRevision as start revision of WatchProducts means only new changes, revision 0 is before the first change.
+// CurrentRevision в качестве начальной ревизии WatchProducts - только новые изменения, ревизия 0 - до первого изменения.
+const CurrentRevision int64 = -1
+
+// WatchProducts calls fn for each change of products after startRevision in commit order.
+// It returns when ctx is done, fn returns error or the stream fails; OutOfRange means the revision is compacted
+// and the watch must be restarted from revision of a new list of products.
+// Вызывает fn для каждого изменения товаров после startRevision в порядке фиксации.
+// Возвращается, когда ctx завершен, fn возвращает ошибку или поток прерван; OutOfRange означает, что ревизия
+// удалена и наблюдение нужно начать заново с ревизии нового списка товаров.
+func (c *Client) WatchProducts(ctx context.Context, startRevision int64, fn func(*pb.ProductEvent) error) error {
+	stream, err := c.rpc.WatchProducts(ctx, &pb.WatchRequest{StartRevision: startRevision})
+	if err != nil {
+		return decodeError(err)
+	}
+	for {
+		e, err := stream.Recv()
+		if err != nil {
+			return decodeError(err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// Invalidates cached products by change feed until ctx is done. The watch is resumed from the last revision
+// after failure, cache is cleared if changes may be missed.
+// Удаляем товары из кэша по ленте изменений, пока ctx не завершен. После сбоя наблюдение продолжается
+// с последней ревизии, кэш очищается, если изменения могли быть пропущены.
+func (c *Client) watchChanges(ctx context.Context, backoff time.Duration) {
+	revision := CurrentRevision
+	delay := backoff
+	for first := true; ; first = false {
+		if !first && revision == CurrentRevision {
+			c.cache.invalidateAll()
+		}
+		err := c.WatchProducts(ctx, revision, func(e *pb.ProductEvent) error {
+			c.cache.invalidate(e.GetProduct().GetId())
+			revision, delay = e.Revision, backoff
+			return nil
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.OutOfRange {
+			revision = CurrentRevision
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if delay *= 2; delay > 10*backoff {
+			delay = 10 * backoff
+		}
+	}
+}
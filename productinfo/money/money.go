@@ -0,0 +1,178 @@
+// Package money helps to build, validate and convert google.type.Money prices of products.
+// Пакет money помогает создавать, проверять и преобразовывать цены товаров google.type.Money.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+)
+
+// DefaultCurrency is currency of legacy float prices unless service is configured otherwise.
+// Валюта устаревших цен float, если сервис не настроен иначе.
+const DefaultCurrency = "RUB"
+
+const nanosPerUnit = 1e9
+
+// ErrCurrencyMismatch is returned by arithmetic of amounts in different currencies.
+// Возвращается арифметикой сумм в разных валютах.
+var ErrCurrencyMismatch = errors.New("money: currencies differ")
+
+// IsCurrency reports whether code is active ISO 4217 alphabetic code. Проверяет, что код - действующий код ISO 4217
+func IsCurrency(code string) bool {
+	_, ok := currencies[code]
+	return ok
+}
+
+// Digits returns number of minor units of currency, for example 2 for USD, 0 for JPY,
+// -1 for codes without minor units like XAU. Количество дробных разрядов валюты.
+func Digits(code string) (int, bool) {
+	d, ok := currencies[code]
+	return d, ok
+}
+
+// Validate checks currency code and that nanos are in range and have sign of units.
+// Проверяет код валюты и что nanos в допустимом диапазоне и имеют знак units.
+func Validate(m *moneypb.Money) error {
+	switch {
+	case m == nil:
+		return errors.New("money is not set")
+	case !IsCurrency(m.CurrencyCode):
+		return fmt.Errorf("unknown currency code %q, want ISO 4217 code like USD", m.CurrencyCode)
+	case m.Nanos <= -nanosPerUnit || m.Nanos >= nanosPerUnit:
+		return fmt.Errorf("nanos %d must be between -999999999 and 999999999", m.Nanos)
+	case m.Units > 0 && m.Nanos < 0, m.Units < 0 && m.Nanos > 0:
+		return fmt.Errorf("units %d and nanos %d must have the same sign", m.Units, m.Nanos)
+	}
+	return nil
+}
+
+// Parse reads decimal amount like "7777.99" or "-0.5" with at most 9 fractional digits.
+// Разбирает десятичную сумму, например "7777.99" или "-0.5", не более 9 дробных разрядов.
+func Parse(amount, currency string) (*moneypb.Money, error) {
+	s := amount
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")
+	whole, frac, dot := strings.Cut(s, ".")
+	if whole == "" || (dot && frac == "") || len(frac) > 9 || !isDigits(whole) || !isDigits(frac) || len(amount)-len(s) > 1 {
+		return nil, fmt.Errorf("invalid amount %q, want decimal number with at most 9 fractional digits", amount)
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("amount %q is out of range", amount)
+	}
+	nanos, _ := strconv.Atoi((frac + "000000000")[:9])
+	m := &moneypb.Money{CurrencyCode: currency, Units: units, Nanos: int32(nanos)}
+	if negative {
+		m.Units, m.Nanos = -m.Units, -m.Nanos
+	}
+	return m, Validate(m)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// FromFloat32 converts legacy float price by its shortest decimal form, so 123.4567 stays 123.4567
+// and does not turn into 123.45670318603516. Преобразует устаревшую цену float по ее кратчайшей десятичной
+// записи, поэтому 123.4567 остается 123.4567, а не превращается в 123.45670318603516.
+func FromFloat32(amount float32, currency string) (*moneypb.Money, error) {
+	if math.IsNaN(float64(amount)) || math.IsInf(float64(amount), 0) {
+		return nil, fmt.Errorf("amount %v is not a number", amount)
+	}
+	s := strconv.FormatFloat(float64(amount), 'f', -1, 32)
+	if _, frac, _ := strings.Cut(s, "."); len(frac) > 9 {
+		s = strconv.FormatFloat(float64(amount), 'f', 9, 32)
+	}
+	return Parse(s, currency)
+}
+
+// Float32 returns amount as legacy float price, nearest to the decimal amount. Сумма как устаревшая цена float
+func Float32(m *moneypb.Money) float32 {
+	if m == nil {
+		return 0
+	}
+	f, _ := strconv.ParseFloat(amount(m, 0), 32)
+	return float32(f)
+}
+
+// Decimal amount with at least digits fractional digits. Десятичная сумма с не менее чем digits дробными разрядами
+func amount(m *moneypb.Money, digits int) string {
+	units, nanos := m.Units, m.Nanos
+	sign := ""
+	if units < 0 || nanos < 0 {
+		sign = "-"
+	}
+	if nanos < 0 {
+		nanos = -nanos
+	}
+	whole := strconv.FormatUint(absUnits(units), 10)
+	frac := strings.TrimRight(fmt.Sprintf("%09d", nanos), "0")
+	for len(frac) < digits {
+		frac += "0"
+	}
+	if frac == "" {
+		return sign + whole
+	}
+	return sign + whole + "." + frac
+}
+
+func absUnits(u int64) uint64 {
+	if u < 0 {
+		return uint64(-(u + 1)) + 1
+	}
+	return uint64(u)
+}
+
+// Format returns amount with minor units of currency and the code, for example "7777.00 RUB" or "1000 JPY",
+// longer fractions are kept. Сумма с дробными разрядами валюты и кодом, более длинная дробная часть сохраняется.
+func Format(m *moneypb.Money) string {
+	if m == nil {
+		return ""
+	}
+	digits, _ := Digits(m.CurrencyCode)
+	return amount(m, digits) + " " + m.CurrencyCode
+}
+
+// CompareAmount compares amounts ignoring currency, returns -1, 0 or 1. Сравнивает суммы без учета валюты
+func CompareAmount(a, b *moneypb.Money) int {
+	switch {
+	case a.Units < b.Units:
+		return -1
+	case a.Units > b.Units:
+		return 1
+	case a.Nanos < b.Nanos:
+		return -1
+	case a.Nanos > b.Nanos:
+		return 1
+	}
+	return 0
+}
+
+// Add returns sum of amounts of the same currency exactly. Точная сумма величин одной валюты
+func Add(a, b *moneypb.Money) (*moneypb.Money, error) {
+	if a.CurrencyCode != b.CurrencyCode {
+		return nil, ErrCurrencyMismatch
+	}
+	total := new(big.Int).Add(totalNanos(a), totalNanos(b))
+	units, nanos := new(big.Int).QuoRem(total, big.NewInt(nanosPerUnit), new(big.Int))
+	if !units.IsInt64() {
+		return nil, errors.New("money: sum is out of range")
+	}
+	return &moneypb.Money{CurrencyCode: a.CurrencyCode, Units: units.Int64(), Nanos: int32(nanos.Int64())}, nil
+}
+
+func totalNanos(m *moneypb.Money) *big.Int {
+	n := new(big.Int).Mul(big.NewInt(m.Units), big.NewInt(nanosPerUnit))
+	return n.Add(n, big.NewInt(int64(m.Nanos)))
+}
@@ -0,0 +1,96 @@
+package money
+
+import (
+	"testing"
+
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+)
+
+func TestParseAndFormat(t *testing.T) {
+	for _, tc := range []struct {
+		amount, currency, want string
+	}{
+		{"7777", "RUB", "7777.00 RUB"},
+		{"7777.99", "USD", "7777.99 USD"},
+		{"-0.5", "EUR", "-0.50 EUR"},
+		{"1000", "JPY", "1000 JPY"},
+		{"1.2345", "USD", "1.2345 USD"},
+		{"0.001", "KWD", "0.001 KWD"},
+		{"+12.000000001", "XAU", "12.000000001 XAU"},
+	} {
+		m, err := Parse(tc.amount, tc.currency)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.amount, err)
+			continue
+		}
+		if got := Format(m); got != tc.want {
+			t.Errorf("Format(Parse(%q)) = %q, want %q", tc.amount, got, tc.want)
+		}
+	}
+	for _, tc := range []struct{ amount, currency string }{
+		{"", "USD"}, {"1.", "USD"}, {".5", "USD"}, {"1e3", "USD"}, {"--1", "USD"},
+		{"0.0000000001", "USD"}, {"99999999999999999999", "USD"}, {"1", "usd"}, {"1", "ABC"},
+	} {
+		if m, err := Parse(tc.amount, tc.currency); err == nil {
+			t.Errorf("Parse(%q, %q) = %v, want error", tc.amount, tc.currency, m)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, m := range []*moneypb.Money{
+		nil,
+		{CurrencyCode: "RUR", Units: 1},
+		{CurrencyCode: "USD", Nanos: 1e9},
+		{CurrencyCode: "USD", Units: 1, Nanos: -1},
+		{CurrencyCode: "USD", Units: -1, Nanos: 1},
+	} {
+		if err := Validate(m); err == nil {
+			t.Errorf("Validate(%v): want error", m)
+		}
+	}
+	if err := Validate(&moneypb.Money{CurrencyCode: "USD", Units: -1, Nanos: -1}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFloat32(t *testing.T) {
+	// Shortest decimal of float is kept. Сохраняется кратчайшая десятичная запись float
+	for f, want := range map[float32]string{7777: "7777.00", 123.4567: "123.4567", 0.1: "0.10", -2.5: "-2.50", 1e-12: "0.00"} {
+		m, err := FromFloat32(f, "USD")
+		if err != nil {
+			t.Errorf("FromFloat32(%v): %v", f, err)
+			continue
+		}
+		if got := Format(m); got != want+" USD" {
+			t.Errorf("FromFloat32(%v) = %s, want %s USD", f, got, want)
+		}
+		if f != 1e-12 && Float32(m) != f {
+			t.Errorf("Float32(FromFloat32(%v)) = %v", f, Float32(m))
+		}
+	}
+	if _, err := FromFloat32(3e38, "USD"); err == nil {
+		t.Error("FromFloat32(3e38): want error")
+	}
+}
+
+func TestAdd(t *testing.T) {
+	a, _ := Parse("0.7", "USD")
+	b, _ := Parse("-1.9", "USD")
+	sum, err := Add(a, b)
+	if err != nil || Format(sum) != "-1.20 USD" {
+		t.Errorf("Add = %v, %v, want -1.20 USD", sum, err)
+	}
+	// Ten cents add up exactly. Десять центов складываются точно
+	total, _ := Parse("0", "USD")
+	cent, _ := Parse("0.1", "USD")
+	for i := 0; i < 10; i++ {
+		total, _ = Add(total, cent)
+	}
+	if one, _ := Parse("1", "USD"); CompareAmount(total, one) != 0 {
+		t.Errorf("10 x 0.1 = %s", Format(total))
+	}
+	if _, err := Add(a, &moneypb.Money{CurrencyCode: "EUR"}); err != ErrCurrencyMismatch {
+		t.Errorf("Add of USD and EUR: %v", err)
+	}
+}